@@ -118,6 +118,36 @@ func (cn *Conn) Touch(key string, exp uint32) (cas uint64, err error) {
 	return m.CAS, err
 }
 
+// LeaseGet retrieves a value from the cache, or if the key is missing, leases
+// it: the first client to miss gets ErrNotFound and a lease token (as the CAS)
+// to fill the key with LeaseSet, the others ErrHotMiss until then. A recently
+// deleted or expired value is returned instead if the server kept it, with stale
+// set (and a lease token as the CAS if the key was leased to this client).
+func (cn *Conn) LeaseGet(key string) (val string, flags uint32, cas uint64, stale bool, err error) {
+	// Variants: LeaseGet
+	// Request : MUST key; MUST NOT value, extras
+	// Response: MAY value, extras ([0..3] flags, [4..7] lease flags)
+	var leaseFlags uint32
+	m := &msg{
+		header: header{
+			Op: opLeaseGet,
+		},
+		oextras: []interface{}{&flags, &leaseFlags},
+		key:     key,
+	}
+
+	err = cn.sendRecv(m)
+	return m.val, flags, m.CAS, leaseFlags&leaseStale != 0, err
+}
+
+// LeaseSet sets a key/value pair in the cache with the lease token LeaseGet
+// returned. Fails with ErrValueNotStored if the lease is no longer valid, as the
+// key was since stored or deleted, or the lease ended.
+func (cn *Conn) LeaseSet(key, val string, flags, exp uint32, token uint64) (cas uint64, err error) {
+	// Variants: LeaseSet
+	return cn.setGeneric(opLeaseSet, key, val, token, flags, exp)
+}
+
 // Set sets a key/value pair in the cache.
 func (cn *Conn) Set(key, val string, flags, exp uint32, ocas uint64) (cas uint64, err error) {
 	// Variants: [R] Set [Q]
@@ -217,3 +217,56 @@ func TestDelete(t *testing.T) {
 	assert.Equalf(t, ErrNotFound, err,
 		"delete with wrong CAS seems to have succeeded: %v", err)
 }
+
+// Test LeaseGet and LeaseSet.
+func TestLease(t *testing.T) {
+	testInit(t)
+
+	const (
+		Key1 = "lease"
+		Val1 = "bar"
+		Val2 = "baz"
+	)
+
+	// a miss grants a lease, the next is a hot miss...
+	_, _, token, _, err := cn.LeaseGet(Key1)
+	assert.Equalf(t, ErrNotFound, err, "expected missing key: %v", err)
+	assert.NotEqual(t, uint64(0), token, "no lease token granted")
+	_, _, cas, _, err := cn.LeaseGet(Key1)
+	assert.Equalf(t, ErrHotMiss, err, "expected hot miss: %v", err)
+	assert.Equalf(t, uint64(0), cas, "lease token granted twice: %d", cas)
+
+	// fill the key with the lease...
+	_, err = cn.LeaseSet(Key1, Val1, 0, 0, token+1)
+	assert.Equalf(t, ErrValueNotStored, err, "lease set with wrong token: %v", err)
+	cas, err = cn.LeaseSet(Key1, Val1, 0, 0, token)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	v, _, cas2, stale, err := cn.LeaseGet(Key1)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	assert.Equalf(t, Val1, v, "wrong value: %s", v)
+	assert.Equalf(t, cas, cas2, "wrong CAS: %d != %d", cas, cas2)
+	assert.Equalf(t, false, stale, "value shouldn't be stale")
+
+	// once deleted, the value is stale...
+	err = cn.Del(Key1)
+	assert.Equalf(t, mcNil, err, "error deleting key: %v", err)
+	v, _, token, stale, err = cn.LeaseGet(Key1)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	assert.Equalf(t, Val1, v, "wrong stale value: %s", v)
+	assert.Equalf(t, true, stale, "value should be stale")
+	assert.NotEqual(t, uint64(0), token, "no lease token granted")
+	_, err = cn.LeaseSet(Key1, Val2, 0, 0, token)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	get(t, Key1, Val2, 0, mcNil)
+
+	// a set invalidates the lease...
+	err = cn.Del(Key1)
+	assert.Equalf(t, mcNil, err, "error deleting key: %v", err)
+	_, _, token, _, err = cn.LeaseGet(Key1)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = cn.Set(Key1, Val1, 0, 0, 0)
+	assert.Equalf(t, mcNil, err, "unexpected error: %v", err)
+	_, err = cn.LeaseSet(Key1, Val2, 0, 0, token)
+	assert.Equalf(t, ErrValueNotStored, err, "lease set after a set: %v", err)
+	get(t, Key1, Val1, 0, mcNil)
+}
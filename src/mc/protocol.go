@@ -36,6 +36,7 @@ var (
 	ErrAuthContinue   = &Error{StatusAuthContinue, "mc: authentication continue (unsupported)", nil}
 	ErrUnknownCommand = &Error{StatusUnknownCommand, "mc: unknown command", nil}
 	ErrOutOfMemory    = &Error{StatusOutOfMemory, "mc: out of memory", nil}
+	ErrHotMiss        = &Error{StatusHotMiss, "mc: hot miss, key leased to another client", nil}
 	ErrUnknownError   = &Error{StatusUnknownError, "mc: unknown error from server", nil}
 )
 
@@ -52,6 +53,7 @@ const (
 	StatusAuthContinue   = uint16(0x21)
 	StatusUnknownCommand = uint16(0x81)
 	StatusOutOfMemory    = uint16(0x82)
+	StatusHotMiss        = uint16(0x90)
 	StatusAuthUnknown    = uint16(0xffff)
 	StatusNetworkError   = uint16(0xfff1)
 	StatusUnknownError   = uint16(0xffff)
@@ -85,6 +87,8 @@ func newError(status uint16) error {
 		return ErrUnknownCommand
 	case StatusOutOfMemory:
 		return ErrOutOfMemory
+	case StatusHotMiss:
+		return ErrHotMiss
 	}
 	return ErrUnknownError
 }
@@ -133,6 +137,15 @@ const (
 	opGATKQ = opCode(0x24)
 )
 
+// Lease ops (an extension of memcached)
+const (
+	opLeaseGet opCode = opCode(iota + 0x50)
+	opLeaseSet
+)
+
+// leaseStale flags a lease get response with a stale value.
+const leaseStale = uint32(0x1)
+
 // Auth Ops
 const (
 	opAuthList opCode = opCode(iota + 0x20)
@@ -0,0 +1,124 @@
+// Package cache is the storage engine of memcached: a hashmap of items with a
+// storage limit and LRU eviction, split between tenants (see tenant.go), along
+// with the background jobs that maintain it (crawler.go, reaper.go and
+// heap_limit.go) and its persistence (write_log.go).
+//
+// A Cache can be embedded in any Go program:
+//
+//	c := cache.New(64<<20, cache.WithMaxItemSize(1<<20))
+//	c.Set(ctx, []byte("key"), []byte("value"), 0, 0, 0)
+//	item, err := c.Get(ctx, []byte("key"))
+//
+// A Cache is a storage.Storage, which the memcached command serves over the
+// network (see package server).
+package cache
+
+import (
+	"time"
+
+	"memcached/storage"
+)
+
+// MAX_VALUE_SIZE is the largest value stored in one piece, and the default
+// item size limit of the server. Larger values are stored in chunks of this
+// size, so that no single allocation holds them.
+const MAX_VALUE_SIZE = 1024 * 1024
+
+// MAX_ITEM_SIZE is the largest item payload (see Item.Payload) ever stored,
+// whatever the limits of the cache, which bounds the size of the records read
+// back from a write log or leader.
+const MAX_ITEM_SIZE = 1024 * 1024 * 1024
+
+// Errors returned by cache operations, those of package storage.
+var (
+	ErrNotFound   = storage.ErrNotFound
+	ErrExists     = storage.ErrExists
+	ErrNotStored  = storage.ErrNotStored
+	ErrTooLarge   = storage.ErrTooLarge
+	ErrNoMemory   = storage.ErrNoMemory
+	ErrNonNumeric = storage.ErrNonNumeric
+
+	ErrNotSupported = storage.ErrNotSupported
+	ErrHotMiss      = storage.ErrHotMiss
+	ErrInvalidLease = storage.ErrInvalidLease
+)
+
+// Logger logs a message with a list of alternating keys and values, as the
+// memcached server's logger does.
+type Logger interface {
+	Error(msg string, kvs ...interface{})
+	Warn(msg string, kvs ...interface{})
+	Info(msg string, kvs ...interface{})
+	Debug(msg string, kvs ...interface{})
+}
+
+// nopLogger discards all messages, it's the logger of a Cache unless another
+// is given.
+type nopLogger struct{}
+
+func (nopLogger) Error(string, ...interface{}) {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Debug(string, ...interface{}) {}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithMaxItemSize limits the payload of items stored (their key, value, flags
+// and tags, but not their overhead), beyond the storage limit of the cache and
+// MAX_ITEM_SIZE.
+func WithMaxItemSize(maxItemSize uint64) Option {
+	return func(c *Cache) { c.maxItemSize = maxItemSize }
+}
+
+// WithNoEvict rejects stores that don't fit with ErrNoMemory, rather than
+// evicting items to make room.
+func WithNoEvict(noEvict bool) Option {
+	return func(c *Cache) { c.noEvict = noEvict }
+}
+
+// WithLogger logs the messages of the cache, and of its background jobs and
+// write log, to log.
+func WithLogger(log Logger) Option {
+	return func(c *Cache) { c.log = log }
+}
+
+// WithLeases enables leases (see lease.go), each lasting ttl (rounded up to a
+// second), which is also how long deleted and expired items are kept as stale
+// values.
+func WithLeases(ttl time.Duration) Option {
+	return func(c *Cache) {
+		if ttl > 0 {
+			c.leaseTTL = int64((ttl + time.Second - 1) / time.Second)
+		}
+	}
+}
+
+// WithClock replaces the clock used for expiry and idle times.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cache) { c.now = now }
+}
+
+// Journal receives every mutation of a cache, encoded as a record (see
+// AppendRecord), in the order they're applied. Append is called with the cache
+// locked, so it mustn't block or use the cache.
+type Journal interface {
+	Append(rec []byte)
+}
+
+// Stats are the statistics of a Cache.
+type Stats struct {
+	Items         int
+	Bytes         uint64 // stored, including the overhead of each item
+	PayloadBytes  uint64 // of keys, values, flags and tags
+	OverheadBytes uint64
+	MaxBytes      uint64
+	MaxItemSize   uint64
+	Evictions     uint64
+	TooLarge      uint64 // stores rejected as too large
+	NoMemory      uint64 // stores rejected as not fitting
+	Invalidations int    // of prefixes and tags, not yet forgotten
+
+	// items removed, by reason (see hooks.go)
+	Removals [NUM_REASONS]uint64
+}
@@ -0,0 +1,230 @@
+package cache
+
+// LRU crawler, walks the cache in small batches (oldest items first) so that
+// the lock is never held for long. Used to dump the metadata of every item and
+// to reclaim expired (or invalidated) items that would otherwise wait to be
+// accessed or pushed out of the LRU.
+//
+// A crawl keeps its position in the LRU with a placeholder item, as memcached
+// does, so items can be freely accessed, stored or removed between batches.
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync/atomic"
+	"time"
+)
+
+// CRAWL_BATCH is the number of items visited by a crawl per hold of the lock.
+const CRAWL_BATCH = 100
+
+// CRAWL_RATE is the default limit on the items visited per second by a crawl.
+const CRAWL_RATE = 100000
+
+// ItemMeta is the metadata of an item, as reported by a crawl, along with its
+// value (which mustn't be modified).
+type ItemMeta struct {
+	Key      string
+	Expires  int64 // UNIX time in seconds, 0 if the item never expires.
+	Accessed int64 // UNIX time in seconds of the last store or retrieval.
+	Size     uint64
+	Cas      uint64
+	Flags    uint32
+	Value    []byte   // nil if the value is on disk
+	Chunks   [][]byte // the value, if stored in chunks (Value is then nil)
+}
+
+// Crawler crawls the LRU of a Cache.
+type Crawler struct {
+	cache   *Cache
+	rate    int  // items visited per second by a crawl, 0 for no limit
+	reclaim bool // remove expired items found
+
+	crawls    uint64
+	checked   uint64
+	reclaimed uint64
+}
+
+// NewCrawler creates a new Crawler for the specified cache.
+func NewCrawler(cache *Cache, rate int, reclaim bool) *Crawler {
+	return &Crawler{cache: cache, rate: rate, reclaim: reclaim}
+}
+
+// Crawl walks every item in the cache from the oldest to the newest, calling
+// fn with the metadata of each batch of (unexpired) items. The lock on Cache
+// isn't held while fn runs, so it's free to use the cache or block. The crawl
+// stops early if fn returns an error, which is then returned.
+//
+// Items stored after the crawl starts may or may not be visited, and an item
+// that is accessed during the crawl may be visited twice.
+func (c *Crawler) Crawl(fn func(batch []ItemMeta) error) error {
+	return c.crawl(c.reclaim, fn)
+}
+
+// Reclaim crawls the cache just to remove expired and invalidated items, even if
+// the crawler isn't configured to do so as part of every crawl.
+func (c *Crawler) Reclaim() {
+	c.crawl(true, func([]ItemMeta) error { return nil })
+}
+
+// crawl runs a single crawl, reclaiming expired items if specified.
+func (c *Crawler) crawl(reclaim bool, fn func(batch []ItemMeta) error) error {
+	atomic.AddUint64(&c.crawls, 1)
+	cache := c.cache
+	mark := &Item{}
+
+	cache.mu.Lock()
+	if cache.crawlers == nil {
+		cache.crawlers = make(map[*Item]struct{})
+	}
+	cache.crawlers[mark] = struct{}{}
+	pushFront(cache.tenants[0], mark)
+	since := cache.version
+	cache.mu.Unlock()
+
+	defer func() {
+		cache.mu.Lock()
+		mark.tenant.lru.Erase(mark)
+		delete(cache.crawlers, mark)
+		cache.mu.Unlock()
+	}()
+
+	batch := make([]ItemMeta, 0, CRAWL_BATCH)
+	for {
+		start := time.Now()
+		var done bool
+		var n int
+		batch, n, done = c.step(mark, reclaim, batch[:0])
+		if len(batch) > 0 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		if done {
+			if reclaim {
+				// every item invalidated before the crawl has been removed
+				cache.mu.Lock()
+				cache.forgetInvalidations(since)
+				cache.mu.Unlock()
+			}
+			return nil
+		}
+		c.wait(n, time.Since(start))
+	}
+}
+
+// step visits the next batch of items after the placeholder mark, appending
+// the metadata of unexpired items to batch and then moving mark past them (on
+// to the next tenant's LRU at the end of one). Returns the number of items
+// visited and true if the crawl is complete.
+func (c *Crawler) step(mark *Item, reclaim bool, batch []ItemMeta) ([]ItemMeta, int, bool) {
+	cache := c.cache
+	cache.mu.Lock()
+	defer cache.unlock()
+
+	now := cache.now().Unix()
+	i := mark.lru.prev
+	n := 0
+	for ; i != nil && n < CRAWL_BATCH; n++ {
+		next := i.lru.prev
+		if cache.isCrawler(i) {
+			i = next
+			continue
+		}
+		if cache.dead(i, now) {
+			if reclaim {
+				cache.removeDead(i, now)
+				atomic.AddUint64(&c.reclaimed, 1)
+			}
+		} else {
+			batch = append(batch, ItemMeta{
+				Key:      i.key,
+				Expires:  i.expires,
+				Accessed: i.accessed,
+				Size:     i.Size(),
+				Cas:      i.version,
+				Flags:    i.Flags(),
+				Value:    i.value,
+				Chunks:   i.valueChunks(),
+			})
+		}
+		i = next
+	}
+	atomic.AddUint64(&c.checked, uint64(n))
+
+	t := mark.tenant
+	t.lru.Erase(mark)
+	if i != nil {
+		t.lru.InsertBefore(mark, i)
+		return batch, n, false
+	}
+	if next := cache.nextTenant(t); next != nil {
+		pushFront(next, mark)
+		return batch, n, false
+	}
+	t.lru.PushBack(mark)
+	return batch, n, true
+}
+
+// pushFront places a crawl's placeholder at the front of the tenant's LRU.
+//
+// The caller of this method should hold the write lock on Cache.
+func pushFront(t *Tenant, mark *Item) {
+	mark.tenant = t
+	if t.lru.head != nil {
+		t.lru.InsertBefore(mark, t.lru.head)
+	} else {
+		t.lru.PushBack(mark)
+	}
+}
+
+// wait sleeps long enough after visiting n items (which took elapsed) to keep
+// the crawl within its rate limit.
+func (c *Crawler) wait(n int, elapsed time.Duration) {
+	if c.rate <= 0 {
+		return
+	}
+	if d := time.Duration(n)*time.Second/time.Duration(c.rate) - elapsed; d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// CrawlerStats are the statistics of a Crawler.
+type CrawlerStats struct {
+	Crawls    uint64
+	Checked   uint64 // items visited
+	Reclaimed uint64 // expired items removed
+}
+
+// Stats returns the statistics of the crawler.
+func (c *Crawler) Stats() CrawlerStats {
+	return CrawlerStats{
+		Crawls:    atomic.LoadUint64(&c.crawls),
+		Checked:   atomic.LoadUint64(&c.checked),
+		Reclaimed: atomic.LoadUint64(&c.reclaimed),
+	}
+}
+
+// errStopCrawl stops a crawl of Items early.
+var errStopCrawl = errors.New("crawl stopped")
+
+// Items returns an iterator over every (unexpired) item in the cache, by
+// tenant from the oldest to the newest, crawling the cache in batches so it's
+// never locked for long. It stops early if ctx is done, and has the same
+// guarantees as Crawler.Crawl.
+func (cache *Cache) Items(ctx context.Context) iter.Seq[ItemMeta] {
+	return func(yield func(ItemMeta) bool) {
+		NewCrawler(cache, 0, false).Crawl(func(batch []ItemMeta) error {
+			if ctx.Err() != nil {
+				return errStopCrawl
+			}
+			for _, meta := range batch {
+				if !yield(meta) {
+					return errStopCrawl
+				}
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// CrawlKeys runs a crawl, returning the keys visited in order.
+func CrawlKeys(t *testing.T, c *Crawler, fn func(batch []ItemMeta)) []string {
+	var keys []string
+	err := c.Crawl(func(batch []ItemMeta) error {
+		for _, meta := range batch {
+			keys = append(keys, meta.Key)
+		}
+		if fn != nil {
+			fn(batch)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Crawl failed: %s\n", err)
+	}
+	return keys
+}
+
+func TestCrawlerMetadata(t *testing.T) {
+	c := New(100000)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	c.Set(ctx, []byte("key1"), value, flags, 0, 0)
+	c.Set(ctx, []byte("key2"), value, flags, 100, 0)
+	now = now.Add(10 * time.Second)
+	c.Get(ctx, []byte("key1"))
+
+	var metas []ItemMeta
+	NewCrawler(c, 0, false).Crawl(func(batch []ItemMeta) error {
+		metas = append(metas, batch...)
+		return nil
+	})
+	expected := []ItemMeta{
+		{"key2", 1500000100, 1500000000, KV_SIZE, 2, flags, value, nil},
+		{"key1", 0, 1500000010, KV_SIZE, 1, flags, value, nil},
+	}
+	if fmt.Sprint(metas) != fmt.Sprint(expected) {
+		t.Errorf("Wrong metadata: %v vs %v\n", metas, expected)
+	}
+}
+
+func TestCrawlerBatches(t *testing.T) {
+	c := New(1000000)
+	n := 3*CRAWL_BATCH + 10
+	for i := 0; i < n; i++ {
+		StoreKey(c, fmt.Sprintf("key%d", i), value)
+	}
+
+	batches := 0
+	keys := CrawlKeys(t, NewCrawler(c, 0, false), func(batch []ItemMeta) {
+		batches++
+		// the lock isn't held, so we're free to use the cache
+		StoreKey(c, "new", value)
+	})
+	if len(keys) != n+1 || batches != 4 {
+		t.Fatalf("Wrong crawl: %d keys in %d batches\n", len(keys), batches)
+	}
+	for i := 0; i < n; i++ {
+		if keys[i] != fmt.Sprintf("key%d", i) {
+			t.Fatalf("Wrong key order: %s at %d\n", keys[i], i)
+		}
+	}
+
+	// the placeholder is gone
+	if len(c.crawlers) != 0 || c.tenants[0].lru.tail.key != "new" {
+		t.Errorf("Crawl placeholder left in LRU\n")
+	}
+}
+
+func TestCrawlerConcurrentMutation(t *testing.T) {
+	c := New(1000000)
+	n := 2 * CRAWL_BATCH
+	for i := 0; i < n; i++ {
+		StoreKey(c, fmt.Sprintf("key%d", i), value)
+	}
+
+	first := true
+	keys := CrawlKeys(t, NewCrawler(c, 0, false), func(batch []ItemMeta) {
+		if !first {
+			return
+		}
+		first = false
+		// remove the next item to be visited, move another to the end and
+		// remove items already visited
+		DeleteKey(c, fmt.Sprintf("key%d", CRAWL_BATCH))
+		c.Get(ctx, []byte(fmt.Sprintf("key%d", CRAWL_BATCH+1)))
+		DeleteKey(c, "key0")
+	})
+	if len(keys) != n-1 || keys[CRAWL_BATCH] != fmt.Sprintf("key%d", CRAWL_BATCH+2) ||
+		keys[n-2] != fmt.Sprintf("key%d", CRAWL_BATCH+1) {
+		t.Errorf("Wrong crawl after mutation: %d keys, %v\n", len(keys), keys[CRAWL_BATCH:])
+	}
+
+	// a flush ends the crawl
+	keys = CrawlKeys(t, NewCrawler(c, 0, false), func([]ItemMeta) { c.Flush(ctx) })
+	if len(keys) != CRAWL_BATCH {
+		t.Errorf("Crawl continued after flush: %d keys\n", len(keys))
+	}
+
+	// and eviction skips the placeholder
+	c = New(2 * KV_SIZE)
+	mark := &Item{tenant: c.tenants[0]}
+	c.crawlers = map[*Item]struct{}{mark: {}}
+	c.tenants[0].lru.PushBack(mark)
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key2", value)
+	StoreKey(c, "key3", value)
+	CheckNoKey(t, c, "key1")
+	CheckKey(t, c, "key3", value)
+	if c.tenants[0].lru.head != mark {
+		t.Errorf("Crawl placeholder evicted\n")
+	}
+}
+
+func TestCrawlerReclaim(t *testing.T) {
+	c := New(100000)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	c.Set(ctx, []byte("key1"), value, flags, 10, 0)
+	c.Set(ctx, []byte("key2"), value, flags, 0, 0)
+	c.Set(ctx, []byte("key3"), value, flags, 10, 0)
+	now = now.Add(20 * time.Second)
+
+	// expired items are never reported, but only removed if reclaiming
+	if keys := CrawlKeys(t, NewCrawler(c, 0, false), nil); fmt.Sprint(keys) != "[key2]" {
+		t.Errorf("Wrong keys: %v\n", keys)
+	}
+	if len(c.hashmap) != 3 {
+		t.Errorf("Expired items removed without reclaim\n")
+	}
+
+	crawler := NewCrawler(c, 0, true)
+	CrawlKeys(t, crawler, nil)
+	if len(c.hashmap) != 1 || c.curBytes != KV_SIZE {
+		t.Errorf("Expired items not reclaimed: %d items %d bytes\n", len(c.hashmap), c.curBytes)
+	}
+	if stats := crawler.Stats(); stats.Reclaimed != 2 || stats.Checked != 3 {
+		t.Errorf("Wrong crawler stats: %v\n", stats)
+	}
+}
+
+func TestCrawlerRate(t *testing.T) {
+	c := New(1000000)
+	for i := 0; i < 2*CRAWL_BATCH; i++ {
+		StoreKey(c, fmt.Sprintf("key%d", i), value)
+	}
+	start := time.Now()
+	CrawlKeys(t, NewCrawler(c, 10*CRAWL_BATCH, false), nil)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Crawl not rate limited: took %s\n", d)
+	}
+}
+
+func TestCacheItems(t *testing.T) {
+	c := New(1000000)
+	for i := 0; i < 2*CRAWL_BATCH; i++ {
+		StoreKey(c, fmt.Sprintf("key%d", i), value)
+	}
+
+	n := 0
+	for meta := range c.Items(ctx) {
+		if meta.Key != fmt.Sprintf("key%d", n) || string(meta.Value) != string(value) || meta.Flags != flags {
+			t.Errorf("Wrong item %d: %v\n", n, meta)
+		}
+		if n++; n == CRAWL_BATCH+1 {
+			break
+		}
+	}
+	if n != CRAWL_BATCH+1 || len(c.crawlers) != 0 {
+		t.Errorf("Iteration not stopped: %d items\n", n)
+	}
+
+	// and a done context ends it
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	for meta := range c.Items(done) {
+		t.Errorf("Item visited after cancel: %s\n", meta.Key)
+	}
+}
@@ -0,0 +1,672 @@
+package cache
+
+// Disk tier, a second tier of storage for items with values too large to be
+// worth keeping in memory once they reach the front of the LRU (as memcached's
+// extstore does). Rather than evicting such an item, we append its key and
+// value to a segment file on local disk (ideally flash) and keep just its
+// header in memory, at the back of its tenant's LRU, with the location of its
+// value. Reads of the item then fetch its value from disk, and removing or
+// replacing the item frees its space in the segment.
+//
+// Segments are append-only and written one at a time, the next started when
+// the current one is full. Once there are DISK_SEGMENTS of them, the oldest is
+// dropped and the items still in it are lost, removed as evicted when they're
+// next looked up. A segment whose items are all gone is removed straight away,
+// and one mostly gone is compacted: its live values are rewritten to the
+// current segment, then it's removed, so space freed by deletes and overwrites
+// is reused rather than waiting for the segment to become the oldest.
+//
+// Evicted values are written to disk with the cache locked, but only into the
+// page cache (segments are never synced, the tier being a cache), while values
+// moved by compaction are written into space reserved for them without it, as
+// are all values read. The tier doesn't survive a restart: segments are emptied
+// on startup, and snapshots of the cache (e.g., for the write log) include the
+// values of items on disk, so they're restored to memory.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"memcached/storage"
+)
+
+// DISK_SEGMENTS is the number of segments the disk tier is divided into, each
+// taking an equal share of its size.
+const DISK_SEGMENTS = 16
+
+// DISK_MIN_VALUE is the default size in bytes of the smallest value written to
+// the disk tier, smaller ones are evicted as usual.
+const DISK_MIN_VALUE = 512
+
+// DISK_COMPACT_RATIO is the fraction of a segment that's live (not freed),
+// below which the segment is compacted.
+const DISK_COMPACT_RATIO = 0.5
+
+// DISK_COMPACT_INTERVAL is how often the disk tier looks for a segment to
+// compact.
+const DISK_COMPACT_INTERVAL = time.Second
+
+// DISK_HEADER_SHARE limits the items of a tenant with their values on disk to
+// this fraction of its storage, beyond which they're evicted in LRU order like
+// any others (see evict).
+const DISK_HEADER_SHARE = 2
+
+// DISK_ENTRY_HEADER is the size in bytes of the header of each entry in a
+// segment: a CRC-32 of the rest of the entry, then the lengths of the key (2
+// bytes) and value (4 bytes), which follow the header.
+const DISK_ENTRY_HEADER = 10
+
+// DISK_ITEM_OVERHEAD is the memory used by each item with its value on disk to
+// record where it is, charged on top of ITEM_OVERHEAD. Values of at most this
+// size are never written to disk, as it would save no memory.
+const DISK_ITEM_OVERHEAD = (uint64(unsafe.Sizeof(itemExtra{})+unsafe.Sizeof(diskLoc{})) + 15) &^ 15
+
+// segmentPattern matches the names of segment files.
+const segmentPattern = "segment-*.dat"
+
+// errCorruptEntry reports an entry read from a segment that fails its checksum
+// or isn't for the item it was read for.
+var errCorruptEntry = errors.New("corrupt disk tier entry")
+
+// DiskTier stores the values of items evicted from a Cache in segment files.
+type DiskTier struct {
+	cache       *Cache
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	minValue    int
+	done        chan struct{}
+	compactMu   sync.Mutex // held while compacting
+
+	// guarded by the lock on the cache
+	segments    []*segment // oldest first, the last written to
+	nextID      int
+	headers     int // items in memory with their values on disk, or lost
+	scratch     []byte
+	written     uint64
+	compactions uint64
+	dropped     uint64
+
+	hits   uint64
+	misses uint64
+}
+
+// segment is a file of the disk tier, holding the values of items.
+type segment struct {
+	file    *os.File
+	size    int64 // of the entries written
+	live    int64 // of the entries of items still in the cache
+	items   int   // still in the cache
+	dropped bool  // the file is closed and removed
+
+	holes map[int64]int64 // offsets and lengths of entries never written
+}
+
+// diskLoc is the location of an item's value in the disk tier. Locations are
+// never modified, an item moved to a new one is given a new diskLoc, so readers
+// can use them without holding the lock.
+type diskLoc struct {
+	segment *segment
+	offset  int64
+	length  int64 // of the entry, including its header and key
+}
+
+// NewDiskTier creates a new DiskTier for the cache, of up to maxBytes in the
+// directory dir, writing the values of evicted items of at least minValue bytes
+// to it. Any segments left in the directory are removed.
+func NewDiskTier(cache *Cache, dir string, maxBytes int64, minValue int) (*DiskTier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range old {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DiskTier{
+		cache:       cache,
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: maxBytes / DISK_SEGMENTS,
+		minValue:    max(minValue, int(DISK_ITEM_OVERHEAD)+1),
+		done:        make(chan struct{}),
+	}
+	if d.segmentSize < DISK_ENTRY_HEADER+MAX_VALUE_SIZE {
+		return nil, fmt.Errorf("disk tier of %d bytes too small for %d segments of %d byte values",
+			maxBytes, DISK_SEGMENTS, MAX_VALUE_SIZE)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, err := d.rotate(); err != nil {
+		return nil, err
+	}
+	cache.disk = d
+	return d, nil
+}
+
+// Run compacts a segment (if any need it) every interval, until the DiskTier is
+// closed.
+func (d *DiskTier) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := d.Compact(); err != nil {
+				d.cache.log.Warn("cannot compact disk tier", "err", err)
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Close stops the DiskTier compacting its segments.
+func (d *DiskTier) Close() {
+	close(d.done)
+}
+
+// Compact compacts the segment with the smallest fraction of it live, if that's
+// below DISK_COMPACT_RATIO, returning true if there was one. The segment being
+// written is never compacted.
+func (d *DiskTier) Compact() (bool, error) {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	cache := d.cache
+	cache.mu.Lock()
+	seg := d.sparsest()
+	var size int64
+	var holes map[int64]int64
+	if seg != nil {
+		size = seg.size // no longer written to, so the entries can be read unlocked
+		holes = maps.Clone(seg.holes)
+	}
+	cache.mu.Unlock()
+	if seg == nil {
+		return false, nil
+	}
+
+	// a read failing as the segment's dropped meanwhile leaves nothing to move
+	err := seg.scan(size, holes, func(off int64, key string, value []byte) error {
+		return d.move(seg, off, key, value)
+	})
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if seg.dropped {
+		err = nil
+	} else if err == nil {
+		d.drop(seg)
+	}
+	if err != nil {
+		return false, err
+	}
+	d.compactions++
+	return true, nil
+}
+
+// scan calls fn with the offset, key and value of each entry in the first size
+// bytes of the segment, skipping the holes. The entries are streamed rather
+// than the segment read at once, each value only valid until fn returns.
+func (seg *segment) scan(size int64, holes map[int64]int64, fn func(int64, string, []byte) error) error {
+	r := bufio.NewReader(io.NewSectionReader(seg.file, 0, size))
+	var entry []byte
+	for off := int64(0); off < size; {
+		if n, ok := holes[off]; ok {
+			if _, err := r.Discard(int(n)); err != nil {
+				return err
+			}
+			off += n
+			continue
+		}
+		entry = slices.Grow(entry[:0], DISK_ENTRY_HEADER)[:DISK_ENTRY_HEADER]
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return err
+		}
+		n := DISK_ENTRY_HEADER + int(binary.BigEndian.Uint16(entry[4:])) + int(binary.BigEndian.Uint32(entry[6:]))
+		if off+int64(n) > size {
+			return errCorruptEntry
+		}
+		entry = slices.Grow(entry, n-DISK_ENTRY_HEADER)[:n]
+		if _, err := io.ReadFull(r, entry[DISK_ENTRY_HEADER:]); err != nil {
+			return err
+		}
+		key, value, ok := parseEntry(entry)
+		if !ok {
+			return errCorruptEntry
+		}
+		if err := fn(off, key, value); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// sparsest returns the sealed segment with the smallest fraction of it live,
+// nil if there's none below DISK_COMPACT_RATIO.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) sparsest() *segment {
+	var best *segment
+	ratio := DISK_COMPACT_RATIO
+	for _, seg := range d.segments[:len(d.segments)-1] {
+		if r := float64(seg.live) / float64(seg.size); r < ratio {
+			best, ratio = seg, r
+		}
+	}
+	return best
+}
+
+// move rewrites the value of the entry at the offset in the segment being
+// compacted to the current segment, if the entry is still its key's. The entry
+// is written without holding the lock on the cache, into space reserved for
+// it, and the item only moved to it if it's still at the old location once the
+// write is done.
+func (d *DiskTier) move(seg *segment, off int64, key string, value []byte) error {
+	cache := d.cache
+	cache.mu.Lock()
+	if !d.at(key, seg, off) {
+		cache.mu.Unlock()
+		return nil
+	}
+	moved, err := d.reserve(entrySize(key, len(value)))
+	cache.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = moved.write(encodeEntry(nil, key, value, nil))
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if moved.segment.dropped {
+		return nil
+	} else if err != nil {
+		d.release(moved)
+		return err
+	}
+	if !d.at(key, seg, off) {
+		return nil // overwritten or removed meanwhile, leaving the entry dead
+	}
+	i := cache.hashmap[key]
+	d.free(i.diskLoc())
+	d.commit(moved)
+	i.setDisk(moved)
+	return nil
+}
+
+// at returns true if the value of the key is in the disk tier at the offset in
+// the segment.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) at(key string, seg *segment, off int64) bool {
+	i, ok := d.cache.hashmap[key]
+	if !ok {
+		return false
+	}
+	loc := i.diskLoc()
+	return loc != nil && loc.segment == seg && loc.offset == off
+}
+
+// entrySize returns the size of the entry for the key and a value of n bytes.
+func entrySize(key string, n int) int64 {
+	return int64(DISK_ENTRY_HEADER + len(key) + n)
+}
+
+// encodeEntry appends the entry for the key and value, given in one piece or in
+// chunks, to buf.
+func encodeEntry(buf []byte, key string, value []byte, chunks [][]byte) []byte {
+	n := len(value)
+	for _, c := range chunks {
+		n += len(c)
+	}
+	start := len(buf)
+	buf = append(buf, make([]byte, DISK_ENTRY_HEADER)...)
+	binary.BigEndian.PutUint16(buf[start+4:], uint16(len(key)))
+	binary.BigEndian.PutUint32(buf[start+6:], uint32(n))
+	buf = append(append(buf, key...), value...)
+	for _, c := range chunks {
+		buf = append(buf, c...)
+	}
+	binary.BigEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(buf[start+4:]))
+	return buf
+}
+
+// append writes an entry for the key and value, given in one piece or in
+// chunks, to the current segment (starting a new one if it's full), returning
+// its location.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) append(key string, value []byte, chunks [][]byte) (*diskLoc, error) {
+	d.scratch = encodeEntry(d.scratch[:0], key, value, chunks)
+	loc, err := d.reserve(int64(len(d.scratch)))
+	if err != nil {
+		return nil, err
+	}
+	if err := loc.write(d.scratch); err != nil {
+		d.release(loc)
+		return nil, err
+	}
+	d.commit(loc)
+	return loc, nil
+}
+
+// reserve reserves space for an entry of length bytes at the end of the current
+// segment (starting a new one if it's full), returning its location. The entry
+// is written with write, and then either committed or released.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) reserve(length int64) (*diskLoc, error) {
+	seg := d.segments[len(d.segments)-1]
+	if seg.size+length > d.segmentSize {
+		var err error
+		if seg, err = d.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	loc := &diskLoc{segment: seg, offset: seg.size, length: length}
+	seg.size += length
+	return loc, nil
+}
+
+// write writes the entry to the space reserved for it. Safe to call without
+// holding the lock on the cache, as nothing else writes there.
+func (loc *diskLoc) write(entry []byte) error {
+	_, err := loc.segment.file.WriteAt(entry, loc.offset)
+	return err
+}
+
+// commit accounts for the entry written at the location as live, its item's
+// value now being there.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) commit(loc *diskLoc) {
+	loc.segment.live += loc.length
+	loc.segment.items++
+	d.written++
+}
+
+// release gives up the space reserved at the location after failing to write
+// to it, if nothing has been reserved after it. Otherwise it's left as a hole,
+// which compaction skips.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) release(loc *diskLoc) {
+	seg := loc.segment
+	if seg.size == loc.offset+loc.length {
+		seg.size = loc.offset
+		return
+	}
+	if seg.holes == nil {
+		seg.holes = make(map[int64]int64)
+	}
+	seg.holes[loc.offset] = loc.length
+}
+
+// rotate starts a new segment, dropping the oldest if there are already
+// DISK_SEGMENTS, and returns it.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) rotate() (*segment, error) {
+	name := filepath.Join(d.dir, fmt.Sprintf("segment-%08d.dat", d.nextID))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{file: f}
+	d.nextID++
+	if len(d.segments) == DISK_SEGMENTS {
+		d.drop(d.segments[0])
+	}
+	d.segments = append(d.segments, seg)
+	return seg, nil
+}
+
+// drop closes and removes the segment, losing any items still in it.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) drop(seg *segment) {
+	seg.dropped = true
+	seg.file.Close()
+	if err := os.Remove(seg.file.Name()); err != nil {
+		d.cache.log.Warn("cannot remove disk tier segment", "err", err)
+	}
+	d.dropped += uint64(seg.items)
+	for n, s := range d.segments {
+		if s == seg {
+			d.segments = append(d.segments[:n], d.segments[n+1:]...)
+			break
+		}
+	}
+}
+
+// free frees the entry at the location (if not nil), as its item has been
+// removed or moved, dropping its segment if it's sealed and now empty.
+//
+// The caller of this method should hold the write lock on Cache.
+func (d *DiskTier) free(loc *diskLoc) {
+	if loc == nil || loc.segment.dropped {
+		return
+	}
+	seg := loc.segment
+	seg.live -= loc.length
+	seg.items--
+	if seg.items == 0 && seg != d.segments[len(d.segments)-1] {
+		d.drop(seg)
+	}
+}
+
+// read reads the entry of the item with the key at the location, returning its
+// value. Safe to call without holding the lock on the cache: if the segment has
+// been dropped since, the read fails.
+func (d *DiskTier) read(key string, loc *diskLoc) ([]byte, error) {
+	buf := make([]byte, loc.length)
+	if _, err := loc.segment.file.ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+	k, value, ok := parseEntry(buf)
+	if !ok || k != key {
+		return nil, errCorruptEntry
+	}
+	return value, nil
+}
+
+// parseEntry parses the entry at the start of buf, returning its key and value,
+// or false if it's truncated or fails its checksum.
+func parseEntry(buf []byte) (string, []byte, bool) {
+	if len(buf) < DISK_ENTRY_HEADER {
+		return "", nil, false
+	}
+	k := int(binary.BigEndian.Uint16(buf[4:]))
+	n := int(binary.BigEndian.Uint32(buf[6:]))
+	end := DISK_ENTRY_HEADER + k + n
+	if len(buf) < end || crc32.ChecksumIEEE(buf[4:end]) != binary.BigEndian.Uint32(buf) {
+		return "", nil, false
+	}
+	return string(buf[DISK_ENTRY_HEADER : DISK_ENTRY_HEADER+k]), buf[DISK_ENTRY_HEADER+k : end], true
+}
+
+// withValue returns the item as retrieved from storage with the value read from
+// disk, split into chunks if it's larger than MAX_VALUE_SIZE (sharing it).
+func withValue(item storage.Item, value []byte) storage.Item {
+	if len(value) <= MAX_VALUE_SIZE {
+		item.Value = value
+		return item
+	}
+	for len(value) > 0 {
+		n := min(len(value), MAX_VALUE_SIZE)
+		item.Chunks, value = append(item.Chunks, value[:n:n]), value[n:]
+	}
+	return item
+}
+
+// demote writes the value of the item to the disk tier (if there is one) rather
+// than evicting the item, keeping it at the back of its tenant's LRU. Returns
+// false if it's to be evicted: if its value is too small, too large for a
+// segment or already on disk, if it's dead, or if the value can't be written.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) demote(i *Item) bool {
+	d := cache.disk
+	if d == nil || i.diskLoc() != nil || cache.dead(i, cache.now().Unix()) {
+		return false
+	}
+	n := len(i.value)
+	for _, c := range i.valueChunks() {
+		n += len(c)
+	}
+	if n < d.minValue || entrySize(i.key, n) > d.segmentSize {
+		return false
+	}
+	loc, err := d.append(i.key, i.value, i.valueChunks())
+	if err != nil {
+		cache.log.Warn("cannot write to disk tier", "key", i.key, "err", err)
+		return false
+	}
+
+	cache.resize(i, func() {
+		i.value = nil
+		i.setChunks(nil)
+		i.setDisk(loc)
+	})
+	d.headers++
+	i.tenant.lru.Erase(i)
+	i.tenant.lru.PushBack(i)
+	return true
+}
+
+// lookupLoaded locks the cache and looks up the key, returning its item along
+// with the item as retrieved from storage, or false if it's missing. A value in
+// the disk tier is loaded without holding the lock, and the lookup retried if
+// the item has been replaced or removed meanwhile. Returns holding the lock
+// either way.
+func (cache *Cache) lookupLoaded(ctx context.Context, key []byte) (*Item, storage.Item, bool) {
+	for {
+		cache.lockFor(ctx)
+		i, ok := cache.lookup(key)
+		if !ok {
+			return nil, storage.Item{}, false
+		}
+		loc := i.diskLoc()
+		if loc == nil {
+			return i, i.stored(), true
+		}
+		item, disk := i.stored(), cache.disk
+		cache.unlock()
+
+		item, err := disk.load(string(key), item, loc)
+		if err != nil {
+			continue // removed as evicted, so looked up again
+		}
+		cache.lockFor(ctx)
+		if i, ok := cache.lookup(key); ok && i.version == item.CAS {
+			return i, item, true
+		}
+		cache.unlock()
+	}
+}
+
+// load completes the item as retrieved from storage with its value read from
+// the disk tier at the location, without holding the lock on the cache. If the
+// value has been moved by a compaction since, it's read from where it's moved
+// to, and if it can't be read, the item is removed as evicted and ErrNotFound
+// returned.
+func (d *DiskTier) load(key string, item storage.Item, loc *diskLoc) (storage.Item, error) {
+	cache := d.cache
+	for {
+		value, err := d.read(key, loc)
+		if err == nil {
+			atomic.AddUint64(&d.hits, 1)
+			return withValue(item, value), nil
+		}
+
+		cache.mu.Lock()
+		i, ok := cache.hashmap[key]
+		if ok && i.version == item.CAS && i.diskLoc() != nil && i.diskLoc() != loc {
+			loc = i.diskLoc()
+			cache.mu.Unlock()
+			continue
+		}
+		if ok && i.diskLoc() == loc {
+			cache.evictItem(i)
+		}
+		cache.unlock()
+		atomic.AddUint64(&d.misses, 1)
+		return storage.Item{}, ErrNotFound
+	}
+}
+
+// resize modifies the item in place with change, accounting for the change in
+// its size.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) resize(i *Item, change func()) {
+	before, t := i.Size(), i.tenant
+	if i.diskLoc() != nil {
+		t.diskBytes -= before
+	}
+	change()
+	cache.curBytes += i.Size() - before
+	t.curBytes += i.Size() - before
+	if i.diskLoc() != nil {
+		t.diskBytes += i.Size()
+	}
+}
+
+// DiskStats are the statistics of a DiskTier.
+type DiskStats struct {
+	Bytes       uint64 // of the segments on disk
+	LiveBytes   uint64 // of the entries of items still in the cache
+	MaxBytes    uint64
+	Segments    int
+	Items       int    // with their values on disk
+	Written     uint64 // values written, including those moved by compaction
+	Hits        uint64 // values read
+	Misses      uint64 // values that couldn't be read
+	Compactions uint64
+	Dropped     uint64 // items lost with the oldest segment
+}
+
+// Stats returns the statistics of the disk tier.
+func (d *DiskTier) Stats() DiskStats {
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+
+	stats := DiskStats{
+		MaxBytes:    uint64(d.maxBytes),
+		Segments:    len(d.segments),
+		Written:     d.written,
+		Hits:        atomic.LoadUint64(&d.hits),
+		Misses:      atomic.LoadUint64(&d.misses),
+		Compactions: d.compactions,
+		Dropped:     d.dropped,
+	}
+	for _, seg := range d.segments {
+		stats.Bytes += uint64(seg.size)
+		stats.LiveBytes += uint64(seg.live)
+		stats.Items += seg.items
+	}
+	return stats
+}
@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// DISK_TEST_SIZE is the size of the disk tiers tested, the smallest allowed.
+const DISK_TEST_SIZE = DISK_SEGMENTS * (DISK_ENTRY_HEADER + MAX_VALUE_SIZE)
+
+// NewTestDiskTier creates a cache with a disk tier in a temporary directory.
+func NewTestDiskTier(t *testing.T, maxBytes uint64) (*Cache, *DiskTier, string) {
+	c := New(maxBytes)
+	dir := t.TempDir()
+	d, err := NewDiskTier(c, dir, DISK_TEST_SIZE, DISK_MIN_VALUE)
+	if err != nil {
+		t.Fatalf("Couldn't create disk tier: %v\n", err)
+	}
+	return c, d, dir
+}
+
+// bigValue returns a value of n bytes, distinct for each seed.
+func bigValue(seed, n int) []byte {
+	return bytes.Repeat([]byte{byte('a' + seed%26)}, n)
+}
+
+func TestDiskTier(t *testing.T) {
+	c, d, _ := NewTestDiskTier(t, 10000)
+	for n := 0; n < 20; n++ {
+		StoreKey(c, fmt.Sprintf("big%d", n), bigValue(n, 1000))
+	}
+
+	// the large values evicted are read back from disk
+	for n := 0; n < 20; n++ {
+		CheckKey(t, c, fmt.Sprintf("big%d", n), bigValue(n, 1000))
+	}
+	stats, ds := c.Stats(), d.Stats()
+	if stats.Bytes > stats.MaxBytes || stats.Evictions != 0 || stats.Items != 20 ||
+		stats.OverheadBytes != 20*ITEM_OVERHEAD+14*DISK_ITEM_OVERHEAD {
+		t.Errorf("Wrong cache stats: %+v\n", stats)
+	}
+	if ds.Items != 14 || ds.Written != 14 || ds.Hits != 14 || ds.Misses != 0 || ds.Segments != 1 ||
+		ds.Bytes != ds.LiveBytes {
+		t.Errorf("Wrong disk tier stats: %+v\n", ds)
+	}
+
+	// deleting, overwriting and flushing frees the values on disk
+	DeleteKey(c, "big0")
+	StoreKey(c, "big1", value)
+	CheckKey(t, c, "big1", value)
+	if ds := d.Stats(); ds.Items != 12 || ds.LiveBytes != ds.Bytes-uint64(2*entrySize("big0", 1000)) {
+		t.Errorf("Values not freed: %+v\n", ds)
+	}
+	c.Flush(ctx)
+	if ds := d.Stats(); ds.Items != 0 || ds.LiveBytes != 0 || c.Stats().Bytes != 0 {
+		t.Errorf("Values not freed by flush: %+v\n", ds)
+	}
+
+	// small values are evicted as usual
+	for n := 0; n < 100; n++ {
+		StoreKey(c, fmt.Sprintf("small%d", n), value)
+	}
+	if stats, ds := c.Stats(), d.Stats(); stats.Evictions == 0 || ds.Items != 0 || ds.Written != 14 {
+		t.Errorf("Small values written to disk: %+v %+v\n", stats, ds)
+	}
+}
+
+func TestDiskTierItems(t *testing.T) {
+	// segments large enough for a value in chunks
+	c := New(3 * MAX_VALUE_SIZE)
+	d, err := NewDiskTier(c, t.TempDir(), 2*DISK_TEST_SIZE, DISK_MIN_VALUE)
+	if err != nil {
+		t.Fatalf("Couldn't create disk tier: %v\n", err)
+	}
+	chunked := bigValue(1, MAX_VALUE_SIZE+1000)
+	c.SetTagged(ctx, []byte("tagged"), bigValue(2, 1000), flags, 0, 0, [][]byte{[]byte("tag")})
+	StoreKey(c, "chunked", chunked)
+	StoreKey(c, "counter", []byte(fmt.Sprintf("%01000d", 41)))
+	for n := 0; n < 4; n++ {
+		StoreKey(c, fmt.Sprintf("filler%d", n), bigValue(n, MAX_VALUE_SIZE-1000))
+	}
+	for _, key := range []string{"tagged", "chunked", "counter"} {
+		if c.hashmap[key].diskLoc() == nil {
+			t.Fatalf("Value not on disk: %s\n", key)
+		}
+	}
+
+	// chunked values come back in chunks, and items on disk can be touched and
+	// incremented
+	i, err := c.Get(ctx, []byte("chunked"))
+	if err != nil || len(i.Chunks) != 2 || !bytes.Equal(i.Bytes(), chunked) || i.Flags != flags {
+		t.Errorf("Wrong chunked item: %d chunks %v\n", len(i.Chunks), err)
+	}
+	if i, err := c.Touch(ctx, []byte("chunked"), 100); err != nil || !bytes.Equal(i.Bytes(), chunked) {
+		t.Errorf("Wrong touched item: %v\n", err)
+	}
+	if n, err := c.Incr(ctx, []byte("counter"), 1, false); err != nil || n != 42 {
+		t.Errorf("Couldn't increment on disk: %d %v\n", n, err)
+	}
+
+	// as well as snapshotted, their values being read as the snapshot is
+	// walked, rather than while it's taken
+	hits := d.Stats().Hits
+	snap := c.Snapshot(nil)
+	if snap.Len() != 8 || d.Stats().Hits != hits {
+		t.Errorf("Wrong snapshot: %d records, %d values read\n", snap.Len(), d.Stats().Hits-hits)
+	}
+	n := 0
+	snap.Each(func(rec *Record) error {
+		n++
+		if rec.Key == "chunked" && !bytes.Equal(bytes.Join(rec.Chunks, nil), chunked) {
+			t.Errorf("Wrong value snapshotted: %d chunks\n", len(rec.Chunks))
+		}
+		return nil
+	})
+	if n != 8 || d.Stats().Hits == hits {
+		t.Errorf("Wrong snapshot records: %d\n", n)
+	}
+
+	// and invalidated by their tags
+	items := d.Stats().Items
+	c.InvalidateTag(ctx, []byte("tag"))
+	CheckNoKey(t, c, "tagged")
+	if ds := d.Stats(); ds.Items != items-1 || ds.Misses != 0 {
+		t.Errorf("Wrong disk tier stats: %+v\n", ds)
+	}
+}
+
+func TestDiskTierCompact(t *testing.T) {
+	size := MAX_VALUE_SIZE/4 - 100
+	c, d, dir := NewTestDiskTier(t, uint64(size+10000))
+	for n := 0; n < 13; n++ {
+		StoreKey(c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+	if ds := d.Stats(); ds.Segments != 3 || ds.Items != 12 {
+		t.Fatalf("Wrong disk tier stats: %+v\n", ds)
+	}
+
+	// a segment emptied is removed straight away, and one mostly emptied
+	// compacted, keeping its values
+	for n := 0; n < 7; n++ {
+		DeleteKey(c, fmt.Sprintf("key%d", n))
+	}
+	if ok, err := d.Compact(); err != nil || !ok {
+		t.Fatalf("Couldn't compact: %v %v\n", ok, err)
+	}
+	if ok, err := d.Compact(); err != nil || ok {
+		t.Errorf("Compacted without need: %v %v\n", ok, err)
+	}
+	for n := 7; n < 13; n++ {
+		CheckKey(t, c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if ds := d.Stats(); ds.Segments != 2 || len(files) != 2 || ds.Items != 5 || ds.Compactions != 1 {
+		t.Errorf("Wrong disk tier stats after compacting: %+v %v\n", ds, files)
+	}
+}
+
+func TestDiskTierCompactConcurrent(t *testing.T) {
+	size := MAX_VALUE_SIZE / 8
+	c, d, _ := NewTestDiskTier(t, uint64(size+10000))
+	for n := 0; n < 40; n++ {
+		StoreKey(c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+	for n := 0; n < 40; n++ {
+		if n%3 != 0 {
+			DeleteKey(c, fmt.Sprintf("key%d", n))
+		}
+	}
+
+	// values being moved are read from wherever they are, and those overwritten
+	// while being moved keep their new value
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Go(func() {
+			for n := g; n < 40; n += 4 {
+				if n%6 == 3 {
+					CheckKey(t, c, fmt.Sprintf("key%d", n), bigValue(n, size))
+				}
+			}
+		})
+	}
+	wg.Go(func() {
+		for n := 0; n < 40; n += 6 {
+			StoreKey(c, fmt.Sprintf("key%d", n), bigValue(n+1, size))
+		}
+	})
+	for {
+		ok, err := d.Compact()
+		if err != nil {
+			t.Fatalf("Couldn't compact: %v\n", err)
+		} else if !ok {
+			break
+		}
+	}
+	wg.Wait()
+	for n := 0; n < 40; n += 6 {
+		CheckKey(t, c, fmt.Sprintf("key%d", n), bigValue(n+1, size))
+	}
+	if ds := d.Stats(); ds.Misses != 0 || ds.Compactions == 0 {
+		t.Errorf("Wrong disk tier stats: %+v\n", ds)
+	}
+}
+
+func TestDiskTierHole(t *testing.T) {
+	size := MAX_VALUE_SIZE/4 - 100
+	c, d, _ := NewTestDiskTier(t, uint64(size+10000))
+	for n := 0; n < 3; n++ {
+		StoreKey(c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+
+	// space reserved but never written, followed by a value, is skipped when
+	// the segment is compacted
+	c.mu.Lock()
+	loc, _ := d.reserve(entrySize("hole", size))
+	c.mu.Unlock()
+	for n := 3; n < 13; n++ {
+		StoreKey(c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+	c.mu.Lock()
+	d.release(loc)
+	c.mu.Unlock()
+	for n := 0; n < 2; n++ {
+		DeleteKey(c, fmt.Sprintf("key%d", n))
+	}
+	if ok, err := d.Compact(); err != nil || !ok {
+		t.Fatalf("Couldn't compact: %v %v\n", ok, err)
+	}
+	for n := 2; n < 13; n++ {
+		CheckKey(t, c, fmt.Sprintf("key%d", n), bigValue(n, size))
+	}
+}
+
+func TestDiskTierFull(t *testing.T) {
+	size := MAX_VALUE_SIZE/2 - 100
+	c, d, dir := NewTestDiskTier(t, uint64(size+100000))
+	n := 2*DISK_SEGMENTS + 4
+	for k := 0; k < n; k++ {
+		StoreKey(c, fmt.Sprintf("key%d", k), bigValue(k, size))
+	}
+
+	// the oldest segments are dropped, their items lost as evicted
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if ds := d.Stats(); ds.Segments != DISK_SEGMENTS || len(files) != DISK_SEGMENTS || ds.Dropped != 4 {
+		t.Errorf("Wrong disk tier stats: %+v %d files\n", ds, len(files))
+	}
+	for k := 0; k < 4; k++ {
+		CheckNoKey(t, c, fmt.Sprintf("key%d", k))
+	}
+	for k := 4; k < n; k++ {
+		CheckKey(t, c, fmt.Sprintf("key%d", k), bigValue(k, size))
+	}
+	if stats := c.Stats(); stats.Evictions != 4 || stats.Removals[REASON_EVICTED] != 4 {
+		t.Errorf("Lost items not evicted: %+v\n", stats)
+	}
+}
+
+func TestDiskTierRestart(t *testing.T) {
+	c, _, dir := NewTestDiskTier(t, 10000)
+	StoreKey(c, "key", bigValue(0, 1000))
+	StoreKey(c, "other", bigValue(1, 10000-1000))
+
+	// segments left by a previous process are removed
+	if _, err := NewDiskTier(New(10000), dir, DISK_TEST_SIZE, DISK_MIN_VALUE); err != nil {
+		t.Fatalf("Couldn't create disk tier: %v\n", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Old segments kept: %v\n", entries)
+	}
+	if _, err := NewDiskTier(New(10000), t.TempDir(), DISK_TEST_SIZE-1, DISK_MIN_VALUE); err == nil {
+		t.Errorf("Created a disk tier too small for its values\n")
+	}
+}
@@ -0,0 +1,210 @@
+package cache
+
+// Heap limiter, caps the cache against the actual memory used by the Go heap
+// rather than our estimate of it. The estimate can be well off, e.g., from
+// fragmentation or garbage that's yet to be collected.
+//
+// After every garbage collection, we compare the live heap to the limit and
+// scale the cache's storage limit by how far over (or under) it we are,
+// evicting items as needed. The storage limit never grows beyond the one
+// configured, nor shrinks below HEAP_MIN_STORAGE_SHARE of it.
+//
+// The limit on the live heap is usually derived from the Go runtime's soft
+// memory limit (GOMEMLIMIT), which may be set relative to the storage limit
+// (see SetMemoryLimit). The runtime collects garbage more often as the total heap
+// nears its limit, so we keep the live heap to HEAP_LIVE_SHARE of it, leaving
+// the rest for garbage between collections rather than have the runtime
+// collect continually.
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// HEAP_CHECK_INTERVAL is how often the heap limiter looks for a completed
+// garbage collection.
+const HEAP_CHECK_INTERVAL = 100 * time.Millisecond
+
+// HEAP_LIVE_SHARE is the share of the Go runtime's memory limit the live heap
+// is limited to, when the limit isn't given explicitly (see MaxHeapFor).
+const HEAP_LIVE_SHARE = 0.5
+
+// HEAP_MIN_STORAGE_SHARE is the share of the configured storage limit the
+// storage limit is never lowered below, however far over the live heap is.
+const HEAP_MIN_STORAGE_SHARE = 1.0 / 16
+
+// SetMemoryLimit sets the Go runtime's soft memory limit to ratio times the
+// storage limit maxBytes, unless it's set by the GOMEMLIMIT environment variable
+// or ratio is 0, and returns the limit in effect (0 if there's none).
+func SetMemoryLimit(maxBytes uint64, ratio float64) uint64 {
+	if os.Getenv("GOMEMLIMIT") == "" && ratio > 0 {
+		debug.SetMemoryLimit(int64(min(float64(maxBytes)*ratio, math.MaxInt64)))
+	}
+	return memoryLimit()
+}
+
+// memoryLimit returns the Go runtime's soft memory limit, 0 if there's none.
+func memoryLimit() uint64 {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return uint64(limit)
+	}
+	return 0
+}
+
+// MaxHeapFor returns the limit on the live heap for a Go runtime memory limit,
+// 0 if there's none.
+func MaxHeapFor(memoryLimit uint64) uint64 {
+	return uint64(float64(memoryLimit) * HEAP_LIVE_SHARE)
+}
+
+// HeapLimiter keeps the live Go heap within a limit by adjusting the storage
+// limit of a Cache.
+type HeapLimiter struct {
+	cache    *Cache
+	maxHeap  uint64
+	maxBytes uint64 // storage limit configured for the cache
+	done     chan struct{}
+
+	// read returns the live heap and the number of completed garbage
+	// collections, stubbed out by tests.
+	read   func() (live, cycles uint64)
+	cycles uint64
+
+	live     uint64
+	stored   uint64 // by the cache, when the live heap was measured
+	adjusted uint64
+	evicted  uint64
+}
+
+// NewHeapLimiter creates a new HeapLimiter, keeping the live heap of the process
+// within maxHeap bytes by shrinking the storage limit of the cache.
+func NewHeapLimiter(cache *Cache, maxHeap uint64) *HeapLimiter {
+	cache.mu.Lock()
+	maxBytes := cache.maxBytes
+	cache.mu.Unlock()
+
+	return &HeapLimiter{
+		cache:    cache,
+		maxHeap:  maxHeap,
+		maxBytes: maxBytes,
+		done:     make(chan struct{}),
+		read:     readHeap,
+	}
+}
+
+// readHeap returns the live heap (as of the last garbage collection) and the
+// number of garbage collections completed.
+func readHeap() (uint64, uint64) {
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+	var live, cycles uint64
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		live = samples[0].Value.Uint64()
+	}
+	if samples[1].Value.Kind() == metrics.KindUint64 {
+		cycles = samples[1].Value.Uint64()
+	}
+	return live, cycles
+}
+
+// Run checks the heap every interval, until the HeapLimiter is closed.
+func (hl *HeapLimiter) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			hl.check()
+		case <-hl.done:
+			return
+		}
+	}
+}
+
+// Close stops the HeapLimiter.
+func (hl *HeapLimiter) Close() {
+	close(hl.done)
+}
+
+// check adjusts the storage limit of the cache if a garbage collection has
+// completed since the last check. The live heap is only measured by a
+// collection, so adjusting more often would act on the same stale measurement
+// repeatedly.
+func (hl *HeapLimiter) check() {
+	live, cycles := hl.read()
+	if cycles == hl.cycles || live == 0 {
+		return
+	}
+	hl.cycles = cycles
+	atomic.StoreUint64(&hl.live, live)
+
+	cache := hl.cache
+	cache.mu.Lock()
+	defer cache.unlock()
+	atomic.StoreUint64(&hl.stored, cache.curBytes)
+
+	// when over, scale what's actually stored rather than the limit, which
+	// may be well above it, and when under, scale the configured limit
+	base := hl.maxBytes
+	if live > hl.maxHeap {
+		base = min(cache.maxBytes, cache.curBytes)
+	}
+	limit := uint64(float64(base) * float64(hl.maxHeap) / float64(live))
+	limit = min(max(limit, uint64(float64(hl.maxBytes)*HEAP_MIN_STORAGE_SHARE)), hl.maxBytes)
+	if limit == cache.maxBytes {
+		return
+	}
+
+	cache.log.Debug("adjusting storage limit for heap", "live", live,
+		"from", cache.maxBytes, "to", limit)
+	evictions := cache.evictions
+	cache.maxBytes = limit
+	cache.evictOverflow()
+	atomic.AddUint64(&hl.adjusted, 1)
+	atomic.AddUint64(&hl.evicted, cache.evictions-evictions)
+}
+
+// HeapLimiterStats are the statistics of a HeapLimiter.
+type HeapLimiterStats struct {
+	MaxHeap      uint64
+	Live         uint64 // as of the last garbage collection
+	Stored       uint64 // by the cache, as of the last garbage collection
+	Goal         uint64 // heap size at which the next collection starts
+	MemoryLimit  uint64 // of the Go runtime, 0 if none
+	MaxBytes     uint64 // storage limit configured
+	StorageLimit uint64 // storage limit in effect
+	Adjustments  uint64 // of the storage limit
+	Evictions    uint64 // of items, by the storage limit being lowered
+}
+
+// Stats returns the statistics of the heap limiter.
+func (hl *HeapLimiter) Stats() HeapLimiterStats {
+	hl.cache.mu.Lock()
+	limit := hl.cache.maxBytes
+	hl.cache.mu.Unlock()
+
+	goal := []metrics.Sample{{Name: "/gc/heap/goal:bytes"}}
+	metrics.Read(goal)
+	stats := HeapLimiterStats{
+		MaxHeap:      hl.maxHeap,
+		Live:         atomic.LoadUint64(&hl.live),
+		Stored:       atomic.LoadUint64(&hl.stored),
+		MemoryLimit:  memoryLimit(),
+		MaxBytes:     hl.maxBytes,
+		StorageLimit: limit,
+		Adjustments:  atomic.LoadUint64(&hl.adjusted),
+		Evictions:    atomic.LoadUint64(&hl.evicted),
+	}
+	if goal[0].Value.Kind() == metrics.KindUint64 {
+		stats.Goal = goal[0].Value.Uint64()
+	}
+	return stats
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestHeapLimiter(t *testing.T) {
+	cache := New(100 * KV_SIZE)
+	for i := 0; i < 100; i++ {
+		StoreKey(cache, fmt.Sprintf("k%03d", i), value)
+	}
+	hl := NewHeapLimiter(cache, 1000)
+	var live, cycles uint64
+	hl.read = func() (uint64, uint64) { return live, cycles }
+
+	// nothing happens until a garbage collection measures the heap
+	live = 2000
+	hl.check()
+	if cache.maxBytes != 100*KV_SIZE {
+		t.Errorf("Storage limit changed without a garbage collection\n")
+	}
+
+	// twice the limit, so we halve what's stored
+	cycles++
+	hl.check()
+	if cache.maxBytes != 50*KV_SIZE || len(cache.hashmap) != 50 {
+		t.Errorf("Storage not halved: limit %d, %d items\n", cache.maxBytes, len(cache.hashmap))
+	}
+	CheckNoKey(t, cache, "k049")
+	CheckKey(t, cache, "k050", value)
+
+	// under the limit, so it grows back but never beyond the configured limit
+	live, cycles = 800, cycles+1
+	hl.check()
+	if cache.maxBytes != 100*KV_SIZE {
+		t.Errorf("Storage limit not restored: %d\n", cache.maxBytes)
+	}
+	live, cycles = 100, cycles+1
+	hl.check()
+	if cache.maxBytes != 100*KV_SIZE {
+		t.Errorf("Storage limit grew beyond the configured limit: %d\n", cache.maxBytes)
+	}
+
+	if stats := hl.Stats(); stats.Live != 100 || stats.Stored != 50*KV_SIZE || stats.Adjustments != 2 ||
+		stats.Evictions != 50 || stats.MaxBytes != 100*KV_SIZE || stats.StorageLimit != 100*KV_SIZE {
+		t.Errorf("Wrong heap limiter stats: %+v\n", stats)
+	}
+}
+
+func TestHeapLimiterEmpty(t *testing.T) {
+	// over the limit with nothing stored, the limit only falls to its floor
+	cache := New(160 * KV_SIZE)
+	hl := NewHeapLimiter(cache, 1000)
+	var live, cycles uint64 = 2000, 1
+	hl.read = func() (uint64, uint64) { return live, cycles }
+	hl.check()
+	if cache.maxBytes != 10*KV_SIZE {
+		t.Errorf("Storage limit not at its floor: %d\n", cache.maxBytes)
+	}
+
+	// so it can still grow back
+	live, cycles = 800, cycles+1
+	hl.check()
+	if cache.maxBytes != 160*KV_SIZE {
+		t.Errorf("Storage limit not restored: %d\n", cache.maxBytes)
+	}
+}
+
+func TestHeapLimiterRead(t *testing.T) {
+	runtime.GC()
+	live, cycles := readHeap()
+	if live == 0 || cycles == 0 {
+		t.Errorf("Couldn't read heap metrics: %d %d\n", live, cycles)
+	}
+}
+
+func TestSetMemoryLimit(t *testing.T) {
+	prev := debug.SetMemoryLimit(-1)
+	defer debug.SetMemoryLimit(prev)
+	t.Setenv("GOMEMLIMIT", "")
+
+	// the runtime's limit follows the storage limit
+	if limit := SetMemoryLimit(1000000, 1.5); limit != 1500000 || debug.SetMemoryLimit(-1) != 1500000 {
+		t.Errorf("Wrong memory limit: %d\n", limit)
+	}
+	if MaxHeapFor(1500000) != 750000 {
+		t.Errorf("Wrong heap limit: %d\n", MaxHeapFor(1500000))
+	}
+
+	// unless it's set by the environment, or disabled
+	t.Setenv("GOMEMLIMIT", "1GiB")
+	if limit := SetMemoryLimit(1000000, 2); limit != 1500000 {
+		t.Errorf("Memory limit from the environment overridden: %d\n", limit)
+	}
+	t.Setenv("GOMEMLIMIT", "")
+	debug.SetMemoryLimit(math.MaxInt64)
+	if limit := SetMemoryLimit(1000000, 0); limit != 0 {
+		t.Errorf("Memory limit set when disabled: %d\n", limit)
+	}
+	if stats := NewHeapLimiter(New(1000), 500).Stats(); stats.MemoryLimit != 0 || stats.Goal == 0 {
+		t.Errorf("Wrong heap limiter stats: %+v\n", stats)
+	}
+}
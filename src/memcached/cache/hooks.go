@@ -0,0 +1,108 @@
+package cache
+
+// Lifecycle hooks, for learning why items leave the cache: evicted for lack of
+// room, expired, deleted, overwritten by a new value, reaped for being idle,
+// flushed or invalidated. Every removal is counted by its reason, and hooks
+// registered with AddHook are called with the key, size and reason of each item
+// removed.
+//
+// Removals happen with the cache locked, so they're queued and the hooks are
+// only called once the operation that removed them unlocks the cache (see
+// unlock), in that operation's goroutine. Hooks are free to use the cache, but
+// a slow hook slows down the request that triggered it.
+
+import "sync"
+
+// Reason is why an item left the cache.
+type Reason uint8
+
+// List of reasons items leave the cache.
+const (
+	REASON_EVICTED     Reason = iota // for lack of room
+	REASON_EXPIRED                   // found past its expiration
+	REASON_DELETED                   // by a delete, or a failed store of its key
+	REASON_OVERWRITTEN               // replaced by a new value for its key
+	REASON_IDLE                      // reaped for not being accessed
+	REASON_FLUSHED                   // by a flush of the cache or its tenant
+	REASON_INVALIDATED               // found invalidated by its prefix or a tag
+	NUM_REASONS
+)
+
+var reasonNames = [NUM_REASONS]string{
+	REASON_EVICTED:     "evicted",
+	REASON_EXPIRED:     "expired",
+	REASON_DELETED:     "deleted",
+	REASON_OVERWRITTEN: "overwritten",
+	REASON_IDLE:        "idle",
+	REASON_FLUSHED:     "flushed",
+	REASON_INVALIDATED: "invalidated",
+}
+
+// String returns the name of the reason.
+func (r Reason) String() string {
+	if r < NUM_REASONS {
+		return reasonNames[r]
+	}
+	return "unknown"
+}
+
+// Hook is called with the key and size of an item removed from the cache, and
+// why it was removed.
+type Hook func(key string, size uint64, reason Reason)
+
+// removal is an item removed from the cache, waiting to be passed to the hooks.
+type removal struct {
+	key    string
+	size   uint64
+	reason Reason
+}
+
+// removalPool holds the queues of removals, so queuing them needn't allocate.
+var removalPool = sync.Pool{New: func() interface{} { return new([]removal) }}
+
+// AddHook registers a hook to be called for every item removed from then on.
+// Hooks of concurrent operations may run concurrently, and so out of order.
+func (cache *Cache) AddHook(hook Hook) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.hooks = append(cache.hooks, hook)
+}
+
+// removed counts an item leaving the cache for the reason, and queues it for
+// the hooks (if any) to be called once the cache is unlocked.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) removed(i *Item, reason Reason) {
+	cache.removals[reason]++
+	if cache.leases != nil {
+		cache.invalidateLease(i, reason)
+	}
+	if len(cache.hooks) == 0 {
+		return
+	}
+	if cache.pending == nil {
+		cache.pending = removalPool.Get().(*[]removal)
+	}
+	*cache.pending = append(*cache.pending, removal{i.key, i.Size(), reason})
+}
+
+// unlock unlocks the cache and then calls the hooks for the items removed
+// while it was locked. Removals queued while the cache was locked by mu.Unlock
+// alone are passed on by the next call.
+func (cache *Cache) unlock() {
+	pending, hooks := cache.pending, cache.hooks
+	cache.pending = nil
+	cache.mu.Unlock()
+	if pending == nil {
+		return
+	}
+
+	for _, r := range *pending {
+		for _, hook := range hooks {
+			hook(r.key, r.size, r.reason)
+		}
+	}
+	clear(*pending)
+	*pending = (*pending)[:0]
+	removalPool.Put(pending)
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// removalLog records the removals a hook is called with.
+type removalLog []string
+
+func (l *removalLog) hook(key string, size uint64, reason Reason) {
+	*l = append(*l, key+" "+reason.String())
+}
+
+func TestHooks(t *testing.T) {
+	c := New(3 * KV_SIZE)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	var removals removalLog
+	c.AddHook(removals.hook)
+	r := NewReaper(c, time.Hour)
+
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key2", value)
+	DeleteKey(c, "key2")
+	c.Set(ctx, []byte("key3"), value, flags, 10, 0)
+	StoreKey(c, "key4", value)
+	StoreKey(c, "key5", value)
+	now = now.Add(20 * time.Second)
+	CheckNoKey(t, c, "key3")
+	now = now.Add(2 * time.Hour)
+	StoreKey(c, "key6", value)
+	r.Reap()
+	StoreKey(c, "key7", value)
+	c.Flush(ctx)
+
+	expected := removalLog{
+		"key1 overwritten",
+		"key2 deleted",
+		"key1 evicted",
+		"key3 expired",
+		"key4 idle",
+		"key5 idle",
+		"key6 flushed",
+		"key7 flushed",
+	}
+	if len(removals) == len(expected) {
+		// a flush removes items in no particular order
+		if removals[7] < removals[6] {
+			removals[6], removals[7] = removals[7], removals[6]
+		}
+	}
+	if !reflect.DeepEqual(removals, expected) {
+		t.Errorf("Wrong removals: %q vs %q\n", removals, expected)
+	}
+
+	counts := c.Stats().Removals
+	if counts != [NUM_REASONS]uint64{1, 1, 1, 1, 2, 2} {
+		t.Errorf("Wrong removal counts: %v\n", counts)
+	}
+}
+
+func TestHooksUnlocked(t *testing.T) {
+	c := New(2 * KV_SIZE)
+	var sizes []uint64
+	c.AddHook(func(key string, size uint64, reason Reason) {
+		// the cache mustn't be locked, or this deadlocks
+		c.Stats()
+		sizes = append(sizes, size)
+	})
+
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key2", value)
+	StoreKey(c, "key3", value)
+	if len(sizes) != 1 || sizes[0] != KV_SIZE {
+		t.Errorf("Wrong removals: %v\n", sizes)
+	}
+}
+
+func TestReplicatedRemovals(t *testing.T) {
+	c := New(100000)
+	var removals removalLog
+	c.AddHook(removals.hook)
+
+	StoreKey(c, "key1", value)
+	c.Apply(&Record{Op: WAL_SET, Cas: 10, Key: "key1", Value: value})
+	c.Apply(&Record{Op: WAL_EXPIRE, Key: "key1"})
+	expected := removalLog{"key1 overwritten", "key1 expired"}
+	if !reflect.DeepEqual(removals, expected) {
+		t.Errorf("Wrong removals: %q vs %q\n", removals, expected)
+	}
+}
@@ -0,0 +1,164 @@
+package cache
+
+// Bulk invalidation, of every key with a prefix (see FlushPrefix) or of every
+// item with a tag given when it was stored (see SetTagged and InvalidateTag),
+// without a locked scan of the whole cache. Invalidating just bumps the cache's
+// version counter and records it against the prefix or tag: items stored
+// before then (having a lower CAS value) with the prefix or tag are dead from
+// that point on.
+//
+// Dead items are removed lazily when looked up, as expired items are, or by a
+// reclaiming LRU crawl (see Crawler.Reclaim), which visits the cache a batch at
+// a time. Once a reclaiming crawl completes, the invalidations made before it
+// started have no items left to apply to and are forgotten, so they only cost
+// a map lookup per distinct prefix length (or tag of the item) on lookups until
+// then.
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+)
+
+// SetTagged stores the specified key in the cache as Set does, tagging the
+// item so that it's invalidated along with every other item with one of its
+// tags by InvalidateTag. The item keeps its tags when incremented.
+func (cache *Cache) SetTagged(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64, tags [][]byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	i, ok := cache.lookup(key)
+	if ok && cas > 0 && i.version != cas {
+		return 0, ErrExists
+	} else if !ok && cas > 0 {
+		return 0, ErrNotFound
+	}
+	var itemTags []string
+	for _, tag := range tags {
+		if !slices.Contains(itemTags, string(tag)) {
+			itemTags = append(itemTags, string(tag))
+		}
+	}
+	return cache.store(key, value, nil, itemTags, flags, cache.expiresAt(exptime), i)
+}
+
+// InvalidateTag invalidates every item stored with the tag, which are removed
+// from the cache lazily.
+func (cache *Cache) InvalidateTag(ctx context.Context, tag []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	cache.version++
+	cache.invalidateTag(string(tag), cache.version)
+	cache.publish(WAL_INVALIDATE_TAG, cache.version, 0, nil, string(tag), nil)
+	return nil
+}
+
+// invalidatePrefix invalidates every item with the prefix stored before the
+// version given.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) invalidatePrefix(prefix string, version uint64) {
+	if cache.prefixGens == nil {
+		cache.prefixGens = make(map[string]uint64)
+	}
+	if !slices.Contains(cache.prefixLens, len(prefix)) {
+		cache.prefixLens = append(cache.prefixLens, len(prefix))
+	}
+	cache.prefixGens[prefix] = version
+}
+
+// invalidateTag invalidates every item with the tag stored before the version
+// given.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) invalidateTag(tag string, version uint64) {
+	if cache.tagGens == nil {
+		cache.tagGens = make(map[string]uint64)
+	}
+	cache.tagGens[tag] = version
+}
+
+// invalidated returns true if the item's prefix or one of its tags has been
+// invalidated since it was stored.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) invalidated(i *Item) bool {
+	return cache.invalidatedSince(i.key, i.itemTags(), i.version)
+}
+
+// invalidatedSince returns true if a prefix of the key or one of the tags has
+// been invalidated since the version given, e.g. since a lease of the key was
+// granted.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) invalidatedSince(key string, tags []string, version uint64) bool {
+	for _, n := range cache.prefixLens {
+		if n <= len(key) {
+			if v, ok := cache.prefixGens[key[:n]]; ok && version < v {
+				return true
+			}
+		}
+	}
+	for _, tag := range tags {
+		if v, ok := cache.tagGens[tag]; ok && version < v {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetInvalidations forgets the invalidations made up to the version given,
+// every item they apply to having been removed. Leases granted before them are
+// revoked first, as they'd no longer be checked against them.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) forgetInvalidations(version uint64) {
+	for key, l := range cache.leases {
+		if l.token != 0 && cache.invalidatedSince(key, l.tags, l.version) {
+			l.token = 0
+		}
+	}
+	cache.prefixLens = cache.prefixLens[:0]
+	for prefix, v := range cache.prefixGens {
+		if v <= version {
+			delete(cache.prefixGens, prefix)
+		} else if !slices.Contains(cache.prefixLens, len(prefix)) {
+			cache.prefixLens = append(cache.prefixLens, len(prefix))
+		}
+	}
+	for tag, v := range cache.tagGens {
+		if v <= version {
+			delete(cache.tagGens, tag)
+		}
+	}
+}
+
+// appendTags encodes tags onto the end of buf (as the value of a WAL_TAG
+// record), each preceded by its length.
+func appendTags(buf []byte, tags []string) []byte {
+	for _, tag := range tags {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(tag)))
+		buf = append(buf, tag...)
+	}
+	return buf
+}
+
+// parseTags decodes tags encoded by appendTags, ignoring any truncated tag.
+func parseTags(buf []byte) []string {
+	var tags []string
+	for len(buf) >= 2 {
+		n := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+n {
+			break
+		}
+		tags, buf = append(tags, string(buf[2:2+n])), buf[2+n:]
+	}
+	return tags
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// SetTaggedKey stores the key with the tags.
+func SetTaggedKey(c *Cache, key string, tags ...string) uint64 {
+	var tagBytes [][]byte
+	for _, tag := range tags {
+		tagBytes = append(tagBytes, []byte(tag))
+	}
+	cas, _ := c.SetTagged(ctx, []byte(key), value, flags, 0, 0, tagBytes)
+	return cas
+}
+
+func TestInvalidatePrefix(t *testing.T) {
+	c := New(100000)
+	StoreKey(c, "user:1:name", value)
+	StoreKey(c, "user:1:email", value)
+	StoreKey(c, "user:10:name", value)
+	StoreKey(c, "user:2:name", value)
+
+	if err := c.FlushPrefix(ctx, []byte("user:1:")); err != nil {
+		t.Fatalf("Couldn't flush prefix: %v\n", err)
+	}
+	if stats := c.Stats(); stats.Items != 4 || stats.Invalidations != 1 {
+		t.Errorf("Invalidated items removed eagerly: %+v\n", stats)
+	}
+	CheckNoKey(t, c, "user:1:name")
+	CheckNoKey(t, c, "user:1:email")
+	CheckKey(t, c, "user:10:name", value)
+	CheckKey(t, c, "user:2:name", value)
+	if stats := c.Stats(); stats.Items != 2 || stats.Removals[REASON_INVALIDATED] != 2 {
+		t.Errorf("Invalidated items not removed: %+v\n", stats)
+	}
+
+	// keys stored after the flush are kept, and can't be added twice
+	StoreKey(c, "user:1:name", []byte("new"))
+	CheckKey(t, c, "user:1:name", []byte("new"))
+	StoreKey(c, "user:1:email", value)
+	if _, err := c.Add(ctx, []byte("user:1:email"), value, flags, 0); err != ErrNotStored {
+		t.Errorf("Added over a key stored after the flush: %v\n", err)
+	}
+
+	// flushing again invalidates the new keys, and a shorter prefix the rest
+	c.FlushPrefix(ctx, []byte("user:1:"))
+	CheckNoKey(t, c, "user:1:name")
+	c.FlushPrefix(ctx, []byte("user:"))
+	CheckNoKey(t, c, "user:10:name")
+	CheckNoKey(t, c, "user:2:name")
+	if _, err := c.Add(ctx, []byte("user:2:name"), value, flags, 0); err != nil {
+		t.Errorf("Couldn't add over an invalidated key: %v\n", err)
+	}
+}
+
+func TestInvalidateTag(t *testing.T) {
+	c := New(100000)
+	SetTaggedKey(c, "profile:1", "user:1")
+	SetTaggedKey(c, "feed:1", "user:1", "feeds")
+	SetTaggedKey(c, "feed:2", "user:2", "feeds")
+	SetTaggedKey(c, "count:1", "user:1", "user:1")
+	c.Set(ctx, []byte("count:1"), []byte("1"), flags, 0, 0)
+	SetTaggedKey(c, "count:2", "user:2")
+	c.SetTagged(ctx, []byte("count:2"), []byte("1"), flags, 0, 0, [][]byte{[]byte("user:2")})
+
+	// an increment keeps the item's tags, a set doesn't
+	if _, err := c.Incr(ctx, []byte("count:2"), 1, false); err != nil {
+		t.Fatalf("Couldn't increment: %v\n", err)
+	}
+	if err := c.InvalidateTag(ctx, []byte("user:1")); err != nil {
+		t.Fatalf("Couldn't invalidate: %v\n", err)
+	}
+	CheckNoKey(t, c, "profile:1")
+	CheckNoKey(t, c, "feed:1")
+	CheckKey(t, c, "feed:2", value)
+	CheckKey(t, c, "count:1", []byte("1"))
+	c.InvalidateTag(ctx, []byte("user:2"))
+	CheckNoKey(t, c, "feed:2")
+	CheckNoKey(t, c, "count:2")
+
+	if stats := c.Stats(); stats.Items != 1 || stats.Removals[REASON_INVALIDATED] != 4 ||
+		stats.Invalidations != 2 {
+		t.Errorf("Wrong stats: %+v\n", stats)
+	}
+}
+
+func TestInvalidateReclaim(t *testing.T) {
+	c := New(100000)
+	for _, key := range []string{"a:1", "a:2", "b:1"} {
+		SetTaggedKey(c, key, "tag")
+	}
+	SetTaggedKey(c, "c:1", "other")
+	c.FlushPrefix(ctx, []byte("a:"))
+	c.InvalidateTag(ctx, []byte("tag"))
+
+	crawler := NewCrawler(c, 0, false)
+	crawler.Reclaim()
+	if stats := c.Stats(); stats.Items != 1 || stats.Invalidations != 0 {
+		t.Errorf("Invalidated items not reclaimed: %+v\n", stats)
+	}
+	if stats := crawler.Stats(); stats.Reclaimed != 3 {
+		t.Errorf("Wrong crawler stats: %+v\n", stats)
+	}
+	CheckKey(t, c, "c:1", value)
+
+	// a crawl that doesn't reclaim keeps the invalidations
+	c.FlushPrefix(ctx, []byte("c:"))
+	CrawlKeys(t, crawler, nil)
+	if stats := c.Stats(); stats.Items != 1 || stats.Invalidations != 1 {
+		t.Errorf("Invalidations forgotten: %+v\n", stats)
+	}
+}
+
+func TestInvalidateLeases(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := NewLeaseCache(100000, &now)
+	SetTaggedKey(c, "key", "tag")
+	c.InvalidateTag(ctx, []byte("tag"))
+
+	// an invalidated item is served stale while it's refreshed
+	i, l, err := c.LeaseGet(ctx, []byte("key"))
+	if err != nil || !l.Stale || l.Token == 0 || string(i.Value) != string(value) {
+		t.Errorf("Wrong stale value: %q %+v %v\n", i.Value, l, err)
+	}
+	if _, err := c.LeaseSet(ctx, []byte("key"), []byte("new"), flags, 0, l.Token); err != nil {
+		t.Errorf("Couldn't lease set: %v\n", err)
+	}
+	CheckKey(t, c, "key", []byte("new"))
+
+	// leases granted before an invalidation of the key are revoked, even once
+	// the invalidation is forgotten
+	_, l, _ = c.LeaseGet(ctx, []byte("p:key"))
+	c.FlushPrefix(ctx, []byte("p:"))
+	if _, err := c.LeaseSet(ctx, []byte("p:key"), value, flags, 0, l.Token); err != ErrInvalidLease {
+		t.Errorf("Lease set after a flush of its prefix: %v\n", err)
+	}
+	SetTaggedKey(c, "t:key", "tag")
+	DeleteKey(c, "t:key")
+	_, l, _ = c.LeaseGet(ctx, []byte("t:key"))
+	c.InvalidateTag(ctx, []byte("tag"))
+	NewCrawler(c, 0, false).Reclaim()
+	if _, err := c.LeaseSet(ctx, []byte("t:key"), value, flags, 0, l.Token); err != ErrInvalidLease ||
+		c.Stats().Invalidations != 0 {
+		t.Errorf("Lease set after an invalidation of its tag: %v\n", err)
+	}
+}
+
+func TestInvalidateWriteLog(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 100000)
+	SetTaggedKey(cache, "a:1", "tag1")
+	SetTaggedKey(cache, "b:1", "tag2")
+	SetTaggedKey(cache, "c:1", "tag1", "tag2")
+	StoreKey(cache, "d:1", value)
+	cache.FlushPrefix(ctx, []byte("a:"))
+	// crash: no Close, rely on the SYNC_ALWAYS policy
+
+	// replaying the log restores the tags and invalidations
+	cache, wl = OpenTestLog(t, dir, 100000)
+	CheckNoKey(t, cache, "a:1")
+	CheckKey(t, cache, "b:1", value)
+	cache.InvalidateTag(ctx, []byte("tag2"))
+	CheckNoKey(t, cache, "b:1")
+	CheckNoKey(t, cache, "c:1")
+	SetTaggedKey(cache, "e:1", "tag1")
+	StoreKey(cache, "a:2", value)
+
+	// as does compacting it, less the items invalidated
+	if err := wl.Compact(cache); err != nil {
+		t.Fatalf("Couldn't compact: %s\n", err)
+	}
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckKey(t, cache, "a:2", value)
+	CheckKey(t, cache, "d:1", value)
+	cache.InvalidateTag(ctx, []byte("tag1"))
+	CheckNoKey(t, cache, "e:1")
+	CheckKey(t, cache, "d:1", value)
+	if stats := cache.Stats(); stats.Items != 2 {
+		t.Errorf("Wrong items after compaction: %+v\n", stats)
+	}
+}
+
+func TestInvalidateReplicated(t *testing.T) {
+	leader, follower := New(100000), New(100000)
+	SetTaggedKey(leader, "a:1", "tag")
+	SetTaggedKey(leader, "b:1", "tag")
+	StoreKey(leader, "c:1", value)
+	leader.FlushPrefix(ctx, []byte("b:"))
+
+	leader.Snapshot(nil).Each(func(rec *Record) error {
+		follower.Apply(rec)
+		return nil
+	})
+	CheckKey(t, follower, "a:1", value)
+	CheckNoKey(t, follower, "b:1")
+
+	// a follower applies invalidations, as records of them
+	follower.Apply(&Record{Op: WAL_INVALIDATE_TAG, Cas: leader.version + 1, Key: "tag"})
+	CheckNoKey(t, follower, "a:1")
+	CheckKey(t, follower, "c:1", value)
+	follower.Apply(&Record{Op: WAL_INVALIDATE_PREFIX, Cas: leader.version + 2, Key: "c:"})
+	CheckNoKey(t, follower, "c:1")
+}
@@ -0,0 +1,198 @@
+package cache
+
+// Leases, for protecting whatever the cache is in front of from a stampede of
+// clients filling a missing key (see "Scaling Memcache at Facebook", 3.2.1). A
+// lease get that misses grants the first client a lease token to fill the key
+// with, and tells the others it's a hot miss, to wait and retry, for as long as
+// the lease lasts. A lease set is only stored if its lease is still valid: a
+// store or delete of the key invalidates it, as does a flush of its prefix or
+// an invalidation of a tag of its last item, so a client can't fill the cache
+// with a value read before the key changed.
+//
+// Items deleted, expired or invalidated are kept as stale values for as long as
+// a lease lasts (up to a share of the storage limit), and lease gets that miss
+// return them, marked stale, so clients that can make do with them needn't wait
+// for the lease holder to fill the key (stale-while-revalidate).
+
+import (
+	"context"
+
+	"memcached/storage"
+)
+
+// STALE_SHARE limits the stale values kept to this fraction of the storage
+// limit, on top of it.
+const STALE_SHARE = 8
+
+// lease is the lease state of a key missing from the cache.
+type lease struct {
+	token      uint64   // 0 if not leased
+	expires    int64    // UNIX time in seconds the lease ends
+	version    uint64   // of the cache when the lease was granted
+	tags       []string // of the key's last item, if its removal was recorded
+	stale      *Item    // deleted or expired value, nil if none
+	staleUntil int64    // UNIX time in seconds the stale value is dropped
+}
+
+// LeaseStats are the statistics of the leases of a Cache.
+type LeaseStats struct {
+	Granted    uint64
+	Rejected   uint64 // lease sets with an invalid lease
+	HotMisses  uint64
+	StaleHits  uint64
+	StaleBytes uint64 // of the stale values kept
+}
+
+// LeaseGet retrieves the specified key from the cache, or if it's missing,
+// leases it to the caller (unless it already is to another client) and returns
+// its stale value, if any. Fails with ErrNotSupported unless leases are enabled
+// (see WithLeases).
+func (cache *Cache) LeaseGet(ctx context.Context, key []byte) (storage.Item, storage.Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, storage.Lease{}, err
+	}
+	if cache.leaseTTL == 0 {
+		return storage.Item{}, storage.Lease{}, ErrNotSupported
+	}
+	i, item, ok := cache.lookupLoaded(ctx, key)
+	defer cache.unlock()
+	if ok {
+		cache.bump(i)
+		i.tenant.hits++
+		return item, storage.Lease{}, nil
+	}
+	cache.tenantFor(key).misses++
+
+	now := cache.now().Unix()
+	cache.pruneLeases(now)
+	l, ok := cache.leases[string(key)]
+	if !ok {
+		l = &lease{}
+		cache.leases[string(key)] = l
+	}
+	var granted storage.Lease
+	if l.token == 0 || l.expires <= now {
+		cache.leaseSeq++
+		l.token, l.expires, l.version = cache.leaseSeq, now+cache.leaseTTL, cache.version
+		granted.Token = l.token
+		cache.leaseStats.Granted++
+	}
+	if l.stale != nil && l.staleUntil > now {
+		cache.leaseStats.StaleHits++
+		granted.Stale = true
+		return l.stale.stored(), granted, nil
+	}
+	if granted.Token == 0 {
+		cache.leaseStats.HotMisses++
+		return storage.Item{}, granted, ErrHotMiss
+	}
+	return storage.Item{}, granted, ErrNotFound
+}
+
+// LeaseSet stores the specified key in the cache as Set does, but only if the
+// lease token is still valid. Fails with ErrNotSupported unless leases are
+// enabled (see WithLeases).
+func (cache *Cache) LeaseSet(ctx context.Context, key, value []byte, flags, exptime uint32, token uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cache.leaseTTL == 0 {
+		return 0, ErrNotSupported
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	// a valid lease means the key is missing, storing it ends the lease
+	l, ok := cache.leases[string(key)]
+	if !ok || token == 0 || l.token != token || l.expires <= cache.now().Unix() ||
+		cache.invalidatedSince(string(key), l.tags, l.version) {
+		cache.leaseStats.Rejected++
+		return 0, ErrInvalidLease
+	}
+	i, _ := cache.lookup(key)
+	return cache.store(key, value, nil, nil, flags, cache.expiresAt(exptime), i)
+}
+
+// LeaseStats returns the statistics of the cache's leases.
+func (cache *Cache) LeaseStats() LeaseStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.leaseStats
+}
+
+// invalidateLease invalidates any lease of a key removed from the cache, which
+// is kept as a stale value if it was deleted, expired or invalidated (unless its
+// value was on disk, as it's freed with the item).
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) invalidateLease(i *Item, reason Reason) {
+	if reason != REASON_DELETED && reason != REASON_EXPIRED && reason != REASON_INVALIDATED {
+		cache.dropLease(i.key)
+		return
+	}
+
+	now := cache.now().Unix()
+	cache.pruneLeases(now)
+	l, ok := cache.leases[i.key]
+	keep := i.diskLoc() == nil && cache.leaseStats.StaleBytes+i.Size() <= cache.maxBytes/STALE_SHARE
+	if !ok && !keep {
+		return
+	} else if !ok {
+		l = &lease{}
+		cache.leases[i.key] = l
+	}
+	l.token, l.tags = 0, i.itemTags()
+	cache.unstale(l)
+	if keep {
+		l.stale, l.staleUntil = i, now+cache.leaseTTL
+		cache.leaseStats.StaleBytes += i.Size()
+	}
+}
+
+// revokeLease invalidates any lease of a key deleted while missing.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) revokeLease(key []byte) {
+	if l, ok := cache.leases[string(key)]; ok {
+		l.token = 0
+	}
+}
+
+// dropLease forgets the lease state of the key, as it's been stored anew.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) dropLease(key string) {
+	if l, ok := cache.leases[key]; ok {
+		cache.unstale(l)
+		delete(cache.leases, key)
+	}
+}
+
+// unstale drops the lease's stale value, if any.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) unstale(l *lease) {
+	if l.stale != nil {
+		cache.leaseStats.StaleBytes -= l.stale.Size()
+		l.stale = nil
+	}
+}
+
+// pruneLeases forgets ended leases and stale values past their time, at most
+// once per lease TTL.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) pruneLeases(now int64) {
+	if now < cache.nextLeasePrune {
+		return
+	}
+	cache.nextLeasePrune = now + cache.leaseTTL
+	for key, l := range cache.leases {
+		if l.stale != nil && l.staleUntil <= now {
+			cache.unstale(l)
+		}
+		if l.stale == nil && (l.token == 0 || l.expires <= now) {
+			delete(cache.leases, key)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// NewLeaseCache creates a cache with leases lasting 10 seconds, on a clock
+// stopped at now.
+func NewLeaseCache(maxBytes uint64, now *time.Time) *Cache {
+	return New(maxBytes, WithLeases(10*time.Second), WithClock(func() time.Time { return *now }))
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := NewLeaseCache(100000, &now)
+
+	_, first, err := c.LeaseGet(ctx, []byte("key"))
+	if err != ErrNotFound || first.Token == 0 {
+		t.Fatalf("Wrong lease: %+v %v\n", first, err)
+	}
+	now = now.Add(9 * time.Second)
+	if _, l, err := c.LeaseGet(ctx, []byte("key")); err != ErrHotMiss || l.Token != 0 {
+		t.Errorf("Key leased twice: %+v %v\n", l, err)
+	}
+
+	// once the lease ends, the key is leased to the next client
+	now = now.Add(time.Second)
+	_, second, err := c.LeaseGet(ctx, []byte("key"))
+	if err != ErrNotFound || second.Token == 0 || second.Token == first.Token {
+		t.Errorf("Wrong lease after the first ended: %+v %v\n", second, err)
+	}
+	if _, err := c.LeaseSet(ctx, []byte("key"), value, flags, 0, first.Token); err != ErrInvalidLease {
+		t.Errorf("Lease set with an ended lease: %v\n", err)
+	}
+	if _, err := c.LeaseSet(ctx, []byte("key"), value, flags, 0, second.Token); err != nil {
+		t.Errorf("Couldn't lease set: %v\n", err)
+	}
+	CheckKey(t, c, "key", value)
+	if len(c.leases) != 0 {
+		t.Errorf("Lease kept once the key was stored: %d\n", len(c.leases))
+	}
+
+	stats := c.LeaseStats()
+	if stats.Granted != 2 || stats.HotMisses != 1 || stats.Rejected != 1 {
+		t.Errorf("Wrong lease stats: %+v\n", stats)
+	}
+}
+
+func TestLeaseStale(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := NewLeaseCache(100000, &now)
+
+	// an expired item is served stale while its first client refreshes it
+	c.Set(ctx, []byte("key1"), value, flags, 5, 0)
+	now = now.Add(5 * time.Second)
+	i, l, err := c.LeaseGet(ctx, []byte("key1"))
+	if err != nil || !l.Stale || l.Token == 0 || string(i.Value) != string(value) || i.Flags != flags {
+		t.Errorf("Wrong stale value: %q %+v %v\n", i.Value, l, err)
+	}
+	if _, l, err := c.LeaseGet(ctx, []byte("key1")); err != nil || !l.Stale || l.Token != 0 {
+		t.Errorf("Wrong stale value for another client: %+v %v\n", l, err)
+	}
+	if c.LeaseStats().StaleBytes != KV_SIZE {
+		t.Errorf("Wrong stale bytes: %d\n", c.LeaseStats().StaleBytes)
+	}
+
+	// stale values are dropped once they've been kept as long as a lease
+	now = now.Add(10 * time.Second)
+	if _, l, err := c.LeaseGet(ctx, []byte("key1")); err != ErrNotFound || l.Stale || l.Token == 0 {
+		t.Errorf("Stale value kept too long: %+v %v\n", l, err)
+	}
+	if c.LeaseStats().StaleBytes != 0 {
+		t.Errorf("Wrong stale bytes: %d\n", c.LeaseStats().StaleBytes)
+	}
+
+	// a flush leaves nothing stale, and no leases
+	StoreKey(c, "key2", value)
+	DeleteKey(c, "key2")
+	c.Flush(ctx)
+	if len(c.leases) != 0 || c.LeaseStats().StaleBytes != 0 {
+		t.Errorf("Leases kept after a flush: %d\n", len(c.leases))
+	}
+}
+
+func TestLeaseStaleLimit(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := NewLeaseCache(STALE_SHARE*2*KV_SIZE, &now)
+
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key2", value)
+	StoreKey(c, "key3", value)
+	DeleteKey(c, "key1")
+	DeleteKey(c, "key2")
+	DeleteKey(c, "key3")
+
+	// only two items fit in the share of the storage limit for stale values
+	for key, stale := range map[string]bool{"key1": true, "key2": true, "key3": false} {
+		if _, l, _ := c.LeaseGet(ctx, []byte(key)); l.Stale != stale {
+			t.Errorf("Wrong lease get of %s: %+v\n", key, l)
+		}
+	}
+}
+
+func TestLeasesDisabled(t *testing.T) {
+	c := New(100000)
+	if _, _, err := c.LeaseGet(ctx, []byte("key")); err != ErrNotSupported {
+		t.Errorf("Lease get without leases: %v\n", err)
+	}
+	StoreKey(c, "key", value)
+	DeleteKey(c, "key")
+	if c.leases != nil {
+		t.Errorf("Stale value kept without leases\n")
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+// Timing waits for the cache lock. A request's context may carry a LockTimer,
+// which the cache adds the time spent waiting for its lock to, telling apart
+// contention from the work done under the lock.
+
+import (
+	"context"
+	"time"
+)
+
+// LockTimer accumulates the time requests waited for the cache lock. It's only
+// used by one goroutine at a time, serving one request after another.
+type LockTimer struct {
+	Wait time.Duration
+}
+
+// lockTimerKey is the context key of the LockTimer of a request.
+type lockTimerKey struct{}
+
+// WithLockTimer returns a context carrying timer, which the operations of a
+// Cache run with the context add their waits for the cache lock to.
+func WithLockTimer(ctx context.Context, timer *LockTimer) context.Context {
+	return context.WithValue(ctx, lockTimerKey{}, timer)
+}
+
+// lockFor takes the write lock on Cache for an operation run with ctx, timing
+// the wait if ctx carries a LockTimer. The clock is only read when the lock is
+// contended.
+func (cache *Cache) lockFor(ctx context.Context) {
+	timer, _ := ctx.Value(lockTimerKey{}).(*LockTimer)
+	if timer == nil {
+		cache.mu.Lock()
+		return
+	}
+	if cache.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	cache.mu.Lock()
+	timer.Wait += time.Since(start)
+}
@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockTimer(t *testing.T) {
+	c := New(10 * KV_SIZE)
+	var timer LockTimer
+	timed := WithLockTimer(ctx, &timer)
+
+	// an uncontended lock isn't waited for
+	c.Set(timed, []byte("key"), value, flags, 0, 0)
+	if timer.Wait != 0 {
+		t.Errorf("Waited for a free lock: %v\n", timer.Wait)
+	}
+
+	// while a contended one is, as long as it's held
+	c.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get(timed, []byte("key"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Unlock()
+	<-done
+	if timer.Wait < 20*time.Millisecond {
+		t.Errorf("Wrong lock wait: %v\n", timer.Wait)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package cache
 
 // LRU represents an LRU (or queue) over Items. We specialize to Item's as
 // Golang lacks a reasonable generics / polymorphic type system to handle this
@@ -60,3 +60,16 @@ func (lru *LRU) PopFront() *Item {
 	lru.Erase(item)
 	return item
 }
+
+// InsertBefore inserts the specified item just before mark (i.e., towards the
+// front of the LRU queue).
+func (lru *LRU) InsertBefore(item, mark *Item) {
+	item.lru.prev = mark
+	item.lru.next = mark.lru.next
+	if mark.lru.next != nil {
+		mark.lru.next.lru.prev = item
+	} else {
+		lru.head = item
+	}
+	mark.lru.next = item
+}
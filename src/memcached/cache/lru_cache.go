@@ -0,0 +1,796 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"memcached/storage"
+)
+
+// Cache represents a cache / hashmap with an finite storage limit and an LRU
+// eviction policy of key-value pairs beyond that limit. Items belong to a
+// tenant (see tenant.go), each with its own LRU and optionally its own storage
+// limit, so eviction only touches the items of a tenant over its limit.
+//
+// Safe to use with from multiple Go routines. We adopt a simple sinle Mutex
+// strategy to protect the shared hashmap. It's tempting to think we could use a
+// RWMutex as a really easy improvement, but `gets` also perform a write due to
+// updating the shared LRU.
+//
+// Memcached improves this situation by having multiple LRU's (one per
+// slab-class) and using a shareded-lock to protect the hashmap too.
+type Cache struct {
+	maxBytes uint64
+	curBytes uint64
+	hashmap  map[string]*Item
+	version  uint64
+	tenants  []*Tenant // the default tenant first
+	journals []Journal
+	hooks    []Hook
+	pending  *[]removal // removed while locked, for the hooks
+	log      Logger
+	scratch  []byte
+	now      func() time.Time
+	crawlers map[*Item]struct{} // placeholders of in-progress crawls in the LRUs
+	disk     *DiskTier          // nil if items are evicted rather than written to disk
+
+	// bulk invalidations (see invalidate.go), by the version they were made at
+	prefixGens map[string]uint64
+	prefixLens []int // the distinct lengths of the prefixes invalidated
+	tagGens    map[string]uint64
+
+	// leases of missing keys (see lease.go), if enabled
+	leases         map[string]*lease
+	leaseTTL       int64 // in seconds, 0 if disabled
+	leaseSeq       uint64
+	nextLeasePrune int64
+	leaseStats     LeaseStats
+
+	// admission policy
+	maxItemSize uint64 // largest item payload stored, 0 for no limit below maxBytes
+	noEvict     bool   // reject stores that don't fit rather than evict
+
+	evictions uint64
+	tooLarge  uint64
+	noMemory  uint64
+	removals  [NUM_REASONS]uint64
+
+	mu sync.Mutex
+}
+
+// New creates a new cache with specified storage limit.
+func New(maxBytes uint64, opts ...Option) *Cache {
+	cache := &Cache{
+		maxBytes: maxBytes,
+		hashmap:  make(map[string]*Item),
+		tenants:  []*Tenant{{name: DEFAULT_TENANT}},
+		log:      nopLogger{},
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if cache.leaseTTL > 0 {
+		cache.leases = make(map[string]*lease)
+	}
+	return cache
+}
+
+// AddJournal adds a journal to receive every further mutation of the cache.
+func (cache *Cache) AddJournal(j Journal) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.journals = append(cache.journals, j)
+}
+
+// MAX_RELATIVE_EXPIRY is the largest expiration (in seconds) that memcache
+// treats as relative to the current time, anything larger is taken to be an
+// absolute UNIX timestamp.
+const MAX_RELATIVE_EXPIRY = storage.MAX_RELATIVE_EXPIRY
+
+// Item represents a value stored in the cache. Items are never modified once
+// stored, other than their expiry and access times, and the location of their
+// value once it's written to the disk tier.
+type Item struct {
+	flags    [4]byte
+	key      string
+	value    []byte
+	chunks   *[][]byte  // the value, if larger than MAX_VALUE_SIZE (value is then nil)
+	extra    *itemExtra // nil if the item isn't tagged or on disk
+	version  uint64
+	expires  int64 // UNIX time in seconds, 0 if the item never expires.
+	accessed int64 // UNIX time in seconds of the last store or retrieval.
+	tenant   *Tenant
+	lru      LRUElem // in the tenant's LRU
+}
+
+// newItem creates a new item for storage in the cache.
+func newItem(key string, value, flags []byte, cas uint64, expires int64) *Item {
+	item := &Item{
+		key:     key,
+		value:   value,
+		version: cas,
+		expires: expires,
+	}
+	copy(item.flags[:], flags)
+	return item
+}
+
+// setChunks stores the item's value in chunks, unless chunks is nil. They're
+// kept by pointer to keep small items small.
+func (item *Item) setChunks(chunks [][]byte) {
+	if chunks != nil {
+		c := chunks // only moved to the heap if there are chunks
+		item.chunks = &c
+	} else {
+		item.chunks = nil
+	}
+}
+
+// valueChunks returns the chunks of the item's value, nil if it's in one piece.
+func (item *Item) valueChunks() [][]byte {
+	if item.chunks == nil {
+		return nil
+	}
+	return *item.chunks
+}
+
+// itemExtra holds what few items have, kept by pointer to keep the rest small.
+type itemExtra struct {
+	tags []string // nil if the item isn't tagged
+	disk *diskLoc // the value, if on disk (value and chunks are then nil)
+}
+
+// setTags tags the item, or untags it if tags is empty.
+func (item *Item) setTags(tags []string) {
+	if len(tags) == 0 {
+		tags = nil
+	}
+	item.setExtra(tags, item.diskLoc())
+}
+
+// itemTags returns the item's tags, nil if it isn't tagged.
+func (item *Item) itemTags() []string {
+	if item.extra == nil {
+		return nil
+	}
+	return item.extra.tags
+}
+
+// setDisk records the location of the item's value in the disk tier.
+func (item *Item) setDisk(loc *diskLoc) {
+	item.setExtra(item.itemTags(), loc)
+}
+
+// diskLoc returns the location of the item's value in the disk tier, nil if
+// it's in memory.
+func (item *Item) diskLoc() *diskLoc {
+	if item.extra == nil {
+		return nil
+	}
+	return item.extra.disk
+}
+
+// setExtra sets the item's tags and the location of its value on disk, only
+// allocating if either is set.
+func (item *Item) setExtra(tags []string, loc *diskLoc) {
+	if tags == nil && loc == nil {
+		item.extra = nil
+	} else {
+		item.extra = &itemExtra{tags: tags, disk: loc}
+	}
+}
+
+// Flags returns the item's (opaque) flags.
+func (item *Item) Flags() uint32 {
+	return binary.BigEndian.Uint32(item.flags[:])
+}
+
+// stored returns the item as retrieved from storage, sharing its value (which
+// is missing if it's on disk, see DiskTier.load).
+func (item *Item) stored() storage.Item {
+	return storage.Item{Value: item.value, Chunks: item.valueChunks(), Flags: item.Flags(),
+		CAS: item.version, Expires: item.expires}
+}
+
+// MAP_ENTRY_OVERHEAD is the average memory used by an entry in the hashmap: the
+// key string header and item pointer, plus the map's own bookkeeping and spare
+// capacity.
+const MAP_ENTRY_OVERHEAD = 32
+
+// ITEM_OVERHEAD is the memory used by each item beyond its key, value and
+// flags: the Item struct (rounded up to the allocator's size class) and its
+// hashmap entry. TestItemOverhead checks this against the measured heap usage.
+const ITEM_OVERHEAD = (uint64(unsafe.Sizeof(Item{}))+15)&^15 + MAP_ENTRY_OVERHEAD
+
+// Size returns the total memory in bytes used by the item, its payload plus a
+// constant per-item overhead (and another if its value is on disk), which is
+// what the storage limit applies to.
+func (item *Item) Size() uint64 {
+	if item.diskLoc() != nil {
+		return item.Payload() + ITEM_OVERHEAD + DISK_ITEM_OVERHEAD
+	}
+	return item.Payload() + ITEM_OVERHEAD
+}
+
+// Payload returns the size in bytes of the item's flags, key, value (unless
+// it's on disk) and tags.
+func (item *Item) Payload() uint64 {
+	n := len(item.flags) + len(item.key) + len(item.value)
+	for _, c := range item.valueChunks() {
+		n += len(c)
+	}
+	for _, tag := range item.itemTags() {
+		n += len(tag)
+	}
+	return uint64(n)
+}
+
+// copyValue copies a value given in one piece, or in chunks if chunks isn't
+// nil, into a single slice if it's at most MAX_VALUE_SIZE or else into chunks
+// of that size (the last possibly shorter).
+func copyValue(value []byte, chunks [][]byte) ([]byte, [][]byte) {
+	if chunks == nil {
+		if len(value) <= MAX_VALUE_SIZE {
+			return append([]byte(nil), value...), nil
+		}
+		chunks = [][]byte{value}
+	}
+	n := 0
+	for _, c := range chunks {
+		n += len(c)
+	}
+	if n <= MAX_VALUE_SIZE {
+		value = make([]byte, 0, n)
+		for _, c := range chunks {
+			value = append(value, c...)
+		}
+		return value, nil
+	}
+
+	copied := make([][]byte, 0, (n+MAX_VALUE_SIZE-1)/MAX_VALUE_SIZE)
+	var chunk []byte
+	for _, c := range chunks {
+		for len(c) > 0 {
+			if chunk == nil {
+				chunk = make([]byte, 0, min(n, MAX_VALUE_SIZE))
+			}
+			m := min(len(c), cap(chunk)-len(chunk))
+			chunk, c, n = append(chunk, c[:m]...), c[m:], n-m
+			if len(chunk) == cap(chunk) {
+				copied, chunk = append(copied, chunk), nil
+			}
+		}
+	}
+	return nil, copied
+}
+
+// expired returns true if the item has an expiration at or before now.
+func (item *Item) expired(now int64) bool {
+	return item.expires != 0 && item.expires <= now
+}
+
+// expiresAt converts a memcache expiration value to an absolute UNIX time.
+func (cache *Cache) expiresAt(exptime uint32) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime <= MAX_RELATIVE_EXPIRY:
+		return cache.now().Unix() + int64(exptime)
+	default:
+		return int64(exptime)
+	}
+}
+
+// lookup finds the specified key in the hashmap, lazily removing it if it has
+// expired or been invalidated. Taking the key as bytes, rather than a string,
+// means the lookup doesn't allocate.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) lookup(key []byte) (*Item, bool) {
+	i, ok := cache.hashmap[string(key)]
+	if !ok {
+		return nil, false
+	}
+	if now := cache.now().Unix(); cache.dead(i, now) {
+		cache.removeDead(i, now)
+		return nil, false
+	}
+	return i, true
+}
+
+// dead returns true if the item has expired, been invalidated or lost its value
+// (with a segment dropped from the disk tier).
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) dead(i *Item, now int64) bool {
+	return i.expired(now) || cache.invalidated(i) || i.lost()
+}
+
+// lost returns true if the item's value was on disk, in a segment since dropped.
+//
+// The caller of this method should hold the write lock on Cache.
+func (item *Item) lost() bool {
+	loc := item.diskLoc()
+	return loc != nil && loc.segment.dropped
+}
+
+// removeDead removes an item that has expired, been invalidated or lost its
+// value (which is counted as an eviction).
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) removeDead(i *Item, now int64) {
+	switch {
+	case i.expired(now):
+		cache.unlink(i)
+		cache.removed(i, REASON_EXPIRED)
+		cache.publishDelete(WAL_EXPIRE, i.key)
+	case cache.invalidated(i):
+		cache.unlink(i)
+		cache.removed(i, REASON_INVALIDATED)
+		cache.publishDelete(WAL_DELETE, i.key)
+	default:
+		cache.evictItem(i)
+	}
+}
+
+// link adds the item to the hashmap and its tenant's LRU.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) link(i *Item) {
+	cache.curBytes += i.Size()
+	i.tenant.curBytes += i.Size()
+	i.tenant.items++
+	i.tenant.lru.PushBack(i)
+	cache.hashmap[i.key] = i
+	if cache.leases != nil {
+		cache.dropLease(i.key)
+	}
+}
+
+// unlink removes the item from the hashmap and its tenant's LRU.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) unlink(i *Item) {
+	cache.curBytes -= i.Size()
+	i.tenant.curBytes -= i.Size()
+	i.tenant.items--
+	i.tenant.lru.Erase(i)
+	delete(cache.hashmap, i.key)
+	if loc := i.diskLoc(); loc != nil {
+		i.tenant.diskBytes -= i.Size()
+		cache.disk.free(loc)
+		cache.disk.headers--
+	}
+}
+
+// bump moves the item to the back of its tenant's LRU.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) bump(i *Item) {
+	i.accessed = cache.now().Unix()
+	i.tenant.lru.Erase(i)
+	i.tenant.lru.PushBack(i)
+}
+
+// Get retrieves the specified key from the cache.
+func (cache *Cache) Get(ctx context.Context, key []byte) (storage.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, err
+	}
+	cache.lockFor(ctx)
+	i, ok := cache.lookup(key)
+	if !ok {
+		cache.tenantFor(key).misses++
+		cache.unlock()
+		return storage.Item{}, ErrNotFound
+	}
+	cache.bump(i)
+	i.tenant.hits++
+	item, loc, disk := i.stored(), i.diskLoc(), cache.disk
+	cache.unlock()
+
+	if loc != nil {
+		return disk.load(string(key), item, loc)
+	}
+	return item, nil
+}
+
+// Set stores the specified key in the cache, returning its new CAS value. If
+// cas is non-zero, the key is only stored if its current CAS value matches.
+// The cache keeps its own copy of the value, so the caller is free to reuse
+// it.
+func (cache *Cache) Set(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	i, ok := cache.lookup(key)
+	if ok && cas > 0 && i.version != cas {
+		return 0, ErrExists
+	} else if !ok && cas > 0 {
+		return 0, ErrNotFound
+	}
+	return cache.store(key, value, nil, nil, flags, cache.expiresAt(exptime), i)
+}
+
+// SetChunks stores the specified key in the cache as Set does, the value being
+// the chunks joined together. Values larger than MAX_VALUE_SIZE are stored in
+// chunks of that size whichever way they're given, SetChunks just spares the
+// caller from joining them.
+func (cache *Cache) SetChunks(ctx context.Context, key []byte, chunks [][]byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	i, ok := cache.lookup(key)
+	if ok && cas > 0 && i.version != cas {
+		return 0, ErrExists
+	} else if !ok && cas > 0 {
+		return 0, ErrNotFound
+	}
+	if chunks == nil {
+		chunks = [][]byte{}
+	}
+	return cache.store(key, nil, chunks, nil, flags, cache.expiresAt(exptime), i)
+}
+
+// Add stores the specified key in the cache only if it isn't already there,
+// returning its CAS value.
+func (cache *Cache) Add(ctx context.Context, key, value []byte, flags, exptime uint32) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	if _, ok := cache.lookup(key); ok {
+		return 0, ErrNotStored
+	}
+	return cache.store(key, value, nil, nil, flags, cache.expiresAt(exptime), nil)
+}
+
+// Incr adds delta to the decimal number stored for the key, or subtracts it if
+// decr is true, returning the result. As in memcache, decrementing stops at 0
+// while incrementing wraps around at 2^64, and the item keeps its flags, expiry
+// and tags.
+func (cache *Cache) Incr(ctx context.Context, key []byte, delta uint64, decr bool) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	i, item, ok := cache.lookupLoaded(ctx, key)
+	defer cache.unlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	n, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, ErrNonNumeric
+	}
+	if !decr {
+		n += delta
+	} else if delta < n {
+		n -= delta
+	} else {
+		n = 0
+	}
+
+	var buf [20]byte
+	if _, err := cache.store(key, strconv.AppendUint(buf[:0], n, 10), nil, i.itemTags(), i.Flags(), i.expires, i); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// store stores a new item for the key with the tags given, replacing old (nil
+// if the key isn't in the cache), and returns its CAS value. The value is given
+// in one piece, or in chunks if chunks isn't nil.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) store(key, value []byte, chunks [][]byte, tags []string, flags uint32, expires int64, old *Item) (uint64, error) {
+	// an existing item's key can be shared rather than copied
+	item := &Item{value: value, expires: expires, tenant: cache.tenantFor(key)}
+	item.setChunks(chunks)
+	item.setTags(tags)
+	if old != nil {
+		item.key = old.key
+	} else {
+		item.key = string(key)
+	}
+	binary.BigEndian.PutUint32(item.flags[:], flags)
+	if err := cache.admit(item, old); err != nil {
+		return 0, err
+	}
+	value, chunks = copyValue(value, chunks)
+	item.value = value
+	item.setChunks(chunks)
+	if old != nil {
+		cache.unlink(old)
+		cache.removed(old, REASON_OVERWRITTEN)
+	}
+
+	cache.version++
+	item.version = cache.version
+	item.accessed = cache.now().Unix()
+	cache.link(item)
+	cache.publishSet(item)
+	cache.evictOverflow()
+	return item.version, nil
+}
+
+// admit checks there is room to store the item, replacing old (nil if the key
+// isn't in the cache). Items too large to ever store (in the cache or their
+// tenant) are rejected, as are items whose payload is over the max item size,
+// and so are items that don't fit in the free space if we may not evict to make
+// room.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) admit(item, old *Item) error {
+	size, payload, t := item.Size(), item.Payload(), item.tenant
+	if size > cache.maxBytes || payload > MAX_ITEM_SIZE ||
+		(cache.maxItemSize > 0 && payload > cache.maxItemSize) || (t.maxBytes > 0 && size > t.maxBytes) {
+		cache.tooLarge++
+		// as memcached does, remove the old value rather than leave it stale
+		if old != nil {
+			cache.unlink(old)
+			cache.removed(old, REASON_DELETED)
+			cache.publishDelete(WAL_DELETE, old.key)
+		}
+		return ErrTooLarge
+	}
+
+	if cache.noEvict {
+		used, tenantUsed := cache.curBytes, t.curBytes
+		if old != nil {
+			used -= old.Size()
+			tenantUsed -= old.Size()
+		}
+		if used+size > cache.maxBytes || (t.maxBytes > 0 && tenantUsed+size > t.maxBytes) {
+			cache.noMemory++
+			return ErrNoMemory
+		}
+	}
+	return nil
+}
+
+// Delete removes the specified key from the cache. If cas is non-zero, the key
+// is only removed if its current CAS value matches.
+func (cache *Cache) Delete(ctx context.Context, key []byte, cas uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	i, ok := cache.lookup(key)
+	if !ok {
+		cache.revokeLease(key)
+		return ErrNotFound
+	} else if cas > 0 && i.version != cas {
+		return ErrExists
+	}
+	cache.unlink(i)
+	cache.removed(i, REASON_DELETED)
+	cache.publishDelete(WAL_DELETE, i.key)
+	return nil
+}
+
+// Touch updates the expiration of the specified key, returning the item.
+func (cache *Cache) Touch(ctx context.Context, key []byte, exptime uint32) (storage.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, err
+	}
+	cache.lockFor(ctx)
+	i, ok := cache.lookup(key)
+	if !ok {
+		cache.unlock()
+		return storage.Item{}, ErrNotFound
+	}
+	i.expires = cache.expiresAt(exptime)
+	cache.bump(i)
+	cache.publish(WAL_TOUCH, i.version, i.expires, nil, i.key, nil)
+	item, loc, disk := i.stored(), i.diskLoc(), cache.disk
+	cache.unlock()
+
+	if loc != nil {
+		return disk.load(string(key), item, loc)
+	}
+	return item, nil
+}
+
+// Flush removes all keys from the cache.
+func (cache *Cache) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	cache.clear()
+	cache.publish(WAL_FLUSH, 0, 0, nil, "", nil)
+	return nil
+}
+
+// FlushPrefix removes all keys starting with the prefix from the cache, in O(1)
+// whatever the prefix (even a tenant's): the prefix is invalidated, and its keys
+// removed lazily (see invalidate.go).
+func (cache *Cache) FlushPrefix(ctx context.Context, prefix []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cache.lockFor(ctx)
+	defer cache.unlock()
+
+	cache.version++
+	cache.invalidatePrefix(string(prefix), cache.version)
+	cache.publish(WAL_INVALIDATE_PREFIX, cache.version, 0, nil, string(prefix), nil)
+	return nil
+}
+
+// Stats returns the statistics of the cache.
+func (cache *Cache) Stats() Stats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	overhead := uint64(len(cache.hashmap)) * ITEM_OVERHEAD
+	if cache.disk != nil {
+		overhead += uint64(cache.disk.headers) * DISK_ITEM_OVERHEAD
+	}
+	return Stats{
+		Items:         len(cache.hashmap),
+		Bytes:         cache.curBytes,
+		PayloadBytes:  cache.curBytes - overhead,
+		OverheadBytes: overhead,
+		MaxBytes:      cache.maxBytes,
+		MaxItemSize:   cache.maxItemSize,
+		Evictions:     cache.evictions,
+		TooLarge:      cache.tooLarge,
+		NoMemory:      cache.noMemory,
+		Removals:      cache.removals,
+		Invalidations: len(cache.prefixGens) + len(cache.tagGens),
+	}
+}
+
+// clear removes all keys from the cache, as flushed.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) clear() {
+	for _, i := range cache.hashmap {
+		if loc := i.diskLoc(); loc != nil {
+			cache.disk.free(loc)
+			cache.disk.headers--
+		}
+		cache.removed(i, REASON_FLUSHED)
+	}
+	cache.hashmap = make(map[string]*Item)
+	cache.prefixGens, cache.prefixLens, cache.tagGens = nil, nil, nil
+	clear(cache.leases)
+	cache.leaseStats.StaleBytes = 0
+	for _, t := range cache.tenants {
+		t.lru = LRU{}
+		t.curBytes, t.items, t.diskBytes = 0, 0, 0
+	}
+	cache.curBytes = 0
+
+	// in-progress crawls have nothing left to visit
+	last := cache.tenants[len(cache.tenants)-1]
+	for c := range cache.crawlers {
+		c.tenant = last
+		last.lru.PushBack(c)
+	}
+}
+
+// isCrawler returns true if the item is the placeholder of a crawl rather than
+// a stored item.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) isCrawler(i *Item) bool {
+	if len(cache.crawlers) == 0 {
+		return false
+	}
+	_, ok := cache.crawlers[i]
+	return ok
+}
+
+// evictOverflow evicts key-value pairs in LRU order until every tenant and the
+// cache as a whole are within their storage limits. A tenant over its own limit
+// only evicts its own items, while the cache being over its limit evicts from
+// the tenant furthest over its share (see overTenant). Items are admitted to
+// the cache only if they fit, so it's never left empty (of all but crawl
+// placeholders) while over the limit, but we check anyway to be safe.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) evictOverflow() {
+	for _, t := range cache.tenants {
+		for t.maxBytes > 0 && t.curBytes > t.maxBytes {
+			if !cache.evict(t) {
+				break
+			}
+		}
+	}
+	for cache.curBytes > cache.maxBytes {
+		if !cache.evict(cache.overTenant()) {
+			break
+		}
+	}
+}
+
+// evict evicts the least recently used item of the tenant, or writes its value
+// to the disk tier (see demote), returning false if it has none. Items with
+// their values already on disk are passed over, moved to the back of the LRU,
+// while they take at most 1/DISK_HEADER_SHARE of the tenant's storage, so they
+// aren't evicted ahead of the values still in memory.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) evict(t *Tenant) bool {
+	i := t.lru.head
+	for i != nil {
+		next := i.lru.prev
+		if !cache.isCrawler(i) {
+			if i.diskLoc() == nil || i.lost() || t.diskBytes > t.curBytes/DISK_HEADER_SHARE {
+				break
+			}
+			t.lru.Erase(i)
+			t.lru.PushBack(i)
+		}
+		i = next
+	}
+	if i == nil {
+		return false
+	}
+	if !cache.demote(i) {
+		cache.evictItem(i)
+	}
+	return true
+}
+
+// evictItem removes the item as evicted.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) evictItem(i *Item) {
+	cache.unlink(i)
+	cache.evictions++
+	i.tenant.evictions++
+	cache.removed(i, REASON_EVICTED)
+	cache.publishDelete(WAL_EVICT, i.key)
+}
+
+// publish records a mutation in the journals (e.g., the write log and
+// replication followers), if any. Any chunks follow the value.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) publish(op WalOp, cas uint64, expires int64, flags []byte,
+	key string, value []byte, chunks ...[]byte) {
+	if len(cache.journals) == 0 {
+		return
+	}
+	cache.scratch = AppendRecord(cache.scratch[:0], op, cas, expires, flags, key, value, chunks...)
+	for _, j := range cache.journals {
+		j.Append(cache.scratch)
+	}
+}
+
+// publishSet records a newly stored item.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) publishSet(item *Item) {
+	cache.publish(WAL_SET, item.version, item.expires, item.flags[:], item.key, item.value, item.valueChunks()...)
+	if item.itemTags() != nil && len(cache.journals) > 0 {
+		cache.publish(WAL_TAG, item.version, 0, nil, item.key, appendTags(nil, item.itemTags()))
+	}
+}
+
+// publishDelete records the removal of a key.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) publishDelete(op WalOp, key string) {
+	cache.publish(op, 0, 0, nil, key, nil)
+}
@@ -0,0 +1,472 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// we store constant KV-pair sizes for testing to make checking the resource
+// limits easier: key + value + flags + overhead
+const KV_SIZE = 4 + 5 + 4 + ITEM_OVERHEAD
+
+var ctx = context.Background()
+var value = []byte("value")
+
+const flags = 42
+
+func StoreKey(c *Cache, key string, val []byte) {
+	c.Set(ctx, []byte(key), val, flags, 0, 0)
+}
+
+func DeleteKey(c *Cache, key string) error {
+	return c.Delete(ctx, []byte(key), 0)
+}
+
+func CheckKey(t *testing.T, c *Cache, key string, val []byte) {
+	i, err := c.Get(ctx, []byte(key))
+	if err != nil {
+		t.Error("Couldn't find key in cache\n")
+	} else if bytes.Compare(val, i.Value) != 0 {
+		t.Errorf("Corrupted value in cache: %s vs %s\n", val, i.Value)
+	}
+}
+
+func CheckNoKey(t *testing.T, c *Cache, key string) {
+	if _, err := c.Get(ctx, []byte(key)); err == nil {
+		t.Error("Found non-existent key in cache\n")
+	}
+}
+
+func CheckKeyInRange(t *testing.T, c *Cache, key string, vals [][]byte) {
+	i, err := c.Get(ctx, []byte(key))
+	if err != nil {
+		t.Error("Couldn't find key in cache\n")
+		return
+	}
+
+	for _, val := range vals {
+		if bytes.Compare(val, i.Value) == 0 {
+			return
+		}
+	}
+	t.Errorf("Corrupted value in cache: %s\n", i.Value)
+}
+
+func TestCacheSetGet(t *testing.T) {
+	cache := New(100000)
+	StoreKey(cache, "key", value)
+	CheckKey(t, cache, "key", value)
+}
+
+func TestCacheGetMiss(t *testing.T) {
+	cache := New(100000)
+	StoreKey(cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+}
+
+func TestCacheSetGetMany(t *testing.T) {
+	cache := New(100000)
+
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	StoreKey(cache, "key3", value)
+
+	CheckKey(t, cache, "key1", value)
+	CheckKey(t, cache, "key2", value)
+	CheckKey(t, cache, "key3", value)
+	CheckNoKey(t, cache, "key4")
+}
+
+func TestCacheDelete(t *testing.T) {
+	cache := New(100000)
+	StoreKey(cache, "key", value)
+	CheckKey(t, cache, "key", value)
+	if err := DeleteKey(cache, "key"); err != nil {
+		t.Error("Couldn't delete key in cache")
+	}
+	CheckNoKey(t, cache, "key")
+}
+
+func TestCacheLRU(t *testing.T) {
+	cache := New(1 * KV_SIZE)
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	CheckNoKey(t, cache, "key1")
+	CheckKey(t, cache, "key2", value)
+}
+
+func PrintLRU(c *Cache) {
+	for item := c.tenants[0].lru.tail; item != nil; item = item.lru.next {
+		fmt.Printf("%s -> ", item.key)
+	}
+	fmt.Printf("|\n")
+}
+
+func TestCacheLRUMany(t *testing.T) {
+	cache := New(3 * KV_SIZE)
+
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	StoreKey(cache, "key3", value)
+	StoreKey(cache, "key4", value)
+	StoreKey(cache, "key5", value)
+
+	CheckNoKey(t, cache, "key1")
+	CheckNoKey(t, cache, "key2")
+	CheckKey(t, cache, "key3", value)
+	CheckKey(t, cache, "key4", value)
+	CheckKey(t, cache, "key5", value)
+	CheckNoKey(t, cache, "key6")
+}
+
+func TestCacheLRUUpdates(t *testing.T) {
+	cache := New(3 * KV_SIZE)
+
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	StoreKey(cache, "key3", value)
+	CheckKey(t, cache, "key1", value)
+	StoreKey(cache, "key4", value)
+	StoreKey(cache, "key5", value)
+
+	CheckKey(t, cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+	CheckNoKey(t, cache, "key3")
+	CheckKey(t, cache, "key4", value)
+	CheckKey(t, cache, "key5", value)
+}
+
+const (
+	N_KV_SIZE      = 12 + 5 + 8 + 12 + 4 + ITEM_OVERHEAD // namespace + ":key:" + keyspace + value + flags + overhead
+	N_WORKERS      = 10
+	N_PRIVATE_KEYS = 10000
+	N_SHARED_KEYS  = 1000
+	N_REPEAT       = 4
+	N_CACHE_SIZE   = N_PRIVATE_KEYS*N_WORKERS + N_SHARED_KEYS
+)
+
+func ConcurrencyWorker(t *testing.T, cache *Cache, namespaces [][]byte, id uint) {
+	var wg sync.WaitGroup
+	namespace := namespaces[id]
+
+	// run queries over private keys
+	wg.Add(1)
+	go func() {
+		for j := 0; j < N_REPEAT; j++ {
+			for i := 0; i < N_PRIVATE_KEYS; i++ {
+				key := fmt.Sprintf("%s:key:%08d", namespace, i)
+				StoreKey(cache, key, namespace)
+				CheckKey(t, cache, key, namespace)
+			}
+			for i := 0; i < N_PRIVATE_KEYS; i++ {
+				key := fmt.Sprintf("%s:key:%08d", namespace, i)
+				CheckKey(t, cache, key, namespace)
+			}
+		}
+		wg.Done()
+	}()
+
+	// run queries over shared keys
+	wg.Add(1)
+	go func() {
+		for j := 0; j < N_REPEAT; j++ {
+			for i := 0; i < N_SHARED_KEYS; i++ {
+				key := fmt.Sprintf("%s:key:%08d", "SharedSpace0", i)
+				StoreKey(cache, key, []byte(namespace))
+			}
+			for i := 0; i < N_SHARED_KEYS; i++ {
+				key := fmt.Sprintf("%s:key:%08d", "SharedSpace0", i)
+				CheckKeyInRange(t, cache, key, namespaces)
+			}
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
+
+func TestConcurrency(t *testing.T) {
+	cache := New(N_CACHE_SIZE * N_KV_SIZE)
+
+	var namespaces [][]byte
+	for i := 0; i < N_WORKERS; i++ {
+		name := []byte(fmt.Sprintf("TestWorker%02d", i))
+		namespaces = append(namespaces, name)
+	}
+
+	for i := uint(0); i < N_WORKERS; i++ {
+		id := i
+		t.Run(string(namespaces[id]), func(t *testing.T) {
+			t.Parallel()
+			ConcurrencyWorker(t, cache, namespaces, id)
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := New(100000)
+	now := time.Unix(1500000000, 0)
+	cache.now = func() time.Time { return now }
+
+	cache.Set(ctx, []byte("key1"), value, flags, 10, 0)
+	cache.Set(ctx, []byte("key2"), value, flags, uint32(now.Unix()+100), 0)
+	StoreKey(cache, "key3", value)
+
+	now = now.Add(10 * time.Second)
+	CheckNoKey(t, cache, "key1")
+	CheckKey(t, cache, "key2", value)
+	now = now.Add(100 * time.Second)
+	CheckNoKey(t, cache, "key2")
+	CheckKey(t, cache, "key3", value)
+
+	if cache.curBytes != KV_SIZE {
+		t.Errorf("Expired items not reclaimed: %d bytes\n", cache.curBytes)
+	}
+}
+
+func TestCacheOversizeItem(t *testing.T) {
+	cache := New(2 * KV_SIZE)
+	StoreKey(cache, "key1", value)
+
+	// larger than the whole cache, which used to evict everything and crash
+	big := bytes.Repeat([]byte("x"), int(2*KV_SIZE))
+	if _, err := cache.Set(ctx, []byte("key2"), big, flags, 0, 0); err != ErrTooLarge {
+		t.Errorf("Wrong status storing oversize item: %s\n", err)
+	}
+	CheckKey(t, cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+
+	// replacing a key with an oversize item removes the old value
+	if _, err := cache.Set(ctx, []byte("key1"), big, flags, 0, 0); err != ErrTooLarge {
+		t.Errorf("Wrong status storing oversize item: %s\n", err)
+	}
+	CheckNoKey(t, cache, "key1")
+	if cache.curBytes != 0 || cache.tooLarge != 2 {
+		t.Errorf("Wrong accounting: %d bytes, %d too large\n", cache.curBytes, cache.tooLarge)
+	}
+
+	// an item of exactly the limit fits
+	exact := bytes.Repeat([]byte("x"), int(2*KV_SIZE-8-ITEM_OVERHEAD))
+	if _, err := cache.Set(ctx, []byte("key3"), exact, flags, 0, 0); err != nil {
+		t.Errorf("Couldn't store item at the limit: %s\n", err)
+	}
+}
+
+func TestCacheMaxItemSize(t *testing.T) {
+	// the limit is on the item's key, value and flags, not its overhead
+	cache := New(100000)
+	cache.maxItemSize = KV_SIZE - ITEM_OVERHEAD
+	StoreKey(cache, "key1", value)
+	if _, err := cache.Set(ctx, []byte("key2"), []byte("value2"), flags, 0, 0); err != ErrTooLarge {
+		t.Errorf("Wrong status storing item over max item size: %s\n", err)
+	}
+	CheckKey(t, cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+
+	// so by default, a value of MAX_VALUE_SIZE less the key and flags fits
+	cache = New(100 * MAX_VALUE_SIZE)
+	cache.maxItemSize = MAX_VALUE_SIZE
+	exact := make([]byte, MAX_VALUE_SIZE-len("key3")-4)
+	if _, err := cache.Set(ctx, []byte("key3"), exact, flags, 0, 0); err != nil {
+		t.Errorf("Couldn't store item of max item size: %s\n", err)
+	}
+	if _, err := cache.Set(ctx, []byte("key4"), make([]byte, MAX_VALUE_SIZE-len("key4")-8), flags, 0, 0); err != nil {
+		t.Errorf("Couldn't store item under max item size: %s\n", err)
+	}
+	if _, err := cache.Set(ctx, []byte("key5"), append(exact, 'x'), flags, 0, 0); err != ErrTooLarge {
+		t.Errorf("Wrong status storing item over max item size: %s\n", err)
+	}
+}
+
+func TestCacheChunks(t *testing.T) {
+	cache := New(100 * MAX_VALUE_SIZE)
+	big := bytes.Repeat([]byte("0123456789"), MAX_VALUE_SIZE/4)
+
+	// a large value is stored in chunks, however it's given
+	cas, err := cache.SetChunks(ctx, []byte("key1"), [][]byte{big[:10], big[10 : MAX_VALUE_SIZE+5], big[MAX_VALUE_SIZE+5:]}, flags, 0, 0)
+	if err != nil {
+		t.Fatalf("Couldn't store chunks: %s\n", err)
+	}
+	StoreKey(cache, "key2", big)
+	for _, key := range []string{"key1", "key2"} {
+		i, _ := cache.Get(ctx, []byte(key))
+		if i.Value != nil || len(i.Chunks) != 3 || len(i.Chunks[0]) != MAX_VALUE_SIZE ||
+			len(i.Chunks[2]) != len(big)-2*MAX_VALUE_SIZE || !bytes.Equal(i.Bytes(), big) {
+			t.Errorf("Wrong chunks for %s: %d\n", key, len(i.Chunks))
+		}
+	}
+	if i, _ := cache.Get(ctx, []byte("key1")); i.CAS != cas || i.Flags != flags {
+		t.Errorf("Wrong chunked item: %+v\n", i)
+	}
+	if size := 2 * (uint64(len(big)+8) + ITEM_OVERHEAD); cache.curBytes != size {
+		t.Errorf("Wrong accounting: %d bytes vs %d\n", cache.curBytes, size)
+	}
+
+	// a small value is stored in one piece, however it's given
+	cache.SetChunks(ctx, []byte("key1"), [][]byte{value[:2], value[2:]}, flags, 0, 0)
+	if i, _ := cache.Get(ctx, []byte("key1")); i.Chunks != nil || !bytes.Equal(i.Value, value) {
+		t.Errorf("Small value stored in chunks: %q\n", i.Bytes())
+	}
+	if _, err := cache.Incr(ctx, []byte("key2"), 1, false); err != ErrNonNumeric {
+		t.Errorf("Wrong status incrementing a chunked item: %v\n", err)
+	}
+}
+
+func TestCacheNoEvict(t *testing.T) {
+	cache := New(2 * KV_SIZE)
+	cache.noEvict = true
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	if _, err := cache.Set(ctx, []byte("key3"), value, flags, 0, 0); err != ErrNoMemory {
+		t.Errorf("Wrong status storing item when full: %s\n", err)
+	}
+	CheckKey(t, cache, "key1", value)
+	CheckKey(t, cache, "key2", value)
+	CheckNoKey(t, cache, "key3")
+
+	// replacing an item only needs room for the difference
+	if _, err := cache.Set(ctx, []byte("key1"), []byte("other"), flags, 0, 0); err != nil {
+		t.Errorf("Couldn't replace item when full: %s\n", err)
+	}
+	if _, err := cache.Set(ctx, []byte("key1"), []byte("longer"), flags, 0, 0); err != ErrNoMemory {
+		t.Errorf("Wrong status growing item when full: %s\n", err)
+	}
+	CheckKey(t, cache, "key1", []byte("other"))
+
+	DeleteKey(cache, "key2")
+	StoreKey(cache, "key3", value)
+	CheckKey(t, cache, "key3", value)
+	if cache.evictions != 0 || cache.noMemory != 2 {
+		t.Errorf("Wrong counters: %d evictions, %d out of memory\n", cache.evictions, cache.noMemory)
+	}
+}
+
+func TestCacheEvictOverflowEmpty(t *testing.T) {
+	// items restored from a write log aren't checked for size, so one may be
+	// larger than the cache
+	cache := New(KV_SIZE)
+	cache.restore(&Record{Op: WAL_SET, Cas: 1, Key: "key1", Value: bytes.Repeat([]byte("x"), 100)})
+	cache.evictOverflow()
+	if len(cache.hashmap) != 0 || cache.curBytes != 0 || cache.tenants[0].lru.head != nil {
+		t.Errorf("Oversize item not evicted\n")
+	}
+	StoreKey(cache, "key2", value)
+	CheckKey(t, cache, "key2", value)
+}
+
+func TestItemOverhead(t *testing.T) {
+	const n = 100000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key:%08d", i))
+	}
+
+	// values and flags are shared, so only keys and overhead are allocated
+	cache := New(1 << 40)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for _, key := range keys {
+		StoreKey(cache, string(key), value)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	measured := float64(after.HeapAlloc-before.HeapAlloc) / n
+	accounted := float64(cache.curBytes)/n - float64(len(value)+4)
+	if accounted < measured*0.75 || accounted > measured*1.5 {
+		t.Errorf("Accounted memory per item far from measured: %.0f vs %.0f bytes\n",
+			accounted, measured)
+	}
+	runtime.KeepAlive(cache)
+
+	if stats := cache.Stats(); stats.OverheadBytes != n*ITEM_OVERHEAD ||
+		stats.PayloadBytes != n*(4+12+5) {
+		t.Errorf("Wrong memory stats: %v\n", stats)
+	}
+}
+
+func TestCacheAdd(t *testing.T) {
+	cache := New(100000)
+	if _, err := cache.Add(ctx, []byte("key"), value, flags, 0); err != nil {
+		t.Errorf("Couldn't add key: %s\n", err)
+	}
+	if _, err := cache.Add(ctx, []byte("key"), []byte("other"), flags, 0); err != ErrNotStored {
+		t.Errorf("Added existing key: %v\n", err)
+	}
+	CheckKey(t, cache, "key", value)
+}
+
+func TestCacheIncr(t *testing.T) {
+	cache := New(100000)
+	cache.Set(ctx, []byte("n"), []byte("10"), flags, 0, 0)
+	StoreKey(cache, "s", value)
+
+	tests := []struct {
+		key      string
+		delta    uint64
+		decr     bool
+		expected uint64
+		err      error
+	}{
+		{"n", 5, false, 15, nil},
+		{"n", 3, true, 12, nil},
+		{"n", 20, true, 0, nil},
+		{"n", 7, false, 7, nil},
+		{"n", 1 << 63, false, 1<<63 + 7, nil},
+		{"n", 1 << 63, true, 7, nil},
+		{"s", 1, false, 0, ErrNonNumeric},
+		{"missing", 1, false, 0, ErrNotFound},
+	}
+	for _, test := range tests {
+		n, err := cache.Incr(ctx, []byte(test.key), test.delta, test.decr)
+		if n != test.expected || err != test.err {
+			t.Errorf("Wrong incr %s by %d (decr %v): %d, %v vs %d, %v\n", test.key, test.delta,
+				test.decr, n, err, test.expected, test.err)
+		}
+	}
+	if i, err := cache.Get(ctx, []byte("n")); err != nil || i.Flags != flags {
+		t.Errorf("Incr lost the item's flags\n")
+	}
+}
+
+func TestCacheCanceled(t *testing.T) {
+	cache := New(100000)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cache.Set(ctx, []byte("key"), value, flags, 0, 0); err != context.Canceled {
+		t.Errorf("Stored with a canceled context: %v\n", err)
+	}
+	CheckNoKey(t, cache, "key")
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	cache := New(1 << 20)
+	StoreKey(cache, "key", value)
+	key := []byte("key")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(ctx, key)
+	}
+}
+
+func BenchmarkCacheSet(b *testing.B) {
+	cache := New(100 << 20)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Set(ctx, keys[i%len(keys)], value, 1, 0, 0)
+	}
+}
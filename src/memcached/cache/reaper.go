@@ -0,0 +1,125 @@
+package cache
+
+// Idle-item reaper, removes items that haven't been stored or retrieved within
+// a maximum idle time, so they don't crowd out useful data while waiting for
+// LRU pressure to reach them.
+//
+// Every access moves an item to the back of its tenant's LRU, so the items at
+// the front are the longest idle and the reaper only ever has to look there,
+// stopping at the first item that has been accessed recently enough.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// REAP_BATCH is the number of items the reaper removes per hold of the lock.
+const REAP_BATCH = 100
+
+// REAP_INTERVAL is how often the reaper looks for idle items.
+const REAP_INTERVAL = time.Second
+
+// Reaper removes idle items from a Cache.
+type Reaper struct {
+	cache   *Cache
+	maxIdle time.Duration
+	done    chan struct{}
+
+	reclaimed      uint64
+	reclaimedBytes uint64
+}
+
+// NewReaper creates a new Reaper, removing items from the cache that are idle
+// for longer than maxIdle.
+func NewReaper(cache *Cache, maxIdle time.Duration) *Reaper {
+	return &Reaper{
+		cache:   cache,
+		maxIdle: maxIdle,
+		done:    make(chan struct{}),
+	}
+}
+
+// Run reaps idle items every interval, until the Reaper is closed.
+func (r *Reaper) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n := r.Reap(); n > 0 {
+				r.cache.log.Debug("reaped idle items", "items", n)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Close stops the Reaper.
+func (r *Reaper) Close() {
+	close(r.done)
+}
+
+// Reap removes all currently idle items, a batch at a time, returning the
+// number removed.
+func (r *Reaper) Reap() int {
+	total := 0
+	for {
+		n, more := r.step()
+		total += n
+		if !more {
+			return total
+		}
+	}
+}
+
+// step removes up to a batch of idle items from the front of the LRUs,
+// returning the number removed and true if there may be more.
+func (r *Reaper) step() (int, bool) {
+	cache := r.cache
+	cache.mu.Lock()
+	defer cache.unlock()
+
+	// idle items were last accessed before the cutoff
+	cutoff := cache.now().Add(-r.maxIdle).Unix()
+	var bytes uint64
+	n := 0
+	for _, t := range cache.tenants {
+		i := t.lru.head
+		for i != nil && n < REAP_BATCH {
+			next := i.lru.prev
+			if !cache.isCrawler(i) {
+				if i.accessed >= cutoff {
+					break
+				}
+				bytes += i.Size()
+				cache.unlink(i)
+				cache.removed(i, REASON_IDLE)
+				cache.publishDelete(WAL_EVICT, i.key)
+				n++
+			}
+			i = next
+		}
+	}
+
+	atomic.AddUint64(&r.reclaimed, uint64(n))
+	atomic.AddUint64(&r.reclaimedBytes, bytes)
+	return n, n == REAP_BATCH
+}
+
+// ReaperStats are the statistics of a Reaper.
+type ReaperStats struct {
+	MaxIdle        time.Duration
+	Reclaimed      uint64
+	ReclaimedBytes uint64
+}
+
+// Stats returns the statistics of the reaper.
+func (r *Reaper) Stats() ReaperStats {
+	return ReaperStats{
+		MaxIdle:        r.maxIdle,
+		Reclaimed:      atomic.LoadUint64(&r.reclaimed),
+		ReclaimedBytes: atomic.LoadUint64(&r.reclaimedBytes),
+	}
+}
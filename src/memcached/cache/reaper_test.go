@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReaperIdle(t *testing.T) {
+	c := New(100000)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	r := NewReaper(c, time.Minute)
+
+	StoreKey(c, "key1", value)
+	StoreKey(c, "key2", value)
+	now = now.Add(30 * time.Second)
+	StoreKey(c, "key3", value)
+	c.Get(ctx, []byte("key1"))
+	if n := r.Reap(); n != 0 {
+		t.Errorf("Reaped %d items before any were idle\n", n)
+	}
+
+	// key2 is idle, key1 was retrieved since
+	now = now.Add(45 * time.Second)
+	if n := r.Reap(); n != 1 {
+		t.Errorf("Wrong number of items reaped: %d\n", n)
+	}
+	CheckNoKey(t, c, "key2")
+	if len(c.hashmap) != 2 || c.curBytes != 2*KV_SIZE {
+		t.Errorf("Wrong accounting after reaping: %d items %d bytes\n", len(c.hashmap), c.curBytes)
+	}
+
+	// a touch counts as an access too
+	c.Touch(ctx, []byte("key3"), 0)
+	now = now.Add(45 * time.Second)
+	r.Reap()
+	CheckNoKey(t, c, "key1")
+	CheckKey(t, c, "key3", value)
+
+	if stats := r.Stats(); stats.Reclaimed != 2 || stats.ReclaimedBytes != 2*KV_SIZE ||
+		stats.MaxIdle != time.Minute {
+		t.Errorf("Wrong reaper stats: %v\n", stats)
+	}
+}
+
+func TestReaperBatches(t *testing.T) {
+	c := New(1000000)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	r := NewReaper(c, time.Minute)
+
+	n := 2*REAP_BATCH + 10
+	for i := 0; i < n; i++ {
+		StoreKey(c, fmt.Sprintf("key%d", i), value)
+	}
+	now = now.Add(time.Hour)
+	StoreKey(c, "new", value)
+
+	// a crawl in progress doesn't get in the way
+	mark := &Item{tenant: c.tenants[0]}
+	c.crawlers = map[*Item]struct{}{mark: {}}
+	c.tenants[0].lru.InsertBefore(mark, c.tenants[0].lru.head)
+
+	if reaped, more := r.step(); reaped != REAP_BATCH || !more {
+		t.Errorf("Wrong first batch: %d %t\n", reaped, more)
+	}
+	if reaped := r.Reap(); reaped != n-REAP_BATCH {
+		t.Errorf("Wrong number of items reaped: %d\n", reaped)
+	}
+	if len(c.hashmap) != 1 || c.curBytes != KV_SIZE-1 || c.tenants[0].lru.head != mark {
+		t.Errorf("Wrong cache after reaping: %d items %d bytes\n", len(c.hashmap), c.curBytes)
+	}
+}
+
+func TestReaperWriteLog(t *testing.T) {
+	dir := t.TempDir()
+	c, wl := OpenTestLog(t, dir, 100000)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	StoreKey(c, "key1", value)
+	now = now.Add(time.Hour)
+	StoreKey(c, "key2", value)
+	NewReaper(c, time.Minute).Reap()
+	wl.Close()
+
+	// the reaped item stays gone after a restart
+	c, wl = OpenTestLog(t, dir, 100000)
+	wl.Close()
+	CheckNoKey(t, c, "key1")
+	CheckKey(t, c, "key2", value)
+}
@@ -0,0 +1,313 @@
+package cache
+
+// Records of cache mutations, as stored in the write log and snapshots and sent
+// to journals (e.g., replication followers), which can apply them to another
+// cache to keep it in step.
+//
+// A record is:
+//
+//   [ 0.. 3] CRC32 (IEEE) of bytes [4..]
+//   [ 4.. 7] length of the record payload (bytes [8..])
+//   [ 8    ] operation
+//   [ 9..16] CAS
+//   [17..24] expiration (UNIX time)
+//   [25..28] flags
+//   [29..30] key length
+//   [31..  ] key, value
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"memcached/storage"
+)
+
+// WalOp is the type of mutation recorded.
+type WalOp uint8
+
+// List of write log operations.
+const (
+	WAL_SET    = WalOp(0x01)
+	WAL_DELETE = WalOp(0x02)
+	WAL_EXPIRE = WalOp(0x03)
+	WAL_EVICT  = WalOp(0x04)
+	WAL_TOUCH  = WalOp(0x05)
+	WAL_FLUSH  = WalOp(0x06)
+
+	// tags of the item just set, encoded by appendTags as the value
+	WAL_TAG = WalOp(0x07)
+
+	// bulk invalidations (see invalidate.go), the key being the prefix or tag
+	// and the CAS the version invalidated at
+	WAL_INVALIDATE_PREFIX = WalOp(0x08)
+	WAL_INVALIDATE_TAG    = WalOp(0x09)
+)
+
+// WAL_HEADER_SIZE is the size in bytes of the fixed part of a record.
+const WAL_HEADER_SIZE = 31
+
+// ErrCorruptRecord is returned when a record fails its checksum.
+var ErrCorruptRecord = errors.New("corrupt write log record")
+
+// Record is a single mutation.
+type Record struct {
+	Op      WalOp
+	Cas     uint64
+	Expires int64
+	Flags   [4]byte
+	Key     string
+	Value   []byte
+	Chunks  [][]byte // the value, if larger than MAX_VALUE_SIZE (Value is then nil)
+
+	loc *diskLoc // of the value in the disk tier, until read (see Snapshot.Each)
+}
+
+// AppendRecord encodes a record onto the end of buf, its value being the value
+// followed by any chunks.
+func AppendRecord(buf []byte, op WalOp, cas uint64, expires int64, flags []byte,
+	key string, value []byte, chunks ...[]byte) []byte {
+	length := WAL_HEADER_SIZE - 8 + len(key) + len(value)
+	for _, c := range chunks {
+		length += len(c)
+	}
+	var hdr [WAL_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(hdr[4:], uint32(length))
+	hdr[8] = uint8(op)
+	binary.BigEndian.PutUint64(hdr[9:], cas)
+	binary.BigEndian.PutUint64(hdr[17:], uint64(expires))
+	copy(hdr[25:29], flags)
+	binary.BigEndian.PutUint16(hdr[29:], uint16(len(key)))
+
+	start := len(buf)
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	for _, c := range chunks {
+		buf = append(buf, c...)
+	}
+	crc := crc32.ChecksumIEEE(buf[start+4:])
+	binary.BigEndian.PutUint32(buf[start:], crc)
+	return buf
+}
+
+// ReadRecord decodes the next record from r, returning the record and its
+// encoded size. It returns io.EOF only if r is at a clean record boundary. A
+// value larger than MAX_VALUE_SIZE is read into chunks of that size.
+func ReadRecord(r io.Reader) (*Record, int, error) {
+	var hdr [WAL_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+		return nil, 0, err
+	}
+	length := int(binary.BigEndian.Uint32(hdr[4:]))
+	if length < WAL_HEADER_SIZE-8 || length > MAX_ITEM_SIZE+WAL_HEADER_SIZE+0xffff {
+		return nil, 0, ErrCorruptRecord
+	}
+	if _, err := io.ReadFull(r, hdr[8:]); err != nil {
+		return nil, 0, unexpected(err)
+	}
+	keyLen := int(binary.BigEndian.Uint16(hdr[29:]))
+	if WAL_HEADER_SIZE-8+keyLen > length {
+		return nil, 0, ErrCorruptRecord
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, 0, unexpected(err)
+	}
+	crc := crc32.Update(crc32.ChecksumIEEE(hdr[4:]), crc32.IEEETable, key)
+
+	rec := &Record{
+		Op:      WalOp(hdr[8]),
+		Cas:     binary.BigEndian.Uint64(hdr[9:]),
+		Expires: int64(binary.BigEndian.Uint64(hdr[17:])),
+		Key:     string(key),
+	}
+	copy(rec.Flags[:], hdr[25:29])
+	n := length - (WAL_HEADER_SIZE - 8) - keyLen
+	if n <= MAX_VALUE_SIZE {
+		rec.Value = make([]byte, n)
+		if _, err := io.ReadFull(r, rec.Value); err != nil {
+			return nil, 0, unexpected(err)
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, rec.Value)
+	}
+	for n > MAX_VALUE_SIZE && len(rec.Chunks)*MAX_VALUE_SIZE < n {
+		chunk := make([]byte, min(n-len(rec.Chunks)*MAX_VALUE_SIZE, MAX_VALUE_SIZE))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, 0, unexpected(err)
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, chunk)
+		rec.Chunks = append(rec.Chunks, chunk)
+	}
+	if crc != binary.BigEndian.Uint32(hdr[:]) {
+		return nil, 0, ErrCorruptRecord
+	}
+	return rec, 8 + length, nil
+}
+
+// unexpected returns the error reading part of a record, io.EOF meaning the
+// record is torn.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Snapshot is a copy of the contents of a Cache at a point in time: a set
+// record (followed by a tag record if it's tagged) for every live item, by
+// tenant, oldest first. Values are never modified in place, so the records
+// share them with the cache, other than those in the disk tier, which aren't
+// read until the snapshot is walked with Each.
+type Snapshot struct {
+	Version uint64 // the cache's version counter
+	records []Record
+	disk    *DiskTier
+}
+
+// Snapshot takes a snapshot of the cache, calling fn (if not nil) before the
+// cache is unlocked so that it can start following mutations from exactly this
+// point, e.g., by registering with a journal.
+func (cache *Cache) Snapshot(fn func()) *Snapshot {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	s := &Snapshot{Version: cache.version, records: make([]Record, 0, len(cache.hashmap)), disk: cache.disk}
+	now := cache.now().Unix()
+	for _, t := range cache.tenants {
+		for i := t.lru.head; i != nil; i = i.lru.prev {
+			if cache.isCrawler(i) || cache.dead(i, now) {
+				continue
+			}
+			s.records = append(s.records, Record{
+				Op:      WAL_SET,
+				Cas:     i.version,
+				Expires: i.expires,
+				Flags:   i.flags,
+				Key:     i.key,
+				Value:   i.value,
+				Chunks:  i.valueChunks(),
+				loc:     i.diskLoc(),
+			})
+			if i.itemTags() != nil {
+				s.records = append(s.records, Record{Op: WAL_TAG, Cas: i.version, Key: i.key,
+					Value: appendTags(nil, i.itemTags())})
+			}
+		}
+	}
+	if fn != nil {
+		fn()
+	}
+	return s
+}
+
+// Len returns the number of records in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.records)
+}
+
+// Each calls fn with each record of the snapshot in turn, stopping at the first
+// error it returns. The values of items in the disk tier are read one at a
+// time, without holding the lock on the cache, and not kept once fn returns.
+// Items whose values can no longer be read (having been overwritten or removed
+// since the snapshot) are left out, along with their tag records: their
+// removal follows the snapshot, so anyone applying it and the mutations after
+// it ends up without them either way.
+func (s *Snapshot) Each(fn func(rec *Record) error) error {
+	lost := false
+	for n := range s.records {
+		rec := s.records[n]
+		if rec.Op == WAL_TAG && lost {
+			continue
+		}
+		lost = false
+		if rec.loc != nil {
+			item, err := s.disk.load(rec.Key, storage.Item{CAS: rec.Cas}, rec.loc)
+			if err != nil {
+				lost = true
+				continue
+			}
+			rec.Value, rec.Chunks, rec.loc = item.Value, item.Chunks, nil
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resync empties the cache ready to apply a snapshot of another cache, taking
+// on its version counter.
+func (cache *Cache) Resync(version uint64) {
+	cache.mu.Lock()
+	defer cache.unlock()
+
+	cache.clear()
+	cache.version = version
+	cache.publish(WAL_FLUSH, 0, 0, nil, "", nil)
+}
+
+// Apply applies a mutation of another cache, recording it in our own journals.
+func (cache *Cache) Apply(rec *Record) {
+	cache.mu.Lock()
+	defer cache.unlock()
+
+	cache.restore(rec)
+	cache.publish(rec.Op, rec.Cas, rec.Expires, rec.Flags[:], rec.Key, rec.Value, rec.Chunks...)
+	cache.evictOverflow()
+}
+
+// restore applies a record read from the write log or a snapshot to the cache,
+// without logging it or evicting any items.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) restore(rec *Record) {
+	i, ok := cache.hashmap[rec.Key]
+	switch rec.Op {
+	case WAL_SET:
+		if ok {
+			cache.unlink(i)
+			cache.removed(i, REASON_OVERWRITTEN)
+		}
+		item := newItem(rec.Key, rec.Value, rec.Flags[:], rec.Cas, rec.Expires)
+		item.setChunks(rec.Chunks)
+		item.accessed = cache.now().Unix()
+		item.tenant = cache.tenantFor([]byte(rec.Key))
+		cache.link(item)
+		if rec.Cas > cache.version {
+			cache.version = rec.Cas
+		}
+	case WAL_TOUCH:
+		if ok {
+			i.expires = rec.Expires
+		}
+	case WAL_TAG:
+		if ok && i.version == rec.Cas {
+			cache.resize(i, func() { i.setTags(parseTags(rec.Value)) })
+		}
+	case WAL_INVALIDATE_PREFIX, WAL_INVALIDATE_TAG:
+		if rec.Op == WAL_INVALIDATE_PREFIX {
+			cache.invalidatePrefix(rec.Key, rec.Cas)
+		} else {
+			cache.invalidateTag(rec.Key, rec.Cas)
+		}
+		if rec.Cas > cache.version {
+			cache.version = rec.Cas
+		}
+	case WAL_FLUSH:
+		cache.clear()
+	default:
+		if ok {
+			cache.unlink(i)
+			cache.removed(i, walReasons[rec.Op])
+		}
+	}
+}
+
+// walReasons are the reasons for the removals recorded by each operation.
+var walReasons = map[WalOp]Reason{
+	WAL_DELETE: REASON_DELETED,
+	WAL_EXPIRE: REASON_EXPIRED,
+	WAL_EVICT:  REASON_EVICTED,
+}
@@ -0,0 +1,26 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"memcached/storage"
+	"memcached/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.TestStorage(t, func() storage.Storage { return New(1 << 20) })
+}
+
+func TestStorageTenants(t *testing.T) {
+	storagetest.TestStorage(t, func() storage.Storage {
+		c := New(1 << 20)
+		c.AddTenant("a", "a:", 0)
+		c.AddTenant("b", "b:", 0)
+		return c
+	})
+}
+
+func TestStorageLeases(t *testing.T) {
+	storagetest.TestStorage(t, func() storage.Storage { return New(1<<20, WithLeases(time.Minute)) })
+}
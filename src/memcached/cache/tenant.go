@@ -0,0 +1,192 @@
+package cache
+
+// Tenants, for sharing a server between teams without one team's writes
+// evicting everyone else's keys. Each tenant owns the keys starting with its
+// prefix and has its own LRU and (optionally) its own storage limit, evicting
+// only its own items when over it. Keys owned by no tenant belong to the
+// default tenant.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DEFAULT_TENANT is the name of the tenant owning keys without a tenant prefix.
+const DEFAULT_TENANT = "default"
+
+// Tenant is a namespace of keys in the cache.
+type Tenant struct {
+	name     string
+	prefix   string
+	maxBytes uint64 // 0 for no limit below the cache's
+	curBytes uint64
+	items    int
+	lru      LRU
+
+	diskBytes uint64 // of the items with their values on disk (see disk_tier.go)
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// AddTenant adds a tenant owning the keys with the prefix, limited to maxBytes
+// of storage (0 for no limit of its own). Tenants can only be added to an
+// empty cache, and their prefixes can't be prefixes of one another.
+func (cache *Cache) AddTenant(name, prefix string, maxBytes uint64) (*Tenant, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.hashmap) > 0 {
+		return nil, fmt.Errorf("tenant %s: cache isn't empty", name)
+	}
+	if prefix == "" {
+		return nil, fmt.Errorf("tenant %s: empty prefix", name)
+	}
+	for i, t := range cache.tenants {
+		if t.name == name {
+			return nil, fmt.Errorf("tenant %s: duplicate name", name)
+		}
+		// a tenant within another would get its keys flushed with the
+		// other's, and the other's users could reach its keys
+		if i > 0 && (strings.HasPrefix(t.prefix, prefix) || strings.HasPrefix(prefix, t.prefix)) {
+			return nil, fmt.Errorf("tenant %s: prefix %q overlaps %q of %s", name, prefix, t.prefix, t.name)
+		}
+	}
+	t := &Tenant{name: name, prefix: prefix, maxBytes: maxBytes}
+	cache.tenants = append(cache.tenants, t)
+	return t, nil
+}
+
+// Name returns the name of the tenant.
+func (t *Tenant) Name() string {
+	return t.name
+}
+
+// Prefix returns the prefix of the tenant's keys.
+func (t *Tenant) Prefix() string {
+	return t.prefix
+}
+
+// Tenant returns the tenant with the name, or nil if there is none.
+func (cache *Cache) Tenant(name string) *Tenant {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, t := range cache.tenants {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Tenants returns the tenants of the cache, the default tenant first.
+func (cache *Cache) Tenants() []*Tenant {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return slices.Clone(cache.tenants)
+}
+
+// tenantFor returns the tenant owning the key, the one with a prefix of it.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) tenantFor(key []byte) *Tenant {
+	for _, t := range cache.tenants[1:] {
+		if len(key) >= len(t.prefix) && string(key[:len(t.prefix)]) == t.prefix {
+			return t
+		}
+	}
+	return cache.tenants[0]
+}
+
+// nextTenant returns the tenant after t, or nil if t is the last.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) nextTenant(t *Tenant) *Tenant {
+	for i := range cache.tenants[:len(cache.tenants)-1] {
+		if cache.tenants[i] == t {
+			return cache.tenants[i+1]
+		}
+	}
+	return nil
+}
+
+// overTenant returns the tenant to evict from when the cache as a whole is over
+// its storage limit: the one using the most storage beyond its own limit (all
+// of it, if it has none). If every tenant is within its limit, as when they
+// add up to more than the cache's, it's the one closest to its limit.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) overTenant() *Tenant {
+	var over *Tenant
+	var overBy int64
+	for _, t := range cache.tenants {
+		if t.curBytes == 0 {
+			continue
+		}
+		by := int64(t.curBytes) - int64(t.maxBytes)
+		if over == nil || by > overBy {
+			over, overBy = t, by
+		}
+	}
+	if over == nil {
+		return cache.tenants[0]
+	}
+	return over
+}
+
+// FlushTenant removes all keys of the tenant from the cache.
+func (cache *Cache) FlushTenant(t *Tenant) {
+	cache.mu.Lock()
+	defer cache.unlock()
+	cache.flushTenant(t)
+}
+
+// flushTenant removes all keys of the tenant from the cache.
+//
+// The caller of this method should hold the write lock on Cache.
+func (cache *Cache) flushTenant(t *Tenant) {
+	for i := t.lru.head; i != nil; {
+		next := i.lru.prev
+		if !cache.isCrawler(i) {
+			cache.unlink(i)
+			cache.removed(i, REASON_FLUSHED)
+			cache.publishDelete(WAL_DELETE, i.key)
+		}
+		i = next
+	}
+}
+
+// TenantStats are the statistics of a tenant.
+type TenantStats struct {
+	Name      string
+	Items     int
+	Bytes     uint64
+	MaxBytes  uint64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// TenantStats returns the statistics of every tenant, the default tenant first.
+func (cache *Cache) TenantStats() []TenantStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	stats := make([]TenantStats, len(cache.tenants))
+	for n, t := range cache.tenants {
+		stats[n] = TenantStats{
+			Name:      t.name,
+			Items:     t.items,
+			Bytes:     t.curBytes,
+			MaxBytes:  t.maxBytes,
+			Hits:      t.hits,
+			Misses:    t.misses,
+			Evictions: t.evictions,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// NewTenantCache creates a cache with a tenant owning keys prefixed "t:".
+func NewTenantCache(t *testing.T, maxBytes, tenantBytes uint64) (*Cache, *Tenant) {
+	c := New(maxBytes)
+	tenant, err := c.AddTenant("team", "t:", tenantBytes)
+	if err != nil {
+		t.Fatalf("Couldn't add tenant: %s\n", err)
+	}
+	return c, tenant
+}
+
+func TestTenantEviction(t *testing.T) {
+	c, tenant := NewTenantCache(t, 10*KV_SIZE, 3*KV_SIZE)
+	for i := 0; i < 5; i++ {
+		StoreKey(c, fmt.Sprintf("d:k%d", i), value)
+	}
+	for i := 0; i < 5; i++ {
+		StoreKey(c, fmt.Sprintf("t:k%d", i), value)
+	}
+
+	// the tenant over its limit only evicts its own items
+	for i := 0; i < 5; i++ {
+		CheckKey(t, c, fmt.Sprintf("d:k%d", i), value)
+	}
+	CheckNoKey(t, c, "t:k0")
+	CheckNoKey(t, c, "t:k1")
+	CheckKey(t, c, "t:k2", value)
+	if tenant.curBytes != 3*KV_SIZE || tenant.items != 3 || tenant.evictions != 2 {
+		t.Errorf("Wrong tenant usage: %d bytes %d items %d evictions\n",
+			tenant.curBytes, tenant.items, tenant.evictions)
+	}
+
+	// the cache over its limit evicts from the tenant furthest over its share,
+	// here the default tenant which has no share of its own
+	StoreKey(c, "d:k5", value)
+	StoreKey(c, "d:k6", value)
+	StoreKey(c, "d:k7", value)
+	CheckNoKey(t, c, "d:k0")
+	CheckKey(t, c, "d:k1", value)
+	CheckKey(t, c, "t:k3", value)
+	if c.curBytes != 10*KV_SIZE || c.tenants[0].evictions != 1 || c.evictions != 3 {
+		t.Errorf("Wrong cache usage: %d bytes %d evictions\n", c.curBytes, c.evictions)
+	}
+
+	// nothing larger than the tenant's limit is stored
+	if _, err := c.Set(ctx, []byte("t:big"), make([]byte, 3*KV_SIZE), flags, 0, 0); err != ErrTooLarge {
+		t.Errorf("Item larger than tenant stored: %s\n", err)
+	}
+}
+
+func TestTenantNoEvict(t *testing.T) {
+	c, _ := NewTenantCache(t, 10*KV_SIZE, 2*KV_SIZE)
+	c.noEvict = true
+	StoreKey(c, "t:k0", value)
+	StoreKey(c, "t:k1", value)
+	if _, err := c.Set(ctx, []byte("t:k2"), value, flags, 0, 0); err != ErrNoMemory {
+		t.Errorf("Tenant over its limit stored without eviction: %s\n", err)
+	}
+	if _, err := c.Set(ctx, []byte("d:k0"), value, flags, 0, 0); err != nil {
+		t.Errorf("Default tenant refused: %s\n", err)
+	}
+}
+
+func TestTenantStats(t *testing.T) {
+	c, _ := NewTenantCache(t, 10*KV_SIZE, 5*KV_SIZE)
+	StoreKey(c, "t:k0", value)
+	StoreKey(c, "d:k0", value)
+	c.Get(ctx, []byte("t:k0"))
+	c.Get(ctx, []byte("t:k1"))
+	c.Get(ctx, []byte("t:k2"))
+	c.Get(ctx, []byte("d:k0"))
+
+	stats := c.TenantStats()
+	expected := []TenantStats{
+		{Name: "default", Items: 1, Bytes: KV_SIZE, Hits: 1},
+		{Name: "team", Items: 1, Bytes: KV_SIZE, MaxBytes: 5 * KV_SIZE, Hits: 1, Misses: 2},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Wrong tenant stats: %+v vs %+v\n", stats, expected)
+	}
+
+	// flushing the tenant leaves other keys alone
+	c.FlushTenant(c.tenants[1])
+	CheckNoKey(t, c, "t:k0")
+	CheckKey(t, c, "d:k0", value)
+}
+
+func TestTenantFlushPrefix(t *testing.T) {
+	c, _ := NewTenantCache(t, 100000, 0)
+	StoreKey(c, "t:k0", value)
+	StoreKey(c, "d:k0", value)
+
+	// flushing a tenant's prefix invalidates it like any other, leaving its
+	// items to be removed lazily
+	c.FlushPrefix(ctx, []byte("t:"))
+	if stats := c.Stats(); stats.Items != 2 || stats.Invalidations != 1 {
+		t.Errorf("Tenant's items visited by flush: %+v\n", stats)
+	}
+	CheckNoKey(t, c, "t:k0")
+	CheckKey(t, c, "d:k0", value)
+	StoreKey(c, "t:k0", value)
+	CheckKey(t, c, "t:k0", value)
+}
+
+func TestTenantCrawlAndReap(t *testing.T) {
+	c, _ := NewTenantCache(t, 100000, 0)
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	StoreKey(c, "t:k0", value)
+	StoreKey(c, "d:k0", value)
+	StoreKey(c, "t:k1", value)
+
+	// crawls visit every tenant
+	if keys := CrawlKeys(t, NewCrawler(c, 0, false), nil); fmt.Sprint(keys) != "[d:k0 t:k0 t:k1]" {
+		t.Errorf("Wrong crawl: %v\n", keys)
+	}
+	if len(c.crawlers) != 0 || c.tenants[1].lru.tail.key != "t:k1" {
+		t.Errorf("Crawl placeholder left in LRU\n")
+	}
+	now = now.Add(time.Minute)
+	if n := NewReaper(c, time.Second).Reap(); n != 3 || len(c.hashmap) != 0 {
+		t.Errorf("Wrong reap: %d reaped\n", n)
+	}
+}
+
+func TestAddTenant(t *testing.T) {
+	c, _ := NewTenantCache(t, 100000, 0)
+	for _, bad := range [][2]string{{"team", "u:"}, {"other", "t:"}, {"other", ""},
+		{"nested", "t:n:"}, {"outer", "t"}} {
+		if _, err := c.AddTenant(bad[0], bad[1], 0); err == nil {
+			t.Errorf("Invalid tenant added: %v\n", bad)
+		}
+	}
+
+	other, err := c.AddTenant("other", "o:", 0)
+	if err != nil {
+		t.Fatalf("Couldn't add tenant: %s\n", err)
+	}
+	if c.tenantFor([]byte("o:key")) != other || c.tenantFor([]byte("t:key")) != c.tenants[1] ||
+		c.tenantFor([]byte("t")) != c.tenants[0] {
+		t.Errorf("Wrong tenant for keys\n")
+	}
+
+	StoreKey(c, "key", value)
+	if _, err := c.AddTenant("late", "l:", 0); err == nil {
+		t.Errorf("Tenant added to non-empty cache\n")
+	}
+}
@@ -0,0 +1,445 @@
+package cache
+
+// Append-only write log and snapshots for crash-consistent persistence of a
+// Cache.
+//
+// Every mutation of the cache (set, delete, touch, flush, expiry and eviction)
+// is appended to a log file while holding the cache lock, so the log order
+// matches the order the mutations were applied. Periodically the log is
+// compacted by writing the full contents of the cache to a snapshot, followed
+// by whatever was logged while it was being written, and truncating the log.
+// Recovery loads the snapshot and replays the log on top of it.
+//
+// Records (see record.go) store the CAS value of each item so that the CAS
+// tokens clients hold remain valid after a restart.
+//
+// Both the log and snapshot files start with a header of an 8 byte magic
+// followed by an 8 byte epoch. The epoch is incremented by every compaction,
+// so a log left over from before a compaction that crashed part way through
+// can be recognised and discarded. Snapshots also store the cache version
+// counter in a further 8 bytes, so CAS values are never reused.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls how often the write log is flushed to stable storage.
+type SyncPolicy uint8
+
+// List of write log sync policies.
+const (
+	SYNC_ALWAYS   SyncPolicy = iota // fsync after every mutation.
+	SYNC_EVERYSEC                   // fsync once a second.
+	SYNC_NEVER                      // write once a second, leave fsync to the OS.
+)
+
+// ParseSyncPolicy parses the name of a sync policy.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SYNC_ALWAYS, nil
+	case "everysec":
+		return SYNC_EVERYSEC, nil
+	case "never":
+		return SYNC_NEVER, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy: %q", s)
+}
+
+const (
+	walMagic      = "GOMCWAL1"
+	snapshotMagic = "GOMCSNP1"
+	walFile       = "wal"
+	snapshotFile  = "snapshot"
+)
+
+// WriteLog is an append-only log of cache mutations, along with the snapshot
+// it is relative to.
+type WriteLog struct {
+	dir    string
+	policy SyncPolicy
+	epoch  uint64
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	err    error
+	log    Logger
+	sync.Mutex
+
+	compacting sync.Mutex // held by Compact, so compactions don't overlap
+}
+
+// OpenWriteLog opens (or creates) the write log stored in the specified
+// directory. Recover must be called before the log is used.
+func OpenWriteLog(dir string, policy SyncPolicy) (*WriteLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriteLog{
+		dir:    dir,
+		policy: policy,
+		file:   f,
+		buf:    bufio.NewWriter(f),
+		log:    nopLogger{},
+	}, nil
+}
+
+// Size returns the current size in bytes of the log (excluding the snapshot).
+func (wl *WriteLog) Size() int64 {
+	wl.Lock()
+	defer wl.Unlock()
+	return wl.size
+}
+
+// Recover loads the latest snapshot and replays the log into the cache, then
+// attaches the log to the cache (as a journal) so that all further mutations
+// are recorded. The log shares the cache's logger.
+// A torn or corrupt record at the end of the log (e.g., from a crash part way
+// through a write) is discarded, along with everything after it.
+func (wl *WriteLog) Recover(cache *Cache) error {
+	cache.mu.Lock()
+	defer cache.unlock()
+	wl.Lock()
+	defer wl.Unlock()
+
+	wl.log = cache.log
+	if err := wl.loadSnapshot(cache); err != nil {
+		return err
+	}
+
+	if _, err := wl.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(wl.file)
+	var hdr [16]byte
+	_, err := io.ReadFull(r, hdr[:])
+	valid := err == nil && string(hdr[:8]) == walMagic &&
+		binary.BigEndian.Uint64(hdr[8:]) == wl.epoch
+
+	var n int
+	good := int64(len(hdr))
+	for valid {
+		var rec *Record
+		rec, n, err = ReadRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			wl.log.Warn("discarding write log after torn record", "offset", good, "err", err)
+			break
+		}
+		cache.restore(rec)
+		good += int64(n)
+	}
+
+	if !valid {
+		// empty, or a stale log from before the last compaction
+		if err := wl.reset(); err != nil {
+			return err
+		}
+	} else {
+		if err := wl.file.Truncate(good); err != nil {
+			return err
+		}
+		if _, err := wl.file.Seek(good, io.SeekStart); err != nil {
+			return err
+		}
+		wl.buf.Reset(wl.file)
+		wl.size = good
+	}
+
+	cache.journals = append(cache.journals, wl)
+	cache.evictOverflow()
+	return nil
+}
+
+// loadSnapshot loads the snapshot (if one exists) into the cache.
+//
+// The caller of this method should hold the write lock on Cache and WriteLog.
+func (wl *WriteLog) loadSnapshot(cache *Cache) error {
+	f, err := os.Open(filepath.Join(wl.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || string(hdr[:8]) != snapshotMagic {
+		return fmt.Errorf("invalid snapshot header: %s", f.Name())
+	}
+	wl.epoch = binary.BigEndian.Uint64(hdr[8:])
+	cache.version = binary.BigEndian.Uint64(hdr[16:])
+
+	for {
+		rec, _, err := ReadRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// snapshots are written atomically, so this isn't a crash artifact
+			return fmt.Errorf("reading snapshot: %s", err)
+		}
+		cache.restore(rec)
+	}
+}
+
+// Compact writes the current contents of the cache to a new snapshot and then
+// truncates the log. The cache is only locked to take the snapshot (see
+// Cache.Snapshot), which is written out and synced without it, and again at the
+// end, to copy (and sync) the records logged since the snapshot onto the end of
+// it before it replaces the current one and the log is truncated.
+//
+// A log disabled by a write error is reopened afresh when the snapshot is
+// taken, as the snapshot holds everything the log missed, so a successful
+// compaction enables it again.
+func (wl *WriteLog) Compact(cache *Cache) error {
+	wl.compacting.Lock()
+	defer wl.compacting.Unlock()
+
+	var start int64
+	var epoch uint64
+	var err error
+	snap := cache.Snapshot(func() {
+		wl.Lock()
+		epoch = wl.epoch + 1
+		if wl.err != nil {
+			err = wl.reopen(epoch)
+		}
+		start = wl.size
+		wl.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(wl.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	// sync the bulk of the snapshot before locking, so only the tail is synced
+	// while mutations wait
+	w := bufio.NewWriter(f)
+	if err := writeSnapshot(w, snap, epoch); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	wl.Lock()
+	defer wl.Unlock()
+
+	if wl.err != nil {
+		return wl.err
+	}
+	if err := wl.copyTail(w, start); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// the tail may have taken CAS values past the snapshot's
+	var version [8]byte
+	binary.BigEndian.PutUint64(version[:], cache.version)
+	if _, err := f.WriteAt(version[:], 16); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(wl.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(wl.dir); err != nil {
+		return err
+	}
+	wl.epoch = epoch
+	return wl.reset()
+}
+
+// writeSnapshot writes out the header and records of a snapshot for epoch.
+func writeSnapshot(w *bufio.Writer, snap *Snapshot, epoch uint64) error {
+	var hdr [24]byte
+	copy(hdr[:], snapshotMagic)
+	binary.BigEndian.PutUint64(hdr[8:], epoch)
+	binary.BigEndian.PutUint64(hdr[16:], snap.Version)
+	w.Write(hdr[:])
+
+	var buf []byte
+	return snap.Each(func(rec *Record) error {
+		buf = AppendRecord(buf[:0], rec.Op, rec.Cas, rec.Expires, rec.Flags[:], rec.Key, rec.Value, rec.Chunks...)
+		_, err := w.Write(buf)
+		return err
+	})
+}
+
+// copyTail copies the records logged from offset start to w.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) copyTail(w io.Writer, start int64) error {
+	if err := wl.buf.Flush(); err != nil {
+		wl.fail(err)
+		return err
+	}
+	_, err := io.Copy(w, io.NewSectionReader(wl.file, start, wl.size-start))
+	return err
+}
+
+// reset truncates the log, leaving just a header for the current epoch.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) reset() error {
+	if err := wl.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wl.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	wl.buf.Reset(wl.file)
+	return wl.writeHeader(wl.epoch)
+}
+
+// writeHeader writes the header of an empty log for epoch, and syncs it.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) writeHeader(epoch uint64) error {
+	var hdr [16]byte
+	copy(hdr[:], walMagic)
+	binary.BigEndian.PutUint64(hdr[8:], epoch)
+	wl.buf.Write(hdr[:])
+	wl.size = int64(len(hdr))
+	return wl.sync()
+}
+
+// reopen replaces a log disabled by a write error with a new, empty one for
+// epoch, so records after a snapshot for epoch can be logged again. The records
+// the log missed aren't replayed on top of the last snapshot (whose epoch is
+// earlier) should we crash before the new snapshot replaces it.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) reopen(epoch uint64) error {
+	wl.file.Close()
+	f, err := os.OpenFile(filepath.Join(wl.dir, walFile), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	wl.file = f
+	wl.buf = bufio.NewWriter(f)
+	if err := wl.writeHeader(epoch); err != nil {
+		return err
+	}
+	wl.log.Info("write log reopened", "epoch", epoch)
+	wl.err = nil
+	return nil
+}
+
+// Append adds an encoded record to the end of the log. Write errors disable the
+// log until the next successful compaction, as replaying a log with missing
+// records could resurrect stale values.
+//
+// The caller of this method should hold the write lock on Cache.
+func (wl *WriteLog) Append(rec []byte) {
+	wl.Lock()
+	defer wl.Unlock()
+
+	if wl.err != nil {
+		return
+	}
+	n, err := wl.buf.Write(rec)
+	wl.size += int64(n)
+	if err == nil && wl.policy == SYNC_ALWAYS {
+		err = wl.sync()
+	}
+	wl.fail(err)
+}
+
+// fail records the first write error encountered by the log.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) fail(err error) {
+	if err != nil && wl.err == nil {
+		wl.log.Error("write log disabled", "err", err)
+		wl.err = err
+	}
+}
+
+// sync flushes buffered records and fsyncs the log file.
+//
+// The caller of this method should hold the write lock on WriteLog.
+func (wl *WriteLog) sync() error {
+	if err := wl.buf.Flush(); err != nil {
+		return err
+	}
+	return wl.file.Sync()
+}
+
+// Run loops forever, syncing the log according to its policy and compacting it
+// into a snapshot every compactEvery (if non-zero).
+func (wl *WriteLog) Run(cache *Cache, compactEvery time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastCompact := time.Now()
+	for now := range ticker.C {
+		if compactEvery > 0 && now.Sub(lastCompact) >= compactEvery {
+			lastCompact = now
+			if err := wl.Compact(cache); err != nil {
+				wl.log.Error("compacting write log failed", "err", err)
+			}
+			continue
+		}
+
+		wl.Lock()
+		if wl.err == nil {
+			if wl.policy == SYNC_NEVER {
+				wl.fail(wl.buf.Flush())
+			} else {
+				wl.fail(wl.sync())
+			}
+		}
+		wl.Unlock()
+	}
+}
+
+// Close flushes and closes the write log.
+func (wl *WriteLog) Close() error {
+	wl.Lock()
+	defer wl.Unlock()
+
+	err := wl.sync()
+	if cerr := wl.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir fsyncs a directory so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func OpenTestLog(t *testing.T, dir string, maxBytes uint64) (*Cache, *WriteLog) {
+	cache := New(maxBytes)
+	wl, err := OpenWriteLog(dir, SYNC_ALWAYS)
+	if err != nil {
+		t.Fatalf("Couldn't open write log: %s\n", err)
+	}
+	if err = wl.Recover(cache); err != nil {
+		t.Fatalf("Couldn't recover write log: %s\n", err)
+	}
+	return cache, wl
+}
+
+func CheckCas(t *testing.T, c *Cache, key string, cas uint64) {
+	i, err := c.Get(ctx, []byte(key))
+	if err != nil {
+		t.Errorf("Couldn't find key %s in cache\n", key)
+	} else if i.CAS != cas {
+		t.Errorf("Wrong CAS for key %s: %d vs %d\n", key, i.CAS, cas)
+	}
+}
+
+func TestWriteLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 100000)
+	cas1, _ := cache.Set(ctx, []byte("key1"), value, flags, 0, 0)
+	cas2, _ := cache.Set(ctx, []byte("key2"), value, flags, 0, 0)
+	cas2, _ = cache.Set(ctx, []byte("key2"), []byte("value2"), flags, 0, cas2)
+	StoreKey(cache, "key3", value)
+	DeleteKey(cache, "key3")
+	// crash: no Close, rely on the SYNC_ALWAYS policy
+
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckKey(t, cache, "key1", value)
+	CheckKey(t, cache, "key2", []byte("value2"))
+	CheckNoKey(t, cache, "key3")
+	CheckCas(t, cache, "key1", cas1)
+	CheckCas(t, cache, "key2", cas2)
+
+	// new CAS values must not collide with those handed out before the crash
+	cas4, _ := cache.Set(ctx, []byte("key4"), value, flags, 0, 0)
+	if cas4 <= cas2 {
+		t.Errorf("CAS reused after recovery: %d <= %d\n", cas4, cas2)
+	}
+}
+
+func TestWriteLogEvictions(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := OpenTestLog(t, dir, 2*KV_SIZE)
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+	CheckKey(t, cache, "key1", value)
+	StoreKey(cache, "key3", value)
+
+	// recovery must evict key2 (as happened originally) not key1
+	cache, wl := OpenTestLog(t, dir, 2*KV_SIZE)
+	defer wl.Close()
+	CheckKey(t, cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+	CheckKey(t, cache, "key3", value)
+}
+
+func TestWriteLogExpiry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1500000000, 0)
+	cache, _ := OpenTestLog(t, dir, 100000)
+	cache.now = func() time.Time { return now }
+	cache.Set(ctx, []byte("key1"), value, flags, 10, 0)
+	cache.Set(ctx, []byte("key2"), value, flags, 100, 0)
+	now = now.Add(20 * time.Second)
+	CheckNoKey(t, cache, "key1")
+
+	cache, wl := OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	cache.now = func() time.Time { return now }
+	CheckNoKey(t, cache, "key1")
+	CheckKey(t, cache, "key2", value)
+	if i, err := cache.Get(ctx, []byte("key2")); err == nil && i.Expires != now.Unix()+80 {
+		t.Errorf("Wrong expiry after recovery: %d\n", i.Expires)
+	}
+}
+
+func TestWriteLogTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := OpenTestLog(t, dir, 100000)
+	StoreKey(cache, "key1", value)
+	StoreKey(cache, "key2", value)
+
+	// chop the last record in half
+	path := filepath.Join(dir, walFile)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, fi.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, wl := OpenTestLog(t, dir, 100000)
+	CheckKey(t, cache, "key1", value)
+	CheckNoKey(t, cache, "key2")
+
+	// the log must still be appendable after discarding the torn record
+	StoreKey(cache, "key3", value)
+	wl.Close()
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckKey(t, cache, "key1", value)
+	CheckKey(t, cache, "key3", value)
+}
+
+func TestWriteLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 100000)
+	for i := 0; i < 100; i++ {
+		StoreKey(cache, "key1", value)
+	}
+	cas2, _ := cache.Set(ctx, []byte("key2"), value, flags, 0, 0)
+	before := wl.Size()
+	if err := wl.Compact(cache); err != nil {
+		t.Fatalf("Couldn't compact: %s\n", err)
+	}
+	if wl.Size() >= before {
+		t.Errorf("Log didn't shrink: %d >= %d\n", wl.Size(), before)
+	}
+	StoreKey(cache, "key3", value)
+	DeleteKey(cache, "key1")
+
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckNoKey(t, cache, "key1")
+	CheckKey(t, cache, "key2", value)
+	CheckKey(t, cache, "key3", value)
+	CheckCas(t, cache, "key2", cas2)
+}
+
+func TestWriteLogCompactFailed(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 100000)
+	StoreKey(cache, "key1", value)
+
+	// a write error disables the log, losing the records after it
+	wl.file.Close()
+	StoreKey(cache, "key2", value)
+	DeleteKey(cache, "key1")
+	if wl.err == nil {
+		t.Fatalf("Write log not disabled by a write error\n")
+	}
+
+	// until a compaction snapshots them and reopens the log
+	if err := wl.Compact(cache); err != nil {
+		t.Fatalf("Couldn't compact: %s\n", err)
+	}
+	if wl.err != nil {
+		t.Errorf("Write log still disabled: %s\n", wl.err)
+	}
+	StoreKey(cache, "key3", value)
+
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckNoKey(t, cache, "key1")
+	CheckKey(t, cache, "key2", value)
+	CheckKey(t, cache, "key3", value)
+}
+
+func TestWriteLogCompactConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 1000000)
+	for n := 0; n < 1000; n++ {
+		StoreKey(cache, fmt.Sprint("key", n), value)
+	}
+
+	// mutations made while the snapshot is written out are kept, whether they
+	// made it into the snapshot or not
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for n := 0; n < 1000; n++ {
+			StoreKey(cache, fmt.Sprint("new", n), value)
+			DeleteKey(cache, fmt.Sprint("key", n))
+		}
+	})
+	if err := wl.Compact(cache); err != nil {
+		t.Fatalf("Couldn't compact: %s\n", err)
+	}
+	wg.Wait()
+	cas, _ := cache.Set(ctx, []byte("last"), value, flags, 0, 0)
+
+	cache, wl = OpenTestLog(t, dir, 1000000)
+	defer wl.Close()
+	for n := 0; n < 1000; n++ {
+		CheckNoKey(t, cache, fmt.Sprint("key", n))
+		CheckKey(t, cache, fmt.Sprint("new", n), value)
+	}
+	CheckCas(t, cache, "last", cas)
+}
+
+func TestWriteLogChunks(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("x"), 2*MAX_VALUE_SIZE+1)
+	cache, wl := OpenTestLog(t, dir, 100*MAX_VALUE_SIZE)
+	StoreKey(cache, "key1", big)
+	if err := wl.Compact(cache); err != nil {
+		t.Fatalf("Couldn't compact: %s\n", err)
+	}
+	StoreKey(cache, "key2", big)
+
+	// chunked items are read back (from the snapshot and log) in chunks
+	cache, wl = OpenTestLog(t, dir, 100*MAX_VALUE_SIZE)
+	defer wl.Close()
+	for _, key := range []string{"key1", "key2"} {
+		i, _ := cache.Get(ctx, []byte(key))
+		if len(i.Chunks) != 3 || !bytes.Equal(i.Bytes(), big) {
+			t.Errorf("Wrong chunks for %s: %d\n", key, len(i.Chunks))
+		}
+	}
+}
+
+func TestWriteLogStaleLog(t *testing.T) {
+	dir := t.TempDir()
+	cache, wl := OpenTestLog(t, dir, 100000)
+	StoreKey(cache, "key1", value)
+	DeleteKey(cache, "key1")
+	stale, err := os.ReadFile(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	StoreKey(cache, "key1", value)
+	wl.Compact(cache)
+
+	// simulate a crash after the snapshot was written but before the log was
+	// truncated: the old log must not be replayed over the snapshot
+	wl.Close()
+	if err = os.WriteFile(filepath.Join(dir, walFile), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, wl = OpenTestLog(t, dir, 100000)
+	defer wl.Close()
+	CheckKey(t, cache, "key1", value)
+}
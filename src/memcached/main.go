@@ -1,25 +1,288 @@
 package main
 
-// Run the memcache server on port 11211 with a 100MB storage limit.
+// Run the memcache server, by default on port 11211 with a 100MB storage limit.
 
 import (
-	"io/ioutil"
-	"log"
+	"flag"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/router"
+	"memcached/server"
+	"memcached/storage"
 )
 
-func init() {
-	// Disabled log output normally, but comment out for testing
-	// TODO: Better log facility like seelog.
-	log.SetOutput(ioutil.Discard)
-}
+var (
+	listenAddr  = flag.String("listen", ":11211", "address to listen on")
+	maxMB       = flag.Uint64("memory", 100, "storage limit in megabytes")
+	maxItem     = flag.Uint64("max-item-size", cache.MAX_VALUE_SIZE, "largest item stored in bytes, values over 1MB are stored in chunks")
+	noEvict     = flag.Bool("no-evict", false, "return an out of memory error when full, rather than evicting items")
+	walDir      = flag.String("wal-dir", "", "directory for the write log and snapshots (disabled if empty)")
+	walSync     = flag.String("wal-sync", "everysec", "write log fsync policy: always, everysec or never")
+	walCompact  = flag.Duration("wal-compact", 10*time.Minute, "interval to compact the write log into a snapshot (0 to disable)")
+	replListen  = flag.String("repl-listen", "", "address to accept replication followers on (disabled if empty)")
+	replLeader  = flag.String("repl-leader", "", "address of a leader to replicate from, making this server a read-only follower")
+	httpAddr    = flag.String("http", "", "address for the HTTP admin and metrics endpoint (disabled if empty)")
+	logLevel    = flag.String("log-level", "warn", "log level: error, warn, info or debug")
+	crawlRate   = flag.Int("crawler-rate", cache.CRAWL_RATE, "items visited per second by an LRU crawl (0 for no limit)")
+	crawlReap   = flag.Bool("crawler-reclaim", true, "remove expired items found by LRU crawls")
+	maxIdle     = flag.Duration("max-idle", 0, "remove items not stored or retrieved for this long (0 to disable)")
+	leaseTTL    = flag.Duration("lease-ttl", 10*time.Second, "how long a lease of a missing key lasts, and deleted or expired items are kept as stale values (0 to disable leases)")
+	hotKeys     = flag.Int("hot-keys", 0, "number of hottest keys to track for reads and writes (0 to disable)")
+	hotKeyRate  = flag.Float64("hot-key-rate", 0, "log keys requested more than this many times a second (0 to disable)")
+	slowTime    = flag.Duration("slow-log-threshold", server.SLOW_LOG_THRESHOLD, "log requests taking longer than this to serve in the slow log")
+	slowSize    = flag.Int("slow-log-size", server.SLOW_LOG_SIZE, "number of the latest slow requests kept (0 to disable the slow log)")
+	usersFile   = flag.String("users", "", "file of users clients must authenticate as, with their rate limits (authentication disabled if empty)")
+	tenantsFile = flag.String("tenants", "", "file of tenants, each with a key prefix, storage limit and users (disabled if empty)")
+	clientOps   = flag.Float64("client-ops-rate", 0, "requests per second allowed each connection (0 for no limit)")
+	clientBytes = flag.Float64("client-bytes-rate", 0, "bytes per second allowed each connection (0 for no limit)")
+	diskDir     = flag.String("disk-dir", "", "directory of a disk tier for the values of evicted items (disabled if empty)")
+	diskMB      = flag.Int64("disk-size", 1024, "size limit of the disk tier in megabytes")
+	diskMin     = flag.Int("disk-min-value", cache.DISK_MIN_VALUE, "smallest value in bytes written to the disk tier, smaller ones are evicted")
+	maxHeapMB   = flag.Uint64("max-heap", 0, "limit on the live Go heap in megabytes, shrinking the storage limit to stay within it (0 for half the Go runtime's memory limit, if any)")
+	memRatio    = flag.Float64("memory-limit-ratio", 0, "Go runtime memory limit, as a multiple of the storage limit, e.g. 2 (0 to leave it to GOMEMLIMIT, which overrides it if set)")
+	readOnly    = flag.Bool("read-only", false, "start in read-only mode, refusing mutations")
+	roStatus    = flag.String("read-only-status", "not_supported", "error status mutations are refused with while read-only (e.g., not_supported or busy)")
+	routesFile  = flag.String("routes", "", "file of pools of backend servers and the routes of keys to them, to run as a router rather than a cache (disabled if empty)")
+	routeTime   = flag.Duration("route-timeout", router.TIMEOUT, "time a backend has to connect and respond to each request routed to it")
+)
+
+// log is the server's logger, shared with the cache.
+var log = server.DefaultLogger
 
 func main() {
-	addr, err := net.ResolveTCPAddr("tcp", ":11211")
+	flag.Parse()
+
+	level, err := server.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatal("invalid log level", "err", err)
+	}
+	log.SetLevel(level)
+
+	addr, err := net.ResolveTCPAddr("tcp", *listenAddr)
+	if err != nil {
+		log.Fatal("cannot parse listen address", "err", err)
+	}
+	if *maxItem > cache.MAX_ITEM_SIZE {
+		log.Fatal("max item size too large", "max", cache.MAX_ITEM_SIZE)
+	}
+	status, err := protocol.ParseStatus(*roStatus)
+	if err != nil {
+		log.Fatal("invalid read-only status", "err", err)
+	}
+	if *routesFile != "" {
+		r, opts := startRouter()
+		serve(r, addr, status, opts...)
+		return
+	}
+
+	c := cache.New(*maxMB*1024*1024,
+		cache.WithMaxItemSize(*maxItem),
+		cache.WithNoEvict(*noEvict),
+		cache.WithLeases(*leaseTTL),
+		cache.WithLogger(log))
+	users, open := loadUsers(c)
+
+	opts := []server.Option{
+		server.WithCrawler(cache.NewCrawler(c, *crawlRate, *crawlReap)),
+		server.WithUsers(users),
+		server.WithOpenTenants(open...),
+		server.WithClientRate(server.Rate{Ops: *clientOps, Bytes: *clientBytes}),
+		server.WithMaxItemSize(int(*maxItem)),
+	}
+	if *walDir != "" {
+		opts = append(opts, server.WithWriteLog(startWriteLog(c)))
+	}
+	if *maxIdle > 0 {
+		reaper := cache.NewReaper(c, *maxIdle)
+		go reaper.Run(cache.REAP_INTERVAL)
+		opts = append(opts, server.WithReaper(reaper))
+	}
+	if *hotKeys > 0 {
+		opts = append(opts, server.WithHotKeys(server.NewHotKeys(*hotKeys, *hotKeyRate)))
+	}
+	if *diskDir != "" {
+		tier, err := cache.NewDiskTier(c, *diskDir, *diskMB*1024*1024, *diskMin)
+		if err != nil {
+			log.Fatal("cannot open disk tier", "err", err)
+		}
+		go tier.Run(cache.DISK_COMPACT_INTERVAL)
+		opts = append(opts, server.WithDiskTier(tier))
+	}
+	maxHeap := *maxHeapMB * 1024 * 1024
+	if limit := cache.SetMemoryLimit(*maxMB*1024*1024, *memRatio); maxHeap == 0 && limit > 0 {
+		maxHeap = cache.MaxHeapFor(limit)
+	}
+	if maxHeap > 0 {
+		hl := cache.NewHeapLimiter(c, maxHeap)
+		go hl.Run(cache.HEAP_CHECK_INTERVAL)
+		opts = append(opts, server.WithHeapLimiter(hl))
+	}
+	opts = append(opts, startReplication(c)...)
+
+	serve(c, addr, status, opts...)
+}
+
+// serve serves the storage (a cache or router) to clients, returning once the
+// server is closed.
+func serve(store storage.Storage, addr *net.TCPAddr, status protocol.Status, opts ...server.Option) {
+	opts = append(opts, server.WithSlowLog(server.NewSlowLog(*slowTime, *slowSize)))
+	handler, err := server.NewConnectionHandler(store, addr, opts...)
 	if err != nil {
-		log.Fatalf("ERROR: Cannot parse listen address: %s\n", err)
+		log.Fatal("cannot listen", "addr", addr, "err", err)
+	}
+	handler.SetReadOnlyStatus(status)
+	handler.SetReadOnly(*readOnly)
+	go handleSignals(handler)
+	if *httpAddr != "" {
+		admin, err := server.NewAdminServer(handler, *httpAddr)
+		if err != nil {
+			log.Fatal("cannot listen for HTTP", "err", err)
+		}
+		go admin.Run()
 	}
-	cache := NewCache(1024 * 1024 * 100)
-	handler := NewConnectionHandler(cache, addr)
 	handler.Run()
 }
+
+// loadUsers loads the users (nil if authentication is disabled) and tenants
+// configured, adding the tenants to the cache. Returns the users and the names
+// of the open tenants.
+func loadUsers(c *cache.Cache) (server.Users, []string) {
+	var users server.Users
+	var open []string
+	if *usersFile != "" {
+		var err error
+		users, err = server.LoadUsers(*usersFile)
+		if err != nil {
+			log.Fatal("cannot load users", "err", err)
+		}
+	}
+	if *tenantsFile != "" {
+		configs, err := server.LoadTenants(*tenantsFile)
+		if err != nil {
+			log.Fatal("cannot load tenants", "err", err)
+		}
+		if err = server.ConfigureTenants(c, users, configs); err != nil {
+			log.Fatal("cannot configure tenants", "err", err)
+		}
+		for _, config := range configs {
+			if config.Open {
+				open = append(open, config.Name)
+			}
+		}
+	}
+	return users, open
+}
+
+// handleSignals switches maintenance modes on signals: SIGUSR1 toggles
+// read-only mode and SIGUSR2 drain mode.
+func handleSignals(handler *server.ConnectionHandler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			handler.ToggleReadOnly()
+		case syscall.SIGUSR2:
+			handler.ToggleDraining()
+		}
+	}
+}
+
+// startReplication starts the server as a replication leader or follower, if
+// either is configured, returning the option to run the server as it.
+func startReplication(c *cache.Cache) []server.Option {
+	if *replListen != "" && *replLeader != "" {
+		log.Fatal("cannot be both a replication leader and follower")
+	}
+	if *replListen != "" {
+		addr, err := net.ResolveTCPAddr("tcp", *replListen)
+		if err != nil {
+			log.Fatal("cannot parse replication address", "err", err)
+		}
+		leader, err := server.NewReplicationLeader(c, addr)
+		if err != nil {
+			log.Fatal("cannot listen for replication", "err", err)
+		}
+		go leader.Run()
+		return []server.Option{server.WithReplicationLeader(leader)}
+	}
+	if *replLeader != "" {
+		follower := server.NewReplicationFollower(c, *replLeader)
+		go follower.Run()
+		return []server.Option{server.WithReplicationFollower(follower)}
+	}
+	return nil
+}
+
+// startWriteLog recovers the cache from the write log and starts recording all
+// further mutations to it.
+func startWriteLog(c *cache.Cache) *cache.WriteLog {
+	policy, err := cache.ParseSyncPolicy(*walSync)
+	if err != nil {
+		log.Fatal("invalid write log sync policy", "err", err)
+	}
+	wl, err := cache.OpenWriteLog(*walDir, policy)
+	if err != nil {
+		log.Fatal("cannot open write log", "err", err)
+	}
+	if err = wl.Recover(c); err != nil {
+		log.Fatal("cannot recover write log", "err", err)
+	}
+	go wl.Run(c, *walCompact)
+	return wl
+}
+
+// startRouter creates the router of the routes configured, returning it with
+// the options to serve it with. Only the server's own features apply to a
+// router, those of a cache (e.g., the write log or tenants) don't.
+func startRouter() (*router.Router, []server.Option) {
+	if *tenantsFile != "" {
+		log.Fatal("cannot configure tenants of a router")
+	}
+	config, err := router.LoadRoutes(*routesFile)
+	if err != nil {
+		log.Fatal("cannot load routes", "err", err)
+	}
+	r, err := router.New(config, router.WithTimeout(*routeTime))
+	if err != nil {
+		log.Fatal("cannot configure routes", "err", err)
+	}
+	users, _ := loadUsers(nil)
+	opts := []server.Option{
+		server.WithUsers(users),
+		server.WithClientRate(server.Rate{Ops: *clientOps, Bytes: *clientBytes}),
+		server.WithMaxItemSize(int(*maxItem)),
+		server.WithStats("router", func() []server.Stat { return routerStats(r) }),
+	}
+	if *hotKeys > 0 {
+		opts = append(opts, server.WithHotKeys(server.NewHotKeys(*hotKeys, *hotKeyRate)))
+	}
+	return r, opts
+}
+
+// routerStats returns the statistics of the router, and of each backend named
+// by pool and address (e.g., "main:10.0.0.1:11211:requests").
+func routerStats(r *router.Router) []server.Stat {
+	rs := r.Stats()
+	stats := []server.Stat{
+		{Name: "failovers", Value: fmt.Sprint(rs.Failovers)},
+		{Name: "shadow_requests", Value: fmt.Sprint(rs.Shadowed)},
+		{Name: "shadow_dropped", Value: fmt.Sprint(rs.ShadowDropped)},
+		{Name: "shadow_failures", Value: fmt.Sprint(rs.ShadowFailed)},
+	}
+	for _, b := range rs.Backends {
+		name := b.Pool + ":" + b.Addr + ":"
+		stats = append(stats,
+			server.Stat{Name: name + "requests", Value: fmt.Sprint(b.Requests)},
+			server.Stat{Name: name + "failures", Value: fmt.Sprint(b.Failures)},
+			server.Stat{Name: name + "down", Value: fmt.Sprint(b.Down)})
+	}
+	return stats
+}
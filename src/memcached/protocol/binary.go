@@ -0,0 +1,412 @@
+// Package protocol encodes the binary wire protocol of memcache.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Command represents a memcache command on the wire.
+type Command uint8
+
+// List of memcache commands.
+const (
+	CMD_GET             = Command(0x00)
+	CMD_SET             = Command(0x01)
+	CMD_ADD             = Command(0x02)
+	CMD_REPLACE         = Command(0x03)
+	CMD_DELETE          = Command(0x04)
+	CMD_INCREMENT       = Command(0x05)
+	CMD_DECREMENT       = Command(0x06)
+	CMD_QUIT            = Command(0x07)
+	CMD_FLUSH           = Command(0x08)
+	CMD_GETQ            = Command(0x09)
+	CMD_NOOP            = Command(0x0a)
+	CMD_VERSION         = Command(0x0b)
+	CMD_GETK            = Command(0x0c)
+	CMD_GETKQ           = Command(0x0d)
+	CMD_APPEND          = Command(0x0e)
+	CMD_PREPEND         = Command(0x0f)
+	CMD_STAT            = Command(0x10)
+	CMD_SETQ            = Command(0x11)
+	CMD_ADDQ            = Command(0x12)
+	CMD_REPLACEQ        = Command(0x13)
+	CMD_DELETEQ         = Command(0x14)
+	CMD_INCREMENTQ      = Command(0x15)
+	CMD_DECREMENTQ      = Command(0x16)
+	CMD_QUITQ           = Command(0x17)
+	CMD_FLUSHQ          = Command(0x18)
+	CMD_APPENDQ         = Command(0x19)
+	CMD_PREPENDQ        = Command(0x1a)
+	CMD_VERBOSITY       = Command(0x1b) // memcache doesn't implement, but in spec.
+	CMD_TOUCH           = Command(0x1c)
+	CMD_GAT             = Command(0x1d)
+	CMD_GATQ            = Command(0x1e)
+	CMD_GATK            = Command(0x23)
+	CMD_GATKQ           = Command(0x24)
+	CMD_SASL_LIST_MECHS = Command(0x20)
+	CMD_SASL_AUTH       = Command(0x21)
+	CMD_SASL_STEP       = Command(0x22)
+
+	// extensions for leases (see LEASE_STALE)
+	CMD_LEASE_GET = Command(0x50)
+	CMD_LEASE_SET = Command(0x51)
+
+	// extensions for bulk invalidation (see TAGS_OFFSET), the key being the
+	// prefix or tag invalidated
+	CMD_FLUSH_PREFIX   = Command(0x52)
+	CMD_INVALIDATE_TAG = Command(0x53)
+)
+
+// Status represents a memcache status response code.
+type Status uint16
+
+// memcache status codes.
+const (
+	STATUS_OK               = Status(0x00)
+	STATUS_KEY_NOT_FOUND    = Status(0x01)
+	STATUS_KEY_EXISTS       = Status(0x02)
+	STATUS_VALUE_TOO_LARGE  = Status(0x03)
+	STATUS_INVALID_ARGUMENT = Status(0x04)
+	STATUS_ITEM_NOT_STORED  = Status(0x05)
+	STATUS_NON_NUMERIC      = Status(0x06)
+	STATUS_AUTH_FAILED      = Status(0x20)
+	STATUS_UNKNOWN_COMMAND  = Status(0x81)
+	STATUS_OUT_OF_MEMORY    = Status(0x82)
+	STATUS_NOT_SUPPORTED    = Status(0x83)
+	STATUS_INTERNAL_ERROR   = Status(0x84)
+	STATUS_BUSY             = Status(0x85)
+
+	// extension for leases: the key is missing and leased to another client
+	STATUS_HOT_MISS = Status(0x90)
+)
+
+// LEASE_STALE is set in the lease flags of a lease get response (the extras
+// after the item flags) when the value returned is stale, having been deleted
+// or expired. A lease get responds with:
+//
+//   - STATUS_OK: the value, and in the extras its flags and lease flags. The
+//     CAS is the value's, or if stale the lease token granted (0 for none).
+//   - STATUS_KEY_NOT_FOUND: the key is missing, the CAS is the lease token
+//     granted to fill it with a lease set (whose CAS is the token).
+//   - STATUS_HOT_MISS: the key is missing and leased to another client.
+const LEASE_STALE = 0x1
+
+// NO_CREATE is the expiration in the extras of an increment or decrement
+// request that fails on a missing key, rather than creating it with the initial
+// value given.
+const NO_CREATE = 0xffffffff
+
+// TAGS_OFFSET is the offset in the extras of a set request of the tags of the
+// item (an extension), after its flags and expiration. Each tag is preceded by
+// its length in a byte.
+const TAGS_OFFSET = 8
+
+// commandNames maps commands to their names as used in metrics and logs.
+var commandNames = map[Command]string{
+	CMD_GET:             "get",
+	CMD_SET:             "set",
+	CMD_ADD:             "add",
+	CMD_REPLACE:         "replace",
+	CMD_DELETE:          "delete",
+	CMD_INCREMENT:       "incr",
+	CMD_DECREMENT:       "decr",
+	CMD_QUIT:            "quit",
+	CMD_FLUSH:           "flush",
+	CMD_GETQ:            "getq",
+	CMD_NOOP:            "noop",
+	CMD_VERSION:         "version",
+	CMD_GETK:            "getk",
+	CMD_GETKQ:           "getkq",
+	CMD_APPEND:          "append",
+	CMD_PREPEND:         "prepend",
+	CMD_STAT:            "stat",
+	CMD_SETQ:            "setq",
+	CMD_ADDQ:            "addq",
+	CMD_REPLACEQ:        "replaceq",
+	CMD_DELETEQ:         "deleteq",
+	CMD_INCREMENTQ:      "incrq",
+	CMD_DECREMENTQ:      "decrq",
+	CMD_QUITQ:           "quitq",
+	CMD_FLUSHQ:          "flushq",
+	CMD_APPENDQ:         "appendq",
+	CMD_PREPENDQ:        "prependq",
+	CMD_VERBOSITY:       "verbosity",
+	CMD_TOUCH:           "touch",
+	CMD_GAT:             "gat",
+	CMD_GATQ:            "gatq",
+	CMD_GATK:            "gatk",
+	CMD_GATKQ:           "gatkq",
+	CMD_SASL_LIST_MECHS: "sasl_list_mechs",
+	CMD_SASL_AUTH:       "sasl_auth",
+	CMD_SASL_STEP:       "sasl_step",
+	CMD_LEASE_GET:       "lease_get",
+	CMD_LEASE_SET:       "lease_set",
+	CMD_FLUSH_PREFIX:    "flush_prefix",
+	CMD_INVALIDATE_TAG:  "invalidate_tag",
+}
+
+// String returns the name of the command.
+func (cmd Command) String() string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%#02x", uint8(cmd))
+}
+
+// IsMutation returns true if the command may modify the cache.
+func (cmd Command) IsMutation() bool {
+	switch cmd {
+	case CMD_SET, CMD_ADD, CMD_REPLACE, CMD_DELETE, CMD_INCREMENT, CMD_DECREMENT,
+		CMD_FLUSH, CMD_APPEND, CMD_PREPEND, CMD_SETQ, CMD_ADDQ, CMD_REPLACEQ,
+		CMD_DELETEQ, CMD_INCREMENTQ, CMD_DECREMENTQ, CMD_FLUSHQ, CMD_APPENDQ,
+		CMD_PREPENDQ, CMD_TOUCH, CMD_GAT, CMD_GATQ, CMD_GATK, CMD_GATKQ, CMD_LEASE_SET,
+		CMD_FLUSH_PREFIX, CMD_INVALIDATE_TAG:
+		return true
+	}
+	return false
+}
+
+// MAX_KEY_LENGTH is the longest key memcache allows.
+const MAX_KEY_LENGTH = 250
+
+// ValidKey returns true if the key is allowed for a command on an item: not
+// empty and at most MAX_KEY_LENGTH bytes. The binary protocol allows any bytes
+// in keys, the text protocol is stricter (as its keys are space separated).
+func ValidKey(key []byte) bool {
+	return len(key) > 0 && len(key) <= MAX_KEY_LENGTH
+}
+
+// statusNames maps status codes to their names as used in metrics and logs.
+var statusNames = map[Status]string{
+	STATUS_OK:               "ok",
+	STATUS_KEY_NOT_FOUND:    "key_not_found",
+	STATUS_KEY_EXISTS:       "key_exists",
+	STATUS_VALUE_TOO_LARGE:  "value_too_large",
+	STATUS_INVALID_ARGUMENT: "invalid_argument",
+	STATUS_ITEM_NOT_STORED:  "item_not_stored",
+	STATUS_NON_NUMERIC:      "non_numeric",
+	STATUS_AUTH_FAILED:      "auth_failed",
+	STATUS_UNKNOWN_COMMAND:  "unknown_command",
+	STATUS_OUT_OF_MEMORY:    "out_of_memory",
+	STATUS_NOT_SUPPORTED:    "not_supported",
+	STATUS_INTERNAL_ERROR:   "internal_error",
+	STATUS_BUSY:             "busy",
+	STATUS_HOT_MISS:         "hot_miss",
+}
+
+// String returns the name of the status code.
+func (status Status) String() string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%#04x", uint16(status))
+}
+
+// ParseStatus parses the name of an error status (e.g., "not_supported").
+func ParseStatus(s string) (Status, error) {
+	for status, name := range statusNames {
+		if name == s && status != STATUS_OK {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown error status: %q", s)
+}
+
+// RequestType is the type of memcache request.
+type RequestType uint8
+
+const (
+	// MSG_REQUEST is the magic code for memcache request type.
+	MSG_REQUEST = RequestType(0x80)
+
+	// MSG_RESPONSE is the magic code for memcache response type.
+	MSG_RESPONSE = RequestType(0x81)
+)
+
+// Header is a memcache request/response header.
+type Header struct {
+	Magic        RequestType
+	Opcode       Command
+	KeyLength    uint16
+	ExtrasLength uint8
+	DataType     uint8
+	Status       uint16
+	TotalLength  uint32
+	Opaque       uint32
+	Cas          uint64
+}
+
+// HEADER_SIZE is the size in bytes of a memcache header.
+const HEADER_SIZE = 24
+
+// BodyLength returns the expected body length of a memcache request.
+func (hdr *Header) BodyLength() uint32 {
+	return hdr.TotalLength - (uint32)(hdr.ExtrasLength) - (uint32)(hdr.KeyLength)
+}
+
+// HeaderParseError represents an invalid header from a client.
+type HeaderParseError struct{}
+
+func (*HeaderParseError) Error() string {
+	return "Failed to parse header"
+}
+
+// ReadRequest reads a memcache request header from a stream.
+func (hdr *Header) ReadRequest(conn io.Reader) error {
+	return hdr.ReadRequestBuf(conn, make([]byte, HEADER_SIZE))
+}
+
+// ReadRequestBuf reads a memcache request header from a stream, using the
+// buffer provided (of length HEADER_SIZE) rather than allocating one.
+func (hdr *Header) ReadRequestBuf(conn io.Reader, buf []byte) error {
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	hdr.parse(buf)
+	return hdr.CheckValidRequest()
+}
+
+// ReadResponseBuf reads a memcache response header from a stream, using the
+// buffer provided (of length HEADER_SIZE) rather than allocating one.
+func (hdr *Header) ReadResponseBuf(conn io.Reader, buf []byte) error {
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	hdr.parse(buf)
+	return hdr.CheckValidResponse()
+}
+
+// parse parses a memcache header from the buffer (of length HEADER_SIZE).
+func (hdr *Header) parse(buf []byte) {
+	hdr.Magic = RequestType(buf[0])
+	hdr.Opcode = Command(buf[1])
+	hdr.KeyLength = binary.BigEndian.Uint16(buf[2:])
+	hdr.ExtrasLength = buf[4]
+	hdr.DataType = buf[5]
+	hdr.Status = binary.BigEndian.Uint16(buf[6:])
+	hdr.TotalLength = binary.BigEndian.Uint32(buf[8:])
+	hdr.Opaque = binary.BigEndian.Uint32(buf[12:])
+	hdr.Cas = binary.BigEndian.Uint64(buf[16:])
+}
+
+// CheckValidRequest checks a memcache header is a valid request header.
+func (hdr *Header) CheckValidRequest() error {
+	if hdr.Magic != MSG_REQUEST {
+		return &HeaderParseError{}
+	} else if uint32(hdr.KeyLength)+uint32(hdr.ExtrasLength) > hdr.TotalLength {
+		return &HeaderParseError{}
+	}
+	return nil
+}
+
+// CheckValidResponse checks a memcache header is a valid response header.
+func (hdr *Header) CheckValidResponse() error {
+	if hdr.Magic != MSG_RESPONSE {
+		return &HeaderParseError{}
+	} else if uint32(hdr.KeyLength)+uint32(hdr.ExtrasLength) > hdr.TotalLength {
+		return &HeaderParseError{}
+	}
+	return nil
+}
+
+// NewRequest creates a Memcache request message header.
+func NewRequest(command Command, key []byte, value []byte, extras []byte, opaque uint32, cas uint64) Header {
+	return Header{
+		Magic:        MSG_REQUEST,
+		Opcode:       command,
+		KeyLength:    uint16(len(key)),
+		ExtrasLength: uint8(len(extras)),
+		TotalLength:  uint32(len(value) + len(extras) + len(key)),
+		Opaque:       opaque,
+		Cas:          cas,
+	}
+}
+
+// NewResponse creates a Memcache response message header.
+func NewResponse(command Command,
+	status Status,
+	key []byte,
+	value []byte,
+	extras []byte,
+	opaque uint32,
+	version uint64) Header {
+	return Header{
+		Magic:        MSG_RESPONSE,
+		Opcode:       command,
+		KeyLength:    uint16(len(key)),
+		ExtrasLength: uint8(len(extras)),
+		DataType:     0,
+		Status:       uint16(status),
+		TotalLength:  uint32(len(value) + len(extras) + len(key)),
+		Opaque:       opaque,
+		Cas:          version,
+	}
+}
+
+// Serialize writes the header out to the buffer provided. The buffer should
+// have length HEADER_SIZE.
+func (hdr *Header) Serialize(buf []byte) {
+	buf[0] = uint8(hdr.Magic)
+	buf[1] = uint8(hdr.Opcode)
+	binary.BigEndian.PutUint16(buf[2:], hdr.KeyLength)
+	buf[4] = hdr.ExtrasLength
+	buf[5] = hdr.DataType
+	binary.BigEndian.PutUint16(buf[6:], hdr.Status)
+	binary.BigEndian.PutUint32(buf[8:], hdr.TotalLength)
+	binary.BigEndian.PutUint32(buf[12:], hdr.Opaque)
+	binary.BigEndian.PutUint64(buf[16:], hdr.Cas)
+}
+
+// WriteTo writes out a memcache header.
+func (hdr *Header) WriteTo(conn io.Writer) (int64, error) {
+	buf := make([]byte, HEADER_SIZE)
+	hdr.Serialize(buf)
+	n, err := conn.Write(buf)
+	return int64(n), err
+}
+
+// WriteRequestBuf writes out a complete memcache request, serializing the
+// header into the buffer provided (of length HEADER_SIZE), as requests are
+// framed the same as responses.
+func WriteRequestBuf(conn io.Writer, buf []byte, hdr *Header, extras, key, value []byte) error {
+	return WriteResponseBuf(conn, buf, hdr, extras, key, value)
+}
+
+// WriteResponse writes out a complete memcache response.
+func WriteResponse(conn io.Writer, hdr *Header, extras, key, value []byte) error {
+	return WriteResponseBuf(conn, make([]byte, HEADER_SIZE), hdr, extras, key, value)
+}
+
+// WriteResponseBuf writes out a complete memcache response, serializing the
+// header into the buffer provided (of length HEADER_SIZE) rather than
+// allocating one.
+func WriteResponseBuf(conn io.Writer, buf []byte, hdr *Header, extras, key, value []byte) error {
+	hdr.Serialize(buf)
+	_, err := conn.Write(buf)
+	if err != nil {
+		return err
+	}
+	if extras != nil {
+		_, err = conn.Write(extras)
+		if err != nil {
+			return err
+		}
+	}
+	if key != nil {
+		_, err = conn.Write(key)
+		if err != nil {
+			return err
+		}
+	}
+	if value != nil {
+		_, err = conn.Write(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestHeaderSerialize(t *testing.T) {
+	bts := make([]byte, 24)
+	originalHeader := Header{
+		Magic:        0x81,
+		Status:       0x4,
+		KeyLength:    16,
+		ExtrasLength: 4,
+		DataType:     3,
+		TotalLength:  1024,
+		Opaque:       1334,
+		Cas:          8839298347234234,
+	}
+
+	originalHeader.Serialize(bts)
+
+	buf := new(bytes.Buffer)
+	buf.Write(bts)
+	var header Header
+	binary.Read(buf, binary.BigEndian, &header)
+
+	if header != originalHeader {
+		t.Errorf("Expected %v but was %v", originalHeader, header)
+	}
+}
+
+func TestHeaderParse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	originalHeader := Header{
+		Magic:        0x81,
+		Status:       0x4,
+		KeyLength:    16,
+		ExtrasLength: 4,
+		DataType:     3,
+		TotalLength:  1024,
+		Opaque:       1334,
+		Cas:          8839298347234234,
+	}
+	binary.Write(buf, binary.BigEndian, &originalHeader)
+
+	bts := buf.Bytes()
+
+	var header Header
+	header.ReadRequest(bytes.NewReader(bts))
+
+	if header != originalHeader {
+		t.Errorf("Expected %v but was %v", originalHeader, header)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	if status, err := ParseStatus("busy"); err != nil || status != STATUS_BUSY {
+		t.Errorf("Wrong status: %s %v\n", status, err)
+	}
+	for _, bad := range []string{"ok", "", "nope"} {
+		if _, err := ParseStatus(bad); err == nil {
+			t.Errorf("Invalid status parsed: %q\n", bad)
+		}
+	}
+}
+
+func TestRequestResponse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	req := NewRequest(CMD_SET, []byte("key"), []byte("value"), make([]byte, 8), 7, 42)
+	if err := WriteRequestBuf(buf, make([]byte, HEADER_SIZE), &req, make([]byte, 8), []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Couldn't write request: %v\n", err)
+	}
+	var hdr Header
+	if err := hdr.ReadResponseBuf(bytes.NewReader(buf.Bytes()), make([]byte, HEADER_SIZE)); err == nil {
+		t.Errorf("Request read as a response\n")
+	}
+	if err := hdr.ReadRequest(buf); err != nil || hdr != req || hdr.BodyLength() != 5 {
+		t.Errorf("Expected %v but was %v (%v)\n", req, hdr, err)
+	}
+	buf.Next(int(hdr.TotalLength))
+
+	resp := NewResponse(CMD_GET, STATUS_KEY_NOT_FOUND, nil, nil, nil, 7, 0)
+	resp.WriteTo(buf)
+	if err := hdr.ReadResponseBuf(buf, make([]byte, HEADER_SIZE)); err != nil || hdr != resp {
+		t.Errorf("Expected %v but was %v (%v)\n", resp, hdr, err)
+	}
+}
@@ -0,0 +1,271 @@
+package router
+
+// Backends, the memcache servers of a pool, which the router speaks the binary
+// protocol to over a few connections kept open to each. A backend that fails a
+// request (rather than answering it) is marked down, and requests to it fail
+// straight away until RETRY_INTERVAL has passed, so they're failed over
+// without waiting on it.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+const (
+	// MAX_IDLE_CONNS is the number of idle connections kept open to each
+	// backend.
+	MAX_IDLE_CONNS = 8
+
+	// RETRY_INTERVAL is how long a backend that failed is marked down for.
+	RETRY_INTERVAL = time.Second
+
+	// TIMEOUT is how long a backend has to connect and respond to a request,
+	// unless configured otherwise (see WithTimeout).
+	TIMEOUT = time.Second
+)
+
+// ErrBackendDown is returned by requests to a backend marked down.
+var ErrBackendDown = errors.New("backend down")
+
+// Backend is a memcache server requests are routed to.
+type Backend struct {
+	addr      string
+	timeout   time.Duration
+	idle      chan *backendConn
+	downUntil int64 // UNIX time in nanoseconds, 0 if up
+	requests  uint64
+	failures  uint64
+}
+
+// backendConn is a connection to a backend.
+type backendConn struct {
+	conn   net.Conn
+	bio    *bufio.ReadWriter
+	buf    [protocol.HEADER_SIZE]byte
+	extras [20]byte
+	opaque uint32
+}
+
+// request is a request routed to a backend.
+type request struct {
+	cmd     protocol.Command
+	key     []byte
+	value   []byte
+	flags   uint32
+	exptime uint32
+	cas     uint64
+	delta   uint64
+}
+
+// clone returns a copy of the request the caller's key and value can be reused
+// under (e.g., for a shadow request sent once the caller is done).
+func (req *request) clone() *request {
+	c := *req
+	c.key = append([]byte(nil), req.key...)
+	c.value = append([]byte(nil), req.value...)
+	return &c
+}
+
+// newBackend creates a backend for the server at addr.
+func newBackend(addr string, timeout time.Duration) *Backend {
+	return &Backend{
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan *backendConn, MAX_IDLE_CONNS),
+	}
+}
+
+// Addr returns the address of the backend.
+func (b *Backend) Addr() string {
+	return b.addr
+}
+
+// Down returns true if the backend is marked down, having failed a request in
+// the last RETRY_INTERVAL.
+func (b *Backend) Down() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&b.downUntil)
+}
+
+// send sends the request to the backend, returning the response as an item:
+// the value and flags of a get or touch, the CAS value of a store, or the
+// result of an increment as an 8 byte value. Statuses are returned as the
+// storage errors they correspond to.
+func (b *Backend) send(ctx context.Context, req *request) (storage.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, err
+	}
+	if b.Down() {
+		return storage.Item{}, ErrBackendDown
+	}
+	atomic.AddUint64(&b.requests, 1)
+
+	deadline := time.Now().Add(b.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	bc, err := b.conn(deadline)
+	if err != nil {
+		b.fail(ctx)
+		return storage.Item{}, fmt.Errorf("backend %s: %w", b.addr, err)
+	}
+	resp, body, err := bc.roundTrip(req, deadline)
+	if err != nil {
+		// the connection is out of step with the backend after an error
+		bc.conn.Close()
+		b.fail(ctx)
+		return storage.Item{}, fmt.Errorf("backend %s: %w", b.addr, err)
+	}
+	b.release(bc)
+
+	if status := protocol.Status(resp.Status); status != protocol.STATUS_OK {
+		return storage.Item{}, errorOf(status)
+	}
+	item := storage.Item{CAS: resp.Cas, Value: body[resp.ExtrasLength:]}
+	if resp.ExtrasLength >= 4 {
+		item.Flags = binary.BigEndian.Uint32(body)
+	}
+	return item, nil
+}
+
+// fail marks the backend down, unless the request failed for being canceled.
+func (b *Backend) fail(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	atomic.AddUint64(&b.failures, 1)
+	atomic.StoreInt64(&b.downUntil, time.Now().Add(RETRY_INTERVAL).UnixNano())
+}
+
+// conn returns an idle connection to the backend, or a new one.
+func (b *Backend) conn(deadline time.Time) (*backendConn, error) {
+	select {
+	case bc := <-b.idle:
+		return bc, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", b.addr, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	return &backendConn{
+		conn: conn,
+		bio:  bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}, nil
+}
+
+// release keeps the connection for the next request, if there's room for it.
+func (b *Backend) release(bc *backendConn) {
+	select {
+	case b.idle <- bc:
+	default:
+		bc.conn.Close()
+	}
+}
+
+// close closes the idle connections to the backend.
+func (b *Backend) close() {
+	for {
+		select {
+		case bc := <-b.idle:
+			bc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// roundTrip writes the request to the backend and reads its response, along
+// with the response's body (without the key, which responses needn't have).
+func (bc *backendConn) roundTrip(req *request, deadline time.Time) (protocol.Header, []byte, error) {
+	var resp protocol.Header
+	if err := bc.conn.SetDeadline(deadline); err != nil {
+		return resp, nil, err
+	}
+
+	var key, value, extras []byte
+	switch req.cmd {
+	case protocol.CMD_GET, protocol.CMD_DELETE, protocol.CMD_FLUSH_PREFIX:
+		key = req.key
+	case protocol.CMD_SET, protocol.CMD_ADD:
+		key, value, extras = req.key, req.value, bc.extras[:8]
+		binary.BigEndian.PutUint32(extras, req.flags)
+		binary.BigEndian.PutUint32(extras[4:], req.exptime)
+	case protocol.CMD_INCREMENT, protocol.CMD_DECREMENT:
+		key, extras = req.key, bc.extras[:20]
+		binary.BigEndian.PutUint64(extras, req.delta)
+		binary.BigEndian.PutUint64(extras[8:], 0)
+		binary.BigEndian.PutUint32(extras[16:], protocol.NO_CREATE)
+	case protocol.CMD_GAT:
+		key, extras = req.key, bc.extras[:4]
+		binary.BigEndian.PutUint32(extras, req.exptime)
+	}
+	bc.opaque++
+	hdr := protocol.NewRequest(req.cmd, key, value, extras, bc.opaque, req.cas)
+	if err := protocol.WriteRequestBuf(bc.bio, bc.buf[:], &hdr, extras, key, value); err != nil {
+		return resp, nil, err
+	}
+	if err := bc.bio.Flush(); err != nil {
+		return resp, nil, err
+	}
+
+	if err := resp.ReadResponseBuf(bc.bio, bc.buf[:]); err != nil {
+		return resp, nil, err
+	}
+	body := make([]byte, resp.TotalLength)
+	if _, err := io.ReadFull(bc.bio, body); err != nil {
+		return resp, nil, err
+	}
+	if resp.Opcode != req.cmd || resp.Opaque != bc.opaque {
+		return resp, nil, fmt.Errorf("unexpected response to %s: %s", req.cmd, resp.Opcode)
+	}
+	if resp.KeyLength > 0 {
+		extrasLen := int(resp.ExtrasLength)
+		body = append(body[:extrasLen], body[extrasLen+int(resp.KeyLength):]...)
+	}
+	return resp, body, nil
+}
+
+// errorOf returns the storage error corresponding to an error status from a
+// backend, or for those that don't correspond to one, an error to fail over on.
+func errorOf(status protocol.Status) error {
+	switch status {
+	case protocol.STATUS_KEY_NOT_FOUND:
+		return storage.ErrNotFound
+	case protocol.STATUS_KEY_EXISTS:
+		return storage.ErrExists
+	case protocol.STATUS_ITEM_NOT_STORED:
+		return storage.ErrNotStored
+	case protocol.STATUS_VALUE_TOO_LARGE:
+		return storage.ErrTooLarge
+	case protocol.STATUS_OUT_OF_MEMORY:
+		return storage.ErrNoMemory
+	case protocol.STATUS_NON_NUMERIC:
+		return storage.ErrNonNumeric
+	case protocol.STATUS_UNKNOWN_COMMAND, protocol.STATUS_NOT_SUPPORTED:
+		return storage.ErrNotSupported
+	}
+	return fmt.Errorf("backend error: %s", status)
+}
+
+// failed returns true if the error is a failure of a backend to answer, which
+// is failed over, rather than one of the storage errors answered with (or the
+// request being canceled).
+func failed(err error) bool {
+	switch err {
+	case nil, storage.ErrNotFound, storage.ErrExists, storage.ErrNotStored, storage.ErrTooLarge,
+		storage.ErrNoMemory, storage.ErrNonNumeric, storage.ErrNotSupported,
+		context.Canceled, context.DeadlineExceeded:
+		return false
+	}
+	return true
+}
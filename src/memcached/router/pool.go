@@ -0,0 +1,123 @@
+package router
+
+// Pools, the groups of backends routes send keys to. Keys are spread over a
+// pool's backends by consistent hashing, as in ketama: each backend is hashed
+// to POINTS_PER_BACKEND points on a ring, and a key goes to the backend of the
+// first point at or after the key's hash, so adding or removing a backend only
+// moves the keys of its own points.
+//
+// Every backend of a replicated pool stores every key: writes go to them all,
+// while reads go to the key's backend and fail over to the other replicas.
+// Each replica gives a key its own CAS values, so sets and deletes with a CAS
+// value (which only the key's backend would accept) aren't supported.
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"memcached/storage"
+)
+
+// POINTS_PER_BACKEND is the number of points each backend is hashed to on the
+// ring of its pool.
+const POINTS_PER_BACKEND = 160
+
+// Pool is a group of backends.
+type Pool struct {
+	name       string
+	replicated bool
+	backends   []*Backend
+	ring       []point // sorted by hash
+}
+
+// point is a point on the ring of a pool.
+type point struct {
+	hash    uint32
+	backend int
+}
+
+// newPool creates a pool from its configuration.
+func newPool(config PoolConfig, timeout time.Duration) (*Pool, error) {
+	if len(config.Addrs) == 0 {
+		return nil, fmt.Errorf("pool %s: no backends", config.Name)
+	}
+	p := &Pool{name: config.Name, replicated: config.Replicated}
+	for n, addr := range config.Addrs {
+		p.backends = append(p.backends, newBackend(addr, timeout))
+		for i := 0; i < POINTS_PER_BACKEND/4; i++ {
+			digest := md5.Sum(fmt.Appendf(nil, "%s-%d", addr, i))
+			for j := 0; j < 4; j++ {
+				p.ring = append(p.ring, point{binary.LittleEndian.Uint32(digest[j*4:]), n})
+			}
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b point) int { return cmp.Compare(a.hash, b.hash) })
+	return p, nil
+}
+
+// Name returns the name of the pool.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Backends returns the backends of the pool.
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// backend returns the index of the key's backend.
+func (p *Pool) backend(key []byte) int {
+	digest := md5.Sum(key)
+	hash := binary.LittleEndian.Uint32(digest[:])
+	i, _ := slices.BinarySearchFunc(p.ring, hash, func(pt point, hash uint32) int {
+		return cmp.Compare(pt.hash, hash)
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].backend
+}
+
+// send sends the request to the key's backend. The writes to a replicated pool
+// are sent to every replica at once, returning the outcome of the key's backend
+// unless it failed, and its reads to the other replicas in turn while they fail.
+func (p *Pool) send(ctx context.Context, req *request) (storage.Item, error) {
+	n := p.backend(req.key)
+	if !p.replicated {
+		return p.backends[n].send(ctx, req)
+	}
+	if req.cas != 0 && req.cmd.IsMutation() {
+		return storage.Item{}, storage.ErrNotSupported
+	}
+
+	if !req.cmd.IsMutation() {
+		var item storage.Item
+		var err error
+		for i := range p.backends {
+			if item, err = p.backends[(n+i)%len(p.backends)].send(ctx, req); !failed(err) {
+				break
+			}
+		}
+		return item, err
+	}
+
+	items := make([]storage.Item, len(p.backends))
+	errs := make([]error, len(p.backends))
+	var wg sync.WaitGroup
+	for i, b := range p.backends {
+		wg.Go(func() { items[i], errs[i] = b.send(ctx, req) })
+	}
+	wg.Wait()
+	for i := range p.backends {
+		if j := (n + i) % len(p.backends); !failed(errs[j]) {
+			return items[j], errs[j]
+		}
+	}
+	return items[n], errs[n]
+}
@@ -0,0 +1,37 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPoolRing(t *testing.T) {
+	p3, _ := newPool(PoolConfig{Name: "main", Addrs: []string{"a:1", "b:1", "c:1"}}, TIMEOUT)
+	p4, _ := newPool(PoolConfig{Name: "main", Addrs: []string{"a:1", "b:1", "c:1", "d:1"}}, TIMEOUT)
+	if len(p3.ring) != 3*POINTS_PER_BACKEND {
+		t.Errorf("Wrong number of points: %d\n", len(p3.ring))
+	}
+
+	// keys are spread evenly, and adding a backend only moves keys to it
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		before, after := p3.backend(key), p4.backend(key)
+		counts[after]++
+		if before != after {
+			moved++
+			if after != 3 {
+				t.Fatalf("Key %s moved between old backends: %d to %d\n", key, before, after)
+			}
+		}
+	}
+	for n, count := range counts {
+		if count < 1500 || count > 3500 {
+			t.Errorf("Keys not spread evenly, backend %d has %d\n", n, count)
+		}
+	}
+	if moved != counts[3] {
+		t.Errorf("Wrong number of keys moved: %d\n", moved)
+	}
+}
@@ -0,0 +1,304 @@
+// Package router routes memcache requests to pools of backend memcache servers
+// (as mcrouter does), so that clients can talk to a single local endpoint. A
+// Router is a storage.Storage, served to clients by package server as a cache
+// would be.
+//
+// Keys are routed by prefix (see routes.go), each route sending its keys to a
+// pool, where they're spread over the pool's backends by consistent hashing or
+// replicated to all of them (see pool.go). A route may fail over to other pools
+// when its pool fails a request (rather than answering it, even with a miss),
+// and send a copy of every request to shadow pools (e.g., to warm them up or
+// try them out), whose responses are ignored.
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// MAX_SHADOW_REQUESTS is the number of shadow requests in flight at once,
+// beyond which they're dropped.
+const MAX_SHADOW_REQUESTS = 64
+
+// ErrNoRoute is returned for keys that no route matches.
+var ErrNoRoute = errors.New("no route for key")
+
+// Router is a storage.Storage routing requests to pools of backends.
+type Router struct {
+	pools   []*Pool
+	routes  []*route // longest prefix first
+	timeout time.Duration
+	shadows chan struct{} // a slot for each shadow request in flight
+
+	failovers     uint64
+	shadowed      uint64
+	shadowDropped uint64
+	shadowFailed  uint64
+}
+
+// route is a route of the keys with its prefix to pools.
+type route struct {
+	prefix  string
+	pools   []*Pool // the pool routed to, then those failed over to in turn
+	shadows []*Pool
+}
+
+// Stats are the statistics of a Router.
+type Stats struct {
+	Failovers     uint64 // requests failed over to another pool
+	Shadowed      uint64 // shadow requests sent
+	ShadowDropped uint64 // shadow requests dropped, too many being in flight
+	ShadowFailed  uint64 // shadow requests failed
+	Backends      []BackendStats
+}
+
+// BackendStats are the statistics of a backend of a pool.
+type BackendStats struct {
+	Pool     string
+	Addr     string
+	Requests uint64
+	Failures uint64
+	Down     bool
+}
+
+// Option configures a Router.
+type Option func(*Router)
+
+// WithTimeout gives backends timeout to connect and respond to each request,
+// rather than TIMEOUT.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Router) { r.timeout = timeout }
+}
+
+// New creates a Router from its configuration.
+func New(config Config, opts ...Option) (*Router, error) {
+	r := &Router{
+		timeout: TIMEOUT,
+		shadows: make(chan struct{}, MAX_SHADOW_REQUESTS),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	pools := make(map[string]*Pool)
+	for _, pc := range config.Pools {
+		if _, ok := pools[pc.Name]; ok {
+			return nil, fmt.Errorf("pool %s: already declared", pc.Name)
+		}
+		p, err := newPool(pc, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		pools[pc.Name] = p
+		r.pools = append(r.pools, p)
+	}
+	lookup := func(rc RouteConfig, names []string) ([]*Pool, error) {
+		var found []*Pool
+		for _, name := range names {
+			p, ok := pools[name]
+			if !ok {
+				return nil, fmt.Errorf("route %q: unknown pool %q", rc.Prefix, name)
+			}
+			found = append(found, p)
+		}
+		return found, nil
+	}
+	for _, rc := range config.Routes {
+		if len(rc.Pools) == 0 {
+			return nil, fmt.Errorf("route %q: no pool", rc.Prefix)
+		}
+		rt := &route{prefix: rc.Prefix}
+		var err error
+		if rt.pools, err = lookup(rc, rc.Pools); err != nil {
+			return nil, err
+		}
+		if rt.shadows, err = lookup(rc, rc.Shadows); err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, rt)
+	}
+	slices.SortStableFunc(r.routes, func(a, b *route) int { return len(b.prefix) - len(a.prefix) })
+	return r, nil
+}
+
+// Close closes the idle connections to the backends.
+func (r *Router) Close() error {
+	for _, p := range r.pools {
+		for _, b := range p.backends {
+			b.close()
+		}
+	}
+	return nil
+}
+
+// Stats returns the statistics of the router and its backends.
+func (r *Router) Stats() Stats {
+	stats := Stats{
+		Failovers:     atomic.LoadUint64(&r.failovers),
+		Shadowed:      atomic.LoadUint64(&r.shadowed),
+		ShadowDropped: atomic.LoadUint64(&r.shadowDropped),
+		ShadowFailed:  atomic.LoadUint64(&r.shadowFailed),
+	}
+	for _, p := range r.pools {
+		for _, b := range p.backends {
+			stats.Backends = append(stats.Backends, BackendStats{
+				Pool:     p.name,
+				Addr:     b.addr,
+				Requests: atomic.LoadUint64(&b.requests),
+				Failures: atomic.LoadUint64(&b.failures),
+				Down:     b.Down(),
+			})
+		}
+	}
+	return stats
+}
+
+// send routes the request to the pool of the key's route, failing over to the
+// route's other pools in turn while they fail, and sends a copy to the route's
+// shadow pools.
+func (r *Router) send(ctx context.Context, req *request) (storage.Item, error) {
+	i := slices.IndexFunc(r.routes, func(rt *route) bool {
+		return len(req.key) >= len(rt.prefix) && string(req.key[:len(rt.prefix)]) == rt.prefix
+	})
+	if i < 0 {
+		return storage.Item{}, ErrNoRoute
+	}
+	rt := r.routes[i]
+	if len(rt.shadows) > 0 {
+		r.shadow(rt.shadows, req.clone())
+	}
+
+	var item storage.Item
+	var err error
+	for n, p := range rt.pools {
+		if n > 0 {
+			atomic.AddUint64(&r.failovers, 1)
+		}
+		if item, err = p.send(ctx, req); !failed(err) {
+			break
+		}
+	}
+	return item, err
+}
+
+// shadow sends the request to the shadow pools in the background, unless too
+// many shadow requests are in flight.
+func (r *Router) shadow(pools []*Pool, req *request) {
+	for _, p := range pools {
+		select {
+		case r.shadows <- struct{}{}:
+		default:
+			atomic.AddUint64(&r.shadowDropped, 1)
+			continue
+		}
+		atomic.AddUint64(&r.shadowed, 1)
+		go func() {
+			defer func() { <-r.shadows }()
+			if _, err := p.send(context.Background(), req); failed(err) {
+				atomic.AddUint64(&r.shadowFailed, 1)
+			}
+		}()
+	}
+}
+
+// Get retrieves the item stored for the key. Its expiry is unknown, as the
+// protocol doesn't return it.
+func (r *Router) Get(ctx context.Context, key []byte) (storage.Item, error) {
+	item, err := r.send(ctx, &request{cmd: protocol.CMD_GET, key: key})
+	if err == nil {
+		item.Expires = storage.EXPIRES_UNKNOWN
+	}
+	return item, err
+}
+
+// Set stores the value for the key. On a replicated pool, the CAS value
+// returned is the key's backend's, and sets with a CAS value fail with
+// ErrNotSupported.
+func (r *Router) Set(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	item, err := r.send(ctx, &request{
+		cmd: protocol.CMD_SET, key: key, value: value, flags: flags, exptime: exptime, cas: cas})
+	return item.CAS, err
+}
+
+// Add stores the value for the key only if it isn't already stored.
+func (r *Router) Add(ctx context.Context, key, value []byte, flags, exptime uint32) (uint64, error) {
+	item, err := r.send(ctx, &request{
+		cmd: protocol.CMD_ADD, key: key, value: value, flags: flags, exptime: exptime})
+	return item.CAS, err
+}
+
+// Incr adds delta to (or if decr is true, subtracts it from) the number stored
+// for the key.
+func (r *Router) Incr(ctx context.Context, key []byte, delta uint64, decr bool) (uint64, error) {
+	cmd := protocol.CMD_INCREMENT
+	if decr {
+		cmd = protocol.CMD_DECREMENT
+	}
+	item, err := r.send(ctx, &request{cmd: cmd, key: key, delta: delta})
+	if err != nil {
+		return 0, err
+	} else if len(item.Value) != 8 {
+		return 0, fmt.Errorf("invalid %s response: %q", cmd, item.Value)
+	}
+	return binary.BigEndian.Uint64(item.Value), nil
+}
+
+// Delete removes the key. On a replicated pool, deletes with a CAS value fail
+// with ErrNotSupported.
+func (r *Router) Delete(ctx context.Context, key []byte, cas uint64) error {
+	_, err := r.send(ctx, &request{cmd: protocol.CMD_DELETE, key: key, cas: cas})
+	return err
+}
+
+// Touch updates the expiration of the key. The item returned expires when the
+// backend takes the expiration to mean.
+func (r *Router) Touch(ctx context.Context, key []byte, exptime uint32) (storage.Item, error) {
+	item, err := r.send(ctx, &request{cmd: protocol.CMD_GAT, key: key, exptime: exptime})
+	if err == nil {
+		item.Expires = expiry(exptime, time.Now())
+	}
+	return item, err
+}
+
+// expiry returns the UNIX time an expiration given at now is at, 0 if never.
+func expiry(exptime uint32, now time.Time) int64 {
+	if exptime == 0 || exptime > storage.MAX_RELATIVE_EXPIRY {
+		return int64(exptime)
+	}
+	return now.Unix() + int64(exptime)
+}
+
+// Flush removes all keys from every backend of every pool, returning the
+// first error of the backends that failed.
+func (r *Router) Flush(ctx context.Context) error {
+	return r.broadcast(ctx, &request{cmd: protocol.CMD_FLUSH})
+}
+
+// FlushPrefix removes all keys starting with the prefix from every backend of
+// every pool, returning the first error of the backends that failed (e.g.,
+// ErrNotSupported from a memcache server without the extension).
+func (r *Router) FlushPrefix(ctx context.Context, prefix []byte) error {
+	return r.broadcast(ctx, &request{cmd: protocol.CMD_FLUSH_PREFIX, key: prefix})
+}
+
+// broadcast sends the request to every backend of every pool, returning the
+// first error of the backends that failed.
+func (r *Router) broadcast(ctx context.Context, req *request) error {
+	var first error
+	for _, p := range r.pools {
+		for _, b := range p.backends {
+			if _, err := b.send(ctx, req); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,289 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/server"
+	"memcached/storage"
+	"memcached/storage/storagetest"
+)
+
+var ctx = context.Background()
+
+// StartBackend starts a memcache server on localhost, returning its address and
+// the cache it serves.
+func StartBackend(t *testing.T) (string, *cache.Cache) {
+	c := cache.New(1000000)
+	handler, err := server.NewConnectionHandler(c, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	go handler.Run()
+	t.Cleanup(func() { handler.Close() })
+	return handler.Addr().String(), c
+}
+
+// DeadAddr returns an address on localhost nothing is listening on.
+func DeadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// NewTestRouter creates a router from a route file, closed when the test ends.
+func NewTestRouter(t *testing.T, routes string, args ...any) *Router {
+	config, err := ParseRoutes(strings.NewReader(fmt.Sprintf(routes, args...)))
+	if err != nil {
+		t.Fatalf("Couldn't parse routes: %v\n", err)
+	}
+	r, err := New(config, WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Couldn't create router: %v\n", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// CheckKey checks the key is stored in the cache with the value given, or is
+// missing if the value is "".
+func CheckKey(t *testing.T, c *cache.Cache, key, value string) {
+	t.Helper()
+	item, err := c.Get(ctx, []byte(key))
+	if value == "" && err != storage.ErrNotFound {
+		t.Errorf("Key %s not missing: %q %v\n", key, item.Value, err)
+	} else if value != "" && (err != nil || string(item.Value) != value) {
+		t.Errorf("Key %s not stored: %q %v\n", key, item.Value, err)
+	}
+}
+
+func TestRouterStorage(t *testing.T) {
+	storagetest.TestStorage(t, func() storage.Storage {
+		addr, _ := StartBackend(t)
+		return NewTestRouter(t, "pool a %s\nroute * a\n", addr)
+	}, storagetest.WithUnknownExpiry())
+}
+
+func TestRouterPrefix(t *testing.T) {
+	addr1, c1 := StartBackend(t)
+	addr2, c2 := StartBackend(t)
+	r := NewTestRouter(t, "pool a %s\npool b %s\nroute a: a\nroute * b\n", addr1, addr2)
+
+	if _, err := r.Set(ctx, []byte("a:key"), []byte("value1"), 7, 0, 0); err != nil {
+		t.Fatalf("Couldn't set: %v\n", err)
+	}
+	if _, err := r.Set(ctx, []byte("b:key"), []byte("value2"), 0, 0, 0); err != nil {
+		t.Fatalf("Couldn't set: %v\n", err)
+	}
+	CheckKey(t, c1, "a:key", "value1")
+	CheckKey(t, c1, "b:key", "")
+	CheckKey(t, c2, "b:key", "value2")
+
+	item, err := r.Get(ctx, []byte("a:key"))
+	if err != nil || string(item.Value) != "value1" || item.Flags != 7 || item.CAS == 0 {
+		t.Errorf("Wrong item: %+v %v\n", item, err)
+	}
+	if _, err := r.Set(ctx, []byte("a:key"), []byte("value3"), 0, 0, item.CAS+1); err != storage.ErrExists {
+		t.Errorf("Set with the wrong CAS: %v\n", err)
+	}
+	if item, err := r.Touch(ctx, []byte("a:key"), 100); err != nil || string(item.Value) != "value1" {
+		t.Errorf("Wrong touch: %+v %v\n", item, err)
+	}
+	if err := r.Delete(ctx, []byte("a:key"), 0); err != nil {
+		t.Errorf("Couldn't delete: %v\n", err)
+	}
+	if _, err := r.Get(ctx, []byte("a:key")); err != storage.ErrNotFound {
+		t.Errorf("Deleted key found: %v\n", err)
+	}
+	if err := r.Flush(ctx); err != nil {
+		t.Errorf("Couldn't flush: %v\n", err)
+	}
+	CheckKey(t, c2, "b:key", "")
+
+	// adds, increments and prefix flushes reach the backends too
+	if _, err := r.Add(ctx, []byte("a:n"), []byte("10"), 0, 0); err != nil {
+		t.Errorf("Couldn't add: %v\n", err)
+	}
+	if n, err := r.Incr(ctx, []byte("a:n"), 1, true); err != nil || n != 9 {
+		t.Errorf("Wrong increment: %d %v\n", n, err)
+	}
+	r.Set(ctx, []byte("b:key"), []byte("value2"), 0, 0, 0)
+	if err := r.FlushPrefix(ctx, []byte("a:")); err != nil {
+		t.Errorf("Couldn't flush prefix: %v\n", err)
+	}
+	CheckKey(t, c1, "a:n", "")
+	CheckKey(t, c2, "b:key", "value2")
+
+	r = NewTestRouter(t, "pool a %s\nroute a: a\n", addr1)
+	if _, err := r.Get(ctx, []byte("b:key")); err != ErrNoRoute {
+		t.Errorf("Key routed without a route: %v\n", err)
+	}
+}
+
+func TestRouterHashing(t *testing.T) {
+	addr1, c1 := StartBackend(t)
+	addr2, c2 := StartBackend(t)
+	addr3, c3 := StartBackend(t)
+	r := NewTestRouter(t, "pool main %s %s %s\nroute * main\n", addr1, addr2, addr3)
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, err := r.Set(ctx, []byte(key), []byte(key), 0, 0, 0); err != nil {
+			t.Fatalf("Couldn't set %s: %v\n", key, err)
+		}
+	}
+	for _, c := range []*cache.Cache{c1, c2, c3} {
+		if n := c.Stats().Items; n < 50 {
+			t.Errorf("Keys not spread over the backends: %d\n", n)
+		}
+	}
+	if n := c1.Stats().Items + c2.Stats().Items + c3.Stats().Items; n != 300 {
+		t.Errorf("Wrong number of keys: %d\n", n)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if item, err := r.Get(ctx, []byte(key)); err != nil || string(item.Value) != key {
+			t.Errorf("Wrong value of %s: %q %v\n", key, item.Value, err)
+		}
+	}
+}
+
+func TestRouterReplicated(t *testing.T) {
+	addr1, c1 := StartBackend(t)
+	addr2, c2 := StartBackend(t)
+	r := NewTestRouter(t, "pool main replicated %s %s\nroute * main\n", addr1, addr2)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, err := r.Set(ctx, []byte(key), []byte("value"), 0, 0, 0); err != nil {
+			t.Fatalf("Couldn't set %s: %v\n", key, err)
+		}
+		CheckKey(t, c1, key, "value")
+		CheckKey(t, c2, key, "value")
+	}
+	if err := r.Delete(ctx, []byte("key0"), 0); err != nil {
+		t.Errorf("Couldn't delete: %v\n", err)
+	}
+	CheckKey(t, c1, "key0", "")
+	CheckKey(t, c2, "key0", "")
+
+	// the replicas' CAS values differ, so CAS mutations are refused rather
+	// than only applied to the key's backend
+	item, _ := r.Get(ctx, []byte("key1"))
+	if _, err := r.Set(ctx, []byte("key1"), []byte("other"), 0, 0, item.CAS); err != storage.ErrNotSupported {
+		t.Errorf("Wrong CAS set: %v\n", err)
+	}
+	if err := r.Delete(ctx, []byte("key1"), item.CAS); err != storage.ErrNotSupported {
+		t.Errorf("Wrong CAS delete: %v\n", err)
+	}
+	CheckKey(t, c1, "key1", "value")
+	CheckKey(t, c2, "key1", "value")
+
+	// reads and writes carry on while a replica is down
+	r = NewTestRouter(t, "pool main replicated %s %s\nroute * main\n", DeadAddr(t), addr2)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, err := r.Set(ctx, []byte(key), []byte("new"), 0, 0, 0); err != nil {
+			t.Errorf("Couldn't set %s: %v\n", key, err)
+		}
+		if item, err := r.Get(ctx, []byte(key)); err != nil || string(item.Value) != "new" {
+			t.Errorf("Wrong value of %s: %q %v\n", key, item.Value, err)
+		}
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	addr, c := StartBackend(t)
+	dead := DeadAddr(t)
+	r := NewTestRouter(t, "pool main %s\npool backup %s\nroute * main failover backup\n", dead, addr)
+
+	if _, err := r.Set(ctx, []byte("key"), []byte("value"), 0, 0, 0); err != nil {
+		t.Fatalf("Couldn't set: %v\n", err)
+	}
+	CheckKey(t, c, "key", "value")
+	if item, err := r.Get(ctx, []byte("key")); err != nil || string(item.Value) != "value" {
+		t.Errorf("Wrong value: %q %v\n", item.Value, err)
+	}
+	// misses are answers, not failures
+	if _, err := r.Get(ctx, []byte("missing")); err != storage.ErrNotFound {
+		t.Errorf("Wrong miss: %v\n", err)
+	}
+
+	stats := r.Stats()
+	if stats.Failovers != 3 || len(stats.Backends) != 2 {
+		t.Errorf("Wrong stats: %+v\n", stats)
+	}
+	if b := stats.Backends[0]; b.Addr != dead || !b.Down || b.Failures != 1 || b.Requests != 1 {
+		t.Errorf("Wrong stats of the dead backend: %+v\n", b)
+	}
+	if b := stats.Backends[1]; b.Pool != "backup" || b.Down || b.Requests != 3 {
+		t.Errorf("Wrong stats of the backup backend: %+v\n", b)
+	}
+
+	// without a pool to fail over to, the backend's failure is returned
+	r = NewTestRouter(t, "pool main %s\nroute * main\n", dead)
+	if _, err := r.Get(ctx, []byte("key")); !failed(err) {
+		t.Errorf("Dead backend answered: %v\n", err)
+	}
+	if _, err := r.Get(ctx, []byte("key")); err != ErrBackendDown {
+		t.Errorf("Backend not marked down: %v\n", err)
+	}
+}
+
+func TestRouterShadow(t *testing.T) {
+	addr1, c1 := StartBackend(t)
+	addr2, c2 := StartBackend(t)
+	r := NewTestRouter(t, "pool main %s\npool canary %s\nroute * main shadow canary\n", addr1, addr2)
+
+	if _, err := r.Set(ctx, []byte("key"), []byte("value"), 0, 0, 0); err != nil {
+		t.Fatalf("Couldn't set: %v\n", err)
+	}
+	CheckKey(t, c1, "key", "value")
+	for i := 0; c2.Stats().Items == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	CheckKey(t, c2, "key", "value")
+	if stats := r.Stats(); stats.Shadowed != 1 || stats.ShadowDropped != 0 {
+		t.Errorf("Wrong stats: %+v\n", stats)
+	}
+
+	// a shadow pool's failures don't affect requests
+	r = NewTestRouter(t, "pool main %s\npool canary %s\nroute * main shadow canary\n", addr1, DeadAddr(t))
+	if item, err := r.Get(ctx, []byte("key")); err != nil || string(item.Value) != "value" {
+		t.Errorf("Wrong value: %q %v\n", item.Value, err)
+	}
+}
+
+func TestRouterServed(t *testing.T) {
+	addr, c := StartBackend(t)
+	r := NewTestRouter(t, "pool main %s\nroute * main\n", addr)
+	handler, err := server.NewConnectionHandler(r, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	go handler.Run()
+	defer handler.Close()
+
+	conn, err := net.Dial("tcp", handler.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to the router: %s\n", err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "set key 5 0 5\r\nvalue\r\nget key\r\n")
+	for _, expected := range []string{"STORED\r\n", "VALUE key 5 5\r\n", "value\r\n", "END\r\n"} {
+		if line, err := rd.ReadString('\n'); err != nil || line != expected {
+			t.Errorf("Expected %q but got %q (%v)\n", expected, line, err)
+		}
+	}
+	CheckKey(t, c, "key", "value")
+}
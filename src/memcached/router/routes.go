@@ -0,0 +1,127 @@
+package router
+
+// Route files, configuring the pools of backends and the routes of keys to
+// them. Pools are declared before the routes using them, a line each:
+//
+//   # pool name [replicated] address...
+//   pool main 10.0.0.1:11211 10.0.0.2:11211 10.0.0.3:11211
+//   pool sessions replicated 10.0.1.1:11211 10.0.1.2:11211
+//   pool backup 10.0.2.1:11211
+//   pool canary 10.0.3.1:11211
+//
+//   # route prefix|* pool [failover pool...] [shadow pool...]
+//   route sess: sessions failover backup
+//   route * main failover backup shadow canary
+//
+// Keys take the route with the longest prefix they start with, * matching
+// every key.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PoolConfig is the configuration of a pool of backends.
+type PoolConfig struct {
+	Name       string
+	Replicated bool
+	Addrs      []string
+}
+
+// RouteConfig is the configuration of a route.
+type RouteConfig struct {
+	Prefix  string   // "" for every key
+	Pools   []string // the pool routed to, then those failed over to in turn
+	Shadows []string
+}
+
+// Config is the configuration of a router.
+type Config struct {
+	Pools  []PoolConfig
+	Routes []RouteConfig
+}
+
+// LoadRoutes reads the route file at path.
+func LoadRoutes(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	return ParseRoutes(f)
+}
+
+// ParseRoutes parses a route file.
+func ParseRoutes(r io.Reader) (Config, error) {
+	var config Config
+	pools, prefixes := make(map[string]bool), make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "pool":
+			pool := PoolConfig{}
+			if len(fields) > 2 {
+				pool.Name, pool.Addrs = fields[1], fields[2:]
+			}
+			if len(pool.Addrs) > 0 && pool.Addrs[0] == "replicated" {
+				pool.Replicated, pool.Addrs = true, pool.Addrs[1:]
+			}
+			if len(pool.Addrs) == 0 {
+				return Config{}, fmt.Errorf("line %d: expected pool name, optional replicated and addresses", n)
+			}
+			if pools[pool.Name] {
+				return Config{}, fmt.Errorf("line %d: pool %s already declared", n, pool.Name)
+			}
+			pools[pool.Name] = true
+			config.Pools = append(config.Pools, pool)
+
+		case "route":
+			if len(fields) < 3 {
+				return Config{}, fmt.Errorf("line %d: expected route prefix, pool and optional failover and shadow pools", n)
+			}
+			route := RouteConfig{Prefix: fields[1], Pools: []string{fields[2]}}
+			if route.Prefix == "*" {
+				route.Prefix = ""
+			}
+			if prefixes[route.Prefix] {
+				return Config{}, fmt.Errorf("line %d: route %s already declared", n, fields[1])
+			}
+			prefixes[route.Prefix] = true
+			if !pools[fields[2]] {
+				return Config{}, fmt.Errorf("line %d: unknown pool %q", n, fields[2])
+			}
+			var list *[]string
+			for _, field := range fields[3:] {
+				switch {
+				case field == "failover":
+					list = &route.Pools
+				case field == "shadow":
+					list = &route.Shadows
+				case list == nil:
+					return Config{}, fmt.Errorf("line %d: expected failover or shadow before pool %s", n, field)
+				case !pools[field]:
+					return Config{}, fmt.Errorf("line %d: unknown pool %q", n, field)
+				default:
+					*list = append(*list, field)
+				}
+			}
+			config.Routes = append(config.Routes, route)
+
+		default:
+			return Config{}, fmt.Errorf("line %d: expected pool or route, not %q", n, fields[0])
+		}
+	}
+	return config, scanner.Err()
+}
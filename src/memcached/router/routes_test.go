@@ -0,0 +1,76 @@
+package router
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	config, err := ParseRoutes(strings.NewReader(`
+# pools
+pool main 10.0.0.1:11211 10.0.0.2:11211
+pool sessions replicated 10.0.1.1:11211 10.0.1.2:11211
+pool backup 10.0.2.1:11211  # spare
+pool canary 10.0.3.1:11211
+
+route sess: sessions failover backup
+route * main failover backup shadow canary sessions
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse routes: %v\n", err)
+	}
+	expected := Config{
+		Pools: []PoolConfig{
+			{"main", false, []string{"10.0.0.1:11211", "10.0.0.2:11211"}},
+			{"sessions", true, []string{"10.0.1.1:11211", "10.0.1.2:11211"}},
+			{"backup", false, []string{"10.0.2.1:11211"}},
+			{"canary", false, []string{"10.0.3.1:11211"}},
+		},
+		Routes: []RouteConfig{
+			{"sess:", []string{"sessions", "backup"}, nil},
+			{"", []string{"main", "backup"}, []string{"canary", "sessions"}},
+		},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v but was %+v\n", expected, config)
+	}
+
+	r, err := New(config)
+	if err != nil {
+		t.Fatalf("Couldn't create router: %v\n", err)
+	}
+	if r.routes[0].prefix != "sess:" || r.routes[1].prefix != "" || len(r.routes[1].shadows) != 2 {
+		t.Errorf("Wrong routes: %+v %+v\n", r.routes[0], r.routes[1])
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, routes := range []string{
+		"pool main",
+		"pool main replicated",
+		"pool main a:1\npool main b:1",
+		"route * main",
+		"pool main a:1\nroute *",
+		"pool main a:1\nroute * main\nroute * main",
+		"pool main a:1\nroute * main backup",
+		"pool main a:1\nroute * main failover backup",
+		"pool main a:1\nroute * main shadow main backup",
+		"pool main a:1\nrouting * main",
+	} {
+		if _, err := ParseRoutes(strings.NewReader(routes)); err == nil {
+			t.Errorf("Invalid routes parsed: %q\n", routes)
+		}
+	}
+
+	for _, config := range []Config{
+		{Pools: []PoolConfig{{Name: "main"}}},
+		{Pools: []PoolConfig{{"main", false, []string{"a:1"}}, {"main", false, []string{"b:1"}}}},
+		{Routes: []RouteConfig{{Prefix: "a:", Pools: []string{"main"}}}},
+		{Pools: []PoolConfig{{"main", false, []string{"a:1"}}}, Routes: []RouteConfig{{Prefix: "a:"}}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("Invalid config accepted: %+v\n", config)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package server
+
+// HTTP admin endpoint, serving Prometheus metrics, a JSON status summary and
+// the standard Go pprof and expvar handlers:
+//
+//   /metrics       -- Prometheus text format metrics.
+//   /status        -- JSON object of the general statistics (as CMD_STAT).
+//   /metadump      -- metadata of every item (as "lru_crawler metadump all").
+//   /hotkeys       -- JSON object of the hottest keys for reads and writes.
+//   /slowlog       -- the latest slow requests (as the slowlog command).
+//   /mode          -- JSON object of the maintenance modes, which a POST with
+//                     read_only or drain set to on or off switches first,
+//                     e.g., POST /mode?read_only=on.
+//   /watch         -- live stream of events (as the watch command), taking
+//                     the arguments of the command as query parameters, e.g.,
+//                     /watch?kinds=fetchers,mutations&prefix=user:&sample=10.
+//   /debug/pprof/  -- Go runtime profiling.
+//   /debug/vars    -- expvar, including the general statistics.
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// AdminServer serves the HTTP admin endpoint for a ConnectionHandler.
+type AdminServer struct {
+	handler  *ConnectionHandler
+	listener net.Listener
+	server   *http.Server
+}
+
+// expvarOnce guards publishing our statistics to expvar, which is global to the
+// process.
+var expvarOnce sync.Once
+
+// NewAdminServer creates a new AdminServer listening on the specified address.
+func NewAdminServer(handler *ConnectionHandler, addr string) (*AdminServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	DefaultLogger.Info("admin listening", "addr", l.Addr())
+
+	as := &AdminServer{handler: handler, listener: l}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", as.serveMetrics)
+	mux.HandleFunc("/status", as.serveStatus)
+	mux.HandleFunc("/metadump", as.serveMetadump)
+	mux.HandleFunc("/hotkeys", as.serveHotKeys)
+	mux.HandleFunc("/slowlog", as.serveSlowLog)
+	mux.HandleFunc("/watch", as.serveWatch)
+	mux.HandleFunc("/mode", as.serveMode)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	as.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	expvarOnce.Do(func() {
+		expvar.Publish("memcached", expvar.Func(func() interface{} {
+			return statsMap(handler.generalStats())
+		}))
+	})
+	return as, nil
+}
+
+// Addr returns the address the AdminServer is listening on.
+func (as *AdminServer) Addr() net.Addr {
+	return as.listener.Addr()
+}
+
+// Run serves HTTP requests until the AdminServer is closed.
+func (as *AdminServer) Run() {
+	err := as.server.Serve(as.listener)
+	if err != nil && err != http.ErrServerClosed {
+		DefaultLogger.Error("admin server failed", "err", err)
+	}
+}
+
+// Close stops the AdminServer.
+func (as *AdminServer) Close() error {
+	return as.server.Close()
+}
+
+// serveStatus serves the general statistics as a JSON object.
+func (as *AdminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(statsMap(as.handler.generalStats()))
+}
+
+// serveHotKeys serves the hottest keys for reads and writes as a JSON object.
+func (as *AdminServer) serveHotKeys(w http.ResponseWriter, r *http.Request) {
+	hk := as.handler.hotKeys
+	if hk == nil {
+		http.Error(w, "hot key tracking disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	visible := as.handler.keyFilter(nil)
+	enc.Encode(map[string][]KeyRate{
+		"reads":  hk.reads.VisibleTop(visible),
+		"writes": hk.writes.VisibleTop(visible),
+	})
+}
+
+// serveSlowLog serves the latest slow requests, one line per request, the
+// number of which may be limited with the count query parameter.
+func (as *AdminServer) serveSlowLog(w http.ResponseWriter, r *http.Request) {
+	count := math.MaxInt32
+	if s := r.FormValue("count"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 31)
+		if err != nil {
+			http.Error(w, "bad count", http.StatusBadRequest)
+			return
+		}
+		count = int(n)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	for _, req := range as.handler.slowLog.Requests(count, as.handler.keyFilter(nil)) {
+		buf = append(appendSlowRequest(buf[:0], &req), '\n')
+		bw.Write(buf)
+	}
+	bw.Flush()
+}
+
+// serveMode serves the maintenance modes as a JSON object, switching them
+// first on a POST.
+func (as *AdminServer) serveMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		// every switch is checked before any is made
+		modes := map[string]func(bool){
+			"read_only": as.handler.SetReadOnly,
+			"drain":     as.handler.SetDraining,
+		}
+		switches := make(map[string]bool)
+		for name := range modes {
+			if v := r.FormValue(name); v != "" {
+				on, ok := parseOnOff(v)
+				if !ok {
+					http.Error(w, fmt.Sprintf("invalid %s: %q", name, v), http.StatusBadRequest)
+					return
+				}
+				switches[name] = on
+			}
+		}
+		for name, on := range switches {
+			modes[name](on)
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]bool{
+		"read_only": as.handler.ReadOnly(),
+		"draining":  as.handler.Draining(),
+	})
+}
+
+// serveWatch streams events until the request is cancelled.
+func (as *AdminServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	var args []string
+	q := r.URL.Query()
+	if kinds := q.Get("kinds"); kinds != "" {
+		args = strings.Split(kinds, ",")
+	}
+	if prefix := q.Get("prefix"); prefix != "" {
+		args = append(args, "prefix="+prefix)
+	}
+	if sample := q.Get("sample"); sample != "" {
+		args = append(args, "sample="+sample)
+	}
+	kinds, prefix, sample, err := ParseWatchArgs(args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	watchers := as.handler.watchers
+	watch := watchers.Subscribe(kinds, prefix, sample, as.handler.keyFilter(nil))
+	defer watchers.Unsubscribe(watch)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	watch.Stream(bufio.NewWriter(flushWriter{w}), r.Context().Done())
+}
+
+// flushWriter flushes an HTTP response after every write, so streamed
+// responses reach the client promptly.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// serveMetadump streams the metadata of every item in the cache, one line per
+// item.
+func (as *AdminServer) serveMetadump(w http.ResponseWriter, r *http.Request) {
+	if as.handler.crawler == nil {
+		http.Error(w, "lru crawler not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	visible := as.handler.keyFilter(nil)
+	as.handler.crawler.Crawl(func(batch []cache.ItemMeta) error {
+		for i := range batch {
+			if visible != nil && !visible(batch[i].Key) {
+				continue
+			}
+			buf = appendMetadump(buf[:0], &batch[i])
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	bw.Flush()
+}
+
+// serveMetrics serves metrics in the Prometheus text exposition format.
+func (as *AdminServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	as.handler.WriteMetrics(bw)
+	bw.Flush()
+}
+
+// WriteMetrics writes out all server metrics in the Prometheus text exposition
+// format.
+func (cnh *ConnectionHandler) WriteMetrics(w io.Writer) {
+	m := cnh.metrics
+
+	writeMetricHeader(w, "memcached_commands_total", "counter",
+		"Requests processed by command and response status.")
+	m.Each(func(cmd protocol.Command, status protocol.Status, n uint64) {
+		name := status.String()
+		if status == protocol.Status(0xffff) {
+			name = "other"
+		}
+		fmt.Fprintf(w, "memcached_commands_total{command=%q,status=%q} %d\n", cmd, name, n)
+	})
+
+	writeMetric(w, "memcached_get_hits_total", "counter",
+		"Get requests that found the key.", m.Count(protocol.CMD_GET, protocol.STATUS_OK))
+	writeMetric(w, "memcached_get_misses_total", "counter",
+		"Get requests that didn't find the key.", m.Count(protocol.CMD_GET, protocol.STATUS_KEY_NOT_FOUND))
+
+	if cnh.cache != nil {
+		cnh.writeCacheMetrics(w)
+	}
+
+	writeMetric(w, "memcached_current_connections", "gauge",
+		"Clients currently connected.", cnh.CurrClients())
+	writeMetric(w, "memcached_connections_total", "counter",
+		"Clients that have ever connected.", cnh.TotalClients())
+	writeMetric(w, "memcached_throttled_total", "counter",
+		"Requests refused for exceeding a rate limit.", atomic.LoadUint64(&cnh.throttled))
+	writeMetric(w, "memcached_read_only", "gauge",
+		"Whether mutations are refused (1) or not (0).", boolInt32(cnh.ReadOnly()))
+	writeMetric(w, "memcached_draining", "gauge",
+		"Whether new connections are refused (1) or not (0).", boolInt32(cnh.Draining()))
+	writeMetric(w, "memcached_uptime_seconds", "gauge",
+		"Time since the server started.", int64(time.Since(cnh.started).Seconds()))
+
+	writeMetricHeader(w, "memcached_command_duration_seconds", "histogram",
+		"Request latency by command.")
+	for cmd := 0; cmd < 256; cmd++ {
+		h := m.Latency(protocol.Command(cmd))
+		count := h.Count()
+		if count == 0 {
+			continue
+		}
+		name := protocol.Command(cmd).String()
+		for i, n := range h.Cumulative() {
+			le := strconv.FormatFloat(LATENCY_BUCKETS[i].Seconds(), 'g', -1, 64)
+			fmt.Fprintf(w, "memcached_command_duration_seconds_bucket{command=%q,le=%q} %d\n",
+				name, le, n)
+		}
+		fmt.Fprintf(w, "memcached_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n",
+			name, count)
+		fmt.Fprintf(w, "memcached_command_duration_seconds_sum{command=%q} %g\n",
+			name, h.Sum().Seconds())
+		fmt.Fprintf(w, "memcached_command_duration_seconds_count{command=%q} %d\n",
+			name, count)
+	}
+
+	writeMetricHeader(w, "memcached_command_phase_seconds", "summary",
+		"Request latency by command and phase of serving it.")
+	cnh.latency.Each(func(cmd protocol.Command, cl *CommandLatency) {
+		for p := range N_PHASES {
+			h := cl.Phase(p)
+			for _, q := range LATENCY_QUANTILES {
+				fmt.Fprintf(w, "memcached_command_phase_seconds{command=%q,phase=%q,quantile=\"%g\"} %g\n",
+					cmd, p, q.Quantile, h.Quantile(q.Quantile).Seconds())
+			}
+			fmt.Fprintf(w, "memcached_command_phase_seconds_sum{command=%q,phase=%q} %g\n",
+				cmd, p, h.Sum().Seconds())
+			fmt.Fprintf(w, "memcached_command_phase_seconds_count{command=%q,phase=%q} %d\n",
+				cmd, p, h.Count())
+		}
+	})
+	writeMetric(w, "memcached_slow_requests_total", "counter",
+		"Requests logged as slow.", cnh.slowLog.Logged())
+}
+
+// writeCacheMetrics writes out the metrics of the cache, if the storage is one.
+func (cnh *ConnectionHandler) writeCacheMetrics(w io.Writer) {
+	cs := cnh.cache.Stats()
+	writeMetric(w, "memcached_items", "gauge", "Items currently stored.", cs.Items)
+	writeMetric(w, "memcached_bytes", "gauge", "Bytes currently stored.", cs.Bytes)
+	writeMetric(w, "memcached_overhead_bytes", "gauge",
+		"Bytes stored that are per-item overhead rather than payload.", cs.OverheadBytes)
+	writeMetric(w, "memcached_limit_bytes", "gauge", "Storage limit in bytes.", cs.MaxBytes)
+	writeMetric(w, "memcached_evictions_total", "counter",
+		"Items evicted to stay within the storage limit.", cs.Evictions)
+	writeMetricHeader(w, "memcached_removed_items_total", "counter",
+		"Items removed from the cache by reason.")
+	for reason, n := range cs.Removals {
+		fmt.Fprintf(w, "memcached_removed_items_total{reason=%q} %d\n", cache.Reason(reason), n)
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines for a metric.
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetric writes a single unlabelled metric.
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	writeMetricHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+// statsMap converts a list of statistics to a map, for JSON encoding.
+func statsMap(stats []Stat) map[string]string {
+	m := make(map[string]string, len(stats))
+	for _, stat := range stats {
+		m[stat.Name] = stat.Value
+	}
+	return m
+}
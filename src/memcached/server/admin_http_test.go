@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"memcached/cache"
+)
+
+func StartTestAdmin(t *testing.T, handler *ConnectionHandler) string {
+	admin, err := NewAdminServer(handler, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start admin server: %s\n", err)
+	}
+	go admin.Run()
+	t.Cleanup(func() { admin.Close() })
+	return "http://" + admin.Addr().String()
+}
+
+func HttpGet(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Couldn't GET %s: %s\n", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Couldn't GET %s: %d %s\n", url, resp.StatusCode, err)
+	}
+	return string(body)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	base := StartTestAdmin(t, server)
+	tc := DialTestClient(t, server.Addr())
+	tc.Set("key", "value", 0, 0)
+	tc.Get("key")
+	tc.Get("key")
+	tc.Get("missing")
+
+	metrics := HttpGet(t, base+"/metrics")
+	for _, line := range []string{
+		`memcached_commands_total{command="get",status="ok"} 2`,
+		`memcached_commands_total{command="get",status="key_not_found"} 1`,
+		`memcached_commands_total{command="set",status="ok"} 1`,
+		`memcached_get_hits_total 2`,
+		`memcached_get_misses_total 1`,
+		`memcached_items 1`,
+		`memcached_removed_items_total{reason="evicted"} 0`,
+		`memcached_current_connections 1`,
+		`memcached_command_duration_seconds_bucket{command="get",le="+Inf"} 3`,
+		`memcached_command_duration_seconds_count{command="set"} 1`,
+		`# TYPE memcached_command_duration_seconds histogram`,
+		`memcached_command_phase_seconds_count{command="set",phase="total"} 1`,
+		`memcached_command_phase_seconds_count{command="set",phase="lock"} 1`,
+		`# TYPE memcached_command_phase_seconds summary`,
+		`# TYPE memcached_slow_requests_total counter`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("Metrics missing %q\n", line)
+		}
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	base := StartTestAdmin(t, server)
+	DialTestClient(t, server.Addr()).Set("key", "value", 0, 0)
+
+	var status map[string]string
+	if err := json.Unmarshal([]byte(HttpGet(t, base+"/status")), &status); err != nil {
+		t.Fatalf("Invalid status JSON: %s\n", err)
+	}
+	if status["curr_items"] != "1" || status["limit_maxbytes"] != "100000" {
+		t.Errorf("Wrong status: %v\n", status)
+	}
+
+	HttpGet(t, base+"/debug/pprof/")
+	if !strings.Contains(HttpGet(t, base+"/debug/vars"), `"memcached"`) {
+		t.Error("expvar missing memcached statistics\n")
+	}
+}
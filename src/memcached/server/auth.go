@@ -0,0 +1,153 @@
+package server
+
+// Users that clients may authenticate as (with SASL PLAIN over the binary
+// protocol), each with their own rate limits. Users are read from a file with a
+// line per user:
+//
+//   # user password [ops/sec] [bytes/sec]
+//   alice s3cret 1000 1048576
+//   bob hunter2
+//
+// Rate limits of 0 (or left out) are unlimited.
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+)
+
+// User is a user that clients may authenticate as.
+type User struct {
+	name     string
+	password string
+	limits   *Limits       // shared by all the user's clients, nil if unlimited
+	tenant   *cache.Tenant // namespace of the user's keys, nil for none
+	conns    int64
+}
+
+// Users are the users that clients may authenticate as, by name.
+type Users map[string]*User
+
+// LoadUsers reads the users file at path.
+func LoadUsers(path string) (Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseUsers(f)
+}
+
+// ParseUsers parses a users file.
+func ParseUsers(r io.Reader) (Users, error) {
+	users := make(Users)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected user, password and optional limits", n)
+		}
+
+		var limits [2]float64
+		for i, field := range fields[2:] {
+			limit, err := strconv.ParseFloat(field, 64)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("line %d: invalid limit %q", n, field)
+			}
+			limits[i] = limit
+		}
+		if _, ok := users[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, fields[0])
+		}
+		users[fields[0]] = &User{
+			name:     fields[0],
+			password: fields[1],
+			limits:   NewLimits(Rate{limits[0], limits[1]}, time.Now()),
+		}
+	}
+	return users, scanner.Err()
+}
+
+// Authenticate returns the user with the name and password, or nil if there is
+// no such user.
+func (users Users) Authenticate(name, password string) *User {
+	user, ok := users[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(user.password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// parsePlain parses the response of a SASL PLAIN authentication, returning the
+// user name and password.
+func parsePlain(resp []byte) (string, string, bool) {
+	// authorization identity, authentication identity and password
+	parts := strings.Split(string(resp), "\x00")
+	if len(parts) != 3 || parts[1] == "" {
+		return "", "", false
+	}
+	// we don't support acting as another user
+	if parts[0] != "" && parts[0] != parts[1] {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// authenticated returns true if the client may make requests: it has
+// authenticated as a user, or authentication is disabled.
+func (client *ClientConn) authenticated() bool {
+	return client.handler.users == nil || client.user != nil
+}
+
+// setUser sets the user the client is authenticated as.
+func (client *ClientConn) setUser(user *User) {
+	if client.user != nil {
+		atomic.AddInt64(&client.user.conns, -1)
+	}
+	client.user = user
+	if user != nil {
+		atomic.AddInt64(&user.conns, 1)
+	}
+}
+
+// Stats returns the statistics of every user, ordered by name.
+func (users Users) Stats() []Stat {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stats []Stat
+	for _, name := range names {
+		user := users[name]
+		var rate Rate
+		if user.limits != nil {
+			rate = user.limits.rate
+		}
+		prefix := "user_" + name + "_"
+		stats = append(stats,
+			Stat{prefix + "connections", fmt.Sprint(atomic.LoadInt64(&user.conns))},
+			Stat{prefix + "ops_limit", fmt.Sprint(rate.Ops)},
+			Stat{prefix + "bytes_limit", fmt.Sprint(rate.Bytes)},
+			Stat{prefix + "throttled", fmt.Sprint(user.limits.Throttled())},
+		)
+	}
+	return stats
+}
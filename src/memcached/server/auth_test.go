@@ -0,0 +1,94 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestParseUsers(t *testing.T) {
+	users, err := ParseUsers(strings.NewReader(`
+# user password [ops/sec] [bytes/sec]
+alice s3cret 1000 1048576 # comment
+bob hunter2
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse users: %s\n", err)
+	}
+	if len(users) != 2 || users["alice"].limits.rate != (Rate{1000, 1048576}) ||
+		users["bob"].limits != nil {
+		t.Errorf("Wrong users: %v\n", users)
+	}
+	if users.Authenticate("alice", "s3cret") != users["alice"] ||
+		users.Authenticate("alice", "hunter2") != nil || users.Authenticate("carol", "") != nil {
+		t.Errorf("Wrong authentication\n")
+	}
+
+	for _, bad := range []string{"alice", "alice pw 1 2 3", "alice pw x", "alice pw -1", "a b\na c"} {
+		if _, err := ParseUsers(strings.NewReader(bad)); err == nil {
+			t.Errorf("Invalid users file parsed: %q\n", bad)
+		}
+	}
+}
+
+func TestParsePlain(t *testing.T) {
+	tests := []struct {
+		resp     string
+		user, pw string
+		ok       bool
+	}{
+		{"\x00alice\x00secret", "alice", "secret", true},
+		{"alice\x00alice\x00secret", "alice", "secret", true},
+		{"bob\x00alice\x00secret", "", "", false},
+		{"\x00\x00secret", "", "", false},
+		{"alice secret", "", "", false},
+	}
+	for _, test := range tests {
+		user, pw, ok := parsePlain([]byte(test.resp))
+		if user != test.user || pw != test.pw || ok != test.ok {
+			t.Errorf("Wrong parse of %q: %q %q %v\n", test.resp, user, pw, ok)
+		}
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	// authentication is unsupported without users
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc.Do(protocol.CMD_SASL_LIST_MECHS, nil, nil, nil, 0), protocol.STATUS_UNKNOWN_COMMAND)
+
+	users, _ := ParseUsers(strings.NewReader("alice secret"))
+	server = StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.users = users
+	})
+	tc = DialTestClient(t, server.Addr())
+	resp := tc.Do(protocol.CMD_SASL_LIST_MECHS, nil, nil, nil, 0)
+	if resp.Status != uint16(protocol.STATUS_OK) || string(resp.value) != "PLAIN" {
+		t.Errorf("Wrong mechanisms: %s %q\n", protocol.Status(resp.Status), resp.value)
+	}
+
+	// nothing else is served until the client has authenticated
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, tc.Set("key", "value", 0, 0), protocol.STATUS_AUTH_FAILED)
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("set key 0 0 5\r\nvalue\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("get key\r\n"), TEXT_DENIED)
+
+	CheckStatus(t, tc.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00alice\x00wrong"), 0), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, tc.Do(protocol.CMD_SASL_AUTH, nil, []byte("CRAM-MD5"), []byte("\x00alice\x00secret"), 0), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, tc.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00alice\x00secret"), 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	if stats := tc.Stats("users"); stats["user_alice_connections"] != "1" {
+		t.Errorf("Wrong user stats: %v\n", stats)
+	}
+	if stats := tc.Stats(""); stats["auth_errors"] != "2" {
+		t.Errorf("Wrong auth errors: %s\n", stats["auth_errors"])
+	}
+
+	tc.conn.Close()
+	Eventually(t, "user disconnected", func() bool {
+		return statsMap(users.Stats())["user_alice_connections"] == "0"
+	})
+}
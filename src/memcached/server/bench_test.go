@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// repeatReader reads the same data over and over, without allocating.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// NewBenchClient creates a client serving the requests over and over, with the
+// responses discarded.
+func NewBenchClient(c *cache.Cache, requests []byte) *ClientConn {
+	handler := &ConnectionHandler{
+		store:   c,
+		cache:   c,
+		metrics: &Metrics{},
+		latency: &Latencies{},
+		slowLog: NewSlowLog(0, 0), // the clients have no connection to log
+		logger:  NewLogger(ioutil.Discard, LOG_WARN),
+
+		maxItemSize: cache.MAX_VALUE_SIZE,
+	}
+	r := bufio.NewReader(&repeatReader{data: requests})
+	client := &ClientConn{
+		handler: handler,
+		store:   c,
+		bio:     bufio.NewReadWriter(r, bufio.NewWriter(ioutil.Discard)),
+		log:     handler.logger,
+	}
+	client.ctx = cache.WithLockTimer(ctx, &client.lockTimer)
+	return client
+}
+
+// EncodeRequest encodes a binary protocol request.
+func EncodeRequest(cmd protocol.Command, extras, key, value []byte) []byte {
+	var buf bytes.Buffer
+	req := protocol.NewResponse(cmd, 0, key, value, extras, 0, 0)
+	req.Magic = protocol.MSG_REQUEST
+	protocol.WriteResponse(&buf, &req, extras, key, value)
+	return buf.Bytes()
+}
+
+// ServeNext serves the client's next binary protocol request.
+func ServeNext(tb testing.TB, client *ClientConn, req *protocol.Header) {
+	if err := req.ReadRequestBuf(client.bio, client.hdr[:]); err != nil {
+		tb.Fatalf("Couldn't read request: %s\n", err)
+	}
+	if err := client.serve(req); err != nil {
+		tb.Fatalf("Couldn't serve request: %s\n", err)
+	}
+}
+
+// ServeNextText serves the client's next text protocol request.
+func ServeNextText(tb testing.TB, client *ClientConn) {
+	line, err := ReadTextLine(client.bio.Reader)
+	if err != nil {
+		tb.Fatalf("Couldn't read request: %s\n", err)
+	}
+	if err = client.serveText(line); err != nil {
+		tb.Fatalf("Couldn't serve request: %s\n", err)
+	}
+}
+
+// value is the value stored by requests.
+var value = []byte("value")
+
+// setExtras are the extras of a set request, with no flags or expiry.
+var setExtras = make([]byte, 8)
+
+func TestServeAllocs(t *testing.T) {
+	c := cache.New(1 << 20)
+	c.Set(ctx, []byte("key"), value, 0, 0, 0)
+	var req protocol.Header
+
+	tests := []struct {
+		name    string
+		request []byte
+		max     float64
+	}{
+		{"get hit", EncodeRequest(protocol.CMD_GET, nil, []byte("key"), nil), 0},
+		{"get miss", EncodeRequest(protocol.CMD_GET, nil, []byte("nokey"), nil), 0},
+		// a new item and its copy of the value, the key being shared
+		{"set", EncodeRequest(protocol.CMD_SET, setExtras, []byte("key"), value), 2},
+		{"set large", EncodeRequest(protocol.CMD_SET, setExtras, []byte("key"), make([]byte, 100000)), 2},
+	}
+	for _, test := range tests {
+		client := NewBenchClient(c, test.request)
+		allocs := testing.AllocsPerRun(1000, func() { ServeNext(t, client, &req) })
+		if allocs > test.max {
+			t.Errorf("Too many allocations for %s: %.1f > %.0f\n", test.name, allocs, test.max)
+		}
+	}
+
+	client := NewBenchClient(c, []byte("get key\r\n"))
+	if allocs := testing.AllocsPerRun(1000, func() { ServeNextText(t, client) }); allocs > 0 {
+		t.Errorf("Too many allocations for text get hit: %.1f\n", allocs)
+	}
+}
+
+func BenchmarkServeGetHit(b *testing.B) {
+	c := cache.New(1 << 20)
+	c.Set(ctx, []byte("key"), value, 0, 0, 0)
+	client := NewBenchClient(c, EncodeRequest(protocol.CMD_GET, nil, []byte("key"), nil))
+	var req protocol.Header
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ServeNext(b, client, &req)
+	}
+}
+
+func BenchmarkServeGetMiss(b *testing.B) {
+	client := NewBenchClient(cache.New(1<<20), EncodeRequest(protocol.CMD_GET, nil, []byte("key"), nil))
+	var req protocol.Header
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ServeNext(b, client, &req)
+	}
+}
+
+func BenchmarkServeSet(b *testing.B) {
+	for _, size := range []int{100, 10000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			request := EncodeRequest(protocol.CMD_SET, setExtras, []byte("key"), make([]byte, size))
+			client := NewBenchClient(cache.New(1<<20), request)
+			var req protocol.Header
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ServeNext(b, client, &req)
+			}
+		})
+	}
+}
+
+func BenchmarkServeTextGetHit(b *testing.B) {
+	c := cache.New(1 << 20)
+	c.Set(ctx, []byte("key"), value, 0, 0, 0)
+	client := NewBenchClient(c, []byte("get key\r\n"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ServeNextText(b, client)
+	}
+}
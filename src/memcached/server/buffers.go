@@ -0,0 +1,97 @@
+package server
+
+// Pooled buffers for request bodies, so serving a request doesn't allocate one.
+// Each connection keeps a small buffer of its own for typical requests, larger
+// bodies borrow a buffer from a pool of size classes (powers of two up to
+// MAX_VALUE_SIZE) for the duration of the request. The value of a set larger
+// than that is read into chunks, each a buffer from the pool.
+//
+// Buffers are never retained beyond a request: the cache keeps its own copy of
+// stored values.
+
+import (
+	"io"
+	"sync"
+
+	"memcached/cache"
+)
+
+// MIN_POOLED_BUFFER is the size of a connection's own buffer, and of the
+// smallest class of pooled buffers.
+const MIN_POOLED_BUFFER = 4 * 1024
+
+// N_BUFFER_CLASSES is the number of size classes of pooled buffers.
+const N_BUFFER_CLASSES = 9
+
+// bufferPools are the pooled buffers by size class, from MIN_POOLED_BUFFER to
+// MAX_VALUE_SIZE. Pointers to slices are pooled, as pooling the slices
+// themselves allocates.
+var bufferPools [N_BUFFER_CLASSES]sync.Pool
+
+// bufferClass returns the size class of a buffer holding n bytes, n being at
+// most MAX_VALUE_SIZE.
+func bufferClass(n int) int {
+	class := 0
+	for size := MIN_POOLED_BUFFER; size < n; size <<= 1 {
+		class++
+	}
+	return class
+}
+
+// GetBuffer returns a buffer of length n (at most MAX_VALUE_SIZE) from the
+// pool, which should be returned with PutBuffer once no longer used.
+func GetBuffer(n int) *[]byte {
+	class := bufferClass(n)
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n, MIN_POOLED_BUFFER<<uint(class))
+	return &buf
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer to the pool.
+func PutBuffer(buf *[]byte) {
+	bufferPools[bufferClass(cap(*buf))].Put(buf)
+}
+
+// buffer returns a buffer of length n for the current request, the client's own
+// if large enough or else one from the pool, which is returned by release.
+func (client *ClientConn) buffer(n int) []byte {
+	if n <= MIN_POOLED_BUFFER {
+		if client.buf == nil {
+			client.buf = make([]byte, MIN_POOLED_BUFFER)
+		}
+		return client.buf[:n]
+	}
+	client.pooled = GetBuffer(n)
+	return *client.pooled
+}
+
+// readChunks reads n bytes of the current request's body into chunks of at most
+// MAX_VALUE_SIZE, borrowed from the pool until release.
+func (client *ClientConn) readChunks(n int) error {
+	for n > 0 {
+		buf := GetBuffer(min(n, cache.MAX_VALUE_SIZE))
+		client.pooledRefs = append(client.pooledRefs, buf)
+		if _, err := io.ReadFull(client.bio, *buf); err != nil {
+			return err
+		}
+		client.chunks = append(client.chunks, *buf)
+		n -= len(*buf)
+	}
+	return nil
+}
+
+// release returns any buffers borrowed from the pool for the current request.
+func (client *ClientConn) release() {
+	if client.pooled != nil {
+		PutBuffer(client.pooled)
+		client.pooled = nil
+	}
+	for i, buf := range client.pooledRefs {
+		PutBuffer(buf)
+		client.pooledRefs[i] = nil
+	}
+	client.pooledRefs, client.chunks = client.pooledRefs[:0], nil
+}
@@ -0,0 +1,255 @@
+// Package server serves a storage.Storage (usually a cache.Cache) to memcache
+// clients over the network, in the binary and text protocols, along with the
+// admin HTTP endpoint, replication and the rest of the memcached server.
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// ConnectionHandler handles accepting new connections from clients and serving
+// their requests.
+type ConnectionHandler struct {
+	store        storage.Storage
+	cache        *cache.Cache    // the storage if it's a Cache, nil otherwise
+	tenants      []*cache.Tenant // of the cache, the default tenant first, nil if none are configured
+	open         map[string]bool // names of the tenants clients in no tenant may use too
+	leaser       storage.Leaser  // the storage if it supports leases, nil otherwise
+	chunker      storage.Chunker // the storage if it stores chunks, nil otherwise
+	tagger       storage.Tagger  // the storage if it tags items, nil otherwise
+	maxItemSize  int             // largest value set, at least cache.MAX_VALUE_SIZE
+	listener     *net.TCPListener
+	started      time.Time
+	totalClients uint64
+	currClients  int64
+	metrics      *Metrics
+	latency      *Latencies
+	slowLog      *SlowLog
+	logger       *Logger
+	crawler      *cache.Crawler     // nil if the storage isn't a Cache
+	reaper       *cache.Reaper      // nil if idle items aren't reaped
+	heapLimiter  *cache.HeapLimiter // nil if the heap isn't limited
+	wal          *cache.WriteLog    // nil if persistence is disabled
+	disk         *cache.DiskTier    // nil if evicted items aren't written to disk
+	hotKeys      *HotKeys           // nil if hot keys aren't tracked
+	watchers     *Watchers
+	users        Users // nil if authentication is disabled
+	clientRate   Rate  // limits of each connection
+	throttled    uint64
+	authFailures uint64
+	maintenance  Maintenance
+	extraStats   map[string]func() []Stat // groups of statistics served besides the server's
+	sweeps       chan struct{}            // a slot for the next sweep (see sweep)
+	sweepMu      sync.Mutex               // held while sweeping
+
+	// replication role of the server, at most one is set
+	leader   *ReplicationLeader
+	follower *ReplicationFollower
+}
+
+// Option configures a ConnectionHandler.
+type Option func(*ConnectionHandler)
+
+// WithLogger logs the messages of the server, and of its clients, to logger.
+func WithLogger(logger *Logger) Option {
+	return func(cnh *ConnectionHandler) { cnh.logger = logger }
+}
+
+// WithCrawler replaces the LRU crawler serving metadumps and crawls.
+func WithCrawler(crawler *cache.Crawler) Option {
+	return func(cnh *ConnectionHandler) { cnh.crawler = crawler }
+}
+
+// WithReaper reports the statistics of the idle item reaper.
+func WithReaper(reaper *cache.Reaper) Option {
+	return func(cnh *ConnectionHandler) { cnh.reaper = reaper }
+}
+
+// WithHeapLimiter reports the statistics of the heap limiter.
+func WithHeapLimiter(hl *cache.HeapLimiter) Option {
+	return func(cnh *ConnectionHandler) { cnh.heapLimiter = hl }
+}
+
+// WithDiskTier reports the statistics of the disk tier.
+func WithDiskTier(d *cache.DiskTier) Option {
+	return func(cnh *ConnectionHandler) { cnh.disk = d }
+}
+
+// WithWriteLog reports the statistics of the write log.
+func WithWriteLog(wl *cache.WriteLog) Option {
+	return func(cnh *ConnectionHandler) { cnh.wal = wl }
+}
+
+// WithHotKeys tracks the hottest keys requested.
+func WithHotKeys(hotKeys *HotKeys) Option {
+	return func(cnh *ConnectionHandler) { cnh.hotKeys = hotKeys }
+}
+
+// WithSlowLog logs slow requests to slowLog, rather than those slower than
+// SLOW_LOG_THRESHOLD to a log of SLOW_LOG_SIZE.
+func WithSlowLog(slowLog *SlowLog) Option {
+	return func(cnh *ConnectionHandler) { cnh.slowLog = slowLog }
+}
+
+// WithMaxItemSize accepts values set of up to maxItemSize bytes, rather than
+// cache.MAX_VALUE_SIZE. Larger values are read from clients into chunks.
+func WithMaxItemSize(maxItemSize int) Option {
+	return func(cnh *ConnectionHandler) { cnh.maxItemSize = max(maxItemSize, cache.MAX_VALUE_SIZE) }
+}
+
+// WithStats serves the statistics returned by stats as the group named.
+func WithStats(group string, stats func() []Stat) Option {
+	return func(cnh *ConnectionHandler) {
+		if cnh.extraStats == nil {
+			cnh.extraStats = make(map[string]func() []Stat)
+		}
+		cnh.extraStats[group] = stats
+	}
+}
+
+// WithUsers enables authentication as one of the users.
+func WithUsers(users Users) Option {
+	return func(cnh *ConnectionHandler) { cnh.users = users }
+}
+
+// WithOpenTenants lets clients in no tenant use the keys of the named tenants
+// as well as those of the default tenant, by including the tenant's prefix.
+func WithOpenTenants(names ...string) Option {
+	return func(cnh *ConnectionHandler) {
+		cnh.open = make(map[string]bool, len(names))
+		for _, name := range names {
+			cnh.open[name] = true
+		}
+	}
+}
+
+// WithClientRate limits the requests of each connection.
+func WithClientRate(rate Rate) Option {
+	return func(cnh *ConnectionHandler) { cnh.clientRate = rate }
+}
+
+// WithReplicationLeader makes the server a replication leader.
+func WithReplicationLeader(leader *ReplicationLeader) Option {
+	return func(cnh *ConnectionHandler) { cnh.leader = leader }
+}
+
+// WithReplicationFollower makes the server a (read-only) replication follower.
+func WithReplicationFollower(follower *ReplicationFollower) Option {
+	return func(cnh *ConnectionHandler) { cnh.follower = follower }
+}
+
+// NewConnectionHandler creates a new ConnectionHandler to accept incoming
+// memcache connections and run them against the specificed storage. The
+// statistics, crawls and eviction watches of a Cache are only served if the
+// storage is one.
+func NewConnectionHandler(store storage.Storage, addr *net.TCPAddr, opts ...Option) (*ConnectionHandler, error) {
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cnh := &ConnectionHandler{
+		store:    store,
+		listener: l,
+		started:  time.Now(),
+		metrics:  &Metrics{},
+		latency:  &Latencies{},
+		slowLog:  NewSlowLog(SLOW_LOG_THRESHOLD, SLOW_LOG_SIZE),
+		logger:   DefaultLogger,
+		watchers: NewWatchers(),
+		sweeps:   make(chan struct{}, 1),
+
+		maxItemSize: cache.MAX_VALUE_SIZE,
+
+		maintenance: Maintenance{status: protocol.STATUS_NOT_SUPPORTED},
+	}
+	if leaser, ok := store.(storage.Leaser); ok {
+		cnh.leaser = leaser
+	}
+	if chunker, ok := store.(storage.Chunker); ok {
+		cnh.chunker = chunker
+	}
+	if tagger, ok := store.(storage.Tagger); ok {
+		cnh.tagger = tagger
+	}
+	if c, ok := store.(*cache.Cache); ok {
+		cnh.cache = c
+		cnh.crawler = cache.NewCrawler(c, cache.CRAWL_RATE, true)
+	}
+	for _, opt := range opts {
+		opt(cnh)
+	}
+	if cnh.cache != nil {
+		cnh.cache.AddHook(cnh.watchers.Removed)
+		if tenants := cnh.cache.Tenants(); len(tenants) > 1 {
+			cnh.tenants = tenants
+		}
+	}
+	cnh.logger.Info("listening", "addr", l.Addr())
+	return cnh, nil
+}
+
+// Addr returns the address the ConnectionHandler is listening on.
+func (cnh *ConnectionHandler) Addr() net.Addr {
+	return cnh.listener.Addr()
+}
+
+// Run runs the ConnectionHandler, it only returns once closed.
+func (cnh *ConnectionHandler) Run() {
+	for {
+		conn, err := cnh.listener.AcceptTCP()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			cnh.logger.Error("accept failed", "err", err)
+			continue
+		}
+		if cnh.Draining() {
+			atomic.AddUint64(&cnh.maintenance.refusedConns, 1)
+			cnh.logger.Debug("refused connection while draining", "addr", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		cnh.runClient(conn)
+	}
+}
+
+// Close stops the ConnectionHandler accepting new connections.
+func (cnh *ConnectionHandler) Close() error {
+	return cnh.listener.Close()
+}
+
+// CurrClients returns the number of currently connected clients.
+func (cnh *ConnectionHandler) CurrClients() int64 {
+	return atomic.LoadInt64(&cnh.currClients)
+}
+
+// TotalClients returns the number of clients that have ever connected.
+func (cnh *ConnectionHandler) TotalClients() uint64 {
+	return atomic.LoadUint64(&cnh.totalClients)
+}
+
+// runClient manages a new client connection.
+func (cnh *ConnectionHandler) runClient(conn *net.TCPConn) {
+	id := atomic.AddUint64(&cnh.totalClients, 1) - 1
+	client := NewClientConn(uint(id), cnh, conn)
+	atomic.AddInt64(&cnh.currClients, 1)
+	go func() {
+		defer atomic.AddInt64(&cnh.currClients, -1)
+		client.Run()
+	}()
+}
+
+// isClosed returns true if the error is from using a closed network connection.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestDiskTierStats(t *testing.T) {
+	c := cache.New(20000)
+	tier, err := cache.NewDiskTier(c, t.TempDir(), cache.DISK_SEGMENTS*2*cache.MAX_VALUE_SIZE, cache.DISK_MIN_VALUE)
+	if err != nil {
+		t.Fatalf("Couldn't create disk tier: %v\n", err)
+	}
+	server := StartTestServerWith(t, c, func(handler *ConnectionHandler) {
+		handler.disk = tier
+	})
+	tc := DialTestClient(t, server.Addr())
+
+	// values evicted to disk are still served
+	for n := 0; n < 30; n++ {
+		CheckStatus(t, tc.Set(fmt.Sprintf("key%d", n), strings.Repeat("x", 1000), 0, 0), protocol.STATUS_OK)
+	}
+	resp := tc.Get("key0")
+	CheckStatus(t, resp, protocol.STATUS_OK)
+	if len(resp.value) != 1000 {
+		t.Errorf("Wrong value from disk: %d bytes\n", len(resp.value))
+	}
+	stats := tc.Stats("")
+	if stats["disk_hits"] != "1" || stats["disk_items"] == "0" || stats["evictions"] != "0" ||
+		stats["disk_segments"] != "1" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+// Hot key detection. The access frequency of every key is estimated with a
+// count-min sketch, which uses a fixed amount of memory however many keys there
+// are, and a small heap tracks the keys with the highest estimates. Counts are
+// kept per window (a second by default), the top keys of the last complete
+// window being reported along with their request rate.
+//
+// Keys are spread over shards by hash, each with its own sketch, heap and lock,
+// so that concurrent requests don't all wait on one lock. A key is only ever
+// counted by its shard, so the top keys are the hottest of every shard's.
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dimensions of the count-min sketch of each shard. With 4 rows of 128
+// counters in each of 16 shards, estimates exceed the true count by at most
+// 0.13% of the requests in a window, for 98% of keys.
+const (
+	SKETCH_DEPTH = 4
+	SKETCH_WIDTH = 128
+)
+
+// HOT_KEYS_SHARDS is the number of shards keys are spread over, so requests
+// for different keys rarely wait on each other.
+const HOT_KEYS_SHARDS = 16
+
+// HOT_KEYS_WINDOW is the default period over which key accesses are counted.
+const HOT_KEYS_WINDOW = time.Second
+
+// KeyRate is the request rate (per second) of a key.
+type KeyRate struct {
+	Key  string  `json:"key"`
+	Rate float64 `json:"rate"`
+}
+
+// HotKeys tracks the most frequently read and written keys.
+type HotKeys struct {
+	reads  *TopKeys
+	writes *TopKeys
+}
+
+// NewHotKeys creates a new HotKeys, tracking the k hottest keys for reads and
+// writes. Keys are logged when their rate crosses threshold requests per
+// second, unless threshold is 0.
+func NewHotKeys(k int, threshold float64) *HotKeys {
+	return &HotKeys{
+		reads:  NewTopKeys("read", k, HOT_KEYS_WINDOW, threshold),
+		writes: NewTopKeys("write", k, HOT_KEYS_WINDOW, threshold),
+	}
+}
+
+// Read records a read of the key. Safe to call on a nil HotKeys, which does
+// nothing.
+func (hk *HotKeys) Read(key []byte) {
+	if hk != nil {
+		hk.reads.Add(key)
+	}
+}
+
+// Write records a write of the key. Safe to call on a nil HotKeys, which does
+// nothing.
+func (hk *HotKeys) Write(key []byte) {
+	if hk != nil {
+		hk.writes.Add(key)
+	}
+}
+
+// Stats returns the hottest keys that visible allows (all of them if nil) as
+// statistics, named by operation and rank (e.g., hot_read_1) with values of the
+// key and its rate.
+func (hk *HotKeys) Stats(visible func(key string) bool) []Stat {
+	var stats []Stat
+	for _, t := range []*TopKeys{hk.reads, hk.writes} {
+		for i, kr := range t.VisibleTop(visible) {
+			stats = append(stats, Stat{
+				fmt.Sprintf("hot_%s_%d", t.op, i+1),
+				fmt.Sprintf("%s %.1f", kr.Key, kr.Rate),
+			})
+		}
+	}
+	return stats
+}
+
+// TopKeys tracks the keys with the most requests of one kind. Safe to use from
+// multiple Go routines.
+type TopKeys struct {
+	op        string
+	k         int
+	window    time.Duration
+	threshold float64
+	now       func() time.Time
+	start     time.Time // of the first window
+
+	shardSeed maphash.Seed
+	seeds     [SKETCH_DEPTH]maphash.Seed
+	shards    [HOT_KEYS_SHARDS]topShard
+}
+
+// topShard counts the requests for the keys hashed to it, tracking the k with
+// the most of them.
+type topShard struct {
+	sketch  [SKETCH_DEPTH][SKETCH_WIDTH]uint32
+	heap    keyHeap
+	index   map[string]*keyCount
+	alerted map[string]bool
+	window  int64     // number of the window being counted
+	last    []KeyRate // top keys of the window before, hottest first
+	sync.Mutex
+}
+
+// keyCount is the estimated requests for a key in the current window.
+type keyCount struct {
+	key   string
+	count uint32
+	pos   int // in the heap
+}
+
+// NewTopKeys creates a new TopKeys, tracking the k keys with the most requests
+// per window.
+func NewTopKeys(op string, k int, window time.Duration, threshold float64) *TopKeys {
+	t := &TopKeys{
+		op:        op,
+		k:         k,
+		window:    window,
+		threshold: threshold,
+		now:       time.Now,
+		shardSeed: maphash.MakeSeed(),
+	}
+	for i := range t.seeds {
+		t.seeds[i] = maphash.MakeSeed()
+	}
+	for i := range t.shards {
+		t.shards[i].index = make(map[string]*keyCount, k)
+		t.shards[i].alerted = make(map[string]bool)
+	}
+	t.start = t.now()
+	return t
+}
+
+// Add records a request for the key.
+func (t *TopKeys) Add(key []byte) {
+	s := &t.shards[maphash.Bytes(t.shardSeed, key)%HOT_KEYS_SHARDS]
+	s.Lock()
+	defer s.Unlock()
+	t.roll(s)
+
+	var est uint32
+	for i := range s.sketch {
+		c := &s.sketch[i][maphash.Bytes(t.seeds[i], key)%SKETCH_WIDTH]
+		*c++
+		if i == 0 || *c < est {
+			est = *c
+		}
+	}
+
+	if kc, ok := s.index[string(key)]; ok {
+		kc.count = est
+		heap.Fix(&s.heap, kc.pos)
+	} else if len(s.heap) < t.k {
+		kc := &keyCount{key: string(key), count: est}
+		heap.Push(&s.heap, kc)
+		s.index[kc.key] = kc
+	} else if t.k > 0 && est > s.heap[0].count {
+		kc := s.heap[0]
+		delete(s.index, kc.key)
+		kc.key, kc.count = string(key), est
+		s.index[kc.key] = kc
+		heap.Fix(&s.heap, 0)
+	}
+
+	if t.threshold > 0 && float64(est) >= t.threshold*t.window.Seconds() &&
+		!s.alerted[string(key)] {
+		s.alerted[string(key)] = true
+		DefaultLogger.Warn("hot key", "op", t.op, "key", key,
+			"rate", t.threshold, "window", t.window)
+	}
+}
+
+// Top returns the keys with the most requests in the last complete window,
+// hottest first.
+func (t *TopKeys) Top() []KeyRate {
+	var top []KeyRate
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		t.roll(s)
+		top = append(top, s.last...)
+		s.Unlock()
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].Rate > top[j].Rate })
+	return top[:min(len(top), t.k)]
+}
+
+// VisibleTop returns the keys of Top that visible allows (all of them if nil).
+func (t *TopKeys) VisibleTop(visible func(key string) bool) []KeyRate {
+	top := t.Top()
+	if visible != nil {
+		top = slices.DeleteFunc(top, func(kr KeyRate) bool { return !visible(kr.Key) })
+	}
+	return top
+}
+
+// roll starts counting the current window in the shard if it's counting an
+// earlier one, saving its top keys if that was the window just before.
+//
+// The caller of this method should hold the lock on the shard.
+func (t *TopKeys) roll(s *topShard) {
+	window := int64(t.now().Sub(t.start) / t.window)
+	if window == s.window {
+		return
+	}
+
+	// if nothing was requested for a whole window, there are no top keys
+	s.last = s.last[:0]
+	if window == s.window+1 {
+		for _, kc := range s.heap {
+			s.last = append(s.last, KeyRate{kc.key, float64(kc.count) / t.window.Seconds()})
+		}
+		sort.Slice(s.last, func(i, j int) bool { return s.last[i].Rate > s.last[j].Rate })
+	}
+
+	s.sketch = [SKETCH_DEPTH][SKETCH_WIDTH]uint32{}
+	s.heap = s.heap[:0]
+	s.index = make(map[string]*keyCount, t.k)
+	if len(s.alerted) > 0 {
+		s.alerted = make(map[string]bool)
+	}
+	s.window = window
+}
+
+// keyHeap is a min-heap of key counts, so the coldest of the top keys is first.
+type keyHeap []*keyCount
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h keyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *keyHeap) Push(x interface{}) {
+	kc := x.(*keyCount)
+	kc.pos = len(*h)
+	*h = append(*h, kc)
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	kc := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return kc
+}
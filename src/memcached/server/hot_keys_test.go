@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"memcached/cache"
+)
+
+func TestTopKeys(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tk := NewTopKeys("read", 3, time.Second, 0)
+	tk.now = func() time.Time { return now }
+	tk.start = now
+
+	// a long tail of cold keys and a few hot ones
+	for i := 0; i < 10000; i++ {
+		tk.Add([]byte(fmt.Sprintf("cold%d", i)))
+		if i%10 == 0 {
+			tk.Add([]byte("hot1"))
+		}
+		if i%20 == 0 {
+			tk.Add([]byte("hot2"))
+		}
+		if i%50 == 0 {
+			tk.Add([]byte("hot3"))
+		}
+	}
+	if top := tk.Top(); len(top) != 0 {
+		t.Errorf("Top keys reported before window ended: %v\n", top)
+	}
+
+	now = now.Add(time.Second)
+	top := tk.Top()
+	if len(top) != 3 || top[0].Key != "hot1" || top[1].Key != "hot2" || top[2].Key != "hot3" {
+		t.Fatalf("Wrong top keys: %v\n", top)
+	}
+	// estimates only ever overcount, by a little
+	if top[0].Rate < 1000 || top[0].Rate > 1050 || top[2].Rate < 200 || top[2].Rate > 250 {
+		t.Errorf("Wrong rates: %v\n", top)
+	}
+
+	// the next window starts afresh
+	tk.Add([]byte("other"))
+	now = now.Add(time.Second)
+	if top := tk.Top(); len(top) != 1 || top[0] != (KeyRate{"other", 1}) {
+		t.Errorf("Wrong top keys in next window: %v\n", top)
+	}
+
+	// and nothing in the last window means no top keys
+	tk.Add([]byte("other"))
+	now = now.Add(3 * time.Second)
+	if top := tk.Top(); len(top) != 0 {
+		t.Errorf("Top keys reported for idle window: %v\n", top)
+	}
+}
+
+func TestTopKeysConcurrent(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tk := NewTopKeys("read", 2, time.Second, 0)
+	tk.now = func() time.Time { return now }
+	tk.start = now
+
+	// keys counted concurrently (in their own shards or not) are all counted
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tk.Add([]byte("hot"))
+				tk.Add([]byte(fmt.Sprintf("cold%d-%d", g, i)))
+				if i%2 == 0 {
+					tk.Add([]byte("warm"))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	now = now.Add(time.Second)
+	top := tk.Top()
+	if len(top) != 2 || top[0].Key != "hot" || top[0].Rate < 8000 || top[1].Key != "warm" || top[1].Rate < 4000 {
+		t.Errorf("Wrong top keys: %v\n", top)
+	}
+}
+
+func TestTopKeysThreshold(t *testing.T) {
+	logger, buf := NewTestLogger(LOG_WARN)
+	defer func(l *Logger) { DefaultLogger = l }(DefaultLogger)
+	DefaultLogger = logger
+
+	tk := NewTopKeys("write", 3, time.Hour, 100.0/3600)
+	for i := 0; i < 200; i++ {
+		tk.Add([]byte("hot"))
+		tk.Add([]byte(fmt.Sprint(i)))
+	}
+	if strings.Count(buf.String(), "msg=\"hot key\"") != 1 ||
+		!strings.Contains(buf.String(), "op=write key=hot") {
+		t.Errorf("Hot key not logged once:\n%s", buf.String())
+	}
+}
+
+func TestClientHotKeys(t *testing.T) {
+	hk := NewHotKeys(2, 0)
+	now := time.Now()
+	for _, tk := range []*TopKeys{hk.reads, hk.writes} {
+		tk.now = func() time.Time { return now }
+		tk.start = now
+	}
+	server := StartTestServerWith(t, cache.New(100000), func(cnh *ConnectionHandler) {
+		cnh.hotKeys = hk
+	})
+	tc := DialTestClient(t, server.Addr())
+	text := DialTextClient(t, server.Addr())
+
+	tc.Set("key1", "value", 0, 0)
+	text.Do("set key2 0 0 1\r\na\r\n")
+	text.Do("set key2 0 0 1\r\na\r\n")
+	for i := 0; i < 3; i++ {
+		tc.Get("key1")
+		text.Do("get key2 key1\r\n")
+	}
+	now = now.Add(time.Second)
+
+	stats := tc.Stats("hotkeys")
+	if stats["hot_read_1"] != "key1 6.0" || stats["hot_read_2"] != "key2 3.0" ||
+		stats["hot_write_1"] != "key2 2.0" || stats["hot_write_2"] != "key1 1.0" {
+		t.Errorf("Wrong hot key stats: %v\n", stats)
+	}
+
+	base := StartTestAdmin(t, server)
+	var hot map[string][]KeyRate
+	if err := json.Unmarshal([]byte(HttpGet(t, base+"/hotkeys")), &hot); err != nil {
+		t.Fatalf("Couldn't decode hot keys: %s\n", err)
+	}
+	if len(hot["reads"]) != 2 || hot["reads"][0] != (KeyRate{"key1", 6}) {
+		t.Errorf("Wrong hot keys: %v\n", hot)
+	}
+}
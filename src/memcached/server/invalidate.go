@@ -0,0 +1,157 @@
+package server
+
+// Bulk invalidation (see cache/invalidate.go), served by extensions of the
+// binary protocol: a prefix flush (CMD_FLUSH_PREFIX) removes every key starting
+// with the request's key, and a tag invalidation (CMD_INVALIDATE_TAG) every item
+// set with the request's key as one of its tags, given in the extras of the set
+// after its flags and expiration (see protocol.TAGS_OFFSET). In the text
+// protocol:
+//
+//   set <key> <flags> <exptime> <bytes> [tags=<tag>,<tag>...] [noreply]
+//   flush_prefix <prefix> [noreply]
+//   invalidate_tag <tag> [noreply]
+//
+// The prefixes and tags of a tenant's clients are in the tenant's namespace, as
+// their keys are. The items invalidated are removed lazily, so every
+// invalidation is followed by a background sweep of the cache.
+
+import (
+	"bytes"
+
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// handleFlushPrefix handles the prefix flush command.
+func (client *ClientConn) handleFlushPrefix(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("flush_prefix", key)
+
+	if len(extras) != 0 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	err := client.flushPrefix(client.key(key))
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleInvalidateTag handles the tag invalidation command.
+func (client *ClientConn) handleInvalidateTag(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("invalidate_tag", key)
+
+	if len(extras) != 0 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	err := client.invalidateTag(client.key(key))
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// flushPrefix removes every key starting with the prefix.
+func (client *ClientConn) flushPrefix(prefix []byte) error {
+	if err := client.store.FlushPrefix(client.ctx, prefix); err != nil {
+		return err
+	}
+	client.handler.sweep()
+	return nil
+}
+
+// invalidateTag removes every item with the tag.
+func (client *ClientConn) invalidateTag(tag []byte) error {
+	if client.handler.tagger == nil {
+		return storage.ErrNotSupported
+	}
+	if err := client.handler.tagger.InvalidateTag(client.ctx, tag); err != nil {
+		return err
+	}
+	client.handler.sweep()
+	return nil
+}
+
+// setTagged stores the value for the key as set does, tagging the item.
+func (client *ClientConn) setTagged(key, value []byte, flags, exptime uint32, cas uint64, tags [][]byte) (uint64, error) {
+	if client.handler.tagger == nil {
+		return 0, storage.ErrNotSupported
+	}
+	if client.chunks != nil {
+		item := storage.Item{Chunks: client.chunks}
+		value = item.Bytes()
+	}
+	return client.handler.tagger.SetTagged(client.ctx, key, value, flags, exptime, cas, tags)
+}
+
+// parseTags checks the extras of a set request, returning the tags after its
+// flags and expiration (nil if there are none) in the client's namespace. The
+// tags returned are only valid until the next call.
+func (client *ClientConn) parseTags(extras []byte) ([][]byte, bool) {
+	if len(extras) < protocol.TAGS_OFFSET {
+		return nil, false
+	}
+	client.tags = client.tags[:0]
+	for buf := extras[protocol.TAGS_OFFSET:]; len(buf) > 0; {
+		n := int(buf[0])
+		if n == 0 || len(buf) < 1+n {
+			return nil, false
+		}
+		client.tags, buf = append(client.tags, client.tag(buf[1:1+n])), buf[1+n:]
+	}
+	if len(client.tags) == 0 {
+		return nil, true
+	}
+	return client.tags, true
+}
+
+// parseTextTags parses the tags argument of a text set (tags=<tag>,<tag>...),
+// returning false if it isn't one.
+func (client *ClientConn) parseTextTags(arg []byte) ([][]byte, bool) {
+	list, ok := bytes.CutPrefix(arg, []byte("tags="))
+	if !ok {
+		return nil, false
+	}
+	client.tags = client.tags[:0]
+	for _, tag := range bytes.Split(list, []byte(",")) {
+		if len(tag) > 0 {
+			client.tags = append(client.tags, client.tag(tag))
+		}
+	}
+	if len(client.tags) == 0 {
+		return nil, false
+	}
+	return client.tags, true
+}
+
+// tag returns the tag in the client's namespace.
+func (client *ClientConn) tag(tag []byte) []byte {
+	if client.user == nil || client.user.tenant == nil {
+		return tag
+	}
+	return append([]byte(client.user.tenant.Prefix()), tag...)
+}
+
+// sweep starts a reclaiming crawl of the cache in the background, to remove
+// the items just invalidated (or on request, by lru_crawler crawl). Sweeps run
+// one at a time, and while one runs at most one more waits to start (which will
+// cover every invalidation made until it does).
+func (cnh *ConnectionHandler) sweep() {
+	if cnh.crawler == nil {
+		return
+	}
+	select {
+	case cnh.sweeps <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		cnh.sweepMu.Lock()
+		defer cnh.sweepMu.Unlock()
+		<-cnh.sweeps
+		cnh.crawler.Reclaim()
+	}()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage/storagetest"
+)
+
+func (tc *TestClient) SetTagged(key, val string, tags ...string) *Response {
+	extras := make([]byte, protocol.TAGS_OFFSET)
+	for _, tag := range tags {
+		extras = append(append(extras, byte(len(tag))), tag...)
+	}
+	return tc.Do(protocol.CMD_SET, extras, []byte(key), []byte(val), 0)
+}
+
+func (tc *TestClient) FlushPrefix(prefix string) *Response {
+	return tc.Do(protocol.CMD_FLUSH_PREFIX, nil, []byte(prefix), nil, 0)
+}
+
+func (tc *TestClient) InvalidateTag(tag string) *Response {
+	return tc.Do(protocol.CMD_INVALIDATE_TAG, nil, []byte(tag), nil, 0)
+}
+
+func TestClientInvalidate(t *testing.T) {
+	c := cache.New(100000)
+	server := StartTestServer(t, c)
+	tc := DialTestClient(t, server.Addr())
+
+	CheckStatus(t, tc.SetTagged("profile:1", "value", "user:1"), protocol.STATUS_OK)
+	CheckStatus(t, tc.SetTagged("feed:1", "value", "user:1", "feeds"), protocol.STATUS_OK)
+	CheckStatus(t, tc.SetTagged("feed:2", "value", "feeds"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Set("user:1:name", "value", 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Set("user:2:name", "value", 0, 0), protocol.STATUS_OK)
+
+	CheckStatus(t, tc.InvalidateTag("user:1"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("profile:1"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Get("feed:1"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Get("feed:2"), protocol.STATUS_OK)
+	CheckStatus(t, tc.FlushPrefix("user:1:"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("user:1:name"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Get("user:2:name"), protocol.STATUS_OK)
+
+	// the invalidated items are swept from the cache in the background
+	CheckStatus(t, tc.InvalidateTag("feeds"), protocol.STATUS_OK)
+	Eventually(t, "the sweep", func() bool { return c.Stats().Items == 1 })
+	Eventually(t, "the invalidations to be forgotten", func() bool { return c.Stats().Invalidations == 0 })
+	if stats := tc.Stats(""); stats["removed_invalidated"] != "4" || stats["invalidations"] != "0" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+
+	// malformed tags, prefixes and tags are refused
+	bad := []byte{0, 0, 0, 0, 0, 0, 0, 0, 3, 'a'}
+	CheckStatus(t, tc.Do(protocol.CMD_SET, bad, []byte("key"), []byte("value"), 0), protocol.STATUS_INVALID_ARGUMENT)
+	CheckStatus(t, tc.Do(protocol.CMD_SET, bad[:6], []byte("key"), []byte("value"), 0), protocol.STATUS_INVALID_ARGUMENT)
+	CheckStatus(t, tc.FlushPrefix(""), protocol.STATUS_INVALID_ARGUMENT)
+	CheckStatus(t, tc.InvalidateTag(strings.Repeat("x", protocol.MAX_KEY_LENGTH+1)), protocol.STATUS_INVALID_ARGUMENT)
+
+	// as are tags, by storage that doesn't support them
+	tc = DialTestClient(t, StartTestServer(t, storagetest.NewMap()).Addr())
+	CheckStatus(t, tc.SetTagged("key", "value", "tag"), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, tc.InvalidateTag("tag"), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, tc.FlushPrefix("key"), protocol.STATUS_OK)
+}
+
+func TestClientInvalidateTenant(t *testing.T) {
+	users, _ := ParseUsers(strings.NewReader("alice secret\nbob pass"))
+	c := cache.New(100000)
+	tenant, _ := c.AddTenant("team", "t:", 0)
+	users["alice"].tenant = tenant
+	server := StartTestServerWith(t, c, func(handler *ConnectionHandler) {
+		handler.users = users
+	})
+	alice := DialTestClient(t, server.Addr())
+	CheckStatus(t, alice.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00alice\x00secret"), 0), protocol.STATUS_OK)
+	other := DialTestClient(t, server.Addr())
+	CheckStatus(t, other.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00bob\x00pass"), 0), protocol.STATUS_OK)
+
+	// a tenant's prefixes and tags are in its namespace
+	CheckStatus(t, alice.SetTagged("a:1", "value", "tag"), protocol.STATUS_OK)
+	CheckStatus(t, other.SetTagged("a:1", "value", "tag"), protocol.STATUS_OK)
+	CheckStatus(t, alice.InvalidateTag("tag"), protocol.STATUS_OK)
+	CheckStatus(t, alice.Get("a:1"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, other.Get("a:1"), protocol.STATUS_OK)
+
+	CheckStatus(t, alice.Set("a:2", "value", 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.FlushPrefix("a:"), protocol.STATUS_OK)
+	CheckStatus(t, alice.Get("a:2"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, other.Get("a:1"), protocol.STATUS_OK)
+	CheckStatus(t, other.InvalidateTag("tag"), protocol.STATUS_OK)
+	CheckStatus(t, other.Get("a:1"), protocol.STATUS_KEY_NOT_FOUND)
+}
+
+func TestTextInvalidate(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTextClient(t, server.Addr())
+
+	CheckLines(t, tc.Do("set feed:1 0 0 1 tags=user:1,feeds\r\na\r\n"), "STORED")
+	CheckLines(t, tc.Do("set feed:2 0 0 1 tags=feeds noreply\r\nb\r\n"+"get feed:2\r\n"), "VALUE feed:2 0 1", "b", "END")
+	lines := tc.Do("gets feed:2\r\n")
+	CheckLines(t, tc.Do("cas feed:2 0 0 1 "+strings.Fields(lines[0])[4]+" tags=user:2\r\nc\r\n"), "STORED")
+	CheckLines(t, tc.Do("set user:1:name 0 0 1\r\nd\r\n"), "STORED")
+
+	CheckLines(t, tc.Do("invalidate_tag feeds\r\n"), "OK")
+	CheckLines(t, tc.Do("get feed:1 feed:2\r\n"), "VALUE feed:2 0 1", "c", "END")
+	CheckLines(t, tc.Do("invalidate_tag user:2 noreply\r\nget feed:2\r\n"), "END")
+	CheckLines(t, tc.Do("flush_prefix user:1:\r\n"), "OK")
+	CheckLines(t, tc.Do("get user:1:name\r\n"), "END")
+
+	CheckLines(t, tc.Do("flush_prefix\r\n"), "CLIENT_ERROR bad command line format")
+	CheckLines(t, tc.Do("set key 0 0 1 tags=\r\n"), "ERROR")
+	server.SetReadOnly(true)
+	CheckLines(t, tc.Do("invalidate_tag feeds\r\n"), TEXT_READ_ONLY)
+}
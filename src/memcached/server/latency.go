@@ -0,0 +1,212 @@
+package server
+
+// Latency by phase: each request is timed end-to-end and split into the phases
+// of serving it, recorded in HDR-style histograms by command. Unlike the fixed
+// buckets of Metrics, these keep a bounded relative error at any latency, so
+// their quantiles tell where the tail comes from, whether reading the request,
+// waiting for the cache lock, running the command or writing the response.
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"memcached/protocol"
+)
+
+// Phase is a phase of serving a request.
+type Phase int
+
+// The phases of serving a request. The ones after PHASE_TOTAL add up to it.
+const (
+	PHASE_TOTAL Phase = iota // from reading the request to flushing the response
+	PHASE_PARSE              // reading and parsing the rest of the request
+	PHASE_LOCK               // waiting for the cache lock
+	PHASE_EXEC               // running the command, less the lock waits
+	PHASE_WRITE              // flushing the response to the client
+	N_PHASES
+)
+
+// phaseNames are the names of the phases, as used in statistics and metrics.
+var phaseNames = [N_PHASES]string{"total", "parse", "lock", "exec", "write"}
+
+func (p Phase) String() string {
+	return phaseNames[p]
+}
+
+// Timing is the time spent in each phase of serving a request.
+type Timing [N_PHASES]time.Duration
+
+// LATENCY_SUB_BITS is the log2 of the number of buckets each power of two
+// nanoseconds is split into, bounding the relative error of a latency read
+// from a histogram to 1/2^LATENCY_SUB_BITS (6.25%).
+const LATENCY_SUB_BITS = 4
+
+// LATENCY_MAX_BITS bounds the latencies recorded to below 2^LATENCY_MAX_BITS
+// nanoseconds (about 18 minutes), longer ones being recorded as the longest.
+const LATENCY_MAX_BITS = 40
+
+// N_HDR_BUCKETS is the number of buckets in a LatencyHistogram.
+const N_HDR_BUCKETS = (LATENCY_MAX_BITS - LATENCY_SUB_BITS + 1) << LATENCY_SUB_BITS
+
+// LatencyQuantile is a quantile reported for each phase of each command.
+type LatencyQuantile struct {
+	Name     string
+	Quantile float64
+}
+
+// LATENCY_QUANTILES are the quantiles reported in statistics and metrics.
+var LATENCY_QUANTILES = []LatencyQuantile{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+	{"p999", 0.999},
+}
+
+// LatencyHistogram is a log-linear histogram of latencies in nanoseconds, as
+// in HdrHistogram: values below 2^LATENCY_SUB_BITS have a bucket each, and
+// each power of two above is split into 2^LATENCY_SUB_BITS equal buckets.
+type LatencyHistogram struct {
+	buckets [N_HDR_BUCKETS]uint64
+	count   uint64
+	sum     uint64 // nanoseconds
+	max     uint64 // nanoseconds
+}
+
+// hdrBucket returns the bucket of a latency of v nanoseconds.
+func hdrBucket(v uint64) int {
+	v = min(v, 1<<LATENCY_MAX_BITS-1)
+	if v < 1<<LATENCY_SUB_BITS {
+		return int(v)
+	}
+	shift := bits.Len64(v) - LATENCY_SUB_BITS - 1
+	return shift<<LATENCY_SUB_BITS + int(v>>shift)
+}
+
+// hdrBucketMax returns the longest latency (in nanoseconds) of bucket i.
+func hdrBucketMax(i int) uint64 {
+	if i < 1<<LATENCY_SUB_BITS {
+		return uint64(i)
+	}
+	shift := i>>LATENCY_SUB_BITS - 1
+	return uint64(i-shift<<LATENCY_SUB_BITS+1)<<shift - 1
+}
+
+// Observe records a single latency in the histogram.
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	v := uint64(max(d, 0))
+	atomic.AddUint64(&h.buckets[hdrBucket(v)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+	for {
+		m := atomic.LoadUint64(&h.max)
+		if v <= m || atomic.CompareAndSwapUint64(&h.max, m, v) {
+			break
+		}
+	}
+}
+
+// Count returns the number of latencies recorded.
+func (h *LatencyHistogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the total of all latencies recorded.
+func (h *LatencyHistogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.sum))
+}
+
+// Max returns the longest latency recorded.
+func (h *LatencyHistogram) Max() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.max))
+}
+
+// Quantile returns the latency that the fraction q of the latencies recorded
+// are at or below, to within the precision of the buckets (0 if none were).
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(count) + 0.5)
+	rank = min(max(rank, 1), count)
+	var seen uint64
+	for i := range h.buckets {
+		seen += atomic.LoadUint64(&h.buckets[i])
+		if seen >= rank {
+			return min(time.Duration(hdrBucketMax(i)), h.Max())
+		}
+	}
+	return h.Max()
+}
+
+// CommandLatency holds the latency histograms of each phase of a command.
+type CommandLatency struct {
+	phases [N_PHASES]LatencyHistogram
+}
+
+// Phase returns the latency histogram of a phase.
+func (cl *CommandLatency) Phase(p Phase) *LatencyHistogram {
+	return &cl.phases[p]
+}
+
+// Latencies collects the latency histograms of each phase of the requests
+// served, by command. The histograms of a command are only allocated once it's
+// served, as few of the possible commands are.
+type Latencies struct {
+	commands [256]atomic.Pointer[CommandLatency]
+}
+
+// Record records the timing of a request for a command.
+func (l *Latencies) Record(cmd protocol.Command, t *Timing) {
+	cl := l.commands[cmd].Load()
+	if cl == nil {
+		l.commands[cmd].CompareAndSwap(nil, &CommandLatency{})
+		cl = l.commands[cmd].Load()
+	}
+	for p, d := range t {
+		cl.phases[p].Observe(d)
+	}
+}
+
+// Command returns the latency histograms of a command, nil if it was never
+// served.
+func (l *Latencies) Command(cmd protocol.Command) *CommandLatency {
+	return l.commands[cmd].Load()
+}
+
+// Each calls fn for every command served, in order.
+func (l *Latencies) Each(fn func(cmd protocol.Command, cl *CommandLatency)) {
+	for cmd := range l.commands {
+		if cl := l.commands[cmd].Load(); cl != nil {
+			fn(protocol.Command(cmd), cl)
+		}
+	}
+}
+
+// micros formats a duration as a number of microseconds, as latencies are
+// reported in statistics.
+func micros(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Microsecond), 'f', 1, 64)
+}
+
+// latencyStats returns the latency statistics of each phase of each command
+// served, in microseconds, and those of the slow log.
+func (cnh *ConnectionHandler) latencyStats() []Stat {
+	stats := cnh.slowLog.Stats()
+	cnh.latency.Each(func(cmd protocol.Command, cl *CommandLatency) {
+		name := cmd.String()
+		stats = append(stats, Stat{name + "_count", fmt.Sprint(cl.Phase(PHASE_TOTAL).Count())})
+		for p := range N_PHASES {
+			h := cl.Phase(p)
+			prefix := name + "_" + p.String() + "_"
+			for _, q := range LATENCY_QUANTILES {
+				stats = append(stats, Stat{prefix + q.Name, micros(h.Quantile(q.Quantile))})
+			}
+			stats = append(stats, Stat{prefix + "max", micros(h.Max())})
+		}
+	})
+	return stats
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	// every latency falls in a bucket at most 1/16th wider than it
+	for v := uint64(1); v < 1<<LATENCY_MAX_BITS; v = v*3/2 + 1 {
+		i := hdrBucket(v)
+		if hi := hdrBucketMax(i); hi < v || float64(hi-v) > float64(v)/16 || (i > 0 && hdrBucketMax(i-1) >= v) {
+			t.Errorf("Wrong bucket for %d: %d up to %d\n", v, i, hi)
+		}
+	}
+	if i := hdrBucket(1 << 50); i != N_HDR_BUCKETS-1 {
+		t.Errorf("Wrong bucket for the longest latency: %d\n", i)
+	}
+
+	var h LatencyHistogram
+	for n := 1; n <= 1000; n++ {
+		h.Observe(time.Duration(n) * time.Microsecond)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		expected := time.Duration(q*1000) * time.Microsecond
+		if d := h.Quantile(q); d < expected || d > expected+expected/16 {
+			t.Errorf("Wrong quantile %v: %v vs %v\n", q, d, expected)
+		}
+	}
+	if h.Count() != 1000 || h.Max() != time.Millisecond || h.Quantile(1) != time.Millisecond ||
+		h.Sum() != 500500*time.Microsecond {
+		t.Errorf("Wrong histogram: %d %v %v %v\n", h.Count(), h.Max(), h.Quantile(1), h.Sum())
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	sl := NewSlowLog(time.Millisecond, 3)
+	if sl.Slow(time.Millisecond) || !sl.Slow(2*time.Millisecond) {
+		t.Errorf("Wrong threshold\n")
+	}
+	for n := 0; n < 5; n++ {
+		sl.Add(SlowRequest{Key: fmt.Sprint("key", n)})
+	}
+
+	// the latest requests are kept, the latest first
+	reqs := sl.Requests(10, nil)
+	if len(reqs) != 3 || reqs[0].ID != 4 || reqs[0].Key != "key4" || reqs[2].Key != "key2" {
+		t.Errorf("Wrong slow requests: %+v\n", reqs)
+	}
+	if reqs := sl.Requests(1, nil); len(reqs) != 1 || reqs[0].Key != "key4" {
+		t.Errorf("Wrong latest slow request: %+v\n", reqs)
+	}
+	sl.Reset()
+	sl.Add(SlowRequest{Key: "key5"})
+	if reqs := sl.Requests(10, nil); len(reqs) != 1 || reqs[0].ID != 5 || sl.Logged() != 6 {
+		t.Errorf("Wrong slow requests after reset: %+v\n", reqs)
+	}
+
+	if NewSlowLog(0, 0).Slow(time.Second) {
+		t.Errorf("Disabled slow log logs requests\n")
+	}
+}
+
+func TestAppendSlowRequest(t *testing.T) {
+	req := SlowRequest{
+		ID:      7,
+		Time:    time.Unix(1500000000, 0),
+		Command: protocol.CMD_SET,
+		Key:     "a key",
+		Size:    100,
+		Client:  3,
+		Addr:    "127.0.0.1:5000",
+		Timing:  Timing{12 * time.Millisecond, 1500 * time.Microsecond, 10 * time.Millisecond, 400 * time.Microsecond, 100 * time.Microsecond},
+	}
+	expected := "id=7 time=1500000000 cmd=set key=a+key size=100 client=3 addr=127.0.0.1:5000 " +
+		"total=12000.0 parse=1500.0 lock=10000.0 exec=400.0 write=100.0"
+	if line := string(appendSlowRequest(nil, &req)); line != expected {
+		t.Errorf("Wrong slow request line: %q vs %q\n", line, expected)
+	}
+}
+
+// blockingJournal holds the cache lock (which journals are appended to under)
+// from its first append until released.
+type blockingJournal struct {
+	once    sync.Once
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (j *blockingJournal) Append(rec []byte) {
+	j.once.Do(func() {
+		close(j.blocked)
+		<-j.release
+	})
+}
+
+func TestLatencyLockWait(t *testing.T) {
+	c := cache.New(100000)
+	server := StartTestServer(t, c)
+	tc := DialTestClient(t, server.Addr())
+	tc.Set("key", "value", 0, 0)
+
+	// a get waiting for the cache lock spends the wait in the lock phase, and
+	// is logged as slow
+	j := &blockingJournal{blocked: make(chan struct{}), release: make(chan struct{})}
+	c.AddJournal(j)
+	go c.Set(ctx, []byte("other"), []byte("value"), 0, 0, 0)
+	<-j.blocked
+	done := make(chan protocol.Status)
+	go func() { done <- protocol.Status(tc.Get("key").Status) }()
+	time.Sleep(2 * SLOW_LOG_THRESHOLD) // less the time the get takes to be sent
+	close(j.release)
+	if status := <-done; status != protocol.STATUS_OK {
+		t.Fatalf("Wrong get status: %v\n", status)
+	}
+
+	Eventually(t, "get timed", func() bool {
+		cl := server.latency.Command(protocol.CMD_GET)
+		return cl != nil && cl.Phase(PHASE_TOTAL).Count() == 1
+	})
+	cl := server.latency.Command(protocol.CMD_GET)
+	if lock := cl.Phase(PHASE_LOCK).Max(); lock < SLOW_LOG_THRESHOLD || lock > cl.Phase(PHASE_TOTAL).Max() {
+		t.Errorf("Wrong lock wait: %v of %v\n", lock, cl.Phase(PHASE_TOTAL).Max())
+	}
+	if cl := server.latency.Command(protocol.CMD_SET); cl.Phase(PHASE_LOCK).Max() >= SLOW_LOG_THRESHOLD {
+		t.Errorf("Set waited for a free lock: %v\n", cl.Phase(PHASE_LOCK).Max())
+	}
+	reqs := server.slowLog.Requests(10, nil)
+	if len(reqs) != 1 || reqs[0].Command != protocol.CMD_GET || reqs[0].Key != "key" || reqs[0].Size != 5 ||
+		reqs[0].Timing[PHASE_LOCK] < SLOW_LOG_THRESHOLD {
+		t.Errorf("Wrong slow requests: %+v\n", reqs)
+	}
+
+	stats, _ := server.Stats("latency")
+	names := statsMap(stats)
+	for _, name := range []string{"get_count", "get_total_p50", "get_lock_p999", "get_write_max", "set_parse_p99", "slowlog_len"} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("Latency stats missing %s: %v\n", name, stats)
+		}
+	}
+	if names["get_count"] != "1" || names["slowlog_len"] != "1" {
+		t.Errorf("Wrong latency stats: %v\n", stats)
+	}
+}
+
+func TestTextSlowLog(t *testing.T) {
+	server := StartTestServerWith(t, cache.New(100000), func(cnh *ConnectionHandler) {
+		cnh.slowLog = NewSlowLog(0, 2)
+	})
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// with no threshold, every request is slow
+	fmt.Fprintf(conn, "set key 0 0 5\r\nvalue\r\n")
+	ReadMetadump(t, r, "STORED\r\n")
+	fmt.Fprintf(conn, "gat 100 key\r\n")
+	ReadMetadump(t, r, "END\r\n")
+	fmt.Fprintf(conn, "slowlog\r\n")
+	lines := ReadMetadump(t, r, "END\r\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "id=1 ") ||
+		!strings.Contains(lines[0], " cmd=gat key=key size=5 client=0 addr=") ||
+		!strings.Contains(lines[1], " cmd=set key=key size=5 ") || !strings.HasSuffix(lines[1], "\r\n") {
+		t.Errorf("Wrong slow log: %q\n", lines)
+	}
+
+	fmt.Fprintf(conn, "slowlog 1\r\n")
+	if lines := ReadMetadump(t, r, "END\r\n"); len(lines) != 1 || !strings.Contains(lines[0], " cmd=stat ") {
+		t.Errorf("Wrong latest slow request: %q\n", lines)
+	}
+
+	// resetting forgets all but the reset itself
+	fmt.Fprintf(conn, "slowlog reset\r\n")
+	ReadMetadump(t, r, "OK\r\n")
+	fmt.Fprintf(conn, "slowlog\r\n")
+	if lines := ReadMetadump(t, r, "END\r\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "id=4 ") {
+		t.Errorf("Slow log not reset: %q\n", lines)
+	}
+	fmt.Fprintf(conn, "slowlog bogus\r\n")
+	ReadMetadump(t, r, "CLIENT_ERROR bad command line format\r\n")
+}
@@ -0,0 +1,101 @@
+package server
+
+// Leases (see cache/lease.go), served by an extension of the binary protocol: a
+// lease get (CMD_LEASE_GET) that misses responds with the lease token granted
+// in its CAS, or a hot miss (STATUS_HOT_MISS) if the key is leased to another
+// client, unless the key has a stale value, which is returned with the
+// LEASE_STALE flag. A lease set (CMD_LEASE_SET) is a set with the lease token
+// as its CAS, refused (STATUS_ITEM_NOT_STORED) if the lease isn't valid.
+//
+// Followers and read-only servers refuse lease sets, as they do every
+// mutation, so they serve lease gets as plain gets: a miss grants no lease (its
+// CAS is 0), rather than one that could never be filled, making the other
+// clients hot miss until it ends.
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// handleLeaseGet handles the lease get command.
+func (client *ClientConn) handleLeaseGet(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("lease_get", key)
+
+	if len(extras) != 0 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	} else if client.handler.leaser == nil {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_NOT_SUPPORTED,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Read(key)
+	var item storage.Item
+	var lease storage.Lease
+	var err error
+	if client.handler.ReadOnly() {
+		item, err = client.store.Get(client.ctx, key)
+	} else {
+		item, lease, err = client.handler.leaser.LeaseGet(client.ctx, key)
+	}
+
+	if err != nil {
+		resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, lease.Token)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	cas, leaseFlags := item.CAS, uint32(0)
+	if lease.Stale {
+		cas, leaseFlags = lease.Token, protocol.LEASE_STALE
+	}
+	binary.BigEndian.PutUint32(client.leaseExtras[:4], item.Flags)
+	binary.BigEndian.PutUint32(client.leaseExtras[4:], leaseFlags)
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, item.Value, client.leaseExtras[:], req.Opaque, cas)
+	return client.writeItem(&resp, client.leaseExtras[:], &item)
+}
+
+// handleLeaseSet handles the lease set command.
+func (client *ClientConn) handleLeaseSet(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("lease_set", key)
+
+	if len(extras) != 8 || !protocol.ValidKey(key) || req.Cas == 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	} else if client.handler.leaser == nil {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_NOT_SUPPORTED,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	if client.chunks != nil {
+		item := storage.Item{Chunks: client.chunks}
+		value = item.Bytes()
+	}
+	flags := binary.BigEndian.Uint32(extras[0:4])
+	exptime := binary.BigEndian.Uint32(extras[4:8])
+	ver, err := client.handler.leaser.LeaseSet(client.ctx, key, value, flags, exptime, req.Cas)
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, ver)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// leaseStats returns the statistics of the cache's leases.
+func (cnh *ConnectionHandler) leaseStats() []Stat {
+	ls := cnh.cache.LeaseStats()
+	return []Stat{
+		{"lease_granted", fmt.Sprint(ls.Granted)},
+		{"lease_rejected", fmt.Sprint(ls.Rejected)},
+		{"lease_hot_misses", fmt.Sprint(ls.HotMisses)},
+		{"lease_stale_hits", fmt.Sprint(ls.StaleHits)},
+		{"lease_stale_bytes", fmt.Sprint(ls.StaleBytes)},
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage/storagetest"
+)
+
+func (tc *TestClient) LeaseGet(key string) *Response {
+	return tc.Do(protocol.CMD_LEASE_GET, nil, []byte(key), nil, 0)
+}
+
+func (tc *TestClient) LeaseSet(key, val string, token uint64) *Response {
+	return tc.Do(protocol.CMD_LEASE_SET, make([]byte, 8), []byte(key), []byte(val), token)
+}
+
+func TestClientLeases(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000, cache.WithLeases(time.Minute)))
+	tc1 := DialTestClient(t, server.Addr())
+	tc2 := DialTestClient(t, server.Addr())
+
+	// the first client to miss gets the lease, the others a hot miss
+	miss := tc1.LeaseGet("key")
+	CheckStatus(t, miss, protocol.STATUS_KEY_NOT_FOUND)
+	if miss.Cas == 0 {
+		t.Fatal("No lease token granted\n")
+	}
+	CheckStatus(t, tc2.LeaseGet("key"), protocol.STATUS_HOT_MISS)
+	Eventually(t, "hot miss counted", func() bool {
+		return server.metrics.Count(protocol.CMD_LEASE_GET, protocol.STATUS_HOT_MISS) == 1
+	})
+	CheckStatus(t, tc2.LeaseSet("key", "value", miss.Cas+1), protocol.STATUS_ITEM_NOT_STORED)
+	set := tc1.LeaseSet("key", "value", miss.Cas)
+	CheckStatus(t, set, protocol.STATUS_OK)
+
+	hit := tc2.LeaseGet("key")
+	CheckStatus(t, hit, protocol.STATUS_OK)
+	if string(hit.value) != "value" || hit.Cas != set.Cas || len(hit.extras) != 8 ||
+		binary.BigEndian.Uint32(hit.extras[4:]) != 0 {
+		t.Errorf("Wrong lease get hit: %q %x (%d)\n", hit.value, hit.extras, hit.Cas)
+	}
+
+	// once deleted, the old value is stale
+	CheckStatus(t, tc1.Delete("key"), protocol.STATUS_OK)
+	stale := tc2.LeaseGet("key")
+	CheckStatus(t, stale, protocol.STATUS_OK)
+	if string(stale.value) != "value" || stale.Cas == 0 || stale.Cas == set.Cas ||
+		binary.BigEndian.Uint32(stale.extras[4:]) != protocol.LEASE_STALE {
+		t.Errorf("Wrong stale lease get: %q %x (%d)\n", stale.value, stale.extras, stale.Cas)
+	}
+	if other := tc1.LeaseGet("key"); binary.BigEndian.Uint32(other.extras[4:]) != protocol.LEASE_STALE ||
+		other.Cas != 0 {
+		t.Errorf("Wrong stale lease get: %x (%d)\n", other.extras, other.Cas)
+	}
+	CheckStatus(t, tc2.LeaseSet("key", "new", stale.Cas), protocol.STATUS_OK)
+	if get := tc1.Get("key"); string(get.value) != "new" {
+		t.Errorf("Wrong value: %q\n", get.value)
+	}
+
+	stats := tc1.Stats("")
+	if stats["lease_granted"] != "2" || stats["lease_rejected"] != "1" ||
+		stats["lease_hot_misses"] != "1" || stats["lease_stale_hits"] != "2" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+	CheckStatus(t, tc1.LeaseSet("key", "value", 0), protocol.STATUS_INVALID_ARGUMENT)
+}
+
+func TestClientLeasesUnsupported(t *testing.T) {
+	tc := DialTestClient(t, StartTestServer(t, cache.New(100000)).Addr())
+	CheckStatus(t, tc.LeaseGet("key"), protocol.STATUS_NOT_SUPPORTED)
+
+	tc = DialTestClient(t, StartTestServer(t, storagetest.NewMap()).Addr())
+	CheckStatus(t, tc.LeaseGet("key"), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, tc.LeaseSet("key", "value", 1), protocol.STATUS_NOT_SUPPORTED)
+}
+
+func TestClientLeasesReadOnly(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000, cache.WithLeases(time.Minute)))
+	tc1 := DialTestClient(t, server.Addr())
+	tc2 := DialTestClient(t, server.Addr())
+	tc1.Set("key", "value", 0, 0)
+	server.SetReadOnly(true)
+
+	// lease gets are served as gets, granting no lease that couldn't be filled
+	for _, tc := range []*TestClient{tc1, tc2} {
+		miss := tc.LeaseGet("missing")
+		CheckStatus(t, miss, protocol.STATUS_KEY_NOT_FOUND)
+		if miss.Cas != 0 {
+			t.Errorf("Lease granted while read-only: %d\n", miss.Cas)
+		}
+	}
+	if hit := tc2.LeaseGet("key"); string(hit.value) != "value" || binary.BigEndian.Uint32(hit.extras[4:]) != 0 {
+		t.Errorf("Wrong lease get hit: %q %x\n", hit.value, hit.extras)
+	}
+	CheckStatus(t, tc1.LeaseSet("missing", "value", 1), protocol.STATUS_NOT_SUPPORTED)
+
+	// and once writable, the key is leased as usual
+	server.SetReadOnly(false)
+	if miss := tc1.LeaseGet("missing"); miss.Cas == 0 {
+		t.Errorf("No lease granted\n")
+	}
+	CheckStatus(t, tc2.LeaseGet("missing"), protocol.STATUS_HOT_MISS)
+}
@@ -0,0 +1,201 @@
+package server
+
+// Leveled, structured logging.
+//
+// Each message is written as a single line of key=value pairs (logfmt), e.g.:
+//
+//   time=2017-07-14T02:40:00.000Z level=info msg="new client" client=3
+//
+// The level can be changed at any time (e.g., by the verbosity command) and
+// applies to all loggers derived from the same root through With.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel is the severity of a log message, messages are logged if their
+// level is at or below the level of the logger.
+type LogLevel int32
+
+// List of log levels.
+const (
+	LOG_ERROR LogLevel = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+)
+
+// String returns the name of the log level.
+func (level LogLevel) String() string {
+	switch level {
+	case LOG_ERROR:
+		return "error"
+	case LOG_WARN:
+		return "warn"
+	case LOG_INFO:
+		return "info"
+	case LOG_DEBUG:
+		return "debug"
+	}
+	return fmt.Sprintf("level%d", int32(level))
+}
+
+// ParseLogLevel parses the name of a log level.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level := LOG_ERROR; level <= LOG_DEBUG; level++ {
+		if s == level.String() {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// VerbosityLevel converts a memcache verbosity (0 upwards) to a log level: 0
+// logs just errors, 1 warnings too, 2 client connections and 3 every request.
+func VerbosityLevel(verbosity uint32) LogLevel {
+	if verbosity > uint32(LOG_DEBUG) {
+		return LOG_DEBUG
+	}
+	return LogLevel(verbosity)
+}
+
+// Logger is a leveled, structured logger. Safe to use from multiple Go
+// routines.
+type Logger struct {
+	level  *int32
+	out    io.Writer
+	mu     *sync.Mutex
+	fields []interface{}
+	now    func() time.Time
+}
+
+// DefaultLogger is the logger used by the server, it logs to standard error.
+var DefaultLogger = NewLogger(os.Stderr, LOG_WARN)
+
+// NewLogger creates a new Logger writing messages at or below level to out.
+func NewLogger(out io.Writer, level LogLevel) *Logger {
+	lvl := int32(level)
+	return &Logger{
+		level: &lvl,
+		out:   out,
+		mu:    &sync.Mutex{},
+		now:   time.Now,
+	}
+}
+
+// With returns a logger that adds the specified key-value pairs to every
+// message. It shares its level with the parent logger.
+func (l *Logger) With(kvs ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}(nil), l.fields...), kvs...)
+	return &child
+}
+
+// Level returns the current level of the logger.
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(l.level))
+}
+
+// SetLevel changes the level of the logger (and all loggers sharing it).
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Enabled returns true if messages at the level will be logged. Useful to
+// avoid expensive work to construct a message that is then discarded.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level <= l.Level()
+}
+
+// Error logs a message at the error level.
+func (l *Logger) Error(msg string, kvs ...interface{}) {
+	l.Log(LOG_ERROR, msg, kvs...)
+}
+
+// Warn logs a message at the warning level.
+func (l *Logger) Warn(msg string, kvs ...interface{}) {
+	l.Log(LOG_WARN, msg, kvs...)
+}
+
+// Info logs a message at the info level.
+func (l *Logger) Info(msg string, kvs ...interface{}) {
+	l.Log(LOG_INFO, msg, kvs...)
+}
+
+// Debug logs a message at the debug level.
+func (l *Logger) Debug(msg string, kvs ...interface{}) {
+	l.Log(LOG_DEBUG, msg, kvs...)
+}
+
+// Fatal logs a message at the error level and then exits the process.
+func (l *Logger) Fatal(msg string, kvs ...interface{}) {
+	l.Log(LOG_ERROR, msg, kvs...)
+	os.Exit(1)
+}
+
+// Log logs a message at the specified level, with the key-value pairs
+// following the message. A key without a value is logged with an empty value.
+func (l *Logger) Log(level LogLevel, msg string, kvs ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("time=")
+	buf.WriteString(l.now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	writeLogValue(&buf, msg)
+	writeLogFields(&buf, l.fields)
+	writeLogFields(&buf, kvs)
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+// writeLogFields writes out a list of key-value pairs.
+func writeLogFields(buf *bytes.Buffer, kvs []interface{}) {
+	for i := 0; i < len(kvs); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(kvs[i]))
+		buf.WriteByte('=')
+		if i+1 < len(kvs) {
+			writeLogValue(buf, kvs[i+1])
+		}
+	}
+}
+
+// writeLogValue writes out a single value, quoting it if needed.
+func writeLogValue(buf *bytes.Buffer, v interface{}) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, isLogControl) >= 0 {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+// isLogControl returns true for characters that need quoting in log values.
+func isLogControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LogBuffer collects log output, safe to read while clients are logging.
+type LogBuffer struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (lb *LogBuffer) Write(p []byte) (int, error) {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *LogBuffer) String() string {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.buf.String()
+}
+
+func (lb *LogBuffer) Reset() {
+	lb.Lock()
+	defer lb.Unlock()
+	lb.buf.Reset()
+}
+
+func NewTestLogger(level LogLevel) (*Logger, *LogBuffer) {
+	buf := new(LogBuffer)
+	l := NewLogger(buf, level)
+	l.now = func() time.Time { return time.Unix(1500000000, 0) }
+	return l, buf
+}
+
+func TestLoggerFormat(t *testing.T) {
+	l, buf := NewTestLogger(LOG_INFO)
+	l.With("client", 3).Info("new client", "addr", "127.0.0.1:1234", "quoted", `a "b"`, "empty", "")
+
+	expected := `time=2017-07-14T02:40:00.000Z level=info msg="new client" client=3 ` +
+		`addr=127.0.0.1:1234 quoted="a \"b\"" empty=""` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Wrong log line:\n%s\nvs\n%s", buf.String(), expected)
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	l, buf := NewTestLogger(LOG_WARN)
+	child := l.With("client", 1)
+
+	l.Error("error")
+	l.Warn("warn")
+	child.Info("info")
+	child.Debug("debug")
+	if strings.Count(buf.String(), "\n") != 2 || strings.Contains(buf.String(), "info") {
+		t.Errorf("Wrong messages logged at warn level:\n%s", buf.String())
+	}
+
+	// the level is shared with derived loggers
+	buf.Reset()
+	l.SetLevel(LOG_DEBUG)
+	child.Debug("debug")
+	if !strings.Contains(buf.String(), "level=debug msg=debug client=1") {
+		t.Errorf("Debug message not logged after level change:\n%s", buf.String())
+	}
+}
+
+func TestLoggerParseLevel(t *testing.T) {
+	for level := LOG_ERROR; level <= LOG_DEBUG; level++ {
+		if l, err := ParseLogLevel(level.String()); err != nil || l != level {
+			t.Errorf("Couldn't parse level %s\n", level)
+		}
+	}
+	if _, err := ParseLogLevel("bogus"); err == nil {
+		t.Error("Parsed bogus log level\n")
+	}
+	if VerbosityLevel(0) != LOG_ERROR || VerbosityLevel(2) != LOG_INFO || VerbosityLevel(10) != LOG_DEBUG {
+		t.Error("Wrong verbosity levels\n")
+	}
+}
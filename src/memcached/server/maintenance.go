@@ -0,0 +1,107 @@
+package server
+
+// Maintenance modes, for freezing a server during migrations:
+//
+//   read-only -- mutations are refused with an error status (not_supported by
+//                default), while reads keep working.
+//   drain     -- new connections are closed as soon as they're accepted, while
+//                existing ones are served as usual.
+//
+// Either can be switched at runtime with the read_only and drain text
+// commands (unless users are configured), the /mode admin endpoint, or a signal
+// (SIGUSR1 toggles read-only mode, SIGUSR2 drain mode). A replication follower
+// is always read-only.
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"memcached/protocol"
+)
+
+// Maintenance is the maintenance mode of a server.
+type Maintenance struct {
+	readOnly int32 // 1 if set
+	draining int32 // 1 if set
+	status   protocol.Status
+
+	refusedMutations uint64
+	refusedConns     uint64
+}
+
+// SetReadOnly switches read-only mode on or off.
+func (cnh *ConnectionHandler) SetReadOnly(on bool) {
+	if atomic.SwapInt32(&cnh.maintenance.readOnly, boolInt32(on)) != boolInt32(on) {
+		cnh.logger.Info("read-only mode", "on", on)
+	}
+}
+
+// SetDraining switches drain mode on or off.
+func (cnh *ConnectionHandler) SetDraining(on bool) {
+	if atomic.SwapInt32(&cnh.maintenance.draining, boolInt32(on)) != boolInt32(on) {
+		cnh.logger.Info("drain mode", "on", on)
+	}
+}
+
+// ToggleReadOnly switches read-only mode on if off, or off if on.
+func (cnh *ConnectionHandler) ToggleReadOnly() {
+	cnh.SetReadOnly(atomic.LoadInt32(&cnh.maintenance.readOnly) == 0)
+}
+
+// ToggleDraining switches drain mode on if off, or off if on.
+func (cnh *ConnectionHandler) ToggleDraining() {
+	cnh.SetDraining(!cnh.Draining())
+}
+
+// SetReadOnlyStatus sets the status mutations are refused with while
+// read-only. It should be set before the server accepts any clients.
+func (cnh *ConnectionHandler) SetReadOnlyStatus(status protocol.Status) {
+	cnh.maintenance.status = status
+}
+
+// ReadOnly returns true if clients may not modify the cache, either as it's a
+// replication follower or in read-only mode.
+func (cnh *ConnectionHandler) ReadOnly() bool {
+	return cnh.follower != nil || atomic.LoadInt32(&cnh.maintenance.readOnly) == 1
+}
+
+// Draining returns true if new connections are refused.
+func (cnh *ConnectionHandler) Draining() bool {
+	return atomic.LoadInt32(&cnh.maintenance.draining) == 1
+}
+
+// refuseMutation records a mutation refused as the server is read-only,
+// returning the status to refuse it with.
+func (cnh *ConnectionHandler) refuseMutation() protocol.Status {
+	atomic.AddUint64(&cnh.maintenance.refusedMutations, 1)
+	return cnh.maintenance.status
+}
+
+// maintenanceStats returns the statistics of the maintenance modes.
+func (cnh *ConnectionHandler) maintenanceStats() []Stat {
+	return []Stat{
+		{"read_only", fmt.Sprint(boolInt32(cnh.ReadOnly()))},
+		{"draining", fmt.Sprint(boolInt32(cnh.Draining()))},
+		{"read_only_refused", fmt.Sprint(atomic.LoadUint64(&cnh.maintenance.refusedMutations))},
+		{"drain_refused_connections", fmt.Sprint(atomic.LoadUint64(&cnh.maintenance.refusedConns))},
+	}
+}
+
+// parseOnOff parses the argument switching a mode, "on" or "off".
+func parseOnOff(s string) (bool, bool) {
+	switch s {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	}
+	return false, false
+}
+
+// boolInt32 returns 1 for true and 0 for false.
+func boolInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	server := StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.SetReadOnlyStatus(protocol.STATUS_BUSY)
+	})
+	tc := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc.Set("key", "value", 0, 0), protocol.STATUS_OK)
+
+	// mutations are refused with the configured status, reads still work
+	server.SetReadOnly(true)
+	CheckStatus(t, tc.Set("key", "other", 0, 0), protocol.STATUS_BUSY)
+	CheckStatus(t, tc.Delete("key"), protocol.STATUS_BUSY)
+	CheckStatus(t, tc.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_BUSY)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_OK)
+
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("set key 0 0 5\r\nother\r\n"), TEXT_READ_ONLY)
+	CheckLines(t, text.Do("get key\r\n"), "VALUE key 0 5", "value", "END")
+
+	stats := tc.Stats("")
+	if stats["read_only"] != "1" || stats["read_only_refused"] != "4" {
+		t.Errorf("Wrong read-only stats: %v\n", stats)
+	}
+
+	// and switching it off with the text command allows them again
+	CheckLines(t, text.Do("read_only off\r\n"), TEXT_OK)
+	CheckLines(t, text.Do("set key 0 0 5\r\nother\r\n"), TEXT_STORED)
+	CheckLines(t, text.Do("read_only maybe\r\n"), "CLIENT_ERROR bad command line format")
+	if server.ReadOnly() {
+		t.Errorf("Still read-only\n")
+	}
+}
+
+func TestTextModeUsers(t *testing.T) {
+	// text clients can't authenticate, so with users they may not switch modes
+	users, _ := ParseUsers(strings.NewReader("alice secret"))
+	server := StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.users = users
+	})
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("read_only on\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("drain on\r\n"), TEXT_DENIED)
+	if server.ReadOnly() || server.Draining() {
+		t.Errorf("Mode switched without authentication\n")
+	}
+}
+
+func TestDrainMode(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("drain on noreply\r\nget key\r\n"), TEXT_END)
+
+	// new connections are closed, existing ones are served
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Connection accepted while draining: read %d\n", n)
+	}
+	CheckStatus(t, tc.Set("key", "value", 0, 0), protocol.STATUS_OK)
+
+	stats := tc.Stats("")
+	if stats["draining"] != "1" || stats["drain_refused_connections"] != "1" {
+		t.Errorf("Wrong drain stats: %v\n", stats)
+	}
+
+	server.ToggleDraining()
+	CheckStatus(t, DialTestClient(t, server.Addr()).Get("key"), protocol.STATUS_OK)
+}
+
+func TestAdminMode(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	base := StartTestAdmin(t, server)
+
+	resp, err := http.Post(base+"/mode?read_only=on&drain=on", "", nil)
+	if err != nil {
+		t.Fatalf("Couldn't POST mode: %s\n", err)
+	}
+	resp.Body.Close()
+	if !server.ReadOnly() || !server.Draining() {
+		t.Errorf("Modes not switched on\n")
+	}
+
+	// invalid switches change nothing
+	resp, err = http.Post(base+"/mode?read_only=off&drain=maybe", "", nil)
+	if err != nil {
+		t.Fatalf("Couldn't POST mode: %s\n", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !server.ReadOnly() {
+		t.Errorf("Invalid mode accepted: %d\n", resp.StatusCode)
+	}
+
+	if body := HttpGet(t, base+"/mode"); !strings.Contains(body, `"read_only": true`) ||
+		!strings.Contains(body, `"draining": true`) {
+		t.Errorf("Wrong modes: %s\n", body)
+	}
+	if metrics := HttpGet(t, base+"/metrics"); !strings.Contains(metrics, "memcached_read_only 1\n") {
+		t.Errorf("Read-only mode missing from metrics\n")
+	}
+}
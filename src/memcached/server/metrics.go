@@ -0,0 +1,162 @@
+package server
+
+// Request metrics: counters of requests by command and response status, and
+// latency histograms by command. All updates are lock-free so recording them
+// doesn't add contention to the request path.
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"memcached/protocol"
+)
+
+// N_LATENCY_BUCKETS is the number of (bounded) buckets in a latency histogram.
+const N_LATENCY_BUCKETS = 16
+
+// LATENCY_BUCKETS are the upper bounds of the latency histogram buckets, an
+// extra unbounded bucket catches everything slower.
+var LATENCY_BUCKETS = [N_LATENCY_BUCKETS]time.Duration{
+	10 * time.Microsecond,
+	25 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// Histogram is a latency histogram with fixed buckets.
+type Histogram struct {
+	buckets [N_LATENCY_BUCKETS + 1]uint64
+	count   uint64
+	sum     uint64 // nanoseconds
+}
+
+// Observe records a single latency in the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(N_LATENCY_BUCKETS, func(i int) bool { return d <= LATENCY_BUCKETS[i] })
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// Count returns the number of latencies recorded.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the total of all latencies recorded.
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.sum))
+}
+
+// Cumulative returns the number of latencies recorded at or below the upper
+// bound of each bucket (excluding the unbounded bucket, which is Count).
+func (h *Histogram) Cumulative() [N_LATENCY_BUCKETS]uint64 {
+	var cum [N_LATENCY_BUCKETS]uint64
+	var total uint64
+	for i := range cum {
+		total += atomic.LoadUint64(&h.buckets[i])
+		cum[i] = total
+	}
+	return cum
+}
+
+// metricStatuses are the statuses we keep separate request counts for, any
+// others are counted together.
+var metricStatuses = [...]protocol.Status{
+	protocol.STATUS_OK,
+	protocol.STATUS_KEY_NOT_FOUND,
+	protocol.STATUS_KEY_EXISTS,
+	protocol.STATUS_VALUE_TOO_LARGE,
+	protocol.STATUS_INVALID_ARGUMENT,
+	protocol.STATUS_ITEM_NOT_STORED,
+	protocol.STATUS_NON_NUMERIC,
+	protocol.STATUS_AUTH_FAILED,
+	protocol.STATUS_UNKNOWN_COMMAND,
+	protocol.STATUS_OUT_OF_MEMORY,
+	protocol.STATUS_NOT_SUPPORTED,
+	protocol.STATUS_INTERNAL_ERROR,
+	protocol.STATUS_BUSY,
+	protocol.STATUS_HOT_MISS,
+}
+
+// N_METRIC_STATUSES is the number of status counters kept for each command, one
+// for each of metricStatuses and one for the rest.
+const N_METRIC_STATUSES = len(metricStatuses) + 1
+
+// statusIndex maps a status to its counter in Metrics.ops.
+var statusIndex [256]uint8
+
+func init() {
+	for i := range statusIndex {
+		statusIndex[i] = uint8(len(metricStatuses))
+	}
+	for i, status := range metricStatuses {
+		statusIndex[status] = uint8(i)
+	}
+}
+
+// Metrics collects counters and latency histograms of the requests served.
+type Metrics struct {
+	ops     [256][N_METRIC_STATUSES]uint64
+	latency [256]Histogram
+}
+
+// Record records a request that completed with the specified status.
+func (m *Metrics) Record(cmd protocol.Command, status protocol.Status, d time.Duration) {
+	idx := uint8(len(metricStatuses))
+	if status < 256 {
+		idx = statusIndex[status]
+	}
+	atomic.AddUint64(&m.ops[cmd][idx], 1)
+	m.latency[cmd].Observe(d)
+}
+
+// Count returns the number of requests for a command that completed with the
+// specified status.
+func (m *Metrics) Count(cmd protocol.Command, status protocol.Status) uint64 {
+	if status >= 256 || statusIndex[status] == uint8(len(metricStatuses)) {
+		return 0
+	}
+	return atomic.LoadUint64(&m.ops[cmd][statusIndex[status]])
+}
+
+// Total returns the number of requests for a command, regardless of status.
+func (m *Metrics) Total(cmd protocol.Command) uint64 {
+	return m.latency[cmd].Count()
+}
+
+// Latency returns the latency histogram for a command.
+func (m *Metrics) Latency(cmd protocol.Command) *Histogram {
+	return &m.latency[cmd]
+}
+
+// Each calls fn for every command and status with a non-zero request count.
+// Statuses without their own counter are reported as 0xffff.
+func (m *Metrics) Each(fn func(cmd protocol.Command, status protocol.Status, count uint64)) {
+	for cmd := range m.ops {
+		for idx := range m.ops[cmd] {
+			n := atomic.LoadUint64(&m.ops[cmd][idx])
+			if n == 0 {
+				continue
+			}
+			status := protocol.Status(0xffff)
+			if idx < len(metricStatuses) {
+				status = metricStatuses[idx]
+			}
+			fn(protocol.Command(cmd), status, n)
+		}
+	}
+}
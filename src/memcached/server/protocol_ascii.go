@@ -0,0 +1,184 @@
+package server
+
+// Encodes the text (ASCII) wire protocol of memcache.
+//
+// Requests are a single line of space separated tokens terminated by "\r\n",
+// storage commands are followed by a data block (also terminated by "\r\n").
+// Responses are one or more lines, retrieval commands end with "END".
+
+import (
+	"bufio"
+	"errors"
+	"net/url"
+	"strconv"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// MAX_TEXT_LINE is the longest request line (excluding any data block) we
+// accept.
+const MAX_TEXT_LINE = 64 * 1024
+
+// Text protocol responses.
+const (
+	TEXT_STORED     = "STORED"
+	TEXT_NOT_STORED = "NOT_STORED"
+	TEXT_EXISTS     = "EXISTS"
+	TEXT_NOT_FOUND  = "NOT_FOUND"
+	TEXT_DELETED    = "DELETED"
+	TEXT_TOUCHED    = "TOUCHED"
+	TEXT_OK         = "OK"
+	TEXT_END        = "END"
+	TEXT_ERROR      = "ERROR"
+	TEXT_TOO_LARGE  = "SERVER_ERROR object too large for cache"
+	TEXT_NO_MEMORY  = "SERVER_ERROR out of memory storing object"
+	TEXT_BUSY       = "SERVER_ERROR busy"
+	TEXT_READ_ONLY  = "SERVER_ERROR read only"
+	TEXT_DENIED     = "CLIENT_ERROR access denied"
+)
+
+// ErrLineTooLong is returned when a text request line exceeds MAX_TEXT_LINE.
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadTextLine reads a single request line, stripping the line terminator. We
+// accept a bare "\n" as the terminator, as memcached does. The returned slice
+// is only valid until the next read.
+func ReadTextLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// longer than the read buffer, so accumulate a copy
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(long) <= MAX_TEXT_LINE {
+			line, err = r.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		line = long
+	}
+	// too long, the read stops short with bufio.ErrBufferFull
+	if len(line) > MAX_TEXT_LINE {
+		return nil, ErrLineTooLong
+	} else if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// validTextKey returns true if the key is allowed in the text protocol: a valid
+// key (see protocol.ValidKey) without control characters or whitespace.
+func validTextKey(key []byte) bool {
+	if !protocol.ValidKey(key) {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// validTextKeys returns true if all the keys are allowed in the text protocol.
+func validTextKeys(keys [][]byte) bool {
+	for _, key := range keys {
+		if !validTextKey(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNoReply returns true if the last token of a request is "noreply".
+func isNoReply(args [][]byte) bool {
+	return len(args) > 0 && string(args[len(args)-1]) == "noreply"
+}
+
+// parseUint parses a decimal token into an unsigned integer of the specified
+// bit size.
+func parseUint(tok []byte, bits int) (uint64, bool) {
+	n, err := strconv.ParseUint(string(tok), 10, bits)
+	return n, err == nil
+}
+
+// parseExptime parses a text protocol expiration time. Negative times mean the
+// item expires immediately, which we represent with an absolute time long in
+// the past.
+func parseExptime(tok []byte) (uint32, bool) {
+	n, err := strconv.ParseInt(string(tok), 10, 64)
+	switch {
+	case err != nil || n > 0xffffffff:
+		return 0, false
+	case n < 0:
+		return cache.MAX_RELATIVE_EXPIRY + 1, true
+	}
+	return uint32(n), true
+}
+
+// appendValueLine appends the header line of a retrieved item to buf.
+func appendValueLine(buf []byte, key []byte, flags uint32, length int, cas uint64, withCas bool) []byte {
+	buf = append(buf, "VALUE "...)
+	buf = append(buf, key...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, uint64(flags), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(length), 10)
+	if withCas {
+		buf = append(buf, ' ')
+		buf = strconv.AppendUint(buf, cas, 10)
+	}
+	return append(buf, "\r\n"...)
+}
+
+// textCommands maps text protocol commands to their binary equivalent, which
+// is what they are recorded as in metrics.
+var textCommands = map[string]protocol.Command{
+	"get":       protocol.CMD_GET,
+	"gets":      protocol.CMD_GET,
+	"set":       protocol.CMD_SET,
+	"cas":       protocol.CMD_SET,
+	"delete":    protocol.CMD_DELETE,
+	"touch":     protocol.CMD_TOUCH,
+	"gat":       protocol.CMD_GAT,
+	"gats":      protocol.CMD_GAT,
+	"flush_all": protocol.CMD_FLUSH,
+	"stats":     protocol.CMD_STAT,
+	"verbosity": protocol.CMD_VERBOSITY,
+	"quit":      protocol.CMD_QUIT,
+
+	// extensions for bulk invalidation
+	"flush_prefix":   protocol.CMD_FLUSH_PREFIX,
+	"invalidate_tag": protocol.CMD_INVALIDATE_TAG,
+
+	// admin commands without a binary equivalent
+	"lru_crawler": protocol.CMD_STAT,
+	"watch":       protocol.CMD_STAT,
+	"read_only":   protocol.CMD_STAT,
+	"drain":       protocol.CMD_STAT,
+	"slowlog":     protocol.CMD_STAT,
+}
+
+// appendMetadump appends the metadump line for an item to buf, in the format
+// of memcached's "lru_crawler metadump" (less the slab details):
+//
+//	key=<url-encoded key> exp=<expiry or -1> la=<last access> cas=<cas> size=<bytes>
+func appendMetadump(buf []byte, meta *cache.ItemMeta) []byte {
+	exp := meta.Expires
+	if exp == 0 {
+		exp = -1
+	}
+	buf = append(buf, "key="...)
+	buf = append(buf, url.QueryEscape(meta.Key)...)
+	buf = append(buf, " exp="...)
+	buf = strconv.AppendInt(buf, exp, 10)
+	buf = append(buf, " la="...)
+	buf = strconv.AppendInt(buf, meta.Accessed, 10)
+	buf = append(buf, " cas="...)
+	buf = strconv.AppendUint(buf, meta.Cas, 10)
+	buf = append(buf, " size="...)
+	buf = strconv.AppendUint(buf, meta.Size, 10)
+	return append(buf, '\n')
+}
@@ -0,0 +1,199 @@
+package server
+
+// Rate limiting of clients, by requests and bytes per second. Each connection
+// has its own limits and, once authenticated, is also held to those of its
+// user, which are shared by all of the user's connections. Limits are token
+// buckets holding up to a second's worth of tokens (and at least one), so a
+// client may burst up to its rate after being idle.
+//
+// The bytes a request transfers aren't known until it has been served, so the
+// bytes bucket is charged afterwards and may go into debt, with requests
+// refused until the debt is paid off.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate is a limit on the requests and bytes per second of a client, 0 for no
+// limit.
+type Rate struct {
+	Ops   float64
+	Bytes float64
+}
+
+// TokenBucket is a token bucket refilled at a fixed rate per second. Safe to use
+// from multiple Go routines.
+type TokenBucket struct {
+	rate   float64
+	burst  float64 // most tokens held, a second's worth but at least 1
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// NewTokenBucket creates a new, full TokenBucket. It holds a second's worth of
+// tokens, or one token for rates below 1 a second, which could otherwise never
+// be taken.
+func NewTokenBucket(rate float64, now time.Time) *TokenBucket {
+	burst := max(rate, 1)
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// refill adds the tokens accumulated since the last refill.
+//
+// The caller of this method should hold the lock on TokenBucket.
+func (tb *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		tb.tokens = min(tb.tokens, tb.burst)
+		tb.last = now
+	}
+}
+
+// Take takes n tokens, returning false (and taking none) if there aren't
+// enough. Safe to call on a nil TokenBucket, which always has enough.
+func (tb *TokenBucket) Take(n float64, now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(now)
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// Has returns true if there are n tokens to take, without taking them. Safe to
+// call on a nil TokenBucket, which always has enough.
+func (tb *TokenBucket) Has(n float64, now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(now)
+	return tb.tokens >= n
+}
+
+// Charge takes n tokens, going into debt if there aren't enough. Safe to call on
+// a nil TokenBucket, which does nothing.
+func (tb *TokenBucket) Charge(n float64, now time.Time) {
+	if tb == nil {
+		return
+	}
+	tb.Lock()
+	tb.refill(now)
+	tb.tokens -= n
+	tb.Unlock()
+}
+
+// InDebt returns true if more tokens have been charged than the bucket holds.
+// Safe to call on a nil TokenBucket, which is never in debt.
+func (tb *TokenBucket) InDebt(now time.Time) bool {
+	if tb == nil {
+		return false
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.refill(now)
+	return tb.tokens < 0
+}
+
+// Limits are the rate limits of a client (or all of a user's clients).
+type Limits struct {
+	rate      Rate
+	ops       *TokenBucket // nil if unlimited
+	bytes     *TokenBucket // nil if unlimited
+	throttled uint64
+}
+
+// NewLimits creates a new Limits enforcing the rate, or nil if the rate has no
+// limits.
+func NewLimits(rate Rate, now time.Time) *Limits {
+	if rate.Ops <= 0 && rate.Bytes <= 0 {
+		return nil
+	}
+	l := &Limits{rate: rate}
+	if rate.Ops > 0 {
+		l.ops = NewTokenBucket(rate.Ops, now)
+	}
+	if rate.Bytes > 0 {
+		l.bytes = NewTokenBucket(rate.Bytes, now)
+	}
+	return l
+}
+
+// Allow returns true if a request may be served now, taking it from the
+// limits. Safe to call on a nil Limits, which allows everything.
+func (l *Limits) Allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if !l.bytes.InDebt(now) && l.ops.Take(1, now) {
+		return true
+	}
+	atomic.AddUint64(&l.throttled, 1)
+	return false
+}
+
+// Ready returns true if a request may be served now, as Allow does, but
+// without taking it from the limits. Safe to call on a nil Limits, which
+// allows everything.
+func (l *Limits) Ready(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if !l.bytes.InDebt(now) && l.ops.Has(1, now) {
+		return true
+	}
+	atomic.AddUint64(&l.throttled, 1)
+	return false
+}
+
+// Charge takes the bytes transferred by a request from the limits. Safe to call
+// on a nil Limits, which does nothing.
+func (l *Limits) Charge(n int, now time.Time) {
+	if l != nil {
+		l.bytes.Charge(float64(n), now)
+	}
+}
+
+// Throttled returns the number of requests refused.
+func (l *Limits) Throttled() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.throttled)
+}
+
+// allow returns true if the client is within its own and its user's limits,
+// taking a request from them, or from neither if either refuses it. The
+// client's own limits are only used by the goroutine serving it, so once they
+// are found ready, taking from them after its user's can't fail.
+func (client *ClientConn) allow(now time.Time) bool {
+	ok := client.limits.Ready(now)
+	if ok && client.user != nil {
+		ok = client.user.limits.Allow(now)
+	}
+	if ok {
+		client.limits.Allow(now)
+	} else {
+		atomic.AddUint64(&client.handler.throttled, 1)
+		client.log.Debug("request throttled")
+	}
+	return ok
+}
+
+// charge takes the bytes transferred by a request from the client's own and its
+// user's limits.
+func (client *ClientConn) charge(n int, now time.Time) {
+	client.limits.Charge(n, now)
+	if client.user != nil {
+		client.user.limits.Charge(n, now)
+	}
+}
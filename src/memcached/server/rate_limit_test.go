@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tb := NewTokenBucket(10, now)
+
+	// starts full, allowing a burst of the rate
+	for i := 0; i < 10; i++ {
+		if !tb.Take(1, now) {
+			t.Fatalf("Burst refused after %d\n", i)
+		}
+	}
+	if tb.Take(1, now) {
+		t.Errorf("Empty bucket allowed a take\n")
+	}
+
+	// refilled at the rate, but never beyond full
+	if !tb.Take(1, now.Add(100*time.Millisecond)) || tb.Take(1, now.Add(100*time.Millisecond)) {
+		t.Errorf("Wrong refill after 100ms\n")
+	}
+	now = now.Add(time.Hour)
+	if !tb.Take(10, now) || tb.Take(1, now) {
+		t.Errorf("Bucket filled beyond its rate\n")
+	}
+
+	// charges go into debt, which has to be paid off
+	tb.Charge(5, now)
+	if !tb.InDebt(now) || !tb.InDebt(now.Add(400*time.Millisecond)) ||
+		tb.InDebt(now.Add(500*time.Millisecond)) {
+		t.Errorf("Wrong debt\n")
+	}
+
+	// rates below 1 a second still hold a token
+	slow := NewTokenBucket(0.5, now)
+	if !slow.Take(1, now) || slow.Has(1, now.Add(time.Second)) || !slow.Take(1, now.Add(2*time.Second)) {
+		t.Errorf("Wrong refill of a slow bucket\n")
+	}
+	if now = now.Add(time.Hour); !slow.Take(1, now) || slow.Has(1, now) {
+		t.Errorf("Slow bucket filled beyond one token\n")
+	}
+
+	var unlimited *TokenBucket
+	if !unlimited.Take(1000, now) || !unlimited.Has(1000, now) || unlimited.InDebt(now) {
+		t.Errorf("Nil bucket limited\n")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	if l := NewLimits(Rate{}, now); l != nil || !l.Allow(now) {
+		t.Fatalf("Unlimited rate has limits\n")
+	}
+
+	ops := NewLimits(Rate{Ops: 2}, now)
+	if !ops.Allow(now) || !ops.Allow(now) || ops.Allow(now) {
+		t.Errorf("Ops limit not enforced\n")
+	}
+	ops.Charge(1<<20, now)
+	if !ops.Allow(now.Add(time.Second)) {
+		t.Errorf("Bytes charged without a bytes limit\n")
+	}
+
+	bytes := NewLimits(Rate{Bytes: 100}, now)
+	bytes.Charge(150, now)
+	if bytes.Allow(now) || !bytes.Allow(now.Add(time.Second)) {
+		t.Errorf("Bytes limit not enforced\n")
+	}
+	if ops.Throttled() != 1 || bytes.Throttled() != 1 {
+		t.Errorf("Wrong throttled counts: %d %d\n", ops.Throttled(), bytes.Throttled())
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server := StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.clientRate = Rate{Ops: 3}
+	})
+	tc := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc.Set("key", "value", 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_BUSY)
+
+	// each connection has its own limits
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("set key 0 0 5\r\nvalue\r\n"), "STORED")
+	CheckLines(t, text.Do("get key\r\n"), "VALUE key 0 5", "value", "END")
+	text.Do("get key\r\n")
+	CheckLines(t, text.Do("set key 0 0 5\r\nvalue\r\n"), TEXT_BUSY)
+	CheckLines(t, text.Do("get key\r\n"), TEXT_BUSY)
+
+	// the data block of a refused set is swallowed, however large
+	big := strings.Repeat("x", cache.MAX_VALUE_SIZE+1)
+	CheckLines(t, text.Do(fmt.Sprintf("set key 0 0 %d\r\n%s\r\n", len(big), big)), TEXT_BUSY)
+	CheckLines(t, text.Do("get key\r\n"), TEXT_BUSY)
+
+	stats := statsMap(server.generalStats())
+	if stats["throttled_requests"] != "5" || stats["client_ops_limit"] != "3" {
+		t.Errorf("Wrong rate limit stats: %v\n", stats)
+	}
+	if busy := server.metrics.Count(protocol.CMD_GET, protocol.STATUS_BUSY); busy != 3 {
+		t.Errorf("Wrong busy gets: %d\n", busy)
+	}
+}
+
+func TestClientUserRateLimit(t *testing.T) {
+	users, err := ParseUsers(strings.NewReader("alice secret 0 1000\nbob pass 2\n"))
+	if err != nil {
+		t.Fatalf("Couldn't parse users: %s\n", err)
+	}
+	server := StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.users = users
+	})
+
+	// limits are shared by all of a user's connections
+	tc1 := DialTestClient(t, server.Addr())
+	tc2 := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc1.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00bob\x00pass"), 0), protocol.STATUS_OK)
+	CheckStatus(t, tc2.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00bob\x00pass"), 0), protocol.STATUS_OK)
+	CheckStatus(t, tc1.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc2.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc1.Get("key"), protocol.STATUS_BUSY)
+
+	// bytes are charged after the request, refusing further requests
+	tc3 := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc3.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00alice\x00secret"), 0), protocol.STATUS_OK)
+	CheckStatus(t, tc3.Set("key", strings.Repeat("x", 1500), 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc3.Get("key"), protocol.STATUS_BUSY)
+
+	stats := statsMap(users.Stats())
+	if stats["user_bob_connections"] != "2" || stats["user_bob_ops_limit"] != "2" ||
+		stats["user_bob_throttled"] != "1" || stats["user_alice_bytes_limit"] != "1000" ||
+		stats["user_alice_throttled"] != "1" {
+		t.Errorf("Wrong user stats: %v\n", stats)
+	}
+}
+
+func TestClientSlowRateLimit(t *testing.T) {
+	server := StartTestServerWith(t, cache.New(100000), func(handler *ConnectionHandler) {
+		handler.clientRate = Rate{Ops: 0.5}
+	})
+
+	// a rate below 1 a second still allows a request every so often
+	tc := DialTestClient(t, server.Addr())
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_BUSY)
+}
+
+func TestClientAllow(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	user := &User{limits: NewLimits(Rate{Ops: 2}, now)}
+	client := &ClientConn{
+		handler: &ConnectionHandler{},
+		log:     NewLogger(io.Discard, LOG_WARN),
+		limits:  NewLimits(Rate{Ops: 2}, now),
+		user:    user,
+	}
+
+	// a request refused by the user's limits (used up by its other clients)
+	// takes nothing from the client's own
+	user.limits.Allow(now)
+	user.limits.Allow(now)
+	if client.allow(now) || !client.limits.ops.Has(2, now) {
+		t.Errorf("Refused request taken from the client's limits\n")
+	}
+	if !client.allow(now.Add(time.Second)) || client.limits.ops.Has(2, now.Add(time.Second)) {
+		t.Errorf("Allowed request not taken from the client's limits\n")
+	}
+	if client.limits.Throttled() != 0 || user.limits.Throttled() != 1 {
+		t.Errorf("Wrong throttled counts: %d %d\n", client.limits.Throttled(), user.limits.Throttled())
+	}
+}
@@ -0,0 +1,414 @@
+package server
+
+// Leader-follower replication between server instances.
+//
+// A follower connects to the leader's replication port and receives a full
+// copy of the leader's cache, followed by a live feed of every mutation the
+// leader applies (set, delete, touch, flush, expiry and eviction). The feed
+// reuses the write log record format, with a few replication specific
+// operations for framing the initial sync and for heartbeats. Followers apply
+// the feed in order and serve reads, but reject writes from clients.
+//
+// The feed is ordered by publishing mutations while the leader holds the cache
+// lock. Publishing never blocks: mutations made while a follower's initial sync
+// is sent are spooled for it however many there are, but a follower that falls
+// too far behind after that is disconnected and will resync from scratch when
+// it reconnects. Mutations are numbered in the order they're published, and
+// heartbeats carry the numbers, so a follower can tell how far behind it is,
+// and resync if it finds it has missed any.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"memcached/cache"
+)
+
+// Replication specific operations sent over the mutation feed.
+const (
+	// REPL_SYNC_START begins a full sync, the CAS field holds the leader's
+	// version counter.
+	REPL_SYNC_START = cache.WalOp(0x10)
+
+	// REPL_SYNC_END ends a full sync, the CAS field holds the sequence number of
+	// the last mutation included in the sync.
+	REPL_SYNC_END = cache.WalOp(0x11)
+
+	// REPL_HEARTBEAT is sent periodically, ahead of any mutations queued for
+	// the follower. The CAS field holds the sequence number of the last
+	// mutation sent before it, which the follower checks it has applied, and
+	// the expiration field the leader's latest sequence number, which tells the
+	// follower how far behind it is.
+	REPL_HEARTBEAT = cache.WalOp(0x12)
+)
+
+const (
+	// REPL_QUEUE_SIZE is the number of mutations that may be queued for a
+	// follower once it's synced before it's considered too slow and
+	// disconnected.
+	REPL_QUEUE_SIZE = 64 * 1024
+
+	// REPL_HEARTBEAT_INTERVAL is how often the leader sends a heartbeat.
+	REPL_HEARTBEAT_INTERVAL = time.Second
+
+	// REPL_RETRY_INTERVAL is how long a follower waits before reconnecting.
+	REPL_RETRY_INTERVAL = time.Second
+)
+
+// ReplicationLeader serves the cache contents and mutation feed to followers.
+type ReplicationLeader struct {
+	cache     *cache.Cache
+	listener  *net.TCPListener
+	followers map[*replFeed]bool
+	seq       uint64
+	dropped   uint64
+	sync.Mutex
+}
+
+// replFeed is the queue of mutations waiting to be sent to one follower.
+type replFeed struct {
+	addr    net.Addr
+	queue   chan []byte
+	syncing bool     // mutations are spooled rather than queued
+	spool   [][]byte // mutations made while the initial sync is sent
+}
+
+// NewReplicationLeader creates a new ReplicationLeader that accepts followers
+// on the specified address, and attaches it to the cache as a journal.
+func NewReplicationLeader(c *cache.Cache, addr *net.TCPAddr) (*ReplicationLeader, error) {
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	DefaultLogger.Info("replication listening", "addr", l.Addr())
+
+	leader := &ReplicationLeader{
+		cache:     c,
+		listener:  l,
+		followers: make(map[*replFeed]bool),
+	}
+	c.AddJournal(leader)
+	return leader, nil
+}
+
+// Addr returns the address the leader is accepting followers on.
+func (leader *ReplicationLeader) Addr() net.Addr {
+	return leader.listener.Addr()
+}
+
+// Run accepts followers until the leader is closed.
+func (leader *ReplicationLeader) Run() {
+	for {
+		conn, err := leader.listener.AcceptTCP()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			DefaultLogger.Error("replication accept failed", "err", err)
+			continue
+		}
+		go leader.serve(conn)
+	}
+}
+
+// Close stops accepting followers and disconnects all existing ones.
+func (leader *ReplicationLeader) Close() error {
+	err := leader.listener.Close()
+	leader.Lock()
+	for feed := range leader.followers {
+		leader.drop(feed)
+	}
+	leader.Unlock()
+	return err
+}
+
+// Append queues an encoded mutation for every follower, or spools it for those
+// still being sent their initial sync. A follower whose queue is full is
+// disconnected.
+//
+// The caller of this method should hold the write lock on Cache.
+func (leader *ReplicationLeader) Append(rec []byte) {
+	leader.Lock()
+	defer leader.Unlock()
+
+	leader.seq++
+	if len(leader.followers) == 0 {
+		return
+	}
+	rec = append([]byte(nil), rec...)
+	for feed := range leader.followers {
+		if feed.syncing {
+			feed.spool = append(feed.spool, rec)
+			continue
+		}
+		select {
+		case feed.queue <- rec:
+		default:
+			DefaultLogger.Warn("replication follower too slow, dropping", "follower", feed.addr)
+			leader.drop(feed)
+		}
+	}
+}
+
+// drop disconnects a follower.
+//
+// The caller of this method should hold the lock on ReplicationLeader.
+func (leader *ReplicationLeader) drop(feed *replFeed) {
+	if leader.followers[feed] {
+		delete(leader.followers, feed)
+		close(feed.queue)
+		leader.dropped++
+	}
+}
+
+// serve sends a full sync and then the mutation feed to a follower.
+func (leader *ReplicationLeader) serve(conn *net.TCPConn) {
+	defer conn.Close()
+	conn.SetNoDelay(true)
+	DefaultLogger.Info("replication follower connected", "follower", conn.RemoteAddr())
+
+	// snapshot the cache contents and register for the feed atomically, so no
+	// mutation is missed or sent twice
+	feed := &replFeed{addr: conn.RemoteAddr(), queue: make(chan []byte, REPL_QUEUE_SIZE), syncing: true}
+	var seq uint64
+	snap := leader.cache.Snapshot(func() {
+		leader.Lock()
+		seq = leader.seq
+		leader.followers[feed] = true
+		leader.Unlock()
+	})
+
+	w := bufio.NewWriter(conn)
+	err := leader.sync(w, seq, snap)
+	snap = nil
+
+	// then the mutations spooled meanwhile, queueing any further ones
+	leader.Lock()
+	spool := feed.spool
+	feed.spool, feed.syncing = nil, false
+	leader.Unlock()
+	for _, rec := range spool {
+		if err == nil {
+			_, err = w.Write(rec)
+			seq++
+		}
+	}
+	spool = nil
+	if err == nil {
+		err = w.Flush()
+	}
+
+	// seq follows the mutations sent, while heartbeats carry the latest too
+	ticker := time.NewTicker(REPL_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	var heartbeat []byte
+	for err == nil {
+		select {
+		case rec, ok := <-feed.queue:
+			if !ok {
+				return
+			}
+			_, err = w.Write(rec)
+			seq++
+		case <-ticker.C:
+			leader.Lock()
+			latest := leader.seq
+			leader.Unlock()
+			heartbeat = cache.AppendRecord(heartbeat[:0], REPL_HEARTBEAT, seq, int64(latest), nil, "", nil)
+			_, err = w.Write(heartbeat)
+		}
+		if err == nil && len(feed.queue) == 0 {
+			err = w.Flush()
+		}
+	}
+
+	DefaultLogger.Info("replication follower disconnected", "follower", conn.RemoteAddr(), "err", err)
+	leader.Lock()
+	leader.drop(feed)
+	leader.Unlock()
+}
+
+// sync writes a full sync of a snapshot to a follower.
+func (leader *ReplicationLeader) sync(w *bufio.Writer, seq uint64, snap *cache.Snapshot) error {
+	buf := cache.AppendRecord(nil, REPL_SYNC_START, snap.Version, 0, nil, "", nil)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	err := snap.Each(func(r *cache.Record) error {
+		buf = cache.AppendRecord(buf[:0], r.Op, r.Cas, r.Expires, r.Flags[:], r.Key, r.Value, r.Chunks...)
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	buf = cache.AppendRecord(buf[:0], REPL_SYNC_END, seq, 0, nil, "", nil)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Stats returns the replication statistics of the leader.
+func (leader *ReplicationLeader) Stats() []Stat {
+	leader.Lock()
+	defer leader.Unlock()
+
+	return []Stat{
+		{"repl_role", "leader"},
+		{"repl_followers", fmt.Sprint(len(leader.followers))},
+		{"repl_followers_dropped", fmt.Sprint(leader.dropped)},
+		{"repl_seq", fmt.Sprint(leader.seq)},
+	}
+}
+
+// ReplicationFollower maintains a copy of a leader's cache.
+type ReplicationFollower struct {
+	cache      *cache.Cache
+	leaderAddr string
+	conn       net.Conn
+	connected  bool
+	synced     bool
+	closed     bool
+	syncs      uint64
+	applied    uint64
+	seq        uint64
+	heartbeat  time.Time
+	lag        uint64 // mutations behind the leader, as of the last heartbeat
+	sync.Mutex
+}
+
+// NewReplicationFollower creates a new ReplicationFollower to replicate the
+// leader at the specified address into the cache.
+func NewReplicationFollower(c *cache.Cache, leaderAddr string) *ReplicationFollower {
+	return &ReplicationFollower{cache: c, leaderAddr: leaderAddr}
+}
+
+// Run connects to the leader and applies its mutation feed, reconnecting (and
+// resyncing) whenever the connection fails, until the follower is closed.
+func (f *ReplicationFollower) Run() {
+	for {
+		conn, err := net.Dial("tcp", f.leaderAddr)
+		if err == nil {
+			err = f.follow(conn)
+		}
+
+		f.Lock()
+		closed := f.closed
+		f.connected = false
+		f.synced = false
+		f.Unlock()
+		if closed {
+			return
+		}
+
+		DefaultLogger.Error("replication failed", "leader", f.leaderAddr, "err", err)
+		time.Sleep(REPL_RETRY_INTERVAL)
+	}
+}
+
+// Close disconnects the follower from the leader and stops Run.
+func (f *ReplicationFollower) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.closed = true
+	if f.conn != nil {
+		return f.conn.Close()
+	}
+	return nil
+}
+
+// Synced returns true if the follower has completed the initial sync with the
+// leader and is applying the mutation feed.
+func (f *ReplicationFollower) Synced() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.synced
+}
+
+// follow applies the sync and mutation feed from a connection to the leader,
+// until an error occurs.
+func (f *ReplicationFollower) follow(conn net.Conn) error {
+	defer conn.Close()
+
+	f.Lock()
+	if f.closed {
+		f.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.connected = true
+	f.Unlock()
+
+	r := bufio.NewReader(conn)
+	for {
+		rec, _, err := cache.ReadRecord(r)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		f.Lock()
+		switch rec.Op {
+		case REPL_SYNC_START:
+			f.cache.Resync(rec.Cas)
+			f.syncs++
+		case REPL_SYNC_END:
+			f.synced = true
+			f.seq = rec.Cas
+		case REPL_HEARTBEAT:
+			if f.synced && rec.Cas != f.seq {
+				// mutations were missed, so the cache has diverged
+				seq := f.seq
+				f.Unlock()
+				return fmt.Errorf("replication feed at seq %d, leader sent up to %d", seq, rec.Cas)
+			}
+			latest := uint64(rec.Expires)
+			f.heartbeat = time.Now()
+			f.lag = latest - min(f.seq, latest)
+		default:
+			f.cache.Apply(rec)
+			f.applied++
+			if f.synced {
+				f.seq++
+			}
+		}
+		f.Unlock()
+	}
+}
+
+// Stats returns the replication statistics of the follower.
+func (f *ReplicationFollower) Stats() []Stat {
+	f.Lock()
+	defer f.Unlock()
+
+	stats := []Stat{
+		{"repl_role", "follower"},
+		{"repl_leader", f.leaderAddr},
+		{"repl_connected", fmt.Sprint(boolToInt(f.connected))},
+		{"repl_synced", fmt.Sprint(boolToInt(f.synced))},
+		{"repl_syncs", fmt.Sprint(f.syncs)},
+		{"repl_applied", fmt.Sprint(f.applied)},
+		{"repl_seq", fmt.Sprint(f.seq)},
+		{"repl_lag", fmt.Sprint(f.lag)},
+	}
+	if !f.heartbeat.IsZero() {
+		since := time.Since(f.heartbeat).Nanoseconds() / int64(time.Millisecond)
+		stats = append(stats, Stat{"repl_last_heartbeat_ms", fmt.Sprint(since)})
+	}
+	return stats
+}
+
+// boolToInt converts a bool to 0 or 1, for reporting in statistics.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
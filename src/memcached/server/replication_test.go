@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// StartTestPair starts a leader and a follower server on localhost, returning
+// once the follower has synced.
+func StartTestPair(t *testing.T) (*ConnectionHandler, *ConnectionHandler) {
+	leader := StartTestServer(t, cache.New(100000))
+	var err error
+	leader.leader, err = NewReplicationLeader(leader.cache, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't start replication leader: %s\n", err)
+	}
+	go leader.leader.Run()
+	t.Cleanup(func() { leader.leader.Close() })
+
+	// populate the leader before the follower connects to test the full sync
+	tc := DialTestClient(t, leader.Addr())
+	tc.Set("sync1", "value1", 0, 0)
+	tc.Set("sync2", "value2", 0, 0)
+	tc.Set("sync3", "value3", 0, 0)
+	tc.Delete("sync3")
+
+	follower := StartTestServer(t, cache.New(100000))
+	follower.follower = NewReplicationFollower(follower.cache, leader.leader.Addr().String())
+	go follower.follower.Run()
+	t.Cleanup(func() { follower.follower.Close() })
+	Eventually(t, "follower to sync", follower.follower.Synced)
+
+	return leader, follower
+}
+
+// WaitForValue waits for a key to have the specified value on a server, or to
+// be missing if value is nil.
+func WaitForValue(t *testing.T, tc *TestClient, key string, value []byte) *Response {
+	t.Helper()
+	var resp *Response
+	Eventually(t, "replication of "+key, func() bool {
+		resp = tc.Get(key)
+		if value == nil {
+			return protocol.Status(resp.Status) == protocol.STATUS_KEY_NOT_FOUND
+		}
+		return protocol.Status(resp.Status) == protocol.STATUS_OK && string(resp.value) == string(value)
+	})
+	return resp
+}
+
+func TestReplicationSync(t *testing.T) {
+	leader, follower := StartTestPair(t)
+	lc := DialTestClient(t, leader.Addr())
+	fc := DialTestClient(t, follower.Addr())
+
+	l1, f1 := lc.Get("sync1"), fc.Get("sync1")
+	CheckStatus(t, f1, protocol.STATUS_OK)
+	if string(f1.value) != "value1" || f1.Cas != l1.Cas {
+		t.Errorf("Wrong synced value: %s (%d vs %d)\n", f1.value, f1.Cas, l1.Cas)
+	}
+	CheckStatus(t, fc.Get("sync2"), protocol.STATUS_OK)
+	CheckStatus(t, fc.Get("sync3"), protocol.STATUS_KEY_NOT_FOUND)
+}
+
+func TestReplicationFeed(t *testing.T) {
+	leader, follower := StartTestPair(t)
+	lc := DialTestClient(t, leader.Addr())
+	fc := DialTestClient(t, follower.Addr())
+
+	// set
+	set := lc.Set("key", "value", 0, 0)
+	get := WaitForValue(t, fc, "key", []byte("value"))
+	if get.Cas != set.Cas {
+		t.Errorf("CAS differs between leader and follower: %d vs %d\n", set.Cas, get.Cas)
+	}
+
+	// touch
+	lc.Do(protocol.CMD_TOUCH, []byte{0, 0, 0, 100}, []byte("key"), nil, 0)
+	lc.Set("marker", "touch", 0, 0)
+	WaitForValue(t, fc, "marker", []byte("touch"))
+	if i, err := follower.cache.Get(ctx, []byte("key")); err != nil || i.Expires == 0 {
+		t.Error("Touch not replicated\n")
+	}
+
+	// delete
+	lc.Delete("key")
+	WaitForValue(t, fc, "key", nil)
+
+	// flush
+	CheckStatus(t, lc.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_OK)
+	WaitForValue(t, fc, "marker", nil)
+	WaitForValue(t, fc, "sync1", nil)
+}
+
+func TestReplicationFollowerReadOnly(t *testing.T) {
+	leader, follower := StartTestPair(t)
+	fc := DialTestClient(t, follower.Addr())
+
+	CheckStatus(t, fc.Set("key", "value", 0, 0), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, fc.Delete("sync1"), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, fc.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_NOT_SUPPORTED)
+	CheckStatus(t, fc.Get("sync1"), protocol.STATUS_OK)
+	CheckStatus(t, DialTestClient(t, leader.Addr()).Get("sync1"), protocol.STATUS_OK)
+}
+
+func TestReplicationResync(t *testing.T) {
+	leader, follower := StartTestPair(t)
+	lc := DialTestClient(t, leader.Addr())
+	fc := DialTestClient(t, follower.Addr())
+
+	// disconnect the follower, it should reconnect and resync
+	leader.leader.Lock()
+	for feed := range leader.leader.followers {
+		leader.leader.drop(feed)
+	}
+	leader.leader.Unlock()
+	Eventually(t, "follower to disconnect", func() bool {
+		return !follower.follower.Synced()
+	})
+	lc.Set("key", "value", 0, 0)
+	Eventually(t, "follower to resync", follower.follower.Synced)
+	WaitForValue(t, fc, "key", []byte("value"))
+
+	stats := fc.Stats("replication")
+	if stats["repl_role"] != "follower" || stats["repl_syncs"] != "2" {
+		t.Errorf("Wrong replication stats: %v\n", stats)
+	}
+	stats = lc.Stats("replication")
+	if stats["repl_role"] != "leader" || stats["repl_followers"] != "1" {
+		t.Errorf("Wrong replication stats: %v\n", stats)
+	}
+}
+
+func TestReplicationSpool(t *testing.T) {
+	leader, err := NewReplicationLeader(cache.New(100000), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't start replication leader: %s\n", err)
+	}
+	defer leader.Close()
+
+	// mutations made during a follower's initial sync are spooled however many
+	// there are, and only queued, up to REPL_QUEUE_SIZE, once it's synced
+	feed := &replFeed{queue: make(chan []byte, REPL_QUEUE_SIZE), syncing: true}
+	leader.followers[feed] = true
+	rec := cache.AppendRecord(nil, cache.WAL_DELETE, 0, 0, nil, "key", nil)
+	for range REPL_QUEUE_SIZE + 1 {
+		leader.Append(rec)
+	}
+	if !leader.followers[feed] || len(feed.spool) != REPL_QUEUE_SIZE+1 || len(feed.queue) != 0 {
+		t.Errorf("Syncing follower not spooled: %d spooled\n", len(feed.spool))
+	}
+	feed.syncing = false
+	for range REPL_QUEUE_SIZE + 1 {
+		leader.Append(rec)
+	}
+	if leader.followers[feed] || leader.dropped != 1 {
+		t.Errorf("Slow follower not dropped\n")
+	}
+}
+
+func TestReplicationHeartbeat(t *testing.T) {
+	f := NewReplicationFollower(cache.New(100000), "leader")
+	leader, conn := net.Pipe()
+	done := make(chan error)
+	go func() { done <- f.follow(conn) }()
+
+	send := func(op cache.WalOp, cas uint64, expires int64, key string) {
+		if _, err := leader.Write(cache.AppendRecord(nil, op, cas, expires, make([]byte, 4), key, nil)); err != nil {
+			t.Fatalf("Couldn't send record: %s\n", err)
+		}
+	}
+	send(REPL_SYNC_START, 10, 0, "")
+	send(REPL_SYNC_END, 5, 0, "")
+	send(cache.WAL_SET, 11, 0, "key")
+
+	// the lag is how many mutations the leader had published beyond those sent
+	send(REPL_HEARTBEAT, 6, 9, "")
+	send(REPL_HEARTBEAT, 6, 9, "")
+	stats := statsMap(f.Stats())
+	if stats["repl_seq"] != "6" || stats["repl_lag"] != "3" {
+		t.Errorf("Wrong replication stats: %v\n", stats)
+	}
+
+	// and a follower that missed mutations disconnects, to resync
+	send(REPL_HEARTBEAT, 8, 9, "")
+	if err := <-done; err == nil {
+		t.Errorf("Follower carried on after missing mutations\n")
+	}
+}
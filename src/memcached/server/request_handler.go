@@ -0,0 +1,656 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// ClientConn represents a connection with a single memcache client.
+type ClientConn struct {
+	id      uint
+	handler *ConnectionHandler
+	store   storage.Storage
+	ctx     context.Context // canceled once the connection closes
+	cancel  context.CancelFunc
+	conn    *net.TCPConn
+	bio     *bufio.ReadWriter
+	log     *Logger
+	status  protocol.Status // status of the last response written
+	size    int             // size of the value in the last response written
+	limits  *Limits
+	user    *User // nil until authenticated
+
+	// timing of the current request (see timed)
+	parsed    time.Time       // when it was read in full
+	lockTimer cache.LockTimer // its waits for the cache lock
+
+	// buffers reused across requests, so serving one needn't allocate
+	hdr         [protocol.HEADER_SIZE]byte
+	flags       [4]byte
+	leaseExtras [8]byte
+	keyBuf      []byte    // for keys in the client's namespace
+	buf         []byte    // for bodies up to MIN_POOLED_BUFFER
+	pooled      *[]byte   // borrowed from the pool for a larger body
+	chunks      [][]byte  // value of a body too large for one buffer
+	pooledRefs  []*[]byte // the pooled buffers of the chunks
+	line        []byte    // copy of the current text request line
+	args        [][]byte
+	tags        [][]byte // of the current set
+	scratch     []byte
+}
+
+// NewClientConn creates a new ClientConn to manage the TCP connection for a
+// memcache client.
+func NewClientConn(id uint, handler *ConnectionHandler, conn *net.TCPConn) *ClientConn {
+	conn.SetLinger(0)
+	conn.SetKeepAlive(true)
+	conn.SetNoDelay(true)
+	bio := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &ClientConn{
+		id:      id,
+		handler: handler,
+		store:   handler.store,
+		cancel:  cancel,
+		conn:    conn,
+		bio:     bio,
+		log:     handler.logger.With("client", id),
+		limits:  NewLimits(handler.clientRate, time.Now()),
+	}
+	client.ctx = cache.WithLockTimer(ctx, &client.lockTimer)
+	return client
+}
+
+// Run loops forever, processing a client connection for incoming requests.
+func (client *ClientConn) Run() {
+	defer client.conn.Close()
+	defer client.cancel()
+	defer client.bio.Flush()
+	defer client.log.Info("end client")
+	defer client.setUser(nil)
+
+	client.log.Info("new client", "addr", client.conn.RemoteAddr())
+
+	// the protocol is chosen by the first byte the client sends
+	first, err := client.bio.Peek(1)
+	if err != nil {
+		return
+	}
+	if protocol.RequestType(first[0]) != protocol.MSG_REQUEST {
+		client.runText()
+		return
+	}
+
+	var req protocol.Header
+
+	for {
+		// read header
+		err := req.ReadRequestBuf(client.bio, client.hdr[:])
+		if err != nil {
+			if err != io.ErrUnexpectedEOF && err != io.EOF {
+				client.log.Error("reading header", "err", err)
+			}
+			return
+		}
+		if err = client.serve(&req); err != nil {
+			return
+		}
+	}
+}
+
+// ErrBodyTooLarge is returned when a request value exceeds cache.MAX_VALUE_SIZE,
+// or the item size limit for a value stored.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// serve serves a single request, the header of which has been read. Returns an
+// error if the connection should be closed.
+func (client *ClientConn) serve(req *protocol.Header) error {
+	start := time.Now()
+	client.parsed = start
+
+	// validate size - we could perhaps get away with a far larger size as we
+	// aren't using a hand-rolled slab allocator like memcached, but a max size
+	// to ensure some safety (e.g., no 4GB value) is reasonable. Only values
+	// stored may be larger than MAX_VALUE_SIZE, up to the item size limit.
+	limit := cache.MAX_VALUE_SIZE
+	switch req.Opcode {
+	case protocol.CMD_SET, protocol.CMD_ADD, protocol.CMD_LEASE_SET:
+		limit = client.handler.maxItemSize
+	}
+	if int(req.TotalLength)-int(req.KeyLength)-int(req.ExtrasLength) > limit {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_VALUE_TOO_LARGE,
+			nil, nil, nil, req.Opaque, 0)
+		client.writeResponse(&resp, nil, nil, nil)
+		client.handler.metrics.Record(req.Opcode, client.status, time.Since(start))
+		flushing := time.Now()
+		client.bio.Flush()
+		client.timed(req.Opcode, nil, 0, start, flushing)
+		return ErrBodyTooLarge
+	}
+
+	// read body, the value into chunks if too large for one buffer
+	n := int(req.TotalLength)
+	if n > cache.MAX_VALUE_SIZE {
+		n = int(req.ExtrasLength) + int(req.KeyLength)
+	}
+	body := client.buffer(n)
+	defer client.release()
+	if _, err := io.ReadFull(client.bio, body); err != nil {
+		client.log.Error("reading body", "err", err)
+		return err
+	}
+	if n < int(req.TotalLength) {
+		if err := client.readChunks(int(req.TotalLength) - n); err != nil {
+			client.log.Error("reading body", "err", err)
+			return err
+		}
+	}
+	extras := body[:req.ExtrasLength]
+	key := body[req.ExtrasLength:][:req.KeyLength]
+	value := body[req.ExtrasLength:][req.KeyLength:]
+	client.parsed = time.Now()
+
+	// run command, unless the client is over its rate limits (having read the
+	// body so we stay in sync with it)
+	var err error
+	if client.allow(start) {
+		err = client.dispatch(req, extras, key, value)
+	} else {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_BUSY, nil, nil, nil, req.Opaque, 0)
+		err = client.writeResponse(&resp, nil, nil, nil)
+	}
+	client.charge(protocol.HEADER_SIZE+int(req.TotalLength)+client.size, start)
+
+	// record metrics before flushing, so they're visible once the client has
+	// its response
+	client.handler.metrics.Record(req.Opcode, client.status, time.Since(start))
+	size := client.size
+	if req.Opcode.IsMutation() {
+		size = int(req.TotalLength) - len(extras) - len(key)
+	}
+	key = client.key(key)
+	client.handler.watchers.Request(client.id, req.Opcode, key, client.status, size)
+
+	// flush output, timing the request once the client has its response
+	flushing := time.Now()
+	client.bio.Flush()
+	client.timed(req.Opcode, key, size, start, flushing)
+	return err
+}
+
+// timed records the timing of a request served since start, its response
+// being flushed from flushing on, in the latency histograms, and in the slow
+// log if it was slow, with the key and size (of the value set or returned).
+func (client *ClientConn) timed(cmd protocol.Command, key []byte, size int, start, flushing time.Time) {
+	now := time.Now()
+	var t Timing
+	t[PHASE_TOTAL] = now.Sub(start)
+	t[PHASE_PARSE] = client.parsed.Sub(start)
+	t[PHASE_LOCK] = client.lockTimer.Wait
+	t[PHASE_EXEC] = max(flushing.Sub(client.parsed)-client.lockTimer.Wait, 0)
+	t[PHASE_WRITE] = now.Sub(flushing)
+	client.lockTimer.Wait = 0
+
+	client.handler.latency.Record(cmd, &t)
+	if slowLog := client.handler.slowLog; slowLog.Slow(t[PHASE_TOTAL]) {
+		slowLog.Add(SlowRequest{
+			Time:    start,
+			Command: cmd,
+			Key:     string(key),
+			Size:    size,
+			Client:  client.id,
+			Addr:    client.conn.RemoteAddr().String(),
+			Timing:  t,
+		})
+	}
+}
+
+// dispatch runs the handler for a single request.
+func (client *ClientConn) dispatch(req *protocol.Header, extras, key, value []byte) error {
+	// with users configured, clients must authenticate before anything else
+	if !client.authenticated() && req.Opcode != protocol.CMD_SASL_LIST_MECHS &&
+		req.Opcode != protocol.CMD_SASL_AUTH {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_AUTH_FAILED,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+	// followers and read-only servers only serve reads
+	if req.Opcode.IsMutation() && client.handler.ReadOnly() {
+		resp := protocol.NewResponse(req.Opcode, client.handler.refuseMutation(),
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+	// clients in no tenant are kept to the default tenant's keys
+	if !client.permitted(req, extras, key) {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_AUTH_FAILED,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	switch req.Opcode {
+	case protocol.CMD_GET:
+		return client.handleGet(req, extras, key, value)
+	case protocol.CMD_SET:
+		return client.handleSet(req, extras, key, value)
+	case protocol.CMD_ADD:
+		return client.handleAdd(req, extras, key, value)
+	case protocol.CMD_INCREMENT, protocol.CMD_DECREMENT:
+		return client.handleIncr(req, extras, key, value)
+	case protocol.CMD_DELETE:
+		return client.handleDelete(req, extras, key, value)
+	case protocol.CMD_TOUCH:
+		return client.handleTouch(req, extras, key, value)
+	case protocol.CMD_GAT:
+		return client.handleGAT(req, extras, key, value)
+	case protocol.CMD_FLUSH:
+		return client.handleFlush(req, extras, key, value)
+	case protocol.CMD_STAT:
+		return client.handleStat(req, extras, key, value)
+	case protocol.CMD_VERBOSITY:
+		return client.handleVerbosity(req, extras, key, value)
+	case protocol.CMD_SASL_LIST_MECHS:
+		return client.handleSASLList(req, extras, key, value)
+	case protocol.CMD_SASL_AUTH:
+		return client.handleSASLAuth(req, extras, key, value)
+	case protocol.CMD_LEASE_GET:
+		return client.handleLeaseGet(req, extras, key, value)
+	case protocol.CMD_LEASE_SET:
+		return client.handleLeaseSet(req, extras, key, value)
+	case protocol.CMD_FLUSH_PREFIX:
+		return client.handleFlushPrefix(req, extras, key, value)
+	case protocol.CMD_INVALIDATE_TAG:
+		return client.handleInvalidateTag(req, extras, key, value)
+	default:
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_UNKNOWN_COMMAND,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+}
+
+// writeResponse writes out a complete memcache response, recording its status
+// for the request metrics.
+func (client *ClientConn) writeResponse(hdr *protocol.Header, extras, key, value []byte) error {
+	client.status = protocol.Status(hdr.Status)
+	client.size = len(value)
+	return protocol.WriteResponseBuf(client.bio, client.hdr[:], hdr, extras, key, value)
+}
+
+// writeItem writes out a complete memcache response with the item's value,
+// which may be in chunks.
+func (client *ClientConn) writeItem(hdr *protocol.Header, extras []byte, item *storage.Item) error {
+	if item.Chunks == nil {
+		return client.writeResponse(hdr, extras, nil, item.Value)
+	}
+	hdr.TotalLength = uint32(len(extras) + item.Len())
+	if err := client.writeResponse(hdr, extras, nil, nil); err != nil {
+		return err
+	}
+	client.size = item.Len()
+	for _, c := range item.Chunks {
+		if _, err := client.bio.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set stores the value for the key, or the value read into chunks for a large
+// body, joined into one piece if the storage doesn't store chunks. The item is
+// tagged if any tags are given, and the storage supports tags.
+func (client *ClientConn) set(key, value []byte, flags, exptime uint32, cas uint64, tags [][]byte) (uint64, error) {
+	if tags != nil {
+		return client.setTagged(key, value, flags, exptime, cas, tags)
+	} else if client.chunks == nil {
+		return client.store.Set(client.ctx, key, value, flags, exptime, cas)
+	} else if client.handler.chunker != nil {
+		return client.handler.chunker.SetChunks(client.ctx, key, client.chunks, flags, exptime, cas)
+	}
+	item := storage.Item{Chunks: client.chunks}
+	return client.store.Set(client.ctx, key, item.Bytes(), flags, exptime, cas)
+}
+
+// statusOf returns the status of the response to a request the storage failed
+// with err.
+func statusOf(err error) protocol.Status {
+	switch err {
+	case nil:
+		return protocol.STATUS_OK
+	case storage.ErrNotFound:
+		return protocol.STATUS_KEY_NOT_FOUND
+	case storage.ErrExists:
+		return protocol.STATUS_KEY_EXISTS
+	case storage.ErrNotStored:
+		return protocol.STATUS_ITEM_NOT_STORED
+	case storage.ErrTooLarge:
+		return protocol.STATUS_VALUE_TOO_LARGE
+	case storage.ErrNoMemory:
+		return protocol.STATUS_OUT_OF_MEMORY
+	case storage.ErrNonNumeric:
+		return protocol.STATUS_NON_NUMERIC
+	case storage.ErrNotSupported:
+		return protocol.STATUS_NOT_SUPPORTED
+	case storage.ErrHotMiss:
+		return protocol.STATUS_HOT_MISS
+	case storage.ErrInvalidLease:
+		return protocol.STATUS_ITEM_NOT_STORED
+	default:
+		return protocol.STATUS_INTERNAL_ERROR
+	}
+}
+
+// itemFlags returns the item's flags as sent to clients. The bytes returned are
+// only valid until the next call.
+func (client *ClientConn) itemFlags(item *storage.Item) []byte {
+	binary.BigEndian.PutUint32(client.flags[:], item.Flags)
+	return client.flags[:]
+}
+
+// debugKey logs a request for a key at the debug level. The level is checked
+// first, so the key is only boxed (which allocates) if it's to be logged.
+func (client *ClientConn) debugKey(msg string, key []byte) {
+	if client.log.Enabled(LOG_DEBUG) {
+		client.log.Debug(msg, "key", key)
+	}
+}
+
+// handleGet handles the memcache get command.
+func (client *ClientConn) handleGet(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("get", key)
+
+	if len(extras) != 0 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Read(key)
+	item, err := client.store.Get(client.ctx, key)
+
+	if err != nil {
+		resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	flags := client.itemFlags(&item)
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, item.Value, flags, req.Opaque, item.CAS)
+	return client.writeItem(&resp, flags, &item)
+}
+
+// handleSet handles the memcache set command.
+func (client *ClientConn) handleSet(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("set", key)
+
+	tags, ok := client.parseTags(extras)
+	if !ok || !protocol.ValidKey(key) {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	flags := binary.BigEndian.Uint32(extras[0:4])
+	exptime := binary.BigEndian.Uint32(extras[4:8])
+	ver, err := client.set(key, value, flags, exptime, req.Cas, tags)
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, ver)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleAdd handles the memcache add command.
+func (client *ClientConn) handleAdd(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("add", key)
+
+	if len(extras) != 8 || !protocol.ValidKey(key) || req.Cas != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	if client.chunks != nil {
+		item := storage.Item{Chunks: client.chunks}
+		value = item.Bytes()
+	}
+	flags := binary.BigEndian.Uint32(extras[0:4])
+	exptime := binary.BigEndian.Uint32(extras[4:8])
+	ver, err := client.store.Add(client.ctx, key, value, flags, exptime)
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, ver)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleIncr handles the memcache increment and decrement commands. A missing
+// key is created with the initial value, unless the expiration is NO_CREATE.
+// The response has no CAS value, as the storage doesn't return one.
+func (client *ClientConn) handleIncr(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey(req.Opcode.String(), key)
+
+	if len(extras) != 20 || !protocol.ValidKey(key) || len(value) != 0 || req.Cas != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	n, err := client.incr(key, binary.BigEndian.Uint64(extras), req.Opcode == protocol.CMD_DECREMENT,
+		binary.BigEndian.Uint64(extras[8:]), binary.BigEndian.Uint32(extras[16:]))
+
+	if err != nil {
+		resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], n)
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, counter[:], nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, counter[:])
+}
+
+// incr adds delta to (or if decr is true, subtracts it from) the number stored
+// for the key, first storing the initial value with the expiration if the key
+// is missing (unless it's NO_CREATE).
+func (client *ClientConn) incr(key []byte, delta uint64, decr bool, initial uint64, exptime uint32) (uint64, error) {
+	n, err := client.store.Incr(client.ctx, key, delta, decr)
+	if err != storage.ErrNotFound || exptime == protocol.NO_CREATE {
+		return n, err
+	}
+	_, err = client.store.Add(client.ctx, key, strconv.AppendUint(nil, initial, 10), 0, exptime)
+	if err == storage.ErrNotStored {
+		// added by another client meanwhile
+		return client.store.Incr(client.ctx, key, delta, decr)
+	}
+	return initial, err
+}
+
+// handleDelete handles the memcache delete command.
+func (client *ClientConn) handleDelete(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("delete", key)
+
+	if len(extras) != 0 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	err := client.store.Delete(client.ctx, key, req.Cas)
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleTouch handles the memcache touch command.
+func (client *ClientConn) handleTouch(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("touch", key)
+
+	if len(extras) != 4 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Write(key)
+	item, err := client.store.Touch(client.ctx, key, binary.BigEndian.Uint32(extras))
+
+	if err != nil {
+		resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, nil, nil, req.Opaque, item.CAS)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleGAT handles the memcache get-and-touch command.
+func (client *ClientConn) handleGAT(req *protocol.Header, extras, key, value []byte) error {
+	client.debugKey("gat", key)
+
+	if len(extras) != 4 || !protocol.ValidKey(key) || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	key = client.key(key)
+	client.handler.hotKeys.Read(key)
+	item, err := client.store.Touch(client.ctx, key, binary.BigEndian.Uint32(extras))
+
+	if err != nil {
+		resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	flags := client.itemFlags(&item)
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, item.Value, flags, req.Opaque, item.CAS)
+	return client.writeItem(&resp, flags, &item)
+}
+
+// handleFlush handles the memcache flush command. We only support flushing
+// immediately, not at some time in the future. Clients of a tenant only flush
+// the tenant's keys, and when tenants are configured clients in none of them
+// only flush the default tenant's.
+func (client *ClientConn) handleFlush(req *protocol.Header, extras, key, value []byte) error {
+	client.log.Debug("flush")
+
+	if (len(extras) != 0 && len(extras) != 4) || len(key) != 0 || len(value) != 0 ||
+		(len(extras) == 4 && binary.BigEndian.Uint32(extras) != 0) {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	err := client.flush()
+
+	resp := protocol.NewResponse(req.Opcode, statusOf(err), nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleStat handles the memcache stat command. The key selects the group of
+// statistics to return, each statistic is sent as a separate response with a
+// final empty response terminating the list.
+func (client *ClientConn) handleStat(req *protocol.Header, extras, key, value []byte) error {
+	client.log.Debug("stat", "group", key)
+
+	if len(extras) != 0 || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	stats, ok := client.stats(string(key))
+	if !ok {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_KEY_NOT_FOUND, nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	for _, stat := range stats {
+		k, v := []byte(stat.Name), []byte(stat.Value)
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, k, v, nil, req.Opaque, 0)
+		if err := client.writeResponse(&resp, nil, k, v); err != nil {
+			return err
+		}
+	}
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// handleVerbosity handles the memcache verbosity command, which changes the log
+// level of the server.
+func (client *ClientConn) handleVerbosity(req *protocol.Header, extras, key, value []byte) error {
+	if len(extras) != 4 || len(key) != 0 || len(value) != 0 {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_INVALID_ARGUMENT,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	client.setVerbosity(binary.BigEndian.Uint32(extras))
+
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, nil, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, nil)
+}
+
+// setVerbosity changes the log level of the server.
+func (client *ClientConn) setVerbosity(verbosity uint32) {
+	level := VerbosityLevel(verbosity)
+	client.handler.logger.SetLevel(level)
+	client.log.Info("log level changed", "level", level)
+}
+
+// handleSASLList handles the memcache SASL list mechanisms command. We only
+// support PLAIN, and only if there are users to authenticate as.
+func (client *ClientConn) handleSASLList(req *protocol.Header, extras, key, value []byte) error {
+	if client.handler.users == nil {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_UNKNOWN_COMMAND,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	mechs := []byte("PLAIN")
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, mechs, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, mechs)
+}
+
+// handleSASLAuth handles the memcache SASL authentication command, the key
+// being the mechanism and the value the client's response.
+func (client *ClientConn) handleSASLAuth(req *protocol.Header, extras, key, value []byte) error {
+	if client.handler.users == nil {
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_UNKNOWN_COMMAND,
+			nil, nil, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, nil)
+	}
+
+	var user *User
+	if name, password, ok := parsePlain(value); ok && string(key) == "PLAIN" {
+		user = client.handler.users.Authenticate(name, password)
+	}
+	if user == nil {
+		client.log.Warn("authentication failed", "mech", key)
+		atomic.AddUint64(&client.handler.authFailures, 1)
+		msg := []byte("Auth failure")
+		resp := protocol.NewResponse(req.Opcode, protocol.STATUS_AUTH_FAILED, nil, msg, nil, req.Opaque, 0)
+		return client.writeResponse(&resp, nil, nil, msg)
+	}
+
+	client.setUser(user)
+	client.log.Info("authenticated", "user", user.name)
+	msg := []byte("Authenticated")
+	resp := protocol.NewResponse(req.Opcode, protocol.STATUS_OK, nil, msg, nil, req.Opaque, 0)
+	return client.writeResponse(&resp, nil, nil, msg)
+}
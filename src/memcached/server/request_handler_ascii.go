@@ -0,0 +1,678 @@
+package server
+
+// Handles requests from clients using the text protocol. We support the subset
+// of commands that the binary protocol handlers support:
+//
+//   get <key>*
+//   gets <key>*
+//   set <key> <flags> <exptime> <bytes> [tags=<tag>,<tag>...] [noreply]
+//   cas <key> <flags> <exptime> <bytes> <cas unique> [tags=<tag>,<tag>...] [noreply]
+//   delete <key> [noreply]
+//   touch <key> <exptime> [noreply]
+//   gat <exptime> <key>*
+//   gats <exptime> <key>*
+//   flush_all [0] [noreply]
+//   flush_prefix <prefix> [noreply]
+//   invalidate_tag <tag> [noreply]
+//   stats [group]
+//   verbosity <level> [noreply]
+//   lru_crawler metadump all
+//   lru_crawler crawl all
+//   watch [fetchers] [mutations] [evictions] [prefix=<prefix>] [sample=<n>]
+//   read_only <on|off> [noreply]
+//   drain <on|off> [noreply]
+//   slowlog [<count>|reset]
+//   quit
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage"
+)
+
+// runText loops processing text protocol requests until the client
+// disconnects or quits.
+func (client *ClientConn) runText() {
+	for {
+		line, err := ReadTextLine(client.bio.Reader)
+		if err == ErrLineTooLong {
+			// we can't tell where the next request starts, so hang up
+			client.log.Warn("reading request", "err", err)
+			client.writeTextError(err.Error())
+			client.bio.Flush()
+			return
+		} else if err != nil {
+			if err != io.EOF {
+				client.log.Error("reading request", "err", err)
+			}
+			return
+		}
+		if err = client.serveText(line); err != nil {
+			return
+		}
+	}
+}
+
+// serveText serves a single text request, the line of which has been read.
+// Returns an error (io.EOF if the client quit) if the connection should be
+// closed.
+func (client *ClientConn) serveText(line []byte) error {
+	// the line is copied, as reading a data block may overwrite it
+	start := time.Now()
+	client.line = append(client.line[:0], line...)
+	client.args = splitTextArgs(client.args[:0], client.line)
+	args := client.args
+	if len(args) == 0 {
+		client.writeTextError(TEXT_ERROR)
+		return client.bio.Flush()
+	}
+
+	client.parsed = time.Now()
+
+	var err error
+	cmd, known := textCommands[string(args[0])]
+	client.status, client.size = protocol.STATUS_OK, 0
+	quit := cmd == protocol.CMD_QUIT
+	if !known {
+		client.log.Debug("unknown command", "command", args[0])
+		err = client.writeTextError(TEXT_ERROR)
+	} else if quit {
+		err = io.EOF
+	} else if !client.allow(start) {
+		err = client.textRefuse(args, protocol.STATUS_BUSY, TEXT_BUSY)
+	} else if !client.authenticated() {
+		// there's no SASL in the text protocol to authenticate with
+		err = client.textRefuse(args, protocol.STATUS_AUTH_FAILED, TEXT_DENIED)
+	} else if !client.textPermitted(args) {
+		err = client.textRefuse(args, protocol.STATUS_AUTH_FAILED, TEXT_DENIED)
+	} else {
+		err = client.dispatchText(cmd, args, start)
+	}
+	client.charge(len(line)+client.size, start)
+
+	// get commands record each key separately, unless refused outright
+	if known && ((cmd != protocol.CMD_GET && cmd != protocol.CMD_GAT) ||
+		client.status == protocol.STATUS_BUSY || client.status == protocol.STATUS_AUTH_FAILED) {
+		client.handler.metrics.Record(cmd, client.status, time.Since(start))
+	}
+	if cmd.IsMutation() && cmd != protocol.CMD_GAT {
+		var key []byte
+		if cmd != protocol.CMD_FLUSH && len(args) > 1 {
+			key = args[1]
+		}
+		client.handler.watchers.Request(client.id, cmd, key, client.status, client.size)
+	}
+
+	// requests ending the connection (quit, or watch once the client's done
+	// watching) aren't timed
+	flushing := time.Now()
+	if ferr := client.bio.Flush(); err == nil {
+		err = ferr
+	}
+	if known && err != io.EOF {
+		client.timed(cmd, client.textKey(cmd, args), client.size, start, flushing)
+	}
+	return err
+}
+
+// textKey returns the key of a text request in the client's namespace, nil if
+// the command has none.
+func (client *ClientConn) textKey(cmd protocol.Command, args [][]byte) []byte {
+	switch cmd {
+	case protocol.CMD_GET, protocol.CMD_SET, protocol.CMD_DELETE, protocol.CMD_TOUCH, protocol.CMD_FLUSH_PREFIX:
+		if len(args) > 1 {
+			return client.key(args[1])
+		}
+	case protocol.CMD_GAT:
+		if len(args) > 2 {
+			return client.key(args[2])
+		}
+	}
+	return nil
+}
+
+// splitTextArgs splits a request line into its space separated tokens,
+// appending them to args.
+func splitTextArgs(args [][]byte, line []byte) [][]byte {
+	for i := 0; i < len(line); {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		j := i
+		for j < len(line) && line[j] != ' ' {
+			j++
+		}
+		if j > i {
+			args = append(args, line[i:j])
+		}
+		i = j
+	}
+	return args
+}
+
+// dispatchText runs the handler for a single text request.
+func (client *ClientConn) dispatchText(cmd protocol.Command, args [][]byte, start time.Time) error {
+	switch string(args[0]) {
+	case "get":
+		return client.textGet(args[1:], false, start)
+	case "gets":
+		return client.textGet(args[1:], true, start)
+	case "gat":
+		return client.textGAT(args[1:], false, start)
+	case "gats":
+		return client.textGAT(args[1:], true, start)
+	case "set":
+		return client.textSet(args[1:], false)
+	case "cas":
+		return client.textSet(args[1:], true)
+	case "delete":
+		return client.textDelete(args[1:])
+	case "touch":
+		return client.textTouch(args[1:])
+	case "flush_all":
+		return client.textFlush(args[1:])
+	case "flush_prefix":
+		return client.textInvalidate(args[1:], client.flushPrefix)
+	case "invalidate_tag":
+		return client.textInvalidate(args[1:], client.invalidateTag)
+	case "stats":
+		return client.textStats(args[1:])
+	case "verbosity":
+		return client.textVerbosity(args[1:])
+	case "lru_crawler":
+		return client.textCrawler(args[1:])
+	case "watch":
+		return client.textWatch(args[1:])
+	case "read_only":
+		return client.textMode(args[1:], client.handler.SetReadOnly)
+	case "drain":
+		return client.textMode(args[1:], client.handler.SetDraining)
+	case "slowlog":
+		return client.textSlowLog(args[1:])
+	}
+	return client.writeTextError(TEXT_ERROR)
+}
+
+// writeText writes out a single line response, unless noreply is set. The
+// status is the binary protocol equivalent of the response, for metrics.
+func (client *ClientConn) writeText(status protocol.Status, noreply bool, line string) error {
+	client.status = status
+	if noreply {
+		return nil
+	}
+	if _, err := client.bio.WriteString(line); err != nil {
+		return err
+	}
+	_, err := client.bio.WriteString("\r\n")
+	return err
+}
+
+// writeTextError writes out an error response, ERROR for an unknown command or
+// a CLIENT_ERROR with the specified message otherwise.
+func (client *ClientConn) writeTextError(msg string) error {
+	if msg == TEXT_ERROR {
+		return client.writeText(protocol.STATUS_UNKNOWN_COMMAND, false, TEXT_ERROR)
+	}
+	return client.writeText(protocol.STATUS_INVALID_ARGUMENT, false, "CLIENT_ERROR "+msg)
+}
+
+// textReadOnly writes out an error if clients may not modify the cache,
+// returning true if so.
+func (client *ClientConn) textReadOnly(noreply bool) (bool, error) {
+	if !client.handler.ReadOnly() {
+		return false, nil
+	}
+	return true, client.writeText(client.handler.refuseMutation(), noreply, TEXT_READ_ONLY)
+}
+
+// textRefuse writes out an error for a request refused outright (e.g., from a
+// client over its rate limits), swallowing the data block of a storage command
+// (however large) so we stay in sync with the client.
+func (client *ClientConn) textRefuse(args [][]byte, status protocol.Status, line string) error {
+	cmd := string(args[0])
+	if (cmd == "set" || cmd == "cas") && len(args) > 4 {
+		if length, ok := parseUint(args[4], 31); ok {
+			if _, err := io.CopyN(ioutil.Discard, client.bio, int64(length)+2); err != nil {
+				return err
+			}
+			client.size = int(length)
+		}
+	}
+	return client.writeText(status, isNoReply(args), line)
+}
+
+// writeTextItem writes out a single retrieved item.
+func (client *ClientConn) writeTextItem(key []byte, item *storage.Item, withCas bool) error {
+	client.scratch = appendValueLine(client.scratch[:0], key, item.Flags, item.Len(), item.CAS, withCas)
+	if _, err := client.bio.Write(client.scratch); err != nil {
+		return err
+	}
+	if _, err := client.bio.Write(item.Value); err != nil {
+		return err
+	}
+	for _, c := range item.Chunks {
+		if _, err := client.bio.Write(c); err != nil {
+			return err
+		}
+	}
+	_, err := client.bio.WriteString("\r\n")
+	return err
+}
+
+// textGet handles the get and gets commands.
+func (client *ClientConn) textGet(keys [][]byte, withCas bool, start time.Time) error {
+	if len(keys) == 0 {
+		return client.writeTextError(TEXT_ERROR)
+	} else if !validTextKeys(keys) {
+		return client.writeTextError("bad command line format")
+	}
+	for _, key := range keys {
+		client.debugKey("get", key)
+		client.handler.hotKeys.Read(key)
+		status, size := protocol.STATUS_KEY_NOT_FOUND, 0
+		if item, err := client.store.Get(client.ctx, key); err == nil {
+			status, size = protocol.STATUS_OK, item.Len()
+			if err := client.writeTextItem(key, &item, withCas); err != nil {
+				return err
+			}
+		}
+		client.size += size
+		client.handler.metrics.Record(protocol.CMD_GET, status, time.Since(start))
+		client.handler.watchers.Request(client.id, protocol.CMD_GET, key, status, size)
+	}
+	return client.writeText(protocol.STATUS_OK, false, TEXT_END)
+}
+
+// textGAT handles the gat and gats commands.
+func (client *ClientConn) textGAT(args [][]byte, withCas bool, start time.Time) error {
+	if len(args) < 2 {
+		return client.writeTextError(TEXT_ERROR)
+	}
+	exptime, ok := parseExptime(args[0])
+	if !ok {
+		return client.writeTextError("invalid exptime argument")
+	} else if !validTextKeys(args[1:]) {
+		return client.writeTextError("bad command line format")
+	}
+	if ro, err := client.textReadOnly(false); ro {
+		return err
+	}
+	for _, key := range args[1:] {
+		client.debugKey("gat", key)
+		client.handler.hotKeys.Read(key)
+		status, size := protocol.STATUS_KEY_NOT_FOUND, 0
+		if item, err := client.store.Touch(client.ctx, key, exptime); err == nil {
+			status, size = protocol.STATUS_OK, item.Len()
+			if err := client.writeTextItem(key, &item, withCas); err != nil {
+				return err
+			}
+		}
+		client.size += size
+		client.handler.metrics.Record(protocol.CMD_GAT, status, time.Since(start))
+		client.handler.watchers.Request(client.id, protocol.CMD_GAT, key, status, size)
+	}
+	return client.writeText(protocol.STATUS_OK, false, TEXT_END)
+}
+
+// textSet handles the set and cas commands.
+func (client *ClientConn) textSet(args [][]byte, withCas bool) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	nargs := 4
+	if withCas {
+		nargs = 5
+	}
+	var tags [][]byte
+	if len(args) == nargs+1 {
+		var ok bool
+		if tags, ok = client.parseTextTags(args[nargs]); ok {
+			args = args[:nargs]
+		}
+	}
+	if len(args) != nargs {
+		return client.writeTextError(TEXT_ERROR)
+	}
+
+	key := args[0]
+	client.debugKey("set", key)
+	flags, ok1 := parseUint(args[1], 32)
+	exptime, ok2 := parseExptime(args[2])
+	length, ok3 := parseUint(args[3], 31)
+	var cas uint64
+	ok4 := true
+	if withCas {
+		cas, ok4 = parseUint(args[4], 64)
+	}
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return client.writeTextError("bad command line format")
+	}
+
+	// invalid key or too large, swallow the data block so we stay in sync
+	// with the client
+	if !validTextKey(key) || int(length) > client.handler.maxItemSize {
+		if _, err := io.CopyN(ioutil.Discard, client.bio, int64(length)+2); err != nil {
+			return err
+		}
+		if !validTextKey(key) {
+			return client.writeTextError("bad command line format")
+		}
+		return client.writeText(protocol.STATUS_VALUE_TOO_LARGE, noreply, TEXT_TOO_LARGE)
+	}
+
+	// read the data block, into chunks if too large for one buffer
+	client.size = int(length)
+	var data []byte
+	defer client.release()
+	if length > cache.MAX_VALUE_SIZE {
+		if err := client.readChunks(int(length)); err != nil {
+			return err
+		}
+	} else {
+		data = client.buffer(int(length))
+		if _, err := io.ReadFull(client.bio, data); err != nil {
+			return err
+		}
+	}
+	crlf := client.hdr[:2]
+	if _, err := io.ReadFull(client.bio, crlf); err != nil {
+		return err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		client.writeTextError("bad data chunk")
+		return io.ErrUnexpectedEOF
+	}
+	client.parsed = time.Now()
+	if ro, err := client.textReadOnly(noreply); ro {
+		return err
+	}
+
+	client.handler.hotKeys.Write(key)
+	_, err := client.set(key, data, uint32(flags), exptime, cas, tags)
+
+	status := statusOf(err)
+	switch status {
+	case protocol.STATUS_OK:
+		return client.writeText(status, noreply, TEXT_STORED)
+	case protocol.STATUS_NOT_SUPPORTED:
+		return client.writeText(status, noreply, "SERVER_ERROR "+err.Error())
+	case protocol.STATUS_KEY_EXISTS:
+		return client.writeText(status, noreply, TEXT_EXISTS)
+	case protocol.STATUS_KEY_NOT_FOUND:
+		return client.writeText(status, noreply, TEXT_NOT_FOUND)
+	case protocol.STATUS_VALUE_TOO_LARGE:
+		return client.writeText(status, noreply, TEXT_TOO_LARGE)
+	case protocol.STATUS_OUT_OF_MEMORY:
+		return client.writeText(status, noreply, TEXT_NO_MEMORY)
+	}
+	return client.writeText(status, noreply, TEXT_NOT_STORED)
+}
+
+// textDelete handles the delete command.
+func (client *ClientConn) textDelete(args [][]byte) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	// memcached still accepts a (zero) hold time after the key
+	if len(args) == 2 && string(args[1]) == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 || !validTextKey(args[0]) {
+		return client.writeTextError("bad command line format. Usage: delete <key> [noreply]")
+	}
+	client.debugKey("delete", args[0])
+	if ro, err := client.textReadOnly(noreply); ro {
+		return err
+	}
+
+	client.handler.hotKeys.Write(args[0])
+	if err := client.store.Delete(client.ctx, args[0], 0); err != nil {
+		return client.writeText(statusOf(err), noreply, TEXT_NOT_FOUND)
+	}
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_DELETED)
+}
+
+// textTouch handles the touch command.
+func (client *ClientConn) textTouch(args [][]byte) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 {
+		return client.writeTextError(TEXT_ERROR)
+	} else if !validTextKey(args[0]) {
+		return client.writeTextError("bad command line format")
+	}
+	client.debugKey("touch", args[0])
+	exptime, ok := parseExptime(args[1])
+	if !ok {
+		return client.writeTextError("invalid exptime argument")
+	}
+	if ro, err := client.textReadOnly(noreply); ro {
+		return err
+	}
+
+	client.handler.hotKeys.Write(args[0])
+	if _, err := client.store.Touch(client.ctx, args[0], exptime); err != nil {
+		return client.writeText(statusOf(err), noreply, TEXT_NOT_FOUND)
+	}
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_TOUCHED)
+}
+
+// textFlush handles the flush_all command. As with the binary protocol, we
+// only support flushing immediately.
+func (client *ClientConn) textFlush(args [][]byte) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 || (len(args) == 1 && string(args[0]) != "0") {
+		return client.writeTextError("delayed flush not supported")
+	}
+	client.log.Debug("flush")
+	if ro, err := client.textReadOnly(noreply); ro {
+		return err
+	}
+
+	if err := client.flush(); err != nil {
+		return client.writeText(statusOf(err), noreply, "SERVER_ERROR "+err.Error())
+	}
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_OK)
+}
+
+// textInvalidate handles the flush_prefix and invalidate_tag commands, the
+// prefix or tag being invalidated by invalidate.
+func (client *ClientConn) textInvalidate(args [][]byte, invalidate func([]byte) error) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 1 || !validTextKey(args[0]) {
+		return client.writeTextError("bad command line format")
+	}
+	client.debugKey("invalidate", args[0])
+	if ro, err := client.textReadOnly(noreply); ro {
+		return err
+	}
+
+	if err := invalidate(args[0]); err != nil {
+		return client.writeText(statusOf(err), noreply, "SERVER_ERROR "+err.Error())
+	}
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_OK)
+}
+
+// textStats handles the stats command.
+func (client *ClientConn) textStats(args [][]byte) error {
+	if len(args) > 1 {
+		return client.writeTextError(TEXT_ERROR)
+	}
+	group := ""
+	if len(args) == 1 {
+		group = string(args[0])
+	}
+	client.log.Debug("stat", "group", group)
+
+	stats, ok := client.stats(group)
+	if !ok {
+		return client.writeTextError(TEXT_ERROR)
+	}
+	for _, stat := range stats {
+		if _, err := client.bio.WriteString("STAT " + stat.Name + " " + stat.Value + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return client.writeText(protocol.STATUS_OK, false, TEXT_END)
+}
+
+// textVerbosity handles the verbosity command.
+func (client *ClientConn) textVerbosity(args [][]byte) error {
+	noreply := isNoReply(args)
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 1 {
+		return client.writeTextError(TEXT_ERROR)
+	}
+	verbosity, ok := parseUint(args[0], 32)
+	if !ok {
+		return client.writeTextError("bad command line format")
+	}
+
+	client.setVerbosity(uint32(verbosity))
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_OK)
+}
+
+// textMode handles the read_only and drain commands, switching a maintenance
+// mode on or off with set. With users configured, text clients (which can't
+// authenticate) may not switch modes, which is left to the admin endpoint and
+// signals.
+func (client *ClientConn) textMode(args [][]byte, set func(bool)) error {
+	noreply := isNoReply(args)
+	if client.handler.users != nil {
+		return client.writeText(protocol.STATUS_AUTH_FAILED, noreply, TEXT_DENIED)
+	}
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 1 {
+		return client.writeTextError(TEXT_ERROR)
+	}
+	on, ok := parseOnOff(string(args[0]))
+	if !ok {
+		return client.writeTextError("bad command line format")
+	}
+
+	set(on)
+	return client.writeText(protocol.STATUS_OK, noreply, TEXT_OK)
+}
+
+// textSlowLog handles the slowlog command, writing out the latest count
+// requests of the slow log (all of them by default), one line each as
+// appendSlowRequest formats them, or resetting it.
+func (client *ClientConn) textSlowLog(args [][]byte) error {
+	slowLog := client.handler.slowLog
+	count := uint64(math.MaxInt32)
+	if len(args) > 1 {
+		return client.writeTextError("bad command line format")
+	} else if len(args) == 1 && string(args[0]) == "reset" {
+		slowLog.Reset()
+		return client.writeText(protocol.STATUS_OK, false, TEXT_OK)
+	} else if len(args) == 1 {
+		var ok bool
+		if count, ok = parseUint(args[0], 31); !ok {
+			return client.writeTextError("bad command line format")
+		}
+	}
+
+	var buf []byte
+	for _, req := range slowLog.Requests(int(count), client.keyFilter()) {
+		buf = appendSlowRequest(buf[:0], &req)
+		if err := client.writeText(protocol.STATUS_OK, false, string(buf)); err != nil {
+			return err
+		}
+	}
+	return client.writeText(protocol.STATUS_OK, false, TEXT_END)
+}
+
+// textCrawler handles the lru_crawler command. We have a single LRU, so "all"
+// is the only class of items that can be crawled.
+func (client *ClientConn) textCrawler(args [][]byte) error {
+	if len(args) != 2 || string(args[1]) != "all" {
+		return client.writeTextError("bad command line format")
+	}
+	client.log.Debug("lru_crawler", "command", args[0])
+
+	if client.handler.crawler == nil {
+		return client.writeTextError("lru crawler not supported by the storage")
+	}
+
+	switch string(args[0]) {
+	case "metadump":
+		var buf []byte
+		visible := client.keyFilter()
+		err := client.handler.crawler.Crawl(func(batch []cache.ItemMeta) error {
+			for i := range batch {
+				if visible != nil && !visible(batch[i].Key) {
+					continue
+				}
+				buf = appendMetadump(buf[:0], &batch[i])
+				if _, err := client.bio.Write(buf); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return client.writeText(protocol.STATUS_OK, false, TEXT_END)
+	case "crawl":
+		// as with memcached, the crawl runs in the background, and as with
+		// sweeps, repeated crawls don't pile up
+		client.handler.sweep()
+		return client.writeText(protocol.STATUS_OK, false, TEXT_OK)
+	}
+	return client.writeTextError("bad command line format")
+}
+
+// textWatch handles the watch command, turning the connection into a stream of
+// events until the client closes it (or sends anything more).
+func (client *ClientConn) textWatch(args [][]byte) error {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	kinds, prefix, sample, err := ParseWatchArgs(strs)
+	if err != nil {
+		return client.writeTextError(err.Error())
+	}
+	client.log.Info("watching", "kinds", kinds, "prefix", prefix, "sample", sample)
+
+	watchers := client.handler.watchers
+	w := watchers.Subscribe(kinds, prefix, sample, client.keyFilter())
+	defer watchers.Unsubscribe(w)
+
+	if err := client.writeText(protocol.STATUS_OK, false, TEXT_OK); err != nil {
+		return err
+	}
+	if err := client.bio.Flush(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		client.bio.ReadByte()
+		close(stop)
+	}()
+	w.Stream(client.bio.Writer, stop)
+
+	// no more requests are processed on the connection
+	return io.EOF
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// TextClient is a minimal text protocol client for testing a server.
+type TextClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func DialTextClient(t *testing.T, addr net.Addr) *TextClient {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &TextClient{t, conn, bufio.NewReader(conn)}
+}
+
+// Do sends a request and reads back lines up to and including a terminating
+// line (any line not starting with VALUE, STAT or a value we've been told to
+// expect).
+func (tc *TextClient) Do(req string) []string {
+	tc.t.Helper()
+	if _, err := tc.conn.Write([]byte(req)); err != nil {
+		tc.t.Fatalf("Couldn't send request: %s\n", err)
+	}
+	var lines []string
+	for {
+		tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("Couldn't read response: %s (%q)\n", err, lines)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "VALUE ") {
+			data, _ := tc.r.ReadString('\n')
+			lines = append(lines, strings.TrimSuffix(data, "\r\n"))
+		} else if !strings.HasPrefix(line, "STAT ") {
+			return lines
+		}
+	}
+}
+
+func CheckLines(t *testing.T, lines []string, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("Wrong response: %q vs %q\n", lines, expected)
+	}
+}
+
+func TestTextSetGet(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTextClient(t, server.Addr())
+
+	CheckLines(t, tc.Do("get key\r\n"), "END")
+	CheckLines(t, tc.Do("set key 42 0 5\r\nvalue\r\n"), "STORED")
+	CheckLines(t, tc.Do("get key missing\r\n"), "VALUE key 42 5", "value", "END")
+
+	lines := tc.Do("gets key\r\n")
+	var cas uint64
+	fmt.Sscanf(lines[0], "VALUE key 42 5 %d", &cas)
+	if cas == 0 {
+		t.Fatalf("No CAS in gets: %q\n", lines)
+	}
+	CheckLines(t, tc.Do(fmt.Sprintf("cas key 1 0 3 %d\r\nnew\r\n", cas+1)), "EXISTS")
+	CheckLines(t, tc.Do(fmt.Sprintf("cas key 1 0 3 %d\r\nnew\r\n", cas)), "STORED")
+	CheckLines(t, tc.Do("get key\r\n"), "VALUE key 1 3", "new", "END")
+	CheckLines(t, tc.Do("cas missing 1 0 3 1\r\nnew\r\n"), "NOT_FOUND")
+
+	// binary clients see the same item
+	bc := DialTestClient(t, server.Addr())
+	if resp := bc.Get("key"); string(resp.value) != "new" {
+		t.Errorf("Wrong value from binary protocol: %s\n", resp.value)
+	}
+}
+
+func TestTextDeleteTouchFlush(t *testing.T) {
+	clock := NewTestClock(time.Unix(1500000000, 0))
+	server := StartTestServer(t, cache.New(100000, cache.WithClock(clock.Now)))
+	tc := DialTextClient(t, server.Addr())
+
+	tc.Do("set key1 0 0 1\r\na\r\n")
+	tc.Do("set key2 0 10 1\r\nb\r\n")
+	CheckLines(t, tc.Do("delete key1\r\n"), "DELETED")
+	CheckLines(t, tc.Do("delete key1 0\r\n"), "NOT_FOUND")
+	CheckLines(t, tc.Do("touch key2 100\r\n"), "TOUCHED")
+	CheckLines(t, tc.Do("touch key1 100\r\n"), "NOT_FOUND")
+
+	clock.Add(50 * time.Second)
+	CheckLines(t, tc.Do("gat 0 key2\r\n"), "VALUE key2 0 1", "b", "END")
+	CheckLines(t, tc.Do("set key3 0 -1 1\r\nc\r\n"), "STORED")
+	CheckLines(t, tc.Do("get key3\r\n"), "END")
+
+	CheckLines(t, tc.Do("flush_all 10\r\n"), "CLIENT_ERROR delayed flush not supported")
+	CheckLines(t, tc.Do("flush_all\r\n"), "OK")
+	CheckLines(t, tc.Do("get key2\r\n"), "END")
+}
+
+func TestTextNoReply(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTextClient(t, server.Addr())
+
+	tc.conn.Write([]byte("set key 0 0 1 noreply\r\na\r\ndelete other noreply\r\n"))
+	CheckLines(t, tc.Do("get key\r\n"), "VALUE key 0 1", "a", "END")
+}
+
+func TestTextErrors(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTextClient(t, server.Addr())
+
+	CheckLines(t, tc.Do("bogus\r\n"), "ERROR")
+	CheckLines(t, tc.Do("\r\n"), "ERROR")
+	CheckLines(t, tc.Do("set key x 0 1\r\n"), "CLIENT_ERROR bad command line format")
+	big := fmt.Sprintf("set key 0 0 %d\r\n%s\r\n", cache.MAX_VALUE_SIZE+1, strings.Repeat("x", cache.MAX_VALUE_SIZE+1))
+	CheckLines(t, tc.Do(big), "SERVER_ERROR object too large for cache")
+	CheckLines(t, tc.Do("get key\r\n"), "END")
+	CheckLines(t, tc.Do("set key 0 0 1\r\nab\r\n"), "CLIENT_ERROR bad data chunk")
+
+	long := DialTextClient(t, server.Addr())
+	CheckLines(t, long.Do("get "+strings.Repeat("k", MAX_TEXT_LINE)+"\r\n"), "CLIENT_ERROR line too long")
+}
+
+func TestTextStatsVerbosity(t *testing.T) {
+	// use our own logger, so we don't change the default one
+	logger, buf := NewTestLogger(LOG_ERROR)
+	server := StartTestServerWith(t, cache.New(100000), func(cnh *ConnectionHandler) {
+		cnh.logger = logger
+	})
+	tc := DialTextClient(t, server.Addr())
+
+	tc.Do("set key 0 0 1\r\na\r\n")
+	lines := tc.Do("stats\r\n")
+	if lines[len(lines)-1] != "END" || !strings.Contains(strings.Join(lines, "\n"), "STAT curr_items 1") {
+		t.Errorf("Wrong stats: %q\n", lines)
+	}
+	CheckLines(t, tc.Do("stats bogus\r\n"), "ERROR")
+
+	CheckLines(t, tc.Do("verbosity 3\r\n"), "OK")
+	if logger.Level() != LOG_DEBUG {
+		t.Errorf("Verbosity didn't change level: %s\n", logger.Level())
+	}
+	tc.Do("get key\r\n")
+	if !strings.Contains(buf.String(), "msg=get client=0 key=key") {
+		t.Errorf("Request not logged at debug level:\n%s", buf.String())
+	}
+
+	// and through the binary protocol
+	bc := DialTestClient(t, server.Addr())
+	CheckStatus(t, bc.Do(protocol.CMD_VERBOSITY, []byte{0, 0, 0, 1}, nil, nil, 0), protocol.STATUS_OK)
+	if logger.Level() != LOG_WARN {
+		t.Errorf("Verbosity didn't change level: %s\n", logger.Level())
+	}
+	CheckStatus(t, bc.Do(protocol.CMD_VERBOSITY, nil, nil, nil, 0), protocol.STATUS_INVALID_ARGUMENT)
+}
+
+// KV_SIZE is the size of an item with a 4 byte key and a 5 byte value.
+const KV_SIZE = 4 + 5 + 4 + cache.ITEM_OVERHEAD
+
+// ReadMetadump reads lines up to (and not including) the end line.
+func ReadMetadump(t *testing.T, r *bufio.Reader, end string) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Couldn't read metadump: %s\n", err)
+		}
+		if line == end {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestTextMetadump(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "set key1 0 0 5\r\nvalue\r\nset key2 0 0 5\r\nvalue\r\n")
+	ReadMetadump(t, r, "STORED\r\n")
+	ReadMetadump(t, r, "STORED\r\n")
+
+	fmt.Fprintf(conn, "lru_crawler metadump all\r\n")
+	lines := ReadMetadump(t, r, "END\r\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "key=key1 exp=-1 la=") ||
+		!strings.HasSuffix(lines[1], fmt.Sprintf(" cas=2 size=%d\n", KV_SIZE)) {
+		t.Errorf("Wrong metadump: %q\n", lines)
+	}
+
+	fmt.Fprintf(conn, "lru_crawler metadump 1\r\n")
+	ReadMetadump(t, r, "CLIENT_ERROR bad command line format\r\n")
+	fmt.Fprintf(conn, "lru_crawler crawl all\r\n")
+	ReadMetadump(t, r, "OK\r\n")
+
+	base := StartTestAdmin(t, server)
+	if dump := HttpGet(t, base+"/metadump"); dump != strings.Join(lines, "") {
+		t.Errorf("Wrong admin metadump: %q vs %q\n", dump, lines)
+	}
+}
+
+func TestAppendMetadump(t *testing.T) {
+	line := string(appendMetadump(nil, &cache.ItemMeta{Key: "a b/c", Accessed: 1500000010, Size: 13, Cas: 1}))
+	if line != "key=a+b%2Fc exp=-1 la=1500000010 cas=1 size=13\n" {
+		t.Errorf("Wrong metadump line: %q\n", line)
+	}
+}
@@ -0,0 +1,498 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+	"memcached/storage"
+	"memcached/storage/storagetest"
+)
+
+// TestClient is a minimal binary protocol client for testing a server.
+type TestClient struct {
+	t    *testing.T
+	conn net.Conn
+	bio  *bufio.ReadWriter
+}
+
+// Response is a response received by a TestClient.
+type Response struct {
+	protocol.Header
+	extras, key, value []byte
+}
+
+var ctx = context.Background()
+
+func StartTestServer(t *testing.T, store storage.Storage) *ConnectionHandler {
+	return StartTestServerWith(t, store, nil)
+}
+
+// StartTestServerWith starts a test server, calling setup (if not nil) to
+// configure it before it accepts any clients.
+func StartTestServerWith(t *testing.T, store storage.Storage, setup func(*ConnectionHandler)) *ConnectionHandler {
+	handler, err := NewConnectionHandler(store, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	if setup != nil {
+		setup(handler)
+	}
+	go handler.Run()
+	t.Cleanup(func() { handler.Close() })
+	return handler
+}
+
+func DialTestClient(t *testing.T, addr net.Addr) *TestClient {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	bio := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return &TestClient{t, conn, bio}
+}
+
+// Send sends a request without waiting for the response.
+func (tc *TestClient) Send(cmd protocol.Command, extras, key, value []byte, cas uint64) {
+	req := protocol.NewResponse(cmd, 0, key, value, extras, 0, cas)
+	req.Magic = protocol.MSG_REQUEST
+	if err := protocol.WriteResponse(tc.bio, &req, extras, key, value); err != nil {
+		tc.t.Fatalf("Couldn't send request: %s\n", err)
+	}
+	if err := tc.bio.Flush(); err != nil {
+		tc.t.Fatalf("Couldn't send request: %s\n", err)
+	}
+}
+
+// Recv receives a single response.
+func (tc *TestClient) Recv() *Response {
+	resp := &Response{}
+	if err := binary.Read(tc.bio, binary.BigEndian, &resp.Header); err != nil {
+		tc.t.Fatalf("Couldn't read response header: %s\n", err)
+	}
+	body := make([]byte, resp.TotalLength)
+	if _, err := io.ReadFull(tc.bio, body); err != nil {
+		tc.t.Fatalf("Couldn't read response body: %s\n", err)
+	}
+	resp.extras = body[:resp.ExtrasLength]
+	resp.key = body[resp.ExtrasLength:][:resp.KeyLength]
+	resp.value = body[int(resp.ExtrasLength)+int(resp.KeyLength):]
+	return resp
+}
+
+// Do sends a request and waits for its response.
+func (tc *TestClient) Do(cmd protocol.Command, extras, key, value []byte, cas uint64) *Response {
+	tc.Send(cmd, extras, key, value, cas)
+	return tc.Recv()
+}
+
+func (tc *TestClient) Get(key string) *Response {
+	return tc.Do(protocol.CMD_GET, nil, []byte(key), nil, 0)
+}
+
+func (tc *TestClient) Set(key, val string, exp uint32, cas uint64) *Response {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[4:], exp)
+	return tc.Do(protocol.CMD_SET, extras, []byte(key), []byte(val), cas)
+}
+
+func (tc *TestClient) Delete(key string) *Response {
+	return tc.Do(protocol.CMD_DELETE, nil, []byte(key), nil, 0)
+}
+
+func (tc *TestClient) Stats(group string) map[string]string {
+	tc.Send(protocol.CMD_STAT, nil, []byte(group), nil, 0)
+	stats := make(map[string]string)
+	for {
+		resp := tc.Recv()
+		if protocol.Status(resp.Status) != protocol.STATUS_OK {
+			tc.t.Fatalf("Stats failed: %d\n", resp.Status)
+		} else if len(resp.key) == 0 {
+			return stats
+		}
+		stats[string(resp.key)] = string(resp.value)
+	}
+}
+
+// TestClock is a clock for a cache, which tests can move on while the server
+// reads it.
+type TestClock struct {
+	now atomic.Int64 // UNIX time in nanoseconds
+}
+
+func NewTestClock(start time.Time) *TestClock {
+	clock := &TestClock{}
+	clock.now.Store(start.UnixNano())
+	return clock
+}
+
+func (clock *TestClock) Now() time.Time {
+	return time.Unix(0, clock.now.Load())
+}
+
+func (clock *TestClock) Add(d time.Duration) {
+	clock.now.Add(int64(d))
+}
+
+func CheckStatus(t *testing.T, resp *Response, status protocol.Status) {
+	t.Helper()
+	if protocol.Status(resp.Status) != status {
+		t.Errorf("Wrong status: %s vs %s\n", protocol.Status(resp.Status), status)
+	}
+}
+
+// Eventually retries check until it returns true or a timeout passes.
+func Eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if check() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s\n", what)
+}
+
+func TestClientSetGetDelete(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	set := tc.Set("key", "value", 0, 0)
+	CheckStatus(t, set, protocol.STATUS_OK)
+	get := tc.Get("key")
+	CheckStatus(t, get, protocol.STATUS_OK)
+	if string(get.value) != "value" || get.Cas != set.Cas {
+		t.Errorf("Wrong get response: %s (%d)\n", get.value, get.Cas)
+	}
+	CheckStatus(t, tc.Delete("key"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+}
+
+func TestClientTouch(t *testing.T) {
+	clock := NewTestClock(time.Unix(1500000000, 0))
+	server := StartTestServer(t, cache.New(100000, cache.WithClock(clock.Now)))
+	tc := DialTestClient(t, server.Addr())
+
+	exp := []byte{0, 0, 0, 100}
+	CheckStatus(t, tc.Do(protocol.CMD_TOUCH, exp, []byte("key"), nil, 0), protocol.STATUS_KEY_NOT_FOUND)
+	set := tc.Set("key", "value", 10, 0)
+	touch := tc.Do(protocol.CMD_TOUCH, exp, []byte("key"), nil, 0)
+	CheckStatus(t, touch, protocol.STATUS_OK)
+	if touch.Cas != set.Cas {
+		t.Errorf("Touch changed CAS: %d vs %d\n", touch.Cas, set.Cas)
+	}
+
+	clock.Add(50 * time.Second)
+	gat := tc.Do(protocol.CMD_GAT, exp, []byte("key"), nil, 0)
+	CheckStatus(t, gat, protocol.STATUS_OK)
+	if string(gat.value) != "value" || len(gat.extras) != 4 {
+		t.Errorf("Wrong gat response: %s\n", gat.value)
+	}
+
+	clock.Add(101 * time.Second)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+}
+
+func TestClientAddIncr(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+
+	add := tc.Do(protocol.CMD_ADD, make([]byte, 8), []byte("n"), []byte("10"), 0)
+	CheckStatus(t, add, protocol.STATUS_OK)
+	CheckStatus(t, tc.Do(protocol.CMD_ADD, make([]byte, 8), []byte("n"), []byte("1"), 0),
+		protocol.STATUS_ITEM_NOT_STORED)
+
+	incr := func(cmd protocol.Command, key string, delta, initial uint64, exptime uint32) *Response {
+		extras := make([]byte, 20)
+		binary.BigEndian.PutUint64(extras, delta)
+		binary.BigEndian.PutUint64(extras[8:], initial)
+		binary.BigEndian.PutUint32(extras[16:], exptime)
+		return tc.Do(cmd, extras, []byte(key), nil, 0)
+	}
+	tests := []struct {
+		cmd      protocol.Command
+		key      string
+		delta    uint64
+		exptime  uint32
+		status   protocol.Status
+		expected uint64
+	}{
+		{protocol.CMD_INCREMENT, "n", 5, 0, protocol.STATUS_OK, 15},
+		{protocol.CMD_DECREMENT, "n", 20, 0, protocol.STATUS_OK, 0},
+		{protocol.CMD_INCREMENT, "missing", 1, protocol.NO_CREATE, protocol.STATUS_KEY_NOT_FOUND, 0},
+		// a missing key is created with the initial value
+		{protocol.CMD_INCREMENT, "created", 1, 0, protocol.STATUS_OK, 42},
+		{protocol.CMD_INCREMENT, "created", 1, 0, protocol.STATUS_OK, 43},
+		// deltas use all 64 bits
+		{protocol.CMD_INCREMENT, "n", 1<<63 + 1, 0, protocol.STATUS_OK, 1<<63 + 1},
+		{protocol.CMD_DECREMENT, "n", 1 << 63, 0, protocol.STATUS_OK, 1},
+		{protocol.CMD_DECREMENT, "n", math.MaxUint64, 0, protocol.STATUS_OK, 0},
+	}
+	for _, test := range tests {
+		resp := incr(test.cmd, test.key, test.delta, 42, test.exptime)
+		CheckStatus(t, resp, test.status)
+		if test.status == protocol.STATUS_OK &&
+			(len(resp.value) != 8 || binary.BigEndian.Uint64(resp.value) != test.expected) {
+			t.Errorf("Wrong %s of %s: %v\n", test.cmd, test.key, resp.value)
+		}
+	}
+	CheckStatus(t, tc.Get("missing"), protocol.STATUS_KEY_NOT_FOUND)
+	if get := tc.Get("created"); string(get.value) != "43" {
+		t.Errorf("Wrong created counter: %q\n", get.value)
+	}
+}
+
+func TestClientFlush(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+
+	tc.Set("key1", "value", 0, 0)
+	tc.Set("key2", "value", 0, 0)
+	CheckStatus(t, tc.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key1"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Get("key2"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, tc.Do(protocol.CMD_FLUSH, []byte{0, 0, 0, 1}, nil, nil, 0), protocol.STATUS_INVALID_ARGUMENT)
+}
+
+func TestClientStats(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+	tc.Set("key", "value", 0, 0)
+	tc.Set("key", "value", 0, 0)
+
+	stats := tc.Stats("")
+	if stats["curr_items"] != "1" || stats["curr_connections"] != "1" ||
+		stats["removed_overwritten"] != "1" || stats["removed_evicted"] != "0" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+	CheckStatus(t, tc.Do(protocol.CMD_STAT, nil, []byte("bogus"), nil, 0), protocol.STATUS_KEY_NOT_FOUND)
+
+	server = StartTestServerWith(t, cache.New(100000), func(cnh *ConnectionHandler) {
+		WithStats("extra", func() []Stat { return []Stat{{"answer", "42"}} })(cnh)
+	})
+	if stats := DialTestClient(t, server.Addr()).Stats("extra"); stats["answer"] != "42" || len(stats) != 1 {
+		t.Errorf("Wrong extra stats: %v\n", stats)
+	}
+
+	// the heap limiter's statistics have a group of their own
+	c := cache.New(100000)
+	server = StartTestServerWith(t, c, WithHeapLimiter(cache.NewHeapLimiter(c, 1000000)))
+	hc := DialTestClient(t, server.Addr())
+	if stats := hc.Stats("heap"); stats["heap_limit"] != "1000000" || stats["heap_maxbytes_configured"] != "100000" {
+		t.Errorf("Wrong heap stats: %v\n", stats)
+	}
+	if stats := hc.Stats(""); stats["heap_limit"] != "" {
+		t.Errorf("Heap stats in general stats: %v\n", stats)
+	}
+
+	// make sure the connection is still in sync
+	if !bytes.Equal(tc.Get("key").value, []byte("value")) {
+		t.Error("Wrong value after stats\n")
+	}
+}
+
+// recordingStorage is an engine recording the operations it's asked to do, and
+// failing them with err (if not nil).
+type recordingStorage struct {
+	*storagetest.Map
+	ops []string
+	err error
+	sync.Mutex
+}
+
+func (r *recordingStorage) record(op string, key []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	r.ops = append(r.ops, op+" "+string(key))
+	return r.err
+}
+
+func (r *recordingStorage) Get(ctx context.Context, key []byte) (storage.Item, error) {
+	if err := r.record("get", key); err != nil {
+		return storage.Item{}, err
+	}
+	return r.Map.Get(ctx, key)
+}
+
+func (r *recordingStorage) Set(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	if err := r.record("set", key); err != nil {
+		return 0, err
+	}
+	return r.Map.Set(ctx, key, value, flags, exptime, cas)
+}
+
+func TestClientStorage(t *testing.T) {
+	store := &recordingStorage{Map: storagetest.NewMap()}
+	server := StartTestServer(t, store)
+	tc := DialTestClient(t, server.Addr())
+
+	set := tc.Set("key", "value", 0, 0)
+	CheckStatus(t, set, protocol.STATUS_OK)
+	get := tc.Get("key")
+	if string(get.value) != "value" || get.Cas != set.Cas {
+		t.Errorf("Wrong get response: %s (%d)\n", get.value, get.Cas)
+	}
+	CheckStatus(t, tc.Do(protocol.CMD_GAT, []byte{0, 0, 0, 100}, []byte("key"), nil, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Delete("key"), protocol.STATUS_OK)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("set key2 3 0 5\r\nvalue\r\n"), TEXT_STORED)
+	CheckLines(t, text.Do("get key2\r\n"), "VALUE key2 3 5", "value", TEXT_END)
+	CheckLines(t, text.Do("flush_all\r\n"), TEXT_OK)
+	CheckLines(t, text.Do("get key2\r\n"), TEXT_END)
+
+	// the statistics and crawls of a Cache aren't available
+	if stats := tc.Stats(""); stats["curr_connections"] != "2" || stats["curr_items"] != "" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+	if lines := text.Do("lru_crawler metadump all\r\n"); !strings.HasPrefix(lines[0], "CLIENT_ERROR") {
+		t.Errorf("Metadump served without a crawler: %q\n", lines)
+	}
+
+	store.Lock()
+	expected := []string{"set key", "get key", "get key", "set key2", "get key2", "get key2"}
+	if !reflect.DeepEqual(store.ops, expected) {
+		t.Errorf("Wrong storage operations: %q vs %q\n", store.ops, expected)
+	}
+
+	// errors other than those of package storage are internal errors
+	store.err = errors.New("disk on fire")
+	store.Unlock()
+	CheckStatus(t, tc.Set("key", "value", 0, 0), protocol.STATUS_INTERNAL_ERROR)
+	CheckStatus(t, tc.Get("key"), protocol.STATUS_INTERNAL_ERROR)
+	Eventually(t, "internal errors counted", func() bool {
+		return server.metrics.Count(protocol.CMD_GET, protocol.STATUS_INTERNAL_ERROR) == 1
+	})
+}
+
+func TestClientOversize(t *testing.T) {
+	c := cache.New(80+2*cache.ITEM_OVERHEAD,
+		cache.WithMaxItemSize(50), cache.WithNoEvict(true))
+	server := StartTestServer(t, c)
+	tc := DialTestClient(t, server.Addr())
+
+	CheckStatus(t, tc.Set("key", strings.Repeat("x", 60), 0, 0), protocol.STATUS_VALUE_TOO_LARGE)
+	CheckStatus(t, tc.Set("key", strings.Repeat("x", 40), 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, tc.Set("key2", strings.Repeat("x", 40), 0, 0), protocol.STATUS_OUT_OF_MEMORY)
+
+	text := DialTextClient(t, server.Addr())
+	CheckLines(t, text.Do("set key3 0 0 60\r\n"+strings.Repeat("x", 60)+"\r\n"), TEXT_TOO_LARGE)
+	CheckLines(t, text.Do("set key3 0 0 40\r\n"+strings.Repeat("x", 40)+"\r\n"), TEXT_NO_MEMORY)
+
+	stats := tc.Stats("")
+	if stats["store_too_large"] != "2" || stats["store_no_memory"] != "2" || stats["item_size_max"] != "50" {
+		t.Errorf("Wrong stats: %v\n", stats)
+	}
+}
+
+func TestKeyValidation(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	tc := DialTestClient(t, server.Addr())
+	text := DialTextClient(t, server.Addr())
+
+	// whether each key is valid in the binary and text protocols
+	keys := []struct {
+		key          string
+		binary, text bool
+	}{
+		{"key", true, true},
+		{"", false, false},
+		{strings.Repeat("k", protocol.MAX_KEY_LENGTH), true, true},
+		{strings.Repeat("k", protocol.MAX_KEY_LENGTH+1), false, false},
+		{strings.Repeat("k", 0xffff), false, false},
+		{"ключ", true, true},
+		{"a:b/c?d=e", true, true},
+		{"tab\tkey", true, false},
+		{"null\x00key", true, false},
+		{"bell\akey", true, false},
+		{"del\x7fkey", true, false},
+		{"vt\vkey", true, false},
+	}
+	for c := 0; c < 0x100; c++ {
+		valid := c > ' ' && c != 0x7f
+		keys = append(keys, struct {
+			key          string
+			binary, text bool
+		}{string([]byte{'k', byte(c), 'k'}), true, valid})
+	}
+
+	for _, k := range keys {
+		status := protocol.STATUS_INVALID_ARGUMENT
+		if k.binary {
+			status = protocol.STATUS_OK
+		}
+		CheckStatus(t, tc.Set(k.key, "value", 0, 0), status)
+		CheckStatus(t, tc.Get(k.key), status)
+		CheckStatus(t, tc.Do(protocol.CMD_TOUCH, make([]byte, 4), []byte(k.key), nil, 0), status)
+		CheckStatus(t, tc.Delete(k.key), status)
+		if strings.ContainsAny(k.key, " \r\n") || k.key == "" || len(k.key) > MAX_TEXT_LINE/2 {
+			continue // not a single text protocol token
+		}
+
+		// the data block of an invalid set is swallowed
+		var expected [4][]string
+		if k.text {
+			expected = [4][]string{{TEXT_STORED}, {"VALUE " + k.key + " 0 5", "value", TEXT_END},
+				{TEXT_TOUCHED}, {TEXT_DELETED}}
+		} else {
+			expected = [4][]string{{"CLIENT_ERROR bad command line format"},
+				{"CLIENT_ERROR bad command line format"}, {"CLIENT_ERROR bad command line format"},
+				{"CLIENT_ERROR bad command line format. Usage: delete <key> [noreply]"}}
+		}
+		for i, req := range []string{"set %s 0 0 5\r\nvalue\r\n", "get %s\r\n", "touch %s 0\r\n", "delete %s\r\n"} {
+			if lines := text.Do(fmt.Sprintf(req, k.key)); fmt.Sprint(lines) != fmt.Sprint(expected[i]) {
+				t.Errorf("Wrong response for %q: %q vs %q\n", fmt.Sprintf(req, k.key), lines, expected[i])
+			}
+		}
+	}
+	CheckLines(t, text.Do("get key k\x01k\r\n"), "CLIENT_ERROR bad command line format")
+}
+
+func TestClientLargeValues(t *testing.T) {
+	big := strings.Repeat("0123456789", 3*cache.MAX_VALUE_SIZE/10)
+	for _, store := range []storage.Storage{cache.New(64 << 20), storagetest.NewMap()} {
+		server := StartTestServerWith(t, store, WithMaxItemSize(4<<20))
+		tc := DialTestClient(t, server.Addr())
+
+		// set and get in chunks over each protocol
+		CheckStatus(t, tc.Set("key", big, 0, 0), protocol.STATUS_OK)
+		if get := tc.Get("key"); string(get.value) != big {
+			t.Errorf("Wrong large value: %d bytes\n", len(get.value))
+		}
+		text := DialTextClient(t, server.Addr())
+		CheckLines(t, text.Do(fmt.Sprintf("set key2 0 0 %d\r\n%s\r\n", len(big), big)), TEXT_STORED)
+		if lines := text.Do("get key2\r\n"); len(lines) != 3 || lines[1] != big {
+			t.Errorf("Wrong large value: %d lines\n", len(lines))
+		}
+
+		// added, and at the item size limit
+		extras := make([]byte, 8)
+		CheckStatus(t, tc.Do(protocol.CMD_ADD, extras, []byte("key4"), []byte(big), 0), protocol.STATUS_OK)
+		if get := tc.Get("key4"); string(get.value) != big {
+			t.Errorf("Wrong large value added: %d bytes\n", len(get.value))
+		}
+		CheckStatus(t, tc.Set("key5", strings.Repeat("x", 4<<20), 0, 0), protocol.STATUS_OK)
+
+		// over the item size limit
+		huge := strings.Repeat("x", 4<<20+1)
+		CheckLines(t, text.Do(fmt.Sprintf("set key3 0 0 %d\r\n%s\r\n", len(huge), huge)), TEXT_TOO_LARGE)
+		CheckLines(t, text.Do("get key3\r\n"), "END")
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+// The slow log: a bounded ring buffer of the most recent requests that took
+// longer than a threshold to serve, with the timing of each phase, for finding
+// which requests (and clients) make up the tail of the latency histograms.
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"memcached/protocol"
+)
+
+// SLOW_LOG_THRESHOLD is the default latency above which requests are logged
+// as slow.
+const SLOW_LOG_THRESHOLD = 10 * time.Millisecond
+
+// SLOW_LOG_SIZE is the default number of slow requests kept.
+const SLOW_LOG_SIZE = 128
+
+// SlowRequest is a request logged as slow.
+type SlowRequest struct {
+	ID      uint64 // increasing with every request logged
+	Time    time.Time
+	Command protocol.Command
+	Key     string
+	Size    int // of the value set or returned
+	Client  uint
+	Addr    string
+	Timing  Timing
+}
+
+// SlowLog keeps the most recent slow requests.
+type SlowLog struct {
+	threshold time.Duration
+
+	mu       sync.Mutex
+	requests []SlowRequest // ring buffer, the next written at logged % len
+	logged   uint64
+	reset    uint64 // logged when last reset
+}
+
+// NewSlowLog creates a new SlowLog keeping the last size requests that took
+// longer than threshold, or none if size is 0.
+func NewSlowLog(threshold time.Duration, size int) *SlowLog {
+	return &SlowLog{threshold: threshold, requests: make([]SlowRequest, size)}
+}
+
+// Slow returns true if a request that took d should be logged.
+func (sl *SlowLog) Slow(d time.Duration) bool {
+	return d > sl.threshold && len(sl.requests) > 0
+}
+
+// Add logs a slow request, replacing the oldest if the log is full. The ID
+// of the request is set by the log.
+func (sl *SlowLog) Add(req SlowRequest) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	req.ID = sl.logged
+	sl.requests[sl.logged%uint64(len(sl.requests))] = req
+	sl.logged++
+}
+
+// Requests returns up to the n most recent slow requests on keys that visible
+// allows (any request if nil), the latest first.
+func (sl *SlowLog) Requests(n int, visible func(key string) bool) []SlowRequest {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	var reqs []SlowRequest
+	logged := min(len(sl.requests), int(sl.logged-sl.reset))
+	for i := 0; i < logged && len(reqs) < n; i++ {
+		req := sl.requests[(sl.logged-1-uint64(i))%uint64(len(sl.requests))]
+		if visible == nil || visible(req.Key) {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// Logged returns the number of slow requests ever logged.
+func (sl *SlowLog) Logged() uint64 {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.logged
+}
+
+// Reset forgets the slow requests logged so far. Their IDs keep increasing.
+func (sl *SlowLog) Reset() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	clear(sl.requests)
+	sl.reset = sl.logged
+}
+
+// Stats returns the statistics of the slow log.
+func (sl *SlowLog) Stats() []Stat {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return []Stat{
+		{"slowlog_threshold", micros(sl.threshold)},
+		{"slowlog_len", fmt.Sprint(min(sl.logged-sl.reset, uint64(len(sl.requests))))},
+		{"slowlog_max_len", fmt.Sprint(len(sl.requests))},
+		{"slowlog_logged", fmt.Sprint(sl.logged)},
+	}
+}
+
+// appendSlowRequest appends the line of the slowlog command for a request to
+// buf, of space separated fields in the format of a metadump line, durations
+// being in microseconds:
+//
+//	id=<id> time=<unix time> cmd=<command> key=<url-encoded key> size=<bytes>
+//	client=<id> addr=<address> total=<us> parse=<us> lock=<us> exec=<us> write=<us>
+func appendSlowRequest(buf []byte, req *SlowRequest) []byte {
+	buf = append(buf, "id="...)
+	buf = strconv.AppendUint(buf, req.ID, 10)
+	buf = append(buf, " time="...)
+	buf = strconv.AppendInt(buf, req.Time.Unix(), 10)
+	buf = append(buf, " cmd="...)
+	buf = append(buf, req.Command.String()...)
+	buf = append(buf, " key="...)
+	buf = append(buf, url.QueryEscape(req.Key)...)
+	buf = append(buf, " size="...)
+	buf = strconv.AppendInt(buf, int64(req.Size), 10)
+	buf = append(buf, " client="...)
+	buf = strconv.AppendUint(buf, uint64(req.Client), 10)
+	buf = append(buf, " addr="...)
+	buf = append(buf, req.Addr...)
+	for p, d := range req.Timing {
+		buf = append(buf, ' ')
+		buf = append(buf, Phase(p).String()...)
+		buf = append(buf, '=')
+		buf = append(buf, micros(d)...)
+	}
+	return buf
+}
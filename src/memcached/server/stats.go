@@ -0,0 +1,190 @@
+package server
+
+// Server statistics, as reported by the memcache stat command.
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// Stat is a single named statistic.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// Stats returns the statistics in the specified group ("" for the general
+// statistics), or false if the group is unknown.
+func (cnh *ConnectionHandler) Stats(group string) ([]Stat, bool) {
+	switch group {
+	case "":
+		return cnh.generalStats(), true
+	case "replication":
+		return cnh.replicationStats(), true
+	case "hotkeys":
+		if cnh.hotKeys == nil {
+			return nil, true
+		}
+		return cnh.hotKeys.Stats(cnh.keyFilter(nil)), true
+	case "latency":
+		return cnh.latencyStats(), true
+	case "heap":
+		return cnh.heapStats(), true
+	case "users":
+		return cnh.users.Stats(), true
+	case "tenants":
+		if cnh.cache == nil {
+			return nil, true
+		}
+		return cnh.tenantStats(), true
+	}
+	if stats, ok := cnh.extraStats[group]; ok {
+		return stats(), true
+	}
+	return nil, false
+}
+
+// stats returns the statistics in the specified group for the client, whose hot
+// keys are limited to those it may see.
+func (client *ClientConn) stats(group string) ([]Stat, bool) {
+	if group == "hotkeys" && client.handler.hotKeys != nil {
+		return client.handler.hotKeys.Stats(client.keyFilter()), true
+	}
+	return client.handler.Stats(group)
+}
+
+// generalStats returns the general server statistics.
+func (cnh *ConnectionHandler) generalStats() []Stat {
+	now := time.Now()
+	stats := []Stat{
+		{"pid", fmt.Sprint(os.Getpid())},
+		{"uptime", fmt.Sprint(int64(now.Sub(cnh.started).Seconds()))},
+		{"time", fmt.Sprint(now.Unix())},
+		{"curr_connections", fmt.Sprint(cnh.CurrClients())},
+		{"total_connections", fmt.Sprint(cnh.TotalClients())},
+		{"cmd_get", fmt.Sprint(cnh.metrics.Total(protocol.CMD_GET))},
+		{"cmd_set", fmt.Sprint(cnh.metrics.Total(protocol.CMD_SET))},
+		{"cmd_touch", fmt.Sprint(cnh.metrics.Total(protocol.CMD_TOUCH))},
+		{"get_hits", fmt.Sprint(cnh.metrics.Count(protocol.CMD_GET, protocol.STATUS_OK))},
+		{"get_misses", fmt.Sprint(cnh.metrics.Count(protocol.CMD_GET, protocol.STATUS_KEY_NOT_FOUND))},
+		{"auth_errors", fmt.Sprint(atomic.LoadUint64(&cnh.authFailures))},
+		{"client_ops_limit", fmt.Sprint(cnh.clientRate.Ops)},
+		{"client_bytes_limit", fmt.Sprint(cnh.clientRate.Bytes)},
+		{"throttled_requests", fmt.Sprint(atomic.LoadUint64(&cnh.throttled))},
+	}
+	stats = append(stats, cnh.maintenanceStats()...)
+	if cnh.cache != nil {
+		stats = append(stats, cnh.cacheStats()...)
+		stats = append(stats, cnh.leaseStats()...)
+		stats = append(stats, cnh.crawlerStats()...)
+	}
+	return append(stats, cnh.replicationStats()...)
+}
+
+// replicationStats returns the statistics of the leader or follower (if
+// replication is enabled).
+func (cnh *ConnectionHandler) replicationStats() []Stat {
+	var stats []Stat
+	if cnh.leader != nil {
+		stats = append(stats, cnh.leader.Stats()...)
+	}
+	if cnh.follower != nil {
+		stats = append(stats, cnh.follower.Stats()...)
+	}
+	return stats
+}
+
+// cacheStats returns the statistics of the cache, its write log and disk tier
+// (if enabled).
+func (cnh *ConnectionHandler) cacheStats() []Stat {
+	cs := cnh.cache.Stats()
+	stats := []Stat{
+		{"curr_items", fmt.Sprint(cs.Items)},
+		{"bytes", fmt.Sprint(cs.Bytes)},
+		{"bytes_payload", fmt.Sprint(cs.PayloadBytes)},
+		{"bytes_overhead", fmt.Sprint(cs.OverheadBytes)},
+		{"limit_maxbytes", fmt.Sprint(cs.MaxBytes)},
+		{"item_size_max", fmt.Sprint(cs.MaxItemSize)},
+		{"evictions", fmt.Sprint(cs.Evictions)},
+		{"store_too_large", fmt.Sprint(cs.TooLarge)},
+		{"store_no_memory", fmt.Sprint(cs.NoMemory)},
+		{"invalidations", fmt.Sprint(cs.Invalidations)},
+	}
+	for reason, n := range cs.Removals {
+		stats = append(stats, Stat{"removed_" + cache.Reason(reason).String(), fmt.Sprint(n)})
+	}
+	if cnh.wal != nil {
+		stats = append(stats, Stat{"wal_bytes", fmt.Sprint(cnh.wal.Size())})
+	}
+	if cnh.disk != nil {
+		ds := cnh.disk.Stats()
+		stats = append(stats,
+			Stat{"disk_bytes", fmt.Sprint(ds.Bytes)},
+			Stat{"disk_bytes_live", fmt.Sprint(ds.LiveBytes)},
+			Stat{"disk_limit_maxbytes", fmt.Sprint(ds.MaxBytes)},
+			Stat{"disk_segments", fmt.Sprint(ds.Segments)},
+			Stat{"disk_items", fmt.Sprint(ds.Items)},
+			Stat{"disk_writes", fmt.Sprint(ds.Written)},
+			Stat{"disk_hits", fmt.Sprint(ds.Hits)},
+			Stat{"disk_misses", fmt.Sprint(ds.Misses)},
+			Stat{"disk_compactions", fmt.Sprint(ds.Compactions)},
+			Stat{"disk_dropped", fmt.Sprint(ds.Dropped)},
+		)
+	}
+	return stats
+}
+
+// crawlerStats returns the statistics of the LRU crawler and the idle item
+// reaper (if enabled).
+func (cnh *ConnectionHandler) crawlerStats() []Stat {
+	cs := cnh.crawler.Stats()
+	stats := []Stat{
+		{"crawler_crawls", fmt.Sprint(cs.Crawls)},
+		{"crawler_items_checked", fmt.Sprint(cs.Checked)},
+		{"crawler_reclaimed", fmt.Sprint(cs.Reclaimed)},
+	}
+	if cnh.reaper != nil {
+		rs := cnh.reaper.Stats()
+		stats = append(stats,
+			Stat{"reaper_max_idle", fmt.Sprint(int64(rs.MaxIdle.Seconds()))},
+			Stat{"reaper_reclaimed", fmt.Sprint(rs.Reclaimed)},
+			Stat{"reaper_reclaimed_bytes", fmt.Sprint(rs.ReclaimedBytes)},
+		)
+	}
+	return stats
+}
+
+// heapStats returns the statistics of the heap limiter (if enabled).
+func (cnh *ConnectionHandler) heapStats() []Stat {
+	if cnh.heapLimiter == nil {
+		return nil
+	}
+	hs := cnh.heapLimiter.Stats()
+	return []Stat{
+		{"heap_limit", fmt.Sprint(hs.MaxHeap)},
+		{"heap_live", fmt.Sprint(hs.Live)},
+		{"heap_stored", fmt.Sprint(hs.Stored)},
+		{"heap_live_ratio", fmt.Sprintf("%.2f", liveRatio(hs))},
+		{"heap_goal", fmt.Sprint(hs.Goal)},
+		{"heap_memory_limit", fmt.Sprint(hs.MemoryLimit)},
+		{"heap_maxbytes_configured", fmt.Sprint(hs.MaxBytes)},
+		{"heap_maxbytes_effective", fmt.Sprint(hs.StorageLimit)},
+		{"heap_limit_adjustments", fmt.Sprint(hs.Adjustments)},
+		{"heap_limit_evictions", fmt.Sprint(hs.Evictions)},
+	}
+}
+
+// liveRatio returns the ratio of the live heap to the bytes stored by the cache,
+// as of the last garbage collection, i.e., how much memory the cache actually
+// uses for each byte it accounts for (0 if nothing was stored).
+func liveRatio(hs cache.HeapLimiterStats) float64 {
+	if hs.Stored == 0 {
+		return 0
+	}
+	return float64(hs.Live) / float64(hs.Stored)
+}
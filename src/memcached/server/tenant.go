@@ -0,0 +1,260 @@
+package server
+
+// Tenants, for sharing a server between teams without one team's writes
+// evicting everyone else's keys (see cache/tenant.go).
+//
+// Clients authenticate as one of a tenant's users to use its keys, which adds
+// the prefix to their keys for them (and so keeps them to the tenant's keys).
+// Clients in no tenant, such as every client when there are no users, are kept
+// to the keys of the default tenant, and of the open tenants listing * as a
+// user, whose keys they use by including the prefix. Tenants are read from a
+// file with a line per tenant:
+//
+//   # tenant prefix memory(MB) [user...]
+//   search s: 100 alice bob
+//   ads ads: 0 *
+//
+// A memory limit of 0 leaves the tenant limited by the storage limit of the
+// cache alone.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// TenantConfig is the configuration of a tenant.
+type TenantConfig struct {
+	Name     string
+	Prefix   string
+	MaxBytes uint64
+	Users    []string
+	Open     bool // clients in no tenant may use the tenant's keys too
+}
+
+// LoadTenants reads the tenants file at path.
+func LoadTenants(path string) ([]TenantConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTenants(f)
+}
+
+// ParseTenants parses a tenants file.
+func ParseTenants(r io.Reader) ([]TenantConfig, error) {
+	var configs []TenantConfig
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected tenant, prefix, memory and optional users", n)
+		}
+		mb, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid memory %q", n, fields[2])
+		}
+		users := slices.DeleteFunc(fields[3:], func(user string) bool { return user == "*" })
+		configs = append(configs, TenantConfig{
+			Name:     fields[0],
+			Prefix:   fields[1],
+			MaxBytes: mb * 1024 * 1024,
+			Users:    users,
+			Open:     len(users) < len(fields)-3,
+		})
+	}
+	return configs, scanner.Err()
+}
+
+// ConfigureTenants adds the tenants to an empty cache, assigning users to the
+// tenants that list them. Tenants must be configured before the cache is served
+// by a ConnectionHandler.
+func ConfigureTenants(c *cache.Cache, users Users, configs []TenantConfig) error {
+	for _, config := range configs {
+		t, err := c.AddTenant(config.Name, config.Prefix, config.MaxBytes)
+		if err != nil {
+			return err
+		}
+		for _, name := range config.Users {
+			user, ok := users[name]
+			if !ok {
+				return fmt.Errorf("tenant %s: unknown user %q", config.Name, name)
+			}
+			if user.tenant != nil {
+				return fmt.Errorf("tenant %s: user %q already in tenant %s",
+					config.Name, name, user.tenant.Name())
+			}
+			user.tenant = t
+		}
+	}
+	return nil
+}
+
+// key returns the key as stored in the cache, in the namespace of the client's
+// tenant if it authenticated as one of the tenant's users. The key returned is
+// only valid until the next call.
+func (client *ClientConn) key(key []byte) []byte {
+	if client.user == nil || client.user.tenant == nil {
+		return key
+	}
+	client.keyBuf = append(append(client.keyBuf[:0], client.user.tenant.Prefix()...), key...)
+	return client.keyBuf
+}
+
+// flush removes the keys of the client's tenant if it authenticated as one of
+// the tenant's users, those of the default tenant if it's in no tenant, or else
+// all keys.
+func (client *ClientConn) flush() error {
+	switch {
+	case client.user != nil && client.user.tenant != nil:
+		return client.store.FlushPrefix(client.ctx, []byte(client.user.tenant.Prefix()))
+	case client.tenantless():
+		client.handler.cache.FlushTenant(client.handler.tenants[0])
+		return nil
+	}
+	return client.store.Flush(client.ctx)
+}
+
+// tenantless returns true if tenants are configured but the client is in none
+// of them, so may only use the keys of the default and open tenants.
+func (client *ClientConn) tenantless() bool {
+	return client.handler.tenants != nil && (client.user == nil || client.user.tenant == nil)
+}
+
+// foreign returns true if the key (or tag) is in the namespace of a tenant the
+// client may not use. Clients in a tenant have its prefix added to their keys,
+// so only ever use the tenant's.
+func (client *ClientConn) foreign(key []byte) bool {
+	if !client.tenantless() {
+		return false
+	}
+	return client.handler.closed(func(prefix string) bool { return bytes.HasPrefix(key, []byte(prefix)) })
+}
+
+// foreignPrefix returns true if keys starting with the prefix may be in the
+// namespace of a tenant the client may not use.
+func (client *ClientConn) foreignPrefix(prefix []byte) bool {
+	if !client.tenantless() {
+		return false
+	}
+	return client.handler.closed(func(p string) bool {
+		return bytes.HasPrefix(prefix, []byte(p)) || strings.HasPrefix(p, string(prefix))
+	})
+}
+
+// closed returns true if match is true of the prefix of a tenant clients in no
+// tenant may not use: any but the default tenant and the open tenants.
+func (cnh *ConnectionHandler) closed(match func(prefix string) bool) bool {
+	for _, t := range cnh.tenants[1:] {
+		if !cnh.open[t.Name()] && match(t.Prefix()) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted returns false if a request uses the keys, prefixes or tags of a
+// tenant the client may not use.
+func (client *ClientConn) permitted(req *protocol.Header, extras, key []byte) bool {
+	if !client.tenantless() {
+		return true
+	}
+	switch req.Opcode {
+	case protocol.CMD_SET:
+		tags, _ := client.parseTags(extras)
+		return !client.foreign(key) && !slices.ContainsFunc(tags, client.foreign)
+	case protocol.CMD_FLUSH_PREFIX:
+		return !client.foreignPrefix(key)
+	case protocol.CMD_GET, protocol.CMD_ADD, protocol.CMD_INCREMENT, protocol.CMD_DECREMENT,
+		protocol.CMD_DELETE, protocol.CMD_TOUCH, protocol.CMD_GAT, protocol.CMD_LEASE_GET,
+		protocol.CMD_LEASE_SET, protocol.CMD_INVALIDATE_TAG:
+		return !client.foreign(key)
+	}
+	return true
+}
+
+// textPermitted returns false if a text request uses the keys, prefixes or
+// tags of a tenant the client may not use.
+func (client *ClientConn) textPermitted(args [][]byte) bool {
+	if !client.tenantless() {
+		return true
+	}
+	switch string(args[0]) {
+	case "get", "gets":
+		return !slices.ContainsFunc(args[1:], client.foreign)
+	case "gat", "gats":
+		return len(args) < 3 || !slices.ContainsFunc(args[2:], client.foreign)
+	case "set", "cas":
+		for _, arg := range args[min(len(args), 2):] {
+			if tags, ok := client.parseTextTags(arg); ok && slices.ContainsFunc(tags, client.foreign) {
+				return false
+			}
+		}
+		return len(args) < 2 || !client.foreign(args[1])
+	case "delete", "touch", "invalidate_tag":
+		return len(args) < 2 || !client.foreign(args[1])
+	case "flush_prefix":
+		return len(args) < 2 || !client.foreignPrefix(args[1])
+	}
+	return true
+}
+
+// keyFilter returns which keys (as stored in the cache) may be shown to a
+// client in the tenant (nil for no tenant) by the commands listing keys, such
+// as metadump, watch, slowlog and the hot keys: those of its tenant, or of the
+// default and open tenants for clients in none. Returns nil if there are no tenants, when
+// every key may be shown.
+func (cnh *ConnectionHandler) keyFilter(t *cache.Tenant) func(key string) bool {
+	switch {
+	case cnh.tenants == nil:
+		return nil
+	case t != nil:
+		return func(key string) bool { return strings.HasPrefix(key, t.Prefix()) }
+	}
+	return func(key string) bool {
+		return !cnh.closed(func(prefix string) bool { return strings.HasPrefix(key, prefix) })
+	}
+}
+
+// keyFilter returns which keys may be shown to the client (see
+// ConnectionHandler.keyFilter).
+func (client *ClientConn) keyFilter() func(key string) bool {
+	if client.user == nil {
+		return client.handler.keyFilter(nil)
+	}
+	return client.handler.keyFilter(client.user.tenant)
+}
+
+// tenantStats returns the statistics of every tenant, named by tenant (e.g.,
+// tenant_default_bytes).
+func (cnh *ConnectionHandler) tenantStats() []Stat {
+	var stats []Stat
+	for _, t := range cnh.cache.TenantStats() {
+		prefix := "tenant_" + t.Name + "_"
+		stats = append(stats,
+			Stat{prefix + "curr_items", fmt.Sprint(t.Items)},
+			Stat{prefix + "bytes", fmt.Sprint(t.Bytes)},
+			Stat{prefix + "limit_maxbytes", fmt.Sprint(t.MaxBytes)},
+			Stat{prefix + "get_hits", fmt.Sprint(t.Hits)},
+			Stat{prefix + "get_misses", fmt.Sprint(t.Misses)},
+			Stat{prefix + "evictions", fmt.Sprint(t.Evictions)},
+		)
+	}
+	return stats
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+func TestConfigureTenants(t *testing.T) {
+	configs, err := ParseTenants(strings.NewReader(`
+# tenant prefix memory(MB) [user...]
+search s: 100 alice bob
+ads ads: 0 *
+`))
+	if err != nil {
+		t.Fatalf("Couldn't parse tenants: %s\n", err)
+	}
+	if len(configs) != 2 || configs[0].MaxBytes != 100*1024*1024 ||
+		fmt.Sprint(configs[0].Users) != "[alice bob]" || configs[0].Open || configs[1].Prefix != "ads:" ||
+		len(configs[1].Users) != 0 || !configs[1].Open {
+		t.Errorf("Wrong tenants: %v\n", configs)
+	}
+	for _, bad := range []string{"search s:", "search s: -1"} {
+		if _, err := ParseTenants(strings.NewReader(bad)); err == nil {
+			t.Errorf("Invalid tenants file parsed: %q\n", bad)
+		}
+	}
+
+	users, _ := ParseUsers(strings.NewReader("alice pw\nbob pw\n"))
+	c := cache.New(100000)
+	if err := ConfigureTenants(c, users, configs); err != nil {
+		t.Fatalf("Couldn't configure tenants: %s\n", err)
+	}
+	if search := c.Tenant("search"); search == nil || users["alice"].tenant != search ||
+		users["bob"].tenant != search {
+		t.Errorf("Users not assigned to tenant\n")
+	}
+	if err := ConfigureTenants(cache.New(100000), users, []TenantConfig{{"x", "x:", 0, []string{"carol"}, false}}); err == nil {
+		t.Errorf("Tenant with unknown user configured\n")
+	}
+}
+
+func TestClientTenant(t *testing.T) {
+	users, _ := ParseUsers(strings.NewReader("alice secret\nbob pass"))
+	c := cache.New(100000)
+	tenant, err := c.AddTenant("team", "t:", 0)
+	if err != nil {
+		t.Fatalf("Couldn't add tenant: %s\n", err)
+	}
+	users["alice"].tenant = tenant
+	server := StartTestServerWith(t, c, func(handler *ConnectionHandler) {
+		handler.users = users
+	})
+
+	// an authenticated client's keys are in its tenant's namespace
+	alice := DialTestClient(t, server.Addr())
+	CheckStatus(t, alice.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00alice\x00secret"), 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.Set("key", "value", 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.Get("key"), protocol.STATUS_OK)
+
+	// clients in no tenant are kept to the default tenant's keys
+	other := DialTestClient(t, server.Addr())
+	CheckStatus(t, other.Do(protocol.CMD_SASL_AUTH, nil, []byte("PLAIN"), []byte("\x00bob\x00pass"), 0), protocol.STATUS_OK)
+	CheckStatus(t, other.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, other.Get("t:key"), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, other.Set("t:key", "value", 0, 0), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, other.Do(protocol.CMD_FLUSH_PREFIX, nil, []byte("t"), nil, 0), protocol.STATUS_AUTH_FAILED)
+	CheckStatus(t, other.Set("key", "value", 0, 0), protocol.STATUS_OK)
+
+	// and flushing only removes the default tenant's keys, or the tenant's
+	CheckStatus(t, other.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.Get("key"), protocol.STATUS_OK)
+	CheckStatus(t, other.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, other.Set("key", "value", 0, 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.Do(protocol.CMD_FLUSH, nil, nil, nil, 0), protocol.STATUS_OK)
+	CheckStatus(t, alice.Get("key"), protocol.STATUS_KEY_NOT_FOUND)
+	CheckStatus(t, other.Get("key"), protocol.STATUS_OK)
+
+	if stats := other.Stats("tenants"); stats["tenant_team_get_hits"] != "2" ||
+		stats["tenant_team_get_misses"] != "1" {
+		t.Errorf("Wrong tenant stats: %v\n", stats)
+	}
+}
+
+func TestTextTenant(t *testing.T) {
+	// without users, clients are all in no tenant
+	c := cache.New(100000)
+	for _, name := range []string{"team", "open"} {
+		if _, err := c.AddTenant(name, name[:1]+":", 0); err != nil {
+			t.Fatalf("Couldn't add tenant: %s\n", err)
+		}
+	}
+	server := StartTestServerWith(t, c, func(cnh *ConnectionHandler) {
+		cnh.slowLog = NewSlowLog(0, 100)
+		WithOpenTenants("open")(cnh)
+	})
+	text := DialTextClient(t, server.Addr())
+
+	CheckLines(t, text.Do("set key 0 0 5\r\nvalue\r\n"), TEXT_STORED)
+	CheckLines(t, text.Do("get key t:key\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("set t:key 0 0 1\r\nx\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("set key 0 0 1 tags=t:tag\r\nx\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("delete t:key\r\n"), TEXT_DENIED)
+	CheckLines(t, text.Do("get key\r\n"), "VALUE key 0 5", "value", TEXT_END)
+
+	// but may use an open tenant's keys by including its prefix
+	CheckLines(t, text.Do("set o:key 0 0 1\r\nx\r\n"), TEXT_STORED)
+	CheckLines(t, text.Do("get o:key\r\n"), "VALUE o:key 0 1", "x", TEXT_END)
+	CheckLines(t, text.Do("delete o:key\r\n"), TEXT_DELETED)
+
+	// nor are the tenant's keys listed by metadump or the slow log
+	c.Set(ctx, []byte("t:key"), []byte("value"), 0, 0, 0)
+	fmt.Fprintf(text.conn, "lru_crawler metadump all\r\n")
+	if lines := ReadMetadump(t, text.r, "END\r\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "key=key ") {
+		t.Errorf("Wrong metadump: %q\n", lines)
+	}
+	fmt.Fprintf(text.conn, "slowlog\r\n")
+	for _, line := range ReadMetadump(t, text.r, "END\r\n") {
+		if strings.Contains(line, "key=t%3A") {
+			t.Errorf("Tenant's key in slow log: %q\n", line)
+		}
+	}
+	base := StartTestAdmin(t, server)
+	if dump := HttpGet(t, base+"/metadump"); strings.Contains(dump, "t%3Akey") {
+		t.Errorf("Tenant's key in admin metadump: %q\n", dump)
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+// Live stream of requests and evictions for debugging, as memcached's watch
+// command. Each event is a single logfmt line, e.g.:
+//
+//   ts=1500000000.123456 type=fetch cmd=get key=foo status=ok size=5 client=3
+//   ts=1500000000.123789 type=eviction key=bar size=141
+//
+// Events are never allowed to slow down the requests producing them: when no
+// one is watching, publishing an event is a single atomic load, and events for
+// a watcher that can't keep up are dropped (and counted) rather than waited on.
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// WatchKind is a kind of event that can be watched.
+type WatchKind uint8
+
+// List of watchable events.
+const (
+	WATCH_FETCHERS WatchKind = 1 << iota
+	WATCH_MUTATIONS
+	WATCH_EVICTIONS
+
+	WATCH_ALL = WATCH_FETCHERS | WATCH_MUTATIONS | WATCH_EVICTIONS
+)
+
+// WATCH_QUEUE_SIZE is the number of events buffered for a watcher before
+// further events are dropped.
+const WATCH_QUEUE_SIZE = 1024
+
+// watchKindNames are the names of the kinds of events, as used by the watch
+// command.
+var watchKindNames = map[string]WatchKind{
+	"fetchers":  WATCH_FETCHERS,
+	"mutations": WATCH_MUTATIONS,
+	"evictions": WATCH_EVICTIONS,
+}
+
+// Watchers is the set of watchers subscribed to the events of a server.
+type Watchers struct {
+	active  int32
+	watches map[*Watch]struct{}
+	now     func() time.Time
+	sync.RWMutex
+}
+
+// NewWatchers creates a new, empty set of watchers.
+func NewWatchers() *Watchers {
+	return &Watchers{
+		watches: make(map[*Watch]struct{}),
+		now:     time.Now,
+	}
+}
+
+// Watch is a single watcher's subscription to events.
+type Watch struct {
+	kinds   WatchKind
+	prefix  string
+	visible func(key string) bool // nil for every key
+	sample  uint64                // deliver one in every sample matching events
+	events  chan []byte
+	seen    uint64
+	skipped uint64
+}
+
+// ParseWatchArgs parses the arguments of the watch command: the kinds of
+// events to watch (all if none are given), "prefix=<prefix>" to only watch keys
+// with that prefix and "sample=<n>" to only receive one in every n events.
+func ParseWatchArgs(args []string) (WatchKind, string, uint64, error) {
+	var kinds WatchKind
+	prefix, sample := "", uint64(1)
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "prefix="):
+			prefix = arg[len("prefix="):]
+		case strings.HasPrefix(arg, "sample="):
+			n, err := strconv.ParseUint(arg[len("sample="):], 10, 32)
+			if err != nil || n == 0 {
+				return 0, "", 0, fmt.Errorf("invalid sample rate: %q", arg)
+			}
+			sample = n
+		default:
+			kind, ok := watchKindNames[arg]
+			if !ok {
+				return 0, "", 0, fmt.Errorf("unknown event kind: %q", arg)
+			}
+			kinds |= kind
+		}
+	}
+	if kinds == 0 {
+		kinds = WATCH_ALL
+	}
+	return kinds, prefix, sample, nil
+}
+
+// Subscribe adds a watcher for the specified kinds of events on keys with the
+// prefix that visible allows (all of them if nil), receiving one in every
+// sample of them.
+func (ws *Watchers) Subscribe(kinds WatchKind, prefix string, sample uint64, visible func(key string) bool) *Watch {
+	w := &Watch{
+		kinds:   kinds,
+		prefix:  prefix,
+		visible: visible,
+		sample:  sample,
+		events:  make(chan []byte, WATCH_QUEUE_SIZE),
+	}
+	ws.Lock()
+	ws.watches[w] = struct{}{}
+	atomic.StoreInt32(&ws.active, int32(len(ws.watches)))
+	ws.Unlock()
+	return w
+}
+
+// Unsubscribe removes a watcher.
+func (ws *Watchers) Unsubscribe(w *Watch) {
+	ws.Lock()
+	delete(ws.watches, w)
+	atomic.StoreInt32(&ws.active, int32(len(ws.watches)))
+	ws.Unlock()
+}
+
+// Request publishes a fetch or mutation by a client. Other commands are
+// ignored. Safe to call on a nil Watchers, which does nothing.
+func (ws *Watchers) Request(client uint, cmd protocol.Command, key []byte, status protocol.Status, size int) {
+	if ws == nil || atomic.LoadInt32(&ws.active) == 0 {
+		return
+	}
+	kind := WATCH_FETCHERS
+	if cmd.IsMutation() {
+		kind = WATCH_MUTATIONS
+	} else if cmd != protocol.CMD_GET && cmd != protocol.CMD_GAT {
+		return
+	}
+	ws.publish(kind, string(key), func(buf []byte) []byte {
+		buf = append(buf, " cmd="...)
+		buf = append(buf, cmd.String()...)
+		buf = appendWatchKey(buf, string(key))
+		buf = append(buf, " status="...)
+		buf = append(buf, status.String()...)
+		buf = append(buf, " size="...)
+		buf = strconv.AppendInt(buf, int64(size), 10)
+		buf = append(buf, " client="...)
+		return strconv.AppendUint(buf, uint64(client), 10)
+	})
+}
+
+// Evicted publishes the eviction of an item. Safe to call on a nil Watchers,
+// which does nothing.
+func (ws *Watchers) Evicted(key string, size uint64) {
+	if ws == nil || atomic.LoadInt32(&ws.active) == 0 {
+		return
+	}
+	ws.publish(WATCH_EVICTIONS, key, func(buf []byte) []byte {
+		buf = appendWatchKey(buf, key)
+		buf = append(buf, " size="...)
+		return strconv.AppendUint(buf, size, 10)
+	})
+}
+
+// Removed is the cache hook publishing items evicted for lack of room or for
+// being idle.
+func (ws *Watchers) Removed(key string, size uint64, reason cache.Reason) {
+	if reason == cache.REASON_EVICTED || reason == cache.REASON_IDLE {
+		ws.Evicted(key, size)
+	}
+}
+
+// publish sends an event to every interested watcher, formatting it (with
+// format appending the fields specific to the event) only if there is one.
+func (ws *Watchers) publish(kind WatchKind, key string, format func([]byte) []byte) {
+	var line []byte
+	ws.RLock()
+	defer ws.RUnlock()
+
+	for w := range ws.watches {
+		if w.kinds&kind == 0 || !strings.HasPrefix(key, w.prefix) ||
+			(w.visible != nil && !w.visible(key)) {
+			continue
+		}
+		if w.sample > 1 && atomic.AddUint64(&w.seen, 1)%w.sample != 0 {
+			continue
+		}
+		if line == nil {
+			line = ws.format(kind, format)
+		}
+		select {
+		case w.events <- line:
+		default:
+			atomic.AddUint64(&w.skipped, 1)
+		}
+	}
+}
+
+// format formats an event line.
+func (ws *Watchers) format(kind WatchKind, format func([]byte) []byte) []byte {
+	now := ws.now()
+	buf := make([]byte, 0, 128)
+	buf = append(buf, "ts="...)
+	buf = strconv.AppendInt(buf, now.Unix(), 10)
+	buf = append(buf, '.')
+	buf = append(buf, fmt.Sprintf("%06d", now.Nanosecond()/1000)...)
+	buf = append(buf, " type="...)
+	switch kind {
+	case WATCH_FETCHERS:
+		buf = append(buf, "fetch"...)
+	case WATCH_MUTATIONS:
+		buf = append(buf, "mutation"...)
+	case WATCH_EVICTIONS:
+		buf = append(buf, "eviction"...)
+	}
+	buf = format(buf)
+	return append(buf, '\n')
+}
+
+// appendWatchKey appends the key field of an event, URL-encoded as keys may
+// contain spaces when set through the binary protocol.
+func appendWatchKey(buf []byte, key string) []byte {
+	buf = append(buf, " key="...)
+	return append(buf, url.QueryEscape(key)...)
+}
+
+// Stream writes out events as they arrive until stop is closed or writing
+// fails. Dropped events are reported with a "skipped=<n>" line.
+func (w *Watch) Stream(out *bufio.Writer, stop <-chan struct{}) error {
+	for {
+		var line []byte
+		select {
+		case line = <-w.events:
+		case <-stop:
+			return nil
+		}
+
+		if skipped := atomic.SwapUint64(&w.skipped, 0); skipped > 0 {
+			fmt.Fprintf(out, "skipped=%d\n", skipped)
+		}
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+		// write out whatever is queued before flushing
+		if len(w.events) == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
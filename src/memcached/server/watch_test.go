@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"memcached/cache"
+	"memcached/protocol"
+)
+
+// NextEvent receives the next event from a watch.
+func NextEvent(t *testing.T, w *Watch) string {
+	t.Helper()
+	select {
+	case line := <-w.events:
+		return string(line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received\n")
+	}
+	return ""
+}
+
+func CheckNoEvent(t *testing.T, w *Watch) {
+	t.Helper()
+	select {
+	case line := <-w.events:
+		t.Errorf("Unexpected event: %s", line)
+	default:
+	}
+}
+
+func TestWatchers(t *testing.T) {
+	ws := NewWatchers()
+	ws.now = func() time.Time { return time.Unix(1500000000, 123456789) }
+
+	// nothing is formatted without a watcher
+	ws.Request(1, protocol.CMD_GET, []byte("key"), protocol.STATUS_OK, 5)
+
+	all := ws.Subscribe(WATCH_ALL, "", 1, nil)
+	fetches := ws.Subscribe(WATCH_FETCHERS, "user:", 1, nil)
+	ws.Request(1, protocol.CMD_GET, []byte("user:1"), protocol.STATUS_OK, 5)
+	ws.Request(2, protocol.CMD_SET, []byte("a key"), protocol.STATUS_OK, 3)
+	ws.Request(2, protocol.CMD_STAT, nil, protocol.STATUS_OK, 0)
+	ws.Evicted("user:2", 141)
+
+	for _, expected := range []string{
+		"ts=1500000000.123456 type=fetch cmd=get key=user%3A1 status=ok size=5 client=1\n",
+		"ts=1500000000.123456 type=mutation cmd=set key=a+key status=ok size=3 client=2\n",
+		"ts=1500000000.123456 type=eviction key=user%3A2 size=141\n",
+	} {
+		if line := NextEvent(t, all); line != expected {
+			t.Errorf("Wrong event: %q vs %q\n", line, expected)
+		}
+	}
+	CheckNoEvent(t, all)
+	if line := NextEvent(t, fetches); !strings.Contains(line, "key=user%3A1") {
+		t.Errorf("Wrong event: %q\n", line)
+	}
+	CheckNoEvent(t, fetches)
+
+	ws.Unsubscribe(fetches)
+	ws.Unsubscribe(all)
+	if ws.active != 0 {
+		t.Errorf("Watchers still active\n")
+	}
+}
+
+func TestWatchSampleAndDrop(t *testing.T) {
+	ws := NewWatchers()
+	sampled := ws.Subscribe(WATCH_ALL, "", 10, nil)
+	for i := 0; i < 100; i++ {
+		ws.Request(1, protocol.CMD_GET, []byte(fmt.Sprint(i)), protocol.STATUS_OK, 1)
+	}
+	if len(sampled.events) != 10 {
+		t.Errorf("Wrong number of sampled events: %d\n", len(sampled.events))
+	}
+	ws.Unsubscribe(sampled)
+
+	// a watcher that isn't reading never blocks requests
+	slow := ws.Subscribe(WATCH_ALL, "", 1, nil)
+	for i := 0; i < WATCH_QUEUE_SIZE+5; i++ {
+		ws.Request(1, protocol.CMD_GET, []byte("key"), protocol.STATUS_OK, 1)
+	}
+	if slow.skipped != 5 {
+		t.Errorf("Wrong number of skipped events: %d\n", slow.skipped)
+	}
+
+	var out strings.Builder
+	bw := bufio.NewWriter(&out)
+	stop := make(chan struct{})
+	go func() {
+		for len(slow.events) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(stop)
+	}()
+	slow.Stream(bw, stop)
+	bw.Flush()
+	if !strings.HasPrefix(out.String(), "skipped=5\n") ||
+		strings.Count(out.String(), "\n") != WATCH_QUEUE_SIZE+1 {
+		t.Errorf("Wrong stream output: %q...\n", out.String()[:100])
+	}
+}
+
+func TestTextWatch(t *testing.T) {
+	server := StartTestServer(t, cache.New(2*KV_SIZE))
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect to server: %s\n", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "watch mutations evictions prefix=key\r\n")
+	ReadMetadump(t, r, "OK\r\n")
+
+	tc := DialTestClient(t, server.Addr())
+	tc.Set("key1", "value", 0, 0)
+	tc.Get("key1")
+	tc.Set("other", "value", 0, 0)
+	text := DialTextClient(t, server.Addr())
+	text.Do("set key2 0 0 5\r\nvalue\r\n")
+	text.Do("delete key1\r\n")
+
+	for _, expected := range []string{
+		"type=mutation cmd=set key=key1 status=ok size=5 client=1\n",
+		"type=eviction key=key1 size=157\n",
+		"type=mutation cmd=set key=key2 status=ok size=5 client=2\n",
+		"type=mutation cmd=delete key=key1 status=key_not_found size=0 client=2\n",
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasSuffix(line, expected) {
+			t.Errorf("Wrong event: %q (%v) vs %q\n", line, err, expected)
+		}
+	}
+
+	// closing the connection stops watching
+	conn.Close()
+	Eventually(t, "watch ended", func() bool {
+		server.watchers.RLock()
+		defer server.watchers.RUnlock()
+		return len(server.watchers.watches) == 0
+	})
+}
+
+func TestAdminWatch(t *testing.T) {
+	server := StartTestServer(t, cache.New(100000))
+	base := StartTestAdmin(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", base+"/watch?kinds=fetchers", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Couldn't watch: %v\n", err)
+	}
+	defer resp.Body.Close()
+
+	tc := DialTestClient(t, server.Addr())
+	tc.Set("key", "value", 0, 0)
+	tc.Get("key")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasSuffix(line, "type=fetch cmd=get key=key status=ok size=5 client=0\n") {
+		t.Errorf("Wrong event: %q (%v)\n", line, err)
+	}
+
+	bad, err := http.Get(base + "/watch?kinds=bogus")
+	if err != nil || bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("Wrong response for bad watch: %v %v\n", bad, err)
+	} else {
+		bad.Body.Close()
+	}
+}
@@ -0,0 +1,174 @@
+// Package storage defines the interface between the memcached server and the
+// engine storing its items, so that requests can be served from engines other
+// than package cache's (e.g., a sharded map, a slab store, a disk tier or a
+// proxy to a remote cache). Package storagetest checks an engine behaves as the
+// server expects.
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// MAX_RELATIVE_EXPIRY is the largest expiration (in seconds) that memcache
+// treats as relative to the current time, anything larger is taken to be an
+// absolute UNIX timestamp.
+const MAX_RELATIVE_EXPIRY = 60 * 60 * 24 * 30
+
+// EXPIRES_UNKNOWN is the expiry of items retrieved by Get from engines that
+// can't tell when they expire (e.g., a proxy to memcache servers, whose
+// protocol doesn't return it).
+const EXPIRES_UNKNOWN = -1
+
+// Errors returned by storage operations. Engines return these for the
+// conditions described, which the server maps to protocol statuses, and any
+// other error is reported to clients as an internal error.
+var (
+	// ErrNotFound is returned when the key isn't stored.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrExists is returned when the CAS value given doesn't match the item's.
+	ErrExists = errors.New("key exists with a different CAS value")
+
+	// ErrNotStored is returned by Add when the key is already stored.
+	ErrNotStored = errors.New("item not stored")
+
+	// ErrTooLarge is returned when an item is larger than could ever be stored.
+	ErrTooLarge = errors.New("item too large")
+
+	// ErrNoMemory is returned when an item doesn't fit and the engine may not
+	// evict to make room for it.
+	ErrNoMemory = errors.New("out of memory")
+
+	// ErrNonNumeric is returned by Incr when the value isn't a number.
+	ErrNonNumeric = errors.New("value isn't a number")
+
+	// ErrNotSupported is returned by operations the engine doesn't support, or
+	// hasn't been configured to.
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrHotMiss is returned by LeaseGet when the key is missing and leased
+	// to another client.
+	ErrHotMiss = errors.New("key missing and leased to another client")
+
+	// ErrInvalidLease is returned by LeaseSet when the lease has ended or been
+	// invalidated by a store or delete of the key.
+	ErrInvalidLease = errors.New("invalid lease")
+)
+
+// Item is a value retrieved from storage.
+type Item struct {
+	Value   []byte   // mustn't be modified, it may be shared with the engine
+	Chunks  [][]byte // the value in chunks if stored in pieces (Value is then nil)
+	Flags   uint32   // opaque to the engine
+	CAS     uint64   // the item's version, unique to each store of the key
+	Expires int64    // UNIX time in seconds, 0 if the item never expires (see EXPIRES_UNKNOWN)
+}
+
+// Len returns the length of the item's value.
+func (i *Item) Len() int {
+	n := len(i.Value)
+	for _, c := range i.Chunks {
+		n += len(c)
+	}
+	return n
+}
+
+// Bytes returns the item's value in one piece, joining its chunks (which
+// allocates) if it's stored in pieces.
+func (i *Item) Bytes() []byte {
+	if i.Chunks == nil {
+		return i.Value
+	}
+	value := make([]byte, 0, i.Len())
+	for _, c := range i.Chunks {
+		value = append(value, c...)
+	}
+	return value
+}
+
+// Storage is an engine storing items by key, with memcache semantics.
+//
+// Expiration times (exptime) are as in memcache: 0 never expires, up to
+// MAX_RELATIVE_EXPIRY is in seconds from now and anything larger is a UNIX
+// time. Operations return the context's error if it's done before they start.
+// Engines keep their own copies of the keys and values given, so callers are
+// free to reuse them, and must be safe to use from multiple goroutines.
+type Storage interface {
+	// Get retrieves the item stored for the key. Its expiry may be
+	// EXPIRES_UNKNOWN.
+	Get(ctx context.Context, key []byte) (Item, error)
+
+	// Set stores the value for the key, returning its new CAS value. If cas is
+	// non-zero, the key is only stored if its current CAS value matches.
+	Set(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64) (uint64, error)
+
+	// Add stores the value for the key only if it isn't already stored,
+	// returning its CAS value.
+	Add(ctx context.Context, key, value []byte, flags, exptime uint32) (uint64, error)
+
+	// Incr adds delta to the decimal number stored for the key, or subtracts it
+	// if decr is true, returning the result. Decrementing stops at 0,
+	// incrementing wraps around at 2^64, and the item keeps its flags and
+	// expiry.
+	Incr(ctx context.Context, key []byte, delta uint64, decr bool) (uint64, error)
+
+	// Delete removes the key. If cas is non-zero, the key is only removed if
+	// its current CAS value matches.
+	Delete(ctx context.Context, key []byte, cas uint64) error
+
+	// Touch updates the expiration of the key, returning its item, whose
+	// expiry is always known.
+	Touch(ctx context.Context, key []byte, exptime uint32) (Item, error)
+
+	// Flush removes all keys.
+	Flush(ctx context.Context) error
+
+	// FlushPrefix removes all keys starting with the prefix.
+	FlushPrefix(ctx context.Context, prefix []byte) error
+}
+
+// Lease is the lease part of the outcome of a lease get (see Leaser).
+type Lease struct {
+	Token uint64 // to fill the key with, 0 if none was granted
+	Stale bool   // the item is a stale value, having been deleted or expired
+}
+
+// Leaser is implemented by engines supporting leases, which protect whatever
+// the cache is in front of from a stampede of clients filling a missing key (as
+// in "Scaling Memcache at Facebook"). On a miss, the first client is granted a
+// lease token to fill the key with, while others are told to wait and retry or
+// are given a stale value of the key, if there is one.
+type Leaser interface {
+	// LeaseGet retrieves the item stored for the key, as Get does. If the key
+	// is missing, it's leased to the caller (unless it already is to another
+	// client), and a stale value of the key (if any) is returned. Otherwise it
+	// fails with ErrNotFound if the caller was granted the lease, or
+	// ErrHotMiss if not.
+	LeaseGet(ctx context.Context, key []byte) (Item, Lease, error)
+
+	// LeaseSet stores the value for the key as Set does, but only if the lease
+	// token is still valid, failing with ErrInvalidLease if not.
+	LeaseSet(ctx context.Context, key, value []byte, flags, exptime uint32, token uint64) (uint64, error)
+}
+
+// Chunker is implemented by engines that can store a value given in chunks, so
+// that a large value (e.g., streamed from a client) is never held in one piece.
+// Engines may return the items they store this way with their value in chunks
+// (see Item).
+type Chunker interface {
+	// SetChunks stores the value for the key as Set does, the value being the
+	// chunks joined together.
+	SetChunks(ctx context.Context, key []byte, chunks [][]byte, flags, exptime uint32, cas uint64) (uint64, error)
+}
+
+// Tagger is implemented by engines that can tag items when they're stored, so
+// that every item with a tag can be invalidated at once (e.g., every key of a
+// user, whatever its prefix).
+type Tagger interface {
+	// SetTagged stores the value for the key as Set does, tagging the item.
+	SetTagged(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64, tags [][]byte) (uint64, error)
+
+	// InvalidateTag removes every item stored with the tag.
+	InvalidateTag(ctx context.Context, tag []byte) error
+}
@@ -0,0 +1,201 @@
+package storagetest
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"memcached/storage"
+)
+
+// Map is the simplest engine: a map of items behind a mutex, without a storage
+// limit or eviction. It's a reference for the behaviour the conformance tests
+// expect, and an engine to serve requests from in tests that mustn't depend on
+// package cache.
+type Map struct {
+	items   map[string]storage.Item
+	version uint64
+	sync.Mutex
+}
+
+// NewMap creates an empty Map.
+func NewMap() *Map {
+	return &Map{items: make(map[string]storage.Item)}
+}
+
+// expiresAt converts a memcache expiration value to an absolute UNIX time.
+func expiresAt(exptime uint32) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime <= storage.MAX_RELATIVE_EXPIRY:
+		return time.Now().Unix() + int64(exptime)
+	default:
+		return int64(exptime)
+	}
+}
+
+// lookup finds the key, lazily removing it if it has expired.
+//
+// The caller of this method should hold the lock on Map.
+func (m *Map) lookup(key []byte) (storage.Item, bool) {
+	i, ok := m.items[string(key)]
+	if ok && i.Expires != 0 && i.Expires <= time.Now().Unix() {
+		delete(m.items, string(key))
+		return storage.Item{}, false
+	}
+	return i, ok
+}
+
+// store stores a copy of the value for the key, returning its CAS value.
+//
+// The caller of this method should hold the lock on Map.
+func (m *Map) store(key, value []byte, flags uint32, expires int64) uint64 {
+	m.version++
+	m.items[string(key)] = storage.Item{
+		Value:   append([]byte{}, value...),
+		Flags:   flags,
+		CAS:     m.version,
+		Expires: expires,
+	}
+	return m.version
+}
+
+// Get retrieves the item stored for the key.
+func (m *Map) Get(ctx context.Context, key []byte) (storage.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	i, ok := m.lookup(key)
+	if !ok {
+		return storage.Item{}, storage.ErrNotFound
+	}
+	return i, nil
+}
+
+// Set stores the value for the key, returning its new CAS value.
+func (m *Map) Set(ctx context.Context, key, value []byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	i, ok := m.lookup(key)
+	if ok && cas > 0 && i.CAS != cas {
+		return 0, storage.ErrExists
+	} else if !ok && cas > 0 {
+		return 0, storage.ErrNotFound
+	}
+	return m.store(key, value, flags, expiresAt(exptime)), nil
+}
+
+// Add stores the value for the key only if it isn't already stored.
+func (m *Map) Add(ctx context.Context, key, value []byte, flags, exptime uint32) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.lookup(key); ok {
+		return 0, storage.ErrNotStored
+	}
+	return m.store(key, value, flags, expiresAt(exptime)), nil
+}
+
+// Incr adds delta to (or if decr is true, subtracts it from) the decimal number
+// stored for the key.
+func (m *Map) Incr(ctx context.Context, key []byte, delta uint64, decr bool) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	i, ok := m.lookup(key)
+	if !ok {
+		return 0, storage.ErrNotFound
+	}
+	n, err := strconv.ParseUint(string(i.Value), 10, 64)
+	if err != nil {
+		return 0, storage.ErrNonNumeric
+	}
+	if !decr {
+		n += delta
+	} else if delta < n {
+		n -= delta
+	} else {
+		n = 0
+	}
+	m.store(key, strconv.AppendUint(nil, n, 10), i.Flags, i.Expires)
+	return n, nil
+}
+
+// Delete removes the key.
+func (m *Map) Delete(ctx context.Context, key []byte, cas uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	i, ok := m.lookup(key)
+	if !ok {
+		return storage.ErrNotFound
+	} else if cas > 0 && i.CAS != cas {
+		return storage.ErrExists
+	}
+	delete(m.items, string(key))
+	return nil
+}
+
+// Touch updates the expiration of the key, returning its item.
+func (m *Map) Touch(ctx context.Context, key []byte, exptime uint32) (storage.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.Item{}, err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	i, ok := m.lookup(key)
+	if !ok {
+		return storage.Item{}, storage.ErrNotFound
+	}
+	i.Expires = expiresAt(exptime)
+	m.items[string(key)] = i
+	return i, nil
+}
+
+// Flush removes all keys.
+func (m *Map) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	clear(m.items)
+	return nil
+}
+
+// FlushPrefix removes all keys starting with the prefix.
+func (m *Map) FlushPrefix(ctx context.Context, prefix []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	for key := range m.items {
+		if strings.HasPrefix(key, string(prefix)) {
+			delete(m.items, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package storagetest
+
+import (
+	"testing"
+
+	"memcached/storage"
+)
+
+func TestMap(t *testing.T) {
+	TestStorage(t, func() storage.Storage { return NewMap() })
+}
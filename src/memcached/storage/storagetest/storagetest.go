@@ -0,0 +1,474 @@
+// Package storagetest checks implementations of storage.Storage, with a suite
+// of tests every engine must pass to be served by the memcached server:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.TestStorage(t, func() storage.Storage { return NewEngine() })
+//	}
+//
+// The suite only stores a few small items, so it doesn't exercise limits or
+// eviction, which are particular to each engine. Engines that can't know the
+// expiry of items got (see storage.EXPIRES_UNKNOWN) are tested with
+// WithUnknownExpiry. Leases are only tested if the engine is a storage.Leaser
+// supporting them, chunked values if it's a storage.Chunker and tags if it's a
+// storage.Tagger.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"memcached/storage"
+)
+
+// options are the options of the conformance tests.
+type options struct {
+	unknownExpiry bool
+}
+
+// Option configures the conformance tests.
+type Option func(*options)
+
+// WithUnknownExpiry lets the engine return items got with their expiry as
+// storage.EXPIRES_UNKNOWN, as a router of servers that don't report it does.
+// Expiries returned by Touch are still checked.
+func WithUnknownExpiry() Option {
+	return func(o *options) { o.unknownExpiry = true }
+}
+
+// TestStorage runs the conformance tests, each against a new, empty engine.
+func TestStorage(t *testing.T, newStorage func() storage.Storage, opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	tests := []struct {
+		name string
+		test func(*testing.T, storage.Storage, *options)
+	}{
+		{"SetGet", testSetGet},
+		{"CAS", testCAS},
+		{"Add", testAdd},
+		{"Incr", testIncr},
+		{"Delete", testDelete},
+		{"Touch", testTouch},
+		{"Expiry", testExpiry},
+		{"Flush", testFlush},
+		{"FlushPrefix", testFlushPrefix},
+		{"Canceled", testCanceled},
+		{"Concurrent", testConcurrent},
+		{"Leases", testLeases},
+		{"Chunks", testChunks},
+		{"Tags", testTags},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { test.test(t, newStorage(), &o) })
+	}
+}
+
+var ctx = context.Background()
+
+// set stores the key, failing the test if it can't.
+func set(t *testing.T, s storage.Storage, key, value string, flags uint32) uint64 {
+	t.Helper()
+	cas, err := s.Set(ctx, []byte(key), []byte(value), flags, 0, 0)
+	if err != nil {
+		t.Fatalf("Couldn't set %s: %v\n", key, err)
+	}
+	if cas == 0 {
+		t.Errorf("Set %s returned no CAS value\n", key)
+	}
+	return cas
+}
+
+// checkItem checks the key is stored with the value and flags, returning its
+// item.
+func checkItem(t *testing.T, s storage.Storage, key, value string, flags uint32) storage.Item {
+	t.Helper()
+	i, err := s.Get(ctx, []byte(key))
+	if err != nil {
+		t.Errorf("Couldn't get %s: %v\n", key, err)
+	} else if string(i.Bytes()) != value || i.Flags != flags {
+		t.Errorf("Wrong item for %s: %q (flags %d) vs %q (flags %d)\n",
+			key, i.Bytes(), i.Flags, value, flags)
+	}
+	return i
+}
+
+// knownExpiry returns true if the item's expiry should be checked, which it
+// isn't if it's unknown to an engine tested WithUnknownExpiry.
+func (o *options) knownExpiry(i storage.Item) bool {
+	return !o.unknownExpiry || i.Expires != storage.EXPIRES_UNKNOWN
+}
+
+// checkErr checks err is expected.
+func checkErr(t *testing.T, op string, err, expected error) {
+	t.Helper()
+	if err != expected {
+		t.Errorf("Wrong error from %s: %v vs %v\n", op, err, expected)
+	}
+}
+
+// checkGone checks the key isn't stored.
+func checkGone(t *testing.T, s storage.Storage, key string) {
+	t.Helper()
+	_, err := s.Get(ctx, []byte(key))
+	checkErr(t, "get "+key, err, storage.ErrNotFound)
+}
+
+func testSetGet(t *testing.T, s storage.Storage, o *options) {
+	checkGone(t, s, "key")
+
+	// the engine keeps its own copies of the key and value
+	key, value := []byte("key"), []byte("value")
+	cas1, err := s.Set(ctx, key, value, 42, 0, 0)
+	checkErr(t, "set", err, nil)
+	copy(key, "xxx")
+	copy(value, "xxxxx")
+	i := checkItem(t, s, "key", "value", 42)
+	if i.CAS != cas1 || (o.knownExpiry(i) && i.Expires != 0) {
+		t.Errorf("Wrong item: CAS %d expires %d vs CAS %d\n", i.CAS, i.Expires, cas1)
+	}
+
+	cas2 := set(t, s, "key", "other", 7)
+	if cas2 == cas1 {
+		t.Errorf("Overwrite kept the CAS value %d\n", cas1)
+	}
+	checkItem(t, s, "key", "other", 7)
+
+	set(t, s, "empty", "", 0)
+	checkItem(t, s, "empty", "", 0)
+
+	large := string(bytes.Repeat([]byte("v"), 100000))
+	set(t, s, "large", large, 0)
+	checkItem(t, s, "large", large, 0)
+}
+
+func testCAS(t *testing.T, s storage.Storage, o *options) {
+	_, err := s.Set(ctx, []byte("key"), []byte("value"), 0, 0, 1)
+	checkErr(t, "set of a missing key with a CAS value", err, storage.ErrNotFound)
+	checkGone(t, s, "key")
+
+	cas := set(t, s, "key", "value", 0)
+	_, err = s.Set(ctx, []byte("key"), []byte("other"), 0, 0, cas+1)
+	checkErr(t, "set with the wrong CAS value", err, storage.ErrExists)
+	checkItem(t, s, "key", "value", 0)
+
+	next, err := s.Set(ctx, []byte("key"), []byte("other"), 0, 0, cas)
+	checkErr(t, "set with the CAS value", err, nil)
+	if next == cas {
+		t.Errorf("Set with the CAS value kept it\n")
+	}
+	checkItem(t, s, "key", "other", 0)
+}
+
+func testAdd(t *testing.T, s storage.Storage, o *options) {
+	cas, err := s.Add(ctx, []byte("key"), []byte("value"), 3, 0)
+	checkErr(t, "add", err, nil)
+	if i := checkItem(t, s, "key", "value", 3); i.CAS != cas {
+		t.Errorf("Wrong CAS value from add: %d vs %d\n", cas, i.CAS)
+	}
+
+	_, err = s.Add(ctx, []byte("key"), []byte("other"), 0, 0)
+	checkErr(t, "add of a stored key", err, storage.ErrNotStored)
+	checkItem(t, s, "key", "value", 3)
+}
+
+func testIncr(t *testing.T, s storage.Storage, o *options) {
+	set(t, s, "n", "10", 42)
+	set(t, s, "max", "18446744073709551615", 0)
+	set(t, s, "s", "ten", 0)
+	tests := []struct {
+		key      string
+		delta    uint64
+		decr     bool
+		expected uint64
+		err      error
+	}{
+		{"n", 5, false, 15, nil},
+		{"n", 3, true, 12, nil},
+		{"n", 20, true, 0, nil},
+		{"n", 7, false, 7, nil},
+		{"max", 2, false, 1, nil},
+		{"max", 1 << 63, false, 1<<63 + 1, nil},
+		{"max", 1<<64 - 1, true, 0, nil},
+		{"s", 1, false, 0, storage.ErrNonNumeric},
+		{"missing", 1, false, 0, storage.ErrNotFound},
+	}
+	for _, test := range tests {
+		n, err := s.Incr(ctx, []byte(test.key), test.delta, test.decr)
+		if n != test.expected || err != test.err {
+			t.Errorf("Wrong incr %s by %d (decr %v): %d, %v vs %d, %v\n", test.key, test.delta,
+				test.decr, n, err, test.expected, test.err)
+		}
+	}
+	checkItem(t, s, "n", "7", 42)
+	checkGone(t, s, "missing")
+}
+
+func testDelete(t *testing.T, s storage.Storage, o *options) {
+	checkErr(t, "delete of a missing key", s.Delete(ctx, []byte("key"), 0), storage.ErrNotFound)
+
+	cas := set(t, s, "key", "value", 0)
+	checkErr(t, "delete with the wrong CAS value", s.Delete(ctx, []byte("key"), cas+1), storage.ErrExists)
+	checkItem(t, s, "key", "value", 0)
+	checkErr(t, "delete with the CAS value", s.Delete(ctx, []byte("key"), cas), nil)
+	checkGone(t, s, "key")
+
+	set(t, s, "key", "value", 0)
+	checkErr(t, "delete", s.Delete(ctx, []byte("key"), 0), nil)
+	checkGone(t, s, "key")
+}
+
+func testTouch(t *testing.T, s storage.Storage, o *options) {
+	_, err := s.Touch(ctx, []byte("key"), 100)
+	checkErr(t, "touch of a missing key", err, storage.ErrNotFound)
+
+	cas := set(t, s, "key", "value", 5)
+	start := time.Now().Unix()
+	i, err := s.Touch(ctx, []byte("key"), 100)
+	checkErr(t, "touch", err, nil)
+	if string(i.Value) != "value" || i.Flags != 5 || i.CAS != cas {
+		t.Errorf("Wrong item from touch: %q (flags %d, CAS %d)\n", i.Value, i.Flags, i.CAS)
+	}
+	if i.Expires < start+100 || i.Expires > time.Now().Unix()+100 {
+		t.Errorf("Wrong expiry from touch: %d, now %d\n", i.Expires, start)
+	}
+	if i = checkItem(t, s, "key", "value", 5); o.knownExpiry(i) && i.Expires < start+100 {
+		t.Errorf("Touch didn't update the expiry: %d\n", i.Expires)
+	}
+
+	i, err = s.Touch(ctx, []byte("key"), 0)
+	checkErr(t, "touch", err, nil)
+	if i.Expires != 0 {
+		t.Errorf("Touch didn't clear the expiry: %d\n", i.Expires)
+	}
+}
+
+func testExpiry(t *testing.T, s storage.Storage, o *options) {
+	// expiration times beyond MAX_RELATIVE_EXPIRY are UNIX times, and this one
+	// has long since passed
+	past := uint32(storage.MAX_RELATIVE_EXPIRY + 1)
+	_, err := s.Set(ctx, []byte("past"), []byte("value"), 0, past, 0)
+	checkErr(t, "set", err, nil)
+	checkGone(t, s, "past")
+
+	future := uint32(time.Now().Unix() + 3600)
+	_, err = s.Set(ctx, []byte("future"), []byte("value"), 0, future, 0)
+	checkErr(t, "set", err, nil)
+	if i := checkItem(t, s, "future", "value", 0); o.knownExpiry(i) && i.Expires != int64(future) {
+		t.Errorf("Wrong expiry: %d vs %d\n", i.Expires, future)
+	}
+
+	set(t, s, "touched", "value", 0)
+	_, err = s.Touch(ctx, []byte("touched"), past)
+	checkErr(t, "touch", err, nil)
+	checkGone(t, s, "touched")
+	_, err = s.Add(ctx, []byte("touched"), []byte("again"), 0, 0)
+	checkErr(t, "add of an expired key", err, nil)
+}
+
+func testFlush(t *testing.T, s storage.Storage, o *options) {
+	for n := 0; n < 10; n++ {
+		set(t, s, fmt.Sprintf("key%d", n), "value", 0)
+	}
+	checkErr(t, "flush", s.Flush(ctx), nil)
+	for n := 0; n < 10; n++ {
+		checkGone(t, s, fmt.Sprintf("key%d", n))
+	}
+	set(t, s, "key0", "value", 0)
+	checkItem(t, s, "key0", "value", 0)
+}
+
+func testFlushPrefix(t *testing.T, s storage.Storage, o *options) {
+	keys := []string{"a:1", "a:2", "a:b:1", "a", "b:1", "ba:1"}
+	for _, key := range keys {
+		set(t, s, key, "value", 0)
+	}
+	checkErr(t, "flush prefix", s.FlushPrefix(ctx, []byte("a:")), nil)
+	checkGone(t, s, "a:1")
+	checkGone(t, s, "a:2")
+	checkGone(t, s, "a:b:1")
+	checkItem(t, s, "a", "value", 0)
+	checkItem(t, s, "b:1", "value", 0)
+	checkItem(t, s, "ba:1", "value", 0)
+}
+
+func testCanceled(t *testing.T, s storage.Storage, o *options) {
+	set(t, s, "key", "1", 0)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err := s.Get(canceled, []byte("key"))
+	checkErr(t, "get", err, context.Canceled)
+	_, err = s.Set(canceled, []byte("new"), []byte("value"), 0, 0, 0)
+	checkErr(t, "set", err, context.Canceled)
+	_, err = s.Add(canceled, []byte("new"), []byte("value"), 0, 0)
+	checkErr(t, "add", err, context.Canceled)
+	_, err = s.Incr(canceled, []byte("key"), 1, false)
+	checkErr(t, "incr", err, context.Canceled)
+	checkErr(t, "delete", s.Delete(canceled, []byte("key"), 0), context.Canceled)
+	_, err = s.Touch(canceled, []byte("key"), 100)
+	checkErr(t, "touch", err, context.Canceled)
+	checkErr(t, "flush", s.Flush(canceled), context.Canceled)
+	checkErr(t, "flush prefix", s.FlushPrefix(canceled, []byte("k")), context.Canceled)
+
+	// nothing was changed
+	checkGone(t, s, "new")
+	if i := checkItem(t, s, "key", "1", 0); o.knownExpiry(i) && i.Expires != 0 {
+		t.Errorf("Canceled touch changed the expiry: %d\n", i.Expires)
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.Storage, o *options) {
+	const workers, ops = 8, 200
+	set(t, s, "counter", "0", 0)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := []byte(fmt.Sprintf("key%d", w))
+			for n := 0; n < ops; n++ {
+				if _, err := s.Incr(ctx, []byte("counter"), 1, false); err != nil {
+					t.Errorf("Couldn't incr: %v\n", err)
+					return
+				}
+				if _, err := s.Set(ctx, key, []byte("value"), 0, 0, 0); err != nil {
+					t.Errorf("Couldn't set: %v\n", err)
+					return
+				}
+				s.Get(ctx, []byte(fmt.Sprintf("key%d", n%workers)))
+			}
+		}()
+	}
+	wg.Wait()
+	checkItem(t, s, "counter", fmt.Sprint(workers*ops), 0)
+}
+
+func testLeases(t *testing.T, s storage.Storage, o *options) {
+	l, ok := s.(storage.Leaser)
+	if !ok {
+		t.Skip("not a Leaser")
+	}
+	_, granted, err := l.LeaseGet(ctx, []byte("key"))
+	if err == storage.ErrNotSupported {
+		t.Skip("leases not supported")
+	}
+	checkErr(t, "lease get of a missing key", err, storage.ErrNotFound)
+	if granted.Token == 0 || granted.Stale {
+		t.Fatalf("Wrong lease of a missing key: %+v\n", granted)
+	}
+	_, other, err := l.LeaseGet(ctx, []byte("key"))
+	checkErr(t, "lease get of a leased key", err, storage.ErrHotMiss)
+	if other.Token != 0 {
+		t.Errorf("Leased key leased again: %+v\n", other)
+	}
+
+	_, err = l.LeaseSet(ctx, []byte("key"), []byte("value"), 3, 0, granted.Token+1)
+	checkErr(t, "lease set with the wrong token", err, storage.ErrInvalidLease)
+	cas, err := l.LeaseSet(ctx, []byte("key"), []byte("value"), 3, 0, granted.Token)
+	checkErr(t, "lease set", err, nil)
+	i, fresh, err := l.LeaseGet(ctx, []byte("key"))
+	checkErr(t, "lease get", err, nil)
+	if string(i.Value) != "value" || i.Flags != 3 || i.CAS != cas || fresh != (storage.Lease{}) {
+		t.Errorf("Wrong lease get: %q (flags %d, CAS %d) %+v\n", i.Value, i.Flags, i.CAS, fresh)
+	}
+	_, err = l.LeaseSet(ctx, []byte("key"), []byte("other"), 0, 0, granted.Token)
+	checkErr(t, "lease set with a used token", err, storage.ErrInvalidLease)
+
+	// a deleted key is leased again, and may be given as a stale value
+	checkErr(t, "delete", s.Delete(ctx, []byte("key"), 0), nil)
+	i, again, err := l.LeaseGet(ctx, []byte("key"))
+	if again.Token == 0 || again.Token == granted.Token {
+		t.Errorf("Wrong lease of a deleted key: %+v\n", again)
+	}
+	if err == nil && (!again.Stale || string(i.Value) != "value") {
+		t.Errorf("Wrong stale value: %q %+v\n", i.Value, again)
+	} else if err != nil {
+		checkErr(t, "lease get of a deleted key", err, storage.ErrNotFound)
+	}
+	_, err = l.LeaseSet(ctx, []byte("key"), []byte("new"), 0, 0, again.Token)
+	checkErr(t, "lease set", err, nil)
+	checkItem(t, s, "key", "new", 0)
+
+	// stores and deletes of the key invalidate its lease
+	_, deleted, _ := l.LeaseGet(ctx, []byte("deleted"))
+	checkErr(t, "delete", s.Delete(ctx, []byte("deleted"), 0), storage.ErrNotFound)
+	_, err = l.LeaseSet(ctx, []byte("deleted"), []byte("old"), 0, 0, deleted.Token)
+	checkErr(t, "lease set after a delete", err, storage.ErrInvalidLease)
+	checkGone(t, s, "deleted")
+
+	_, stored, _ := l.LeaseGet(ctx, []byte("stored"))
+	set(t, s, "stored", "new", 0)
+	_, err = l.LeaseSet(ctx, []byte("stored"), []byte("old"), 0, 0, stored.Token)
+	checkErr(t, "lease set after a set", err, storage.ErrInvalidLease)
+	checkItem(t, s, "stored", "new", 0)
+}
+
+func testChunks(t *testing.T, s storage.Storage, o *options) {
+	c, ok := s.(storage.Chunker)
+	if !ok {
+		t.Skip("not a Chunker")
+	}
+	chunks := [][]byte{[]byte("chu"), []byte("nked "), nil, []byte("value")}
+	cas, err := c.SetChunks(ctx, []byte("key"), chunks, 7, 0, 0)
+	checkErr(t, "set of chunks", err, nil)
+	chunks[0][0] = 'X'
+	i := checkItem(t, s, "key", "chunked value", 7)
+	if i.CAS != cas || i.Len() != len("chunked value") {
+		t.Errorf("Wrong chunked item: CAS %d vs %d, length %d\n", i.CAS, cas, i.Len())
+	}
+
+	_, err = c.SetChunks(ctx, []byte("key"), chunks, 0, 0, cas+1)
+	checkErr(t, "set of chunks with the wrong CAS", err, storage.ErrExists)
+	_, err = c.SetChunks(ctx, []byte("missing"), chunks, 0, 0, cas)
+	checkErr(t, "set of chunks with the CAS of a missing key", err, storage.ErrNotFound)
+	_, err = c.SetChunks(ctx, []byte("key"), [][]byte{[]byte("new")}, 0, 0, cas)
+	checkErr(t, "set of chunks with the right CAS", err, nil)
+	checkItem(t, s, "key", "new", 0)
+}
+
+func testTags(t *testing.T, s storage.Storage, o *options) {
+	tg, ok := s.(storage.Tagger)
+	if !ok {
+		t.Skip("not a Tagger")
+	}
+	tagged := func(key string, tags ...string) uint64 {
+		var tagBytes [][]byte
+		for _, tag := range tags {
+			tagBytes = append(tagBytes, []byte(tag))
+		}
+		cas, err := tg.SetTagged(ctx, []byte(key), []byte("value"), 3, 0, 0, tagBytes)
+		checkErr(t, "tagged set of "+key, err, nil)
+		return cas
+	}
+	tagged("key1", "user:1")
+	tagged("key2", "user:1", "user:2")
+	tagged("key3", "user:2")
+	set(t, s, "key4", "value", 0)
+	checkItem(t, s, "key1", "value", 3)
+
+	checkErr(t, "invalidation", tg.InvalidateTag(ctx, []byte("user:1")), nil)
+	checkGone(t, s, "key1")
+	checkGone(t, s, "key2")
+	checkItem(t, s, "key3", "value", 3)
+	checkItem(t, s, "key4", "value", 0)
+	checkErr(t, "invalidation of an unused tag", tg.InvalidateTag(ctx, []byte("none")), nil)
+
+	// items stored after the invalidation are kept
+	tagged("key1", "user:1")
+	checkItem(t, s, "key1", "value", 3)
+	cas := tagged("key3", "user:2")
+	_, err := tg.SetTagged(ctx, []byte("key3"), []byte("value"), 0, 0, cas+1, nil)
+	checkErr(t, "tagged set with the wrong CAS", err, storage.ErrExists)
+
+	// an untagged set replaces the item's tags
+	set(t, s, "key3", "untagged", 0)
+	checkErr(t, "invalidation", tg.InvalidateTag(ctx, []byte("user:2")), nil)
+	checkItem(t, s, "key3", "untagged", 0)
+}